@@ -0,0 +1,474 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// aclDefaultUser is the identity of every client that has not authenticated
+// as a specific ACL user. When it's not defined in the ACL table, the default
+// user has full access, which matches the behavior of the shared --auth.
+const aclDefaultUser = "default"
+
+// aclRule is a single permission rule. A rule matches a command when its
+// kind is in kinds (or kinds is empty) and its name matches the pattern.
+type aclRule struct {
+	Allow   bool   `json:"allow"`
+	Kinds   string `json:"kinds,omitempty"`
+	Pattern string `json:"pattern"`
+}
+
+type aclUser struct {
+	Name      string    `json:"name"`
+	Enabled   bool      `json:"enabled"`
+	NoPass    bool      `json:"nopass,omitempty"`
+	Passwords []string  `json:"passwords,omitempty"` // sha256 hex digests
+	Rules     []aclRule `json:"rules,omitempty"`
+}
+
+// aclTable is the replicated set of users. It's only altered from inside of
+// the Apply function and is persisted in snapshots.
+type aclTable struct {
+	users map[string]*aclUser
+}
+
+func newACLTable() *aclTable {
+	return &aclTable{users: make(map[string]*aclUser)}
+}
+
+func aclHashPassword(pass string) string {
+	sum := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(sum[:])
+}
+
+// aclRedacted replaces a password in the args of a redacted command.
+const aclRedacted = "(redacted)"
+
+// aclRedactArgs returns the args with the passwords and password hashes
+// replaced, for the monitor and the slow log. This covers AUTH, HELLO AUTH,
+// and the password rules of ACL SETUSER. The args are only copied when
+// something is redacted.
+func aclRedactArgs(args []string) []string {
+	var redacted []string
+	redact := func(i int) {
+		if redacted == nil {
+			redacted = append([]string(nil), args...)
+		}
+		redacted[i] = aclRedacted
+	}
+	if len(args) == 0 {
+		return args
+	}
+	switch strings.ToLower(args[0]) {
+	case "auth":
+		for i := 1; i < len(args); i++ {
+			redact(i)
+		}
+	case "hello":
+		// HELLO protover AUTH username password
+		for i := 2; i < len(args)-2; i++ {
+			if strings.ToLower(args[i]) == "auth" {
+				redact(i + 2)
+				i += 2
+			}
+		}
+	case "acl", "aclwrite":
+		// ACL SETUSER username rule...
+		// ACLWRITE SETUSER username rule...
+		if len(args) < 4 || strings.ToLower(args[1]) != "setuser" {
+			break
+		}
+		for i := 3; i < len(args); i++ {
+			if args[i] != "" && strings.IndexByte("><#!", args[i][0]) != -1 {
+				redact(i)
+			}
+		}
+	}
+	if redacted == nil {
+		return args
+	}
+	return redacted
+}
+
+// allowed returns true when the user is permitted to run the command. The
+// last matching rule wins and a user with no matching rules is denied.
+func (u *aclUser) allowed(kind byte, name string) bool {
+	if !u.Enabled {
+		return false
+	}
+	var allow bool
+	for _, r := range u.Rules {
+		if r.Kinds != "" && strings.IndexByte(r.Kinds, kind) == -1 {
+			continue
+		}
+		if match.Match(name, r.Pattern) {
+			allow = r.Allow
+		}
+	}
+	return allow
+}
+
+// checkPassword returns true when the password is valid for the user.
+func (u *aclUser) checkPassword(pass string) bool {
+	if !u.Enabled {
+		return false
+	}
+	if u.NoPass {
+		return true
+	}
+	hash := aclHashPassword(pass)
+	for _, p := range u.Passwords {
+		if subtle.ConstantTimeCompare([]byte(p), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// apply applies ACL SETUSER rules to the user.
+func (u *aclUser) apply(rules []string) error {
+	for _, rule := range rules {
+		lrule := strings.ToLower(rule)
+		switch {
+		case lrule == "on":
+			u.Enabled = true
+		case lrule == "off":
+			u.Enabled = false
+		case lrule == "nopass":
+			u.NoPass = true
+			u.Passwords = nil
+		case lrule == "resetpass":
+			u.NoPass = false
+			u.Passwords = nil
+		case lrule == "reset":
+			*u = aclUser{Name: u.Name}
+		case lrule == "allcommands":
+			u.Rules = append(u.Rules, aclRule{true, "", "*"})
+		case lrule == "nocommands":
+			u.Rules = append(u.Rules, aclRule{false, "", "*"})
+		case rule[0] == '>':
+			u.addPassword(aclHashPassword(rule[1:]))
+		case rule[0] == '#':
+			if len(rule) != 65 {
+				return fmt.Errorf("invalid password hash '%s'", rule)
+			}
+			u.addPassword(strings.ToLower(rule[1:]))
+		case rule[0] == '<':
+			u.removePassword(aclHashPassword(rule[1:]))
+		case rule[0] == '!':
+			u.removePassword(strings.ToLower(rule[1:]))
+		case rule[0] == '+' || rule[0] == '-':
+			r := aclRule{Allow: rule[0] == '+'}
+			if strings.HasPrefix(lrule[1:], "@") {
+				switch lrule[2:] {
+				case "all":
+				case "read":
+					r.Kinds = "r"
+				case "write":
+					r.Kinds = "w"
+				case "system":
+					r.Kinds = "s"
+				default:
+					return fmt.Errorf("unknown command category '%s'",
+						rule[2:])
+				}
+				r.Pattern = "*"
+			} else {
+				r.Pattern = lrule[1:]
+			}
+			if r.Pattern == "" {
+				return ErrSyntax
+			}
+			u.Rules = append(u.Rules, r)
+		default:
+			return fmt.Errorf("syntax error in ACL SETUSER modifier '%s'",
+				rule)
+		}
+	}
+	return nil
+}
+
+func (u *aclUser) addPassword(hash string) {
+	u.NoPass = false
+	u.removePassword(hash)
+	u.Passwords = append(u.Passwords, hash)
+}
+
+func (u *aclUser) removePassword(hash string) {
+	for i := 0; i < len(u.Passwords); i++ {
+		if u.Passwords[i] == hash {
+			u.Passwords = append(u.Passwords[:i], u.Passwords[i+1:]...)
+			i--
+		}
+	}
+}
+
+// String returns the user description in the format used by ACL LIST.
+func (u *aclUser) String() string {
+	parts := []string{"user", u.Name}
+	if u.Enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.NoPass {
+		parts = append(parts, "nopass")
+	}
+	for _, p := range u.Passwords {
+		parts = append(parts, "#"+p)
+	}
+	for _, r := range u.Rules {
+		sign := "-"
+		if r.Allow {
+			sign = "+"
+		}
+		switch r.Kinds {
+		case "":
+			if r.Pattern == "*" {
+				parts = append(parts, sign+"@all")
+			} else {
+				parts = append(parts, sign+r.Pattern)
+			}
+		case "r":
+			parts = append(parts, sign+"@read")
+		case "w":
+			parts = append(parts, sign+"@write")
+		case "s":
+			parts = append(parts, sign+"@system")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// allowed returns true when the user may run the command. An undefined
+// default user has full access.
+func (t *aclTable) allowed(user string, kind byte, name string) bool {
+	if user == "" {
+		user = aclDefaultUser
+	}
+	u, ok := t.users[user]
+	if !ok {
+		return user == aclDefaultUser
+	}
+	return u.allowed(kind, name)
+}
+
+func (t *aclTable) encode() ([]byte, error) {
+	users := make([]*aclUser, 0, len(t.users))
+	for _, u := range t.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	return json.Marshal(users)
+}
+
+func decodeACL(data []byte) (*aclTable, error) {
+	t := newACLTable()
+	if len(data) == 0 {
+		return t, nil
+	}
+	var users []*aclUser
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		t.users[u.Name] = u
+	}
+	return t, nil
+}
+
+// ACL subcommand args...
+// help: manages the users and their permissions.
+func cmdACL(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 2 {
+		return nil, errWrongNumArgsACL
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		return cmdACLHELP(um, ra, args)
+	case "setuser":
+		return cmdACLSETUSER(um, ra, args)
+	case "deluser":
+		return cmdACLDELUSER(um, ra, args)
+	case "list":
+		return cmdACLLIST(um, ra, args)
+	case "whoami":
+		return cmdACLWHOAMI(um, ra, args)
+	default:
+		return nil, errUnknownACLCommand(args[:2])
+	}
+}
+
+// ACL HELP
+// help: returns the valid ACL related commands; []string
+func cmdACLHELP(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsACL
+	}
+	lines := []redcon.SimpleString{
+		"ACL SETUSER username [rule [rule ...]]",
+		"ACL DELUSER username [username ...]",
+		"ACL LIST",
+		"ACL WHOAMI",
+	}
+	return lines, nil
+}
+
+// ACL SETUSER username [rule [rule ...]]
+// help: creates or modifies a user. Rules are on, off, >password, <password,
+//       #hash, !hash, nopass, resetpass, reset, allcommands, nocommands,
+//       +@category, -@category, +pattern, and -pattern. The categories are
+//       read, write, system, and all. Plain text passwords are hashed before
+//       going through the raft log.
+func cmdACLSETUSER(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, errWrongNumArgsACL
+	}
+	wargs := []string{"aclwrite", "setuser", args[2]}
+	for _, rule := range args[3:] {
+		if rule == "" {
+			return nil, ErrSyntax
+		}
+		switch rule[0] {
+		case '>':
+			rule = "#" + aclHashPassword(rule[1:])
+		case '<':
+			rule = "!" + aclHashPassword(rule[1:])
+		}
+		wargs = append(wargs, rule)
+	}
+	// Validate the rules prior to going through the raft log.
+	if err := new(aclUser).apply(wargs[3:]); err != nil {
+		return nil, err
+	}
+	return getBaseMachine(um).writeInternal(wargs, sendOpts(um))
+}
+
+// ACL DELUSER username [username ...]
+// help: deletes users; returns the number of users deleted
+func cmdACLDELUSER(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, errWrongNumArgsACL
+	}
+	wargs := append([]string{"aclwrite", "deluser"}, args[2:]...)
+	return getBaseMachine(um).writeInternal(wargs, sendOpts(um))
+}
+
+// ACL LIST
+// help: returns the users and their rules; []string
+func cmdACLLIST(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsACL
+	}
+	m := getBaseMachine(um)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var names []string
+	for name := range m.acl.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{}
+	for _, name := range names {
+		lines = append(lines, m.acl.users[name].String())
+	}
+	return lines, nil
+}
+
+// ACL WHOAMI
+// help: returns the user name of the current connection; string
+func cmdACLWHOAMI(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsACL
+	}
+	if m, ok := um.(intermediateMachine); ok && m.user != "" {
+		return m.user, nil
+	}
+	return aclDefaultUser, nil
+}
+
+// ACLWRITE subcommand args...
+// help: applies an ACL change to the replicated user table. It's not
+//       possible to directly call this from a client service.
+func cmdACLWRITE(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 3 {
+		return nil, ErrWrongNumArgs
+	}
+	switch args[1] {
+	case "setuser":
+		name := args[2]
+		u, ok := m.acl.users[name]
+		if !ok {
+			u = &aclUser{Name: name}
+		} else {
+			// work on a copy so that a bad rule does not leave the user
+			// partially modified
+			cu := *u
+			cu.Passwords = append([]string(nil), u.Passwords...)
+			cu.Rules = append([]aclRule(nil), u.Rules...)
+			u = &cu
+		}
+		if err := u.apply(args[3:]); err != nil {
+			return nil, err
+		}
+		m.acl.users[name] = u
+		return redcon.SimpleString("OK"), nil
+	case "deluser":
+		var n int
+		for _, name := range args[2:] {
+			if _, ok := m.acl.users[name]; ok {
+				delete(m.acl.users, name)
+				n++
+			}
+		}
+		return redcon.SimpleInt(n), nil
+	default:
+		return nil, ErrSyntax
+	}
+}
+
+// authUser checks the user credentials against the ACL table.
+func (m *machine) authUser(user, pass string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u, ok := m.acl.users[user]
+	if !ok || !u.checkPassword(pass) {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// allowed returns ErrNoPermission when the user is not permitted to run the
+// command.
+func (m *machine) allowed(user string, kind byte, name string) error {
+	m.mu.RLock()
+	ok := m.acl.allowed(user, kind, name)
+	m.mu.RUnlock()
+	if !ok {
+		return ErrNoPermission
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestACLRules(t *testing.T) {
+	u := &aclUser{Name: "analyst"}
+	if err := u.apply([]string{"on", ">secret", "+@read", "-keys",
+		"+raft", "-@system"}); err != nil {
+		t.Fatal(err)
+	}
+	if !u.checkPassword("secret") || u.checkPassword("other") {
+		t.Fatal("password mismatch")
+	}
+	for _, c := range []struct {
+		kind  byte
+		name  string
+		allow bool
+	}{
+		{'r', "get", true},
+		{'r', "keys", false},
+		{'w', "set", false},
+		{'s', "raft", false},
+	} {
+		if u.allowed(c.kind, c.name) != c.allow {
+			t.Fatalf("%c %s: expected %v", c.kind, c.name, c.allow)
+		}
+	}
+	if err := u.apply([]string{"off"}); err != nil {
+		t.Fatal(err)
+	}
+	if u.allowed('r', "get") || u.checkPassword("secret") {
+		t.Fatal("disabled user must be denied")
+	}
+	if err := u.apply([]string{"+@bogus"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestACLEncode(t *testing.T) {
+	acl := newACLTable()
+	if !acl.allowed("", 'w', "set") {
+		t.Fatal("undefined default user must have full access")
+	}
+	if acl.allowed("nobody", 'r', "get") {
+		t.Fatal("unknown user must be denied")
+	}
+	acl.users["default"] = &aclUser{Name: "default", Enabled: true,
+		NoPass: true, Rules: []aclRule{{true, "r", "*"}}}
+	data, err := acl.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl2, err := decodeACL(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl2.allowed("", 'w', "set") || !acl2.allowed("", 'r', "get") {
+		t.Fatal("restored default user rules mismatch")
+	}
+	if s := acl2.users["default"].String(); s != "user default on nopass +@read" {
+		t.Fatalf("got '%s'", s)
+	}
+}
+
+func TestACLRedact(t *testing.T) {
+	for _, c := range []struct {
+		args, expect []string
+	}{
+		{[]string{"AUTH", "secret"}, []string{"AUTH", aclRedacted}},
+		{[]string{"hello", "3", "AUTH", "bob", "secret", "setname", "x"},
+			[]string{"hello", "3", "AUTH", "bob", aclRedacted, "setname",
+				"x"}},
+		{[]string{"acl", "setuser", "bob", "on", ">secret", "<old", "+@all"},
+			[]string{"acl", "setuser", "bob", "on", aclRedacted, aclRedacted,
+				"+@all"}},
+		{[]string{"aclwrite", "setuser", "bob", "#abc"},
+			[]string{"aclwrite", "setuser", "bob", aclRedacted}},
+		{[]string{"set", "a", ">b"}, []string{"set", "a", ">b"}},
+	} {
+		orig := append([]string(nil), c.args...)
+		if got := aclRedactArgs(c.args); !reflect.DeepEqual(got, c.expect) {
+			t.Fatalf("expected %v, got %v", c.expect, got)
+		}
+		if !reflect.DeepEqual(c.args, orig) {
+			t.Fatalf("args were altered: %v", c.args)
+		}
+	}
+
+	// the monitor only sees the redacted args
+	mon := newMonitor()
+	o := mon.NewObserver()
+	defer o.Stop()
+	mon.Send(Message{Args: []string{"acl", "setuser", "bob", ">secret"}})
+	if msg := <-o.C(); msg.Args[3] != aclRedacted {
+		t.Fatalf("unexpected %v", msg.Args)
+	}
+}
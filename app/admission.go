@@ -0,0 +1,158 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errTooManyInFlight = errors.New("BUSY too many writes in flight for " +
+	"this connection")
+
+var errRateLimited = errors.New("BUSY write rate limit exceeded")
+
+// admission controls which client writes are allowed into the write queue.
+// It's shared by the services of all raft groups.
+type admission struct {
+	maxInFlight int
+	limit       func(context interface{}, user string) (key string,
+		rate float64, burst int)
+
+	mu        sync.Mutex
+	inflight  map[interface{}]int     // pending writes per connection
+	buckets   map[string]*tokenBucket // rate limits per key
+	lastSweep time.Time
+}
+
+func newAdmission(conf Config) *admission {
+	return &admission{
+		maxInFlight: conf.MaxInFlight,
+		limit:       conf.WriteLimit,
+		inflight:    make(map[interface{}]int),
+		buckets:     make(map[string]*tokenBucket),
+	}
+}
+
+// admit returns an error when the write is not allowed. Otherwise the write
+// is counted as in flight until it's released.
+func (a *admission) admit(opts *SendOptions) error {
+	var key string
+	var rate float64
+	var burst int
+	if a.limit != nil {
+		key, rate, burst = a.limit(opts.Context, opts.User)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if opts.From != nil && a.maxInFlight > 0 &&
+		a.inflight[opts.From] >= a.maxInFlight {
+		return errTooManyInFlight
+	}
+	if rate > 0 {
+		now := time.Now()
+		if now.Sub(a.lastSweep) > time.Minute {
+			a.sweep(now)
+			a.lastSweep = now
+		}
+		b := a.buckets[key]
+		if b == nil {
+			b = newTokenBucket(rate, burst, now)
+			a.buckets[key] = b
+		}
+		if !b.take(rate, burst, now) {
+			return errRateLimited
+		}
+	}
+	if opts.From != nil {
+		a.inflight[opts.From]++
+	}
+	return nil
+}
+
+// release is called when the write has been applied, or was rejected after
+// being admitted.
+func (a *admission) release(from interface{}) {
+	if from == nil {
+		return
+	}
+	a.mu.Lock()
+	if n := a.inflight[from]; n > 1 {
+		a.inflight[from] = n - 1
+	} else {
+		delete(a.inflight, from)
+	}
+	a.mu.Unlock()
+}
+
+// reject is called when an admitted write could not be added to the write
+// queue. The write is released and its rate token is returned, so the client
+// is not limited for a write that was never applied.
+func (a *admission) reject(opts *SendOptions) {
+	if a.limit != nil {
+		if key, rate, _ := a.limit(opts.Context, opts.User); rate > 0 {
+			a.mu.Lock()
+			if b := a.buckets[key]; b != nil {
+				b.give()
+			}
+			a.mu.Unlock()
+		}
+	}
+	a.release(opts.From)
+}
+
+// sweep removes the buckets that have been refilled, which is the same as
+// not having a bucket at all.
+func (a *admission) sweep(now time.Time) {
+	for key, b := range a.buckets {
+		if b.full(now) {
+			delete(a.buckets, key)
+		}
+	}
+}
+
+// tokenBucket allows for bursts of up to burst writes, which are refilled at
+// rate writes per second.
+type tokenBucket struct {
+	tokens float64
+	burst  float64
+	rate   float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{tokens: float64(burst), burst: float64(burst),
+		rate: rate, last: now}
+}
+
+// take removes a token from the bucket. The rate and burst may change
+// between calls. Returns false when the bucket is empty.
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	if burst < 1 {
+		burst = 1
+	}
+	b.rate, b.burst = rate, float64(burst)
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// give returns a token that was taken.
+func (b *tokenBucket) give() {
+	if b.tokens++; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdmissionInFlight(t *testing.T) {
+	a := newAdmission(Config{MaxInFlight: 2})
+	opts := &SendOptions{From: 1}
+	for i := 0; i < 2; i++ {
+		if err := a.admit(opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.admit(opts); err != errTooManyInFlight {
+		t.Fatalf("expected %v, got %v", errTooManyInFlight, err)
+	}
+	// other connections are not affected
+	if err := a.admit(&SendOptions{From: 2}); err != nil {
+		t.Fatal(err)
+	}
+	a.release(1)
+	if err := a.admit(opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdmissionRateLimit(t *testing.T) {
+	a := newAdmission(Config{
+		WriteLimit: func(context interface{}, user string) (string,
+			float64, int) {
+			if user == "loader" {
+				return user, 1000, 3
+			}
+			return "", 0, 0
+		},
+	})
+	loader := &SendOptions{User: "loader"}
+	for i := 0; i < 3; i++ {
+		if err := a.admit(loader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.admit(loader); err != errRateLimited {
+		t.Fatalf("expected %v, got %v", errRateLimited, err)
+	}
+	// a write that is rejected by the full queue returns its token
+	a.reject(loader)
+	if err := a.admit(loader); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.admit(loader); err != errRateLimited {
+		t.Fatalf("expected %v, got %v", errRateLimited, err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := a.admit(&SendOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond * 5)
+	if err := a.admit(loader); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 2, now)
+	if !b.take(2, 2, now) || !b.take(2, 2, now) || b.take(2, 2, now) {
+		t.Fatal("expected burst of 2")
+	}
+	if b.full(now) {
+		t.Fatal("expected not full")
+	}
+	now = now.Add(time.Second / 2)
+	if !b.take(2, 2, now) || b.take(2, 2, now) {
+		t.Fatal("expected one refilled token")
+	}
+	if !b.full(now.Add(time.Second)) {
+		t.Fatal("expected full")
+	}
+}
@@ -1,32 +1,47 @@
 package app
 
+import (
+	"fmt"
+	"os"
+)
+
 // Main entrypoint for the cluster node. This must be called once and only
 // once, and as the last call in the Go main() function. There are no return
 // values as all application operations, logging, and I/O will be forever
 // transferred.
 func Main(conf Config) error {
+	if !conf.Flag.Custom && len(os.Args) > 1 && os.Args[1] == "log" {
+		if err := LogTool(conf, os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	confInit(&conf)
+	conf.keys = keyRingInit(conf)
 	conf.AddService(redisService())
 
 	hclogger := logInit(conf)
-	tm := remoteTimeInit(conf)
+	tm := timeInit(conf)
 	dir, data := dataDirInit(conf)
-	m := machineInit(conf, dir, data)
 	tlscfg := tlsInit(conf)
 	svr, addr := serverInit(conf, tlscfg)
-	trans := transportInit(conf, tlscfg, svr, hclogger)
-	lstore, sstore := storeInit(conf, dir)
-	snaps := snapshotInit(conf, dir, m, hclogger)
-	ra := raftInit(conf, hclogger, m, lstore, sstore, snaps, trans)
+	groups := groupsInit(conf, dir, data, hclogger, tlscfg, svr)
+	audit := auditInit(conf, dir)
 
-	joinClusterIfNeeded(conf, ra, addr, tlscfg)
-	startUserServices(conf, svr, m, ra)
+	for _, g := range groups {
+		joinClusterIfNeeded(conf, g.ra, addr, tlscfg)
+	}
+	startUserServices(conf, svr, groups[0].m, groups[0].ra)
+	go runEventObserver(conf, groups[0].ra)
 
 	//_ = tm
-	go runMaintainServers(ra)
-	go runWriteApplier(conf, m, ra)
-	go runLogLoadedPoller(conf, m, ra, tlscfg)
-	go runTicker(conf, tm, m, ra)
+	for _, g := range groups {
+		go runMaintainServers(g.ra)
+		go runWriteApplier(conf, g.m, g.ra, audit)
+		go runLogLoadedPoller(conf, g.m, g.ra, tlscfg)
+		go runTicker(conf, tm, g.m, g.ra)
+	}
 
 	return svr.serve()
 }
@@ -1,14 +1,21 @@
 package app
 
-import "github.com/golang/snappy"
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/golang/snappy"
+)
 
 // runWriteApplier is a background routine that handles all write requests.
 // It's job is to apply the request to the Raft log and returns the result to
 // writeRequest.
-func runWriteApplier(conf Config, m *machine, ra *raftWrap) {
-	var maxReqs = 1024 // TODO: make configurable
+func runWriteApplier(conf Config, m *machine, ra *raftWrap, audit *auditLog) {
+	maxReqs := conf.WriteBatchSize
 	for {
-		// Gather up as many requests (up to 256) into a single list.
+		// Gather up as many requests (up to WriteBatchSize) into a single
+		// list.
 		var reqs []*writeRequestFuture
 		r := <-m.wrC
 		reqs = append(reqs, r)
@@ -22,48 +29,157 @@ func runWriteApplier(conf Config, m *machine, ra *raftWrap) {
 				done = true
 			}
 		}
-		// Combined multiple requests the data to a single, snappy-encoded,
-		// message using the following binary format:
-		// (count, cmd...)
-		//   - count: uvarint
-		//   - cmd: (count, args...)
-		//     - count: uvarint
-		//     - arg: (count, byte...)
-		//       - count: uvarint
-		var data []byte
-		data = appendUvarint(data, uint64(len(reqs)))
-		for _, r := range reqs {
-			data = appendUvarint(data, uint64(len(r.args)))
-			for _, arg := range r.args {
-				data = appendUvarint(data, uint64(len(arg)))
-				data = append(data, arg...)
-			}
-		}
-
-		data = snappy.Encode(nil, data)
+		data := encodeBatch(reqs)
 
 		// Apply the data and read back the messages
-		resps, err := func() ([]applyResp, error) {
+		start := time.Now()
+		res, err := func() (*applyResult, error) {
 			// THE ONLY APPLY CALL IN THE CODEBASE SO ENJOY IT
 			f := ra.Apply(data, 0)
 			err := f.Error()
 			if err != nil {
 				return nil, err
 			}
-			return f.Response().([]applyResp), nil
+			return f.Response().(*applyResult), nil
 		}()
 		if err != nil {
 			for _, r := range reqs {
-				r.err = errRaftConvert(ra, err)
-				r.wg.Done()
+				r.err = errRaftConvertSlot(ra, err, r.slot)
+				r.done()
 			}
 		} else {
+			m.latency.recordWrites(reqs, res, start, time.Since(start))
+			if audit != nil {
+				audit.record(m.group, res, reqs)
+			}
 			for i := range reqs {
-				reqs[i].resp = resps[i].resp
-				reqs[i].elap = resps[i].elap
-				reqs[i].err = resps[i].err
-				reqs[i].wg.Done()
+				reqs[i].resp = res.resps[i].resp
+				reqs[i].elap = res.resps[i].elap
+				reqs[i].err = res.resps[i].err
+				reqs[i].done()
+			}
+		}
+	}
+}
+
+// batchCommand is a single command that was decoded from a raft log entry.
+type batchCommand struct {
+	clientID string
+	seq      uint64
+	args     []string
+}
+
+// encodeBatch combines multiple requests into a single, snappy-encoded,
+// message using the following binary format:
+// (count, cmd...)
+//   - count: uvarint
+//   - cmd: (count, args...)
+//     - count: uvarint
+//     - arg: (count, byte...)
+//       - count: uvarint
+//
+// When any of the requests belongs to a client session, the batch uses the
+// version 2 format, which is prefixed by a zero count:
+// (0, 2, count, cmd...)
+//   - cmd: (client, seq, count, args...)
+//     - client: (count, byte...)
+//     - seq: uvarint
+func encodeBatch(reqs []*writeRequestFuture) []byte {
+	var sessions bool
+	for _, r := range reqs {
+		if r.clientID != "" {
+			sessions = true
+			break
+		}
+	}
+	var data []byte
+	if sessions {
+		data = appendUvarint(data, 0)
+		data = appendUvarint(data, 2)
+	}
+	data = appendUvarint(data, uint64(len(reqs)))
+	for _, r := range reqs {
+		if sessions {
+			data = appendUvarint(data, uint64(len(r.clientID)))
+			data = append(data, r.clientID...)
+			data = appendUvarint(data, r.seq)
+		}
+		data = appendUvarint(data, uint64(len(r.args)))
+		for _, arg := range r.args {
+			data = appendUvarint(data, uint64(len(arg)))
+			data = append(data, arg...)
+		}
+	}
+	return snappy.Encode(nil, data)
+}
+
+var errInvalidBatch = errors.New("invalid apply")
+
+// decodeBatch decodes the commands from a raft log entry that was encoded
+// using encodeBatch.
+func decodeBatch(data []byte) ([]batchCommand, error) {
+	packet, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, err
+	}
+	readUvarint := func() (uint64, error) {
+		x, n := binary.Uvarint(packet)
+		if n <= 0 {
+			return 0, errInvalidBatch
+		}
+		packet = packet[n:]
+		return x, nil
+	}
+	readBytes := func() (string, error) {
+		n, err := readUvarint()
+		if err != nil {
+			return "", err
+		}
+		if uint64(len(packet)) < n {
+			return "", errInvalidBatch
+		}
+		b := string(packet[:n])
+		packet = packet[n:]
+		return b, nil
+	}
+	numReqs, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	var sessions bool
+	if numReqs == 0 {
+		vers, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if vers != 2 {
+			return nil, errInvalidBatch
+		}
+		sessions = true
+		if numReqs, err = readUvarint(); err != nil {
+			return nil, err
+		}
+	}
+	cmds := make([]batchCommand, numReqs)
+	for i := range cmds {
+		if sessions {
+			if cmds[i].clientID, err = readBytes(); err != nil {
+				return nil, err
+			}
+			if cmds[i].seq, err = readUvarint(); err != nil {
+				return nil, err
+			}
+		}
+		numArgs, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		cmds[i].args = make([]string, numArgs)
+		for j := range cmds[i].args {
+			if cmds[i].args[j], err = readBytes(); err != nil {
+				return nil, err
 			}
 		}
 	}
+	return cmds, nil
 }
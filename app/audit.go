@@ -0,0 +1,254 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moontrade/server/logger"
+	"github.com/tidwall/redcon"
+)
+
+// auditEntry is a single line in the audit log.
+type auditEntry struct {
+	Group    int         `json:"group,omitempty"`
+	Index    uint64      `json:"index"`
+	Term     uint64      `json:"term"`
+	Time     string      `json:"time"` // machine time
+	Addr     string      `json:"addr,omitempty"`
+	User     string      `json:"user,omitempty"`
+	Context  string      `json:"context,omitempty"`
+	ClientID string      `json:"client_id,omitempty"`
+	Seq      uint64      `json:"seq,omitempty"`
+	Internal bool        `json:"internal,omitempty"`
+	Args     []string    `json:"args"`
+	Resp     interface{} `json:"resp,omitempty"`
+	Err      string      `json:"err,omitempty"`
+}
+
+// auditLog records the applied writes that were sent through this server
+// to rotating JSON files in the "audit" directory of the data directory.
+// Only the server that receives a write knows the client identity, so the
+// audit log of a cluster is the combined logs of all servers.
+type auditLog struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	redact   func(args []string) []string
+
+	mu   sync.Mutex
+	f    *os.File
+	wr   *bufio.Writer
+	size int64
+}
+
+func auditInit(conf Config, dir string) *auditLog {
+	if !conf.Audit {
+		return nil
+	}
+	a := &auditLog{
+		dir:      filepath.Join(dir, "audit"),
+		maxSize:  conf.AuditMaxSize,
+		maxFiles: conf.AuditMaxFiles,
+		redact:   conf.AuditRedact,
+	}
+	if err := os.MkdirAll(a.dir, 0777); err != nil {
+		logger.Fatal(err)
+	}
+	if err := a.open(); err != nil {
+		logger.Fatal(err)
+	}
+	return a
+}
+
+func (a *auditLog) path() string {
+	return filepath.Join(a.dir, "audit.log")
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+		0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f = f
+	a.wr = bufio.NewWriter(f)
+	a.size = fi.Size()
+	return nil
+}
+
+// rotate renames the current file using the current time, removes the
+// oldest files, and opens a new file.
+func (a *auditLog) rotate() error {
+	if err := a.wr.Flush(); err != nil {
+		return err
+	}
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("audit-%s.log",
+		time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(a.path(), filepath.Join(a.dir, name)); err != nil {
+		return err
+	}
+	if a.maxFiles > 0 {
+		olds, err := filepath.Glob(filepath.Join(a.dir, "audit-*.log"))
+		if err != nil {
+			return err
+		}
+		sort.Strings(olds)
+		for len(olds) > a.maxFiles {
+			if err := os.Remove(olds[0]); err != nil {
+				return err
+			}
+			olds = olds[1:]
+		}
+	}
+	return a.open()
+}
+
+// record writes the entries for the applied write requests.
+func (a *auditLog) record(group int, res *applyResult,
+	reqs []*writeRequestFuture,
+) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	tm := time.Unix(0, res.ts).UTC().Format(time.RFC3339Nano)
+	for i, r := range reqs {
+		if len(r.args) == 0 || strings.ToLower(r.args[0]) == "tick" {
+			continue
+		}
+		e := auditEntry{
+			Group:    group,
+			Index:    res.index,
+			Term:     res.term,
+			Time:     tm,
+			Addr:     r.addr,
+			User:     r.user,
+			ClientID: r.clientID,
+			Seq:      r.seq,
+			Internal: r.s == nil,
+			Args:     r.args,
+		}
+		if r.context != nil {
+			if s, ok := r.context.(fmt.Stringer); ok {
+				e.Context = s.String()
+			}
+		}
+		e.Args = redactArgs(r.args, aclRedactArgs)
+		if a.redact != nil {
+			e.Args = redactArgs(e.Args, a.redact)
+		}
+		if err := res.resps[i].err; err != nil {
+			e.Err = err.Error()
+		} else {
+			e.Resp = auditValue(res.resps[i].resp)
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			logger.Error(fmt.Errorf("audit: %w", err))
+			continue
+		}
+		data = append(data, '\n')
+		n, err := a.wr.Write(data)
+		a.size += int64(n)
+		if err != nil {
+			logger.Error(fmt.Errorf("audit: %w", err))
+			return
+		}
+	}
+	if err := a.wr.Flush(); err != nil {
+		logger.Error(fmt.Errorf("audit: %w", err))
+		return
+	}
+	if a.maxSize > 0 && a.size >= a.maxSize {
+		if err := a.rotate(); err != nil {
+			logger.Error(fmt.Errorf("audit: rotate: %w", err))
+		}
+	}
+}
+
+// redactArgs returns a copy of the args that has been altered by the redact
+// function. The commands that are wrapped by a transaction, a script run, or
+// a scheduled job are redacted on their own, with a script run passed as an
+// EVAL or EVALSHA.
+func redactArgs(args []string, redact func(args []string) []string,
+) []string {
+	if len(args) == 0 {
+		return args
+	}
+	switch strings.ToLower(args[0]) {
+	case "txn":
+		// (txn, index, count, key..., count, cmd...)
+		if _, watch, cmds, err := parseTxnArgs(args); err == nil {
+			for i := range cmds {
+				cmds[i] = redactArgs(cmds[i], redact)
+			}
+			head := append([]string(nil), args[:3+len(watch)]...)
+			return appendTxnCommands(head, cmds)
+		}
+	case "schedulewrite":
+		// (schedulewrite, add, id, cron-expr, command...)
+		if len(args) > 4 && strings.ToLower(args[1]) == "add" {
+			head := append([]string(nil), args[:4]...)
+			return append(head, redactArgs(args[4:], redact)...)
+		}
+	case "scriptwrite":
+		// (scriptwrite, run|runsha, user, script|sha1, numkeys, ...)
+		var name string
+		if len(args) > 4 {
+			switch strings.ToLower(args[1]) {
+			case "run":
+				name = "eval"
+			case "runsha":
+				name = "evalsha"
+			}
+		}
+		if name != "" {
+			cmd := redact(append([]string{name}, args[3:]...))
+			head := append([]string(nil), args[:3]...)
+			if len(cmd) > 0 {
+				cmd = cmd[1:]
+			}
+			return append(head, cmd...)
+		}
+	}
+	return redact(append([]string(nil), args...))
+}
+
+// auditValue converts a command response into a value that is suitable for
+// JSON.
+func auditValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, string, bool, int, int64, uint64, float64:
+		return v
+	case []byte:
+		return string(v)
+	case redcon.SimpleString:
+		return string(v)
+	case redcon.SimpleInt:
+		return int(v)
+	case []string:
+		return v
+	case []interface{}:
+		vals := make([]interface{}, len(v))
+		for i := range v {
+			vals[i] = auditValue(v[i])
+		}
+		return vals
+	case error:
+		return v.Error()
+	}
+	return fmt.Sprint(v)
+}
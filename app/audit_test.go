@@ -0,0 +1,148 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	a := auditInit(Config{
+		Audit:         true,
+		AuditMaxSize:  600,
+		AuditMaxFiles: 2,
+		AuditRedact: func(args []string) []string {
+			if len(args) > 2 && args[0] == "set" && args[1] == "secret" {
+				args[2] = "***"
+			}
+			return args
+		},
+	}, dir)
+	s := &service{adm: newAdmission(Config{})}
+	for i := 0; i < 10; i++ {
+		reqs := []*writeRequestFuture{
+			{args: []string{"tick", "1", "2"}},
+			{args: []string{"set", "secret", "password"}, s: s,
+				addr: "10.0.0.1:5000", user: "alice"},
+			{args: []string{"del", "key"}, s: s},
+		}
+		res := &applyResult{index: uint64(i + 1), term: 2, ts: 1e9,
+			resps: []applyResp{{}, {resp: redcon.SimpleString("OK")},
+				{err: errors.New("denied")}}}
+		a.record(0, res, reqs)
+	}
+	olds, _ := filepath.Glob(filepath.Join(dir, "audit", "audit-*.log"))
+	if len(olds) != 2 {
+		t.Fatalf("expected 2 rotated files, got %d", len(olds))
+	}
+	f, err := os.Open(filepath.Join(dir, "audit", "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []auditEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Index != 10 || e.Term != 2 || e.User != "alice" ||
+		e.Addr != "10.0.0.1:5000" || e.Args[2] != "***" || e.Resp != "OK" ||
+		e.Time != "1970-01-01T00:00:01Z" {
+		t.Fatalf("unexpected %+v", e)
+	}
+	if entries[1].Err != "denied" {
+		t.Fatalf("unexpected %+v", entries[1])
+	}
+}
+
+func TestAuditInternal(t *testing.T) {
+	dir := t.TempDir()
+	a := auditInit(Config{Audit: true}, dir)
+	var conf Config
+	conf.def()
+	m := machineInit(conf, 0, "", nil)
+	// apply the writes like the write applier
+	go func() {
+		for r := range m.wrC {
+			res := &applyResult{index: 1, term: 1, ts: 1e9,
+				resps: []applyResp{{resp: redcon.SimpleString("OK")}}}
+			a.record(0, res, []*writeRequestFuture{r})
+			r.resp = redcon.SimpleString("OK")
+			r.done()
+		}
+	}()
+	defer close(m.wrC)
+	im := intermediateMachine{m: m, user: "admin", addr: "10.0.0.1:5000"}
+	if _, err := cmdACLSETUSER(im, nil, []string{"acl", "setuser", "bob",
+		"on", ">secret"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "audit", "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e auditEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.User != "admin" || e.Addr != "10.0.0.1:5000" || !e.Internal ||
+		e.Args[0] != "aclwrite" || e.Args[2] != "bob" {
+		t.Fatalf("unexpected %+v", e)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	redact := func(args []string) []string {
+		for i := range args {
+			if args[i] == "password" {
+				args[i] = "***"
+			}
+		}
+		if args[0] == "eval" && len(args) > 1 {
+			args[1] = "(script)"
+		}
+		return args
+	}
+	txn := appendTxnCommands([]string{"txn", "7", "1", "w"},
+		[][]string{{"set", "a", "password"}, {"get", "b"}})
+	tests := []struct {
+		args, expect []string
+	}{
+		{[]string{"set", "a", "password"}, []string{"set", "a", "***"}},
+		{txn, appendTxnCommands([]string{"txn", "7", "1", "w"},
+			[][]string{{"set", "a", "***"}, {"get", "b"}})},
+		{[]string{"schedulewrite", "add", "job", "@daily", "set", "a",
+			"password"}, []string{"schedulewrite", "add", "job", "@daily",
+			"set", "a", "***"}},
+		{[]string{"scriptwrite", "run", "alice", "return 1", "0", "password"},
+			[]string{"scriptwrite", "run", "alice", "(script)", "0", "***"}},
+		{[]string{"schedulewrite", "add", "job", "@daily", "acl", "setuser",
+			"bob", ">secret"}, []string{"schedulewrite", "add", "job",
+			"@daily", "acl", "setuser", "bob", aclRedacted}},
+	}
+	for _, tt := range tests {
+		orig := append([]string(nil), tt.args...)
+		got := redactArgs(redactArgs(tt.args, aclRedactArgs), redact)
+		if !reflect.DeepEqual(got, tt.expect) {
+			t.Fatalf("expected %v, got %v", tt.expect, got)
+		}
+		if !reflect.DeepEqual(tt.args, orig) {
+			t.Fatalf("args were altered: %v", tt.args)
+		}
+	}
+}
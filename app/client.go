@@ -0,0 +1,303 @@
+package app
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+)
+
+// maxPendingInvalidations is the number of invalidated keys that can wait
+// to be sent to a tracking connection before the connection is told to
+// flush all keys instead.
+const maxPendingInvalidations = 10000
+
+var errNoProto = errors.New("NOPROTO unsupported protocol version")
+
+var errTrackingRESP3 = errors.New("CLIENT TRACKING requires RESP3, use " +
+	"HELLO 3 first")
+
+// redisMap is a response that is written as a RESP3 map, or as a flat array
+// of key-value pairs for RESP2 connections.
+type redisMap []interface{}
+
+// redisTrackingOn is the response of CLIENT TRACKING ON, which detaches the
+// connection for receiving the invalidation pushes.
+type redisTrackingOn struct{}
+
+// redisServiceHello handles HELLO [protover [AUTH user pass] [SETNAME name]]
+func redisServiceHello(s Service, client *redisClient, args []string,
+) Receiver {
+	proto := client.resp
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return Response(nil, 0, errors.New("Protocol version is not "+
+				"an integer or out of range"))
+		}
+		if n != 2 && n != 3 {
+			return Response(nil, 0, errNoProto)
+		}
+		proto = n
+	}
+	var name string
+	var setName bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "auth":
+			if i+2 >= len(args) {
+				return Response(nil, 0, ErrSyntax)
+			}
+			if err := s.AuthUser(args[i+1], args[i+2]); err != nil {
+				client.authorized = false
+				client.opts.User = ""
+				return Response(nil, 0, err)
+			}
+			client.authorized = true
+			client.opts.User = args[i+1]
+			i += 2
+		case "setname":
+			if i+1 >= len(args) {
+				return Response(nil, 0, ErrSyntax)
+			}
+			name, setName = args[i+1], true
+			i++
+		default:
+			return Response(nil, 0, ErrSyntax)
+		}
+	}
+	if !client.authorized {
+		if err := s.Auth(""); err != nil {
+			return Response(nil, 0, err)
+		}
+		client.authorized = true
+	}
+	if setName {
+		_, _, err := s.Send([]string{"client", "setname", name},
+			&client.opts).Recv()
+		if err != nil {
+			return Response(nil, 0, err)
+		}
+	}
+	client.resp = proto
+	return Response(redisMap{
+		"server", "uhaha",
+		"proto", redcon.SimpleInt(proto),
+		"id", redcon.SimpleInt(client.opts.ConnID),
+		"mode", "standalone",
+		"modules", []interface{}{},
+	}, 0, nil)
+}
+
+// redisServiceClient handles the CLIENT subcommands.
+func redisServiceClient(s Service, client *redisClient, args []string,
+) Receiver {
+	if err := s.Allowed('s', "client", &client.opts); err != nil {
+		return Response(nil, 0, err)
+	}
+	if len(args) < 2 {
+		return Response(nil, 0, ErrWrongNumArgs)
+	}
+	switch strings.ToLower(args[1]) {
+	case "id":
+		if len(args) != 2 {
+			return Response(nil, 0, ErrWrongNumArgs)
+		}
+		return Response(redcon.SimpleInt(client.opts.ConnID), 0, nil)
+	case "tracking":
+		return redisServiceClientTracking(s, client, args)
+	}
+	return s.Send(args, &client.opts)
+}
+
+// CLIENT TRACKING ON|OFF [BCAST] [PREFIX prefix ...]
+func redisServiceClientTracking(s Service, client *redisClient, args []string,
+) Receiver {
+	if len(args) < 3 {
+		return Response(nil, 0, ErrWrongNumArgs)
+	}
+	var opts TrackingOptions
+	for i := 3; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "bcast":
+			opts.BCast = true
+		case "prefix":
+			if i+1 >= len(args) {
+				return Response(nil, 0, ErrSyntax)
+			}
+			opts.Prefixes = append(opts.Prefixes, args[i+1])
+			i++
+		default:
+			return Response(nil, 0, ErrSyntax)
+		}
+	}
+	if len(opts.Prefixes) > 0 && !opts.BCast {
+		return Response(nil, 0, errors.New("PREFIX requires BCAST"))
+	}
+	switch strings.ToLower(args[2]) {
+	case "on":
+		if client.resp != 3 {
+			return Response(nil, 0, errTrackingRESP3)
+		}
+		if client.tracking == nil {
+			client.tracking = &redisTracking{signal: make(chan struct{}, 1)}
+		}
+		opts.Push = client.tracking.push
+		s.Track(client, &opts)
+		return Response(redisTrackingOn{}, 0, nil)
+	case "off":
+		if len(args) != 3 {
+			return Response(nil, 0, ErrSyntax)
+		}
+		s.Track(client, nil)
+		return Response(redcon.SimpleString("OK"), 0, nil)
+	}
+	return Response(nil, 0, ErrSyntax)
+}
+
+// redisTracking holds the invalidated keys that are waiting to be pushed to
+// a tracking connection.
+type redisTracking struct {
+	signal chan struct{}
+
+	mu    sync.Mutex
+	keys  []string
+	flush bool
+}
+
+func (rt *redisTracking) push(keys []string) {
+	rt.mu.Lock()
+	if keys == nil || len(rt.keys)+len(keys) > maxPendingInvalidations {
+		rt.flush = true
+		rt.keys = nil
+	} else if !rt.flush {
+		rt.keys = append(rt.keys, keys...)
+	}
+	rt.mu.Unlock()
+	select {
+	case rt.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (rt *redisTracking) take() (keys []string, flush bool) {
+	rt.mu.Lock()
+	keys, flush = rt.keys, rt.flush
+	rt.keys, rt.flush = nil, false
+	rt.mu.Unlock()
+	return keys, flush
+}
+
+// redisWriteInvalidate writes the RESP3 invalidate push. A flush is a null
+// array of keys.
+func redisWriteInvalidate(conn redcon.Conn, keys []string, flush bool) {
+	conn.WriteRaw([]byte(">2\r\n$10\r\ninvalidate\r\n"))
+	if flush {
+		conn.WriteRaw([]byte("_\r\n"))
+		return
+	}
+	conn.WriteArray(len(keys))
+	for _, key := range keys {
+		conn.WriteBulkString(key)
+	}
+}
+
+// redisWriteMap writes the key-value pairs as a RESP3 map, or as an array
+// for RESP2.
+func redisWriteMap(conn redcon.Conn, resp int, m redisMap) {
+	if resp == 3 {
+		conn.WriteRaw([]byte("%" + strconv.Itoa(len(m)/2) + "\r\n"))
+	} else {
+		conn.WriteArray(len(m))
+	}
+	for _, v := range m {
+		redisWriteAny(conn, resp, v)
+	}
+}
+
+// redisWriteAny writes the value, including any maps that are nested in
+// arrays or maps.
+func redisWriteAny(conn redcon.Conn, resp int, v interface{}) {
+	switch v := v.(type) {
+	case redisMap:
+		redisWriteMap(conn, resp, v)
+	case []interface{}:
+		conn.WriteArray(len(v))
+		for _, v := range v {
+			redisWriteAny(conn, resp, v)
+		}
+	default:
+		conn.WriteAny(v)
+	}
+}
+
+// detach detaches the connection from the network loop and reads its
+// commands in the background, which detects when the client goes away.
+func (client *redisClient) detach(conn redcon.Conn) redcon.DetachedConn {
+	dconn := conn.Detach()
+	client.detached = true
+	// The buffer lets a blocked client pipeline commands and still be seen
+	// going away.
+	client.cmds = make(chan []string, 64)
+	client.gone = make(chan struct{})
+	client.stop = make(chan struct{})
+	go func() {
+		defer close(client.gone)
+		for {
+			cmd, err := dconn.ReadCommand()
+			if err != nil {
+				return
+			}
+			select {
+			case client.cmds <- redisCommandToArgs(cmd):
+			case <-client.stop:
+				return
+			}
+		}
+	}()
+	return dconn
+}
+
+// redisServeDetached serves a connection that was detached from the network
+// loop, which allows for invalidation pushes to be written between the
+// command responses.
+func redisServeDetached(s Service, client *redisClient,
+	dconn redcon.DetachedConn,
+) {
+	addr := dconn.RemoteAddr()
+	defer func() {
+		close(client.stop)
+		s.Track(client, nil)
+		dconn.Close()
+		s.Unregister(&client.opts)
+		s.Closed(client.opts.Context, addr)
+	}()
+	// the responses prior to the detach have not been flushed
+	if dconn.Flush() != nil {
+		return
+	}
+	for {
+		// the tracking is off for a connection detached by a blocking command
+		var signal chan struct{}
+		if client.tracking != nil {
+			signal = client.tracking.signal
+		}
+		select {
+		case args := <-client.cmds:
+			redisServiceExecArgs(s, client, dconn, [][]string{args})
+		case <-signal:
+			keys, flush := client.tracking.take()
+			if len(keys) == 0 && !flush {
+				continue
+			}
+			redisWriteInvalidate(dconn, keys, flush)
+		case <-client.gone:
+			return
+		}
+		if dconn.Flush() != nil {
+			return
+		}
+	}
+}
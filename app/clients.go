@@ -0,0 +1,449 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// clientNextID is the last client connection id.
+var clientNextID uint64
+
+var errNoSuchClient = errors.New("No such client")
+
+var errClientName = errors.New("Client names cannot contain spaces, " +
+	"newlines or special characters.")
+
+var errNotRegistered = errors.New("connection is not registered")
+
+// clientConn is a connection in the client registry.
+type clientConn struct {
+	id      uint64
+	addr    string
+	created time.Time
+	kill    func()
+
+	mu     sync.Mutex
+	user   string    // ACL user
+	name   string    // set by CLIENT SETNAME
+	cmd    string    // last command
+	active time.Time // time of the last command
+}
+
+// clientTable is the registry of the client connections from all services.
+// It's shared by all raft groups.
+type clientTable struct {
+	mu    sync.RWMutex
+	conns map[uint64]*clientConn
+
+	paused      int32 // (atomic bool) a pause is active or expired
+	pmu         sync.Mutex
+	pauseUntil  time.Time
+	pauseWrites bool          // only writes are paused
+	pauseSig    chan struct{} // closed when the pause changes
+}
+
+func newClientTable() *clientTable {
+	return &clientTable{
+		conns:    make(map[uint64]*clientConn),
+		pauseSig: make(chan struct{}),
+	}
+}
+
+// register adds a connection and sets opts.ConnID.
+func (ct *clientTable) register(opts *SendOptions, kill func()) {
+	now := time.Now()
+	c := &clientConn{
+		id:      atomic.AddUint64(&clientNextID, 1),
+		addr:    opts.Addr,
+		created: now,
+		kill:    kill,
+		user:    opts.User,
+		active:  now,
+	}
+	ct.mu.Lock()
+	ct.conns[c.id] = c
+	ct.mu.Unlock()
+	opts.ConnID = c.id
+}
+
+func (ct *clientTable) unregister(id uint64) {
+	ct.mu.Lock()
+	delete(ct.conns, id)
+	ct.mu.Unlock()
+}
+
+func (ct *clientTable) get(id uint64) *clientConn {
+	ct.mu.RLock()
+	c := ct.conns[id]
+	ct.mu.RUnlock()
+	return c
+}
+
+// name returns the name of the connection, or an empty string when the
+// connection has no name or is not registered.
+func (ct *clientTable) name(id uint64) string {
+	if id == 0 {
+		return ""
+	}
+	c := ct.get(id)
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.name
+}
+
+// touch records the command as the last command of the connection.
+func (ct *clientTable) touch(opts *SendOptions, name string) {
+	if opts.ConnID == 0 {
+		return
+	}
+	c := ct.get(opts.ConnID)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.user = opts.User
+	c.cmd = name
+	c.active = time.Now()
+	c.mu.Unlock()
+}
+
+// list returns all connections ordered by id.
+func (ct *clientTable) list() []*clientConn {
+	ct.mu.RLock()
+	conns := make([]*clientConn, 0, len(ct.conns))
+	for _, c := range ct.conns {
+		conns = append(conns, c)
+	}
+	ct.mu.RUnlock()
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].id < conns[j].id
+	})
+	return conns
+}
+
+// info returns the connection in the CLIENT LIST format.
+func (c *clientConn) info(now time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	user := c.user
+	if user == "" {
+		user = aclDefaultUser
+	}
+	cmd := c.cmd
+	if cmd == "" {
+		cmd = "NULL"
+	}
+	return fmt.Sprintf("id=%d addr=%s name=%s age=%d idle=%d user=%s cmd=%s",
+		c.id, c.addr, c.name, int64(now.Sub(c.created)/time.Second),
+		int64(now.Sub(c.active)/time.Second), user, cmd)
+}
+
+// pause pauses the client commands until the timeout, replacing any current
+// pause. Only write commands are paused when writes is true.
+func (ct *clientTable) pause(timeout time.Duration, writes bool) {
+	ct.pmu.Lock()
+	ct.pauseUntil = time.Now().Add(timeout)
+	ct.pauseWrites = writes
+	close(ct.pauseSig)
+	ct.pauseSig = make(chan struct{})
+	atomic.StoreInt32(&ct.paused, 1)
+	ct.pmu.Unlock()
+}
+
+func (ct *clientTable) unpause() {
+	ct.pmu.Lock()
+	ct.pauseUntil = time.Time{}
+	close(ct.pauseSig)
+	ct.pauseSig = make(chan struct{})
+	atomic.StoreInt32(&ct.paused, 0)
+	ct.pmu.Unlock()
+}
+
+// wait blocks while the commands of the kind are paused. The kind is 'r'
+// read, or 'w' write.
+func (ct *clientTable) wait(kind byte) {
+	if atomic.LoadInt32(&ct.paused) == 0 {
+		return
+	}
+	for {
+		ct.pmu.Lock()
+		d := time.Until(ct.pauseUntil)
+		if d <= 0 || (ct.pauseWrites && kind != 'w') {
+			ct.pmu.Unlock()
+			return
+		}
+		sig := ct.pauseSig
+		ct.pmu.Unlock()
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-sig:
+		}
+		t.Stop()
+	}
+}
+
+// CLIENT subcommand args...
+// help: manages the client connections of this server.
+func cmdCLIENT(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 2 {
+		return nil, errWrongNumArgsClient
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		return cmdCLIENTHELP(um, ra, args)
+	case "list":
+		return cmdCLIENTLIST(um, ra, args)
+	case "kill":
+		return cmdCLIENTKILL(um, ra, args)
+	case "setname":
+		return cmdCLIENTSETNAME(um, ra, args)
+	case "getname":
+		return cmdCLIENTGETNAME(um, ra, args)
+	case "pause":
+		return cmdCLIENTPAUSE(um, ra, args)
+	case "unpause":
+		return cmdCLIENTUNPAUSE(um, ra, args)
+	default:
+		return nil, errUnknownClientCommand(args[:2])
+	}
+}
+
+// CLIENT HELP
+// help: returns the valid CLIENT related commands; []string
+func cmdCLIENTHELP(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsClient
+	}
+	lines := []redcon.SimpleString{
+		"CLIENT ID",
+		"CLIENT LIST [ID id ...]",
+		"CLIENT KILL addr",
+		"CLIENT KILL [ID id] [ADDR addr] [USER user] [SKIPME yes|no]",
+		"CLIENT SETNAME name",
+		"CLIENT GETNAME",
+		"CLIENT PAUSE timeout [WRITE|ALL]",
+		"CLIENT UNPAUSE",
+		"CLIENT TRACKING ON|OFF [BCAST] [PREFIX prefix ...]",
+	}
+	return lines, nil
+}
+
+// CLIENT LIST [ID id ...]
+// help: returns the client connections from all services, one per line,
+//       with the id, address, name, age and idle seconds, user, and last
+//       command.
+func cmdCLIENTLIST(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	var ids map[uint64]bool
+	if len(args) > 2 {
+		if strings.ToLower(args[2]) != "id" || len(args) == 3 {
+			return nil, ErrSyntax
+		}
+		ids = make(map[uint64]bool)
+		for _, arg := range args[3:] {
+			id, err := strconv.ParseUint(arg, 10, 64)
+			if err != nil {
+				return nil, errNotInteger
+			}
+			ids[id] = true
+		}
+	}
+	now := time.Now()
+	var sb strings.Builder
+	for _, c := range getBaseMachine(um).clients.list() {
+		if ids == nil || ids[c.id] {
+			sb.WriteString(c.info(now))
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String(), nil
+}
+
+// CLIENT KILL addr
+// CLIENT KILL [ID id] [ADDR addr] [USER user] [SKIPME yes|no]
+// help: closes the connections that match all of the filters, and returns
+//       the number of closed connections. The current connection is skipped
+//       unless SKIPME is no. The old form closes the connection with the
+//       address and returns OK.
+func cmdCLIENTKILL(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, errWrongNumArgsClient
+	}
+	var self uint64
+	if im, ok := um.(intermediateMachine); ok {
+		self = im.conn
+	}
+	var id uint64
+	var addr, user string
+	var hasID, hasAddr, hasUser bool
+	skipme := true
+	old := len(args) == 3
+	if old {
+		addr, hasAddr, skipme = args[2], true, false
+	} else {
+		if len(args)%2 != 0 {
+			return nil, ErrSyntax
+		}
+		for i := 2; i < len(args); i += 2 {
+			switch strings.ToLower(args[i]) {
+			case "id":
+				n, err := strconv.ParseUint(args[i+1], 10, 64)
+				if err != nil {
+					return nil, errNotInteger
+				}
+				id, hasID = n, true
+			case "addr":
+				addr, hasAddr = args[i+1], true
+			case "user":
+				user, hasUser = args[i+1], true
+			case "skipme":
+				switch strings.ToLower(args[i+1]) {
+				case "yes":
+					skipme = true
+				case "no":
+					skipme = false
+				default:
+					return nil, ErrSyntax
+				}
+			default:
+				return nil, ErrSyntax
+			}
+		}
+	}
+	ct := getBaseMachine(um).clients
+	var n int
+	for _, c := range ct.list() {
+		c.mu.Lock()
+		cuser := c.user
+		c.mu.Unlock()
+		if cuser == "" {
+			cuser = aclDefaultUser
+		}
+		if (hasID && c.id != id) || (hasAddr && c.addr != addr) ||
+			(hasUser && cuser != user) || (skipme && c.id == self) {
+			continue
+		}
+		ct.unregister(c.id)
+		if c.kill != nil {
+			c.kill()
+		}
+		n++
+	}
+	if old {
+		if n == 0 {
+			return nil, errNoSuchClient
+		}
+		return redcon.SimpleString("OK"), nil
+	}
+	return redcon.SimpleInt(n), nil
+}
+
+// CLIENT SETNAME name
+// help: sets the name of the current connection. An empty name removes the
+//       name.
+func cmdCLIENTSETNAME(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumArgsClient
+	}
+	for _, ch := range args[2] {
+		if ch <= ' ' || ch > '~' {
+			return nil, errClientName
+		}
+	}
+	c := clientCurrent(um)
+	if c == nil {
+		return nil, errNotRegistered
+	}
+	c.mu.Lock()
+	c.name = args[2]
+	c.mu.Unlock()
+	return redcon.SimpleString("OK"), nil
+}
+
+// CLIENT GETNAME
+// help: returns the name of the current connection, or nil when there is
+//       no name.
+func cmdCLIENTGETNAME(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsClient
+	}
+	c := clientCurrent(um)
+	if c == nil {
+		return nil, errNotRegistered
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.name == "" {
+		return nil, nil
+	}
+	return c.name, nil
+}
+
+// CLIENT PAUSE timeout [WRITE|ALL]
+// help: pauses the read and write commands from all connections for the
+//       timeout in milliseconds, or only the write commands with WRITE.
+//       System commands, such as CLIENT UNPAUSE, are not paused.
+func cmdCLIENTPAUSE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 3 && len(args) != 4 {
+		return nil, errWrongNumArgsClient
+	}
+	ms, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || ms < 0 {
+		return nil, errors.New("timeout is not an integer or out of range")
+	}
+	var writes bool
+	if len(args) == 4 {
+		switch strings.ToLower(args[3]) {
+		case "write":
+			writes = true
+		case "all":
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	getBaseMachine(um).clients.pause(time.Duration(ms)*time.Millisecond,
+		writes)
+	return redcon.SimpleString("OK"), nil
+}
+
+// CLIENT UNPAUSE
+// help: resumes the paused commands.
+func cmdCLIENTUNPAUSE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsClient
+	}
+	getBaseMachine(um).clients.unpause()
+	return redcon.SimpleString("OK"), nil
+}
+
+// clientCurrent returns the registered connection that is running the
+// command.
+func clientCurrent(um Machine) *clientConn {
+	im, ok := um.(intermediateMachine)
+	if !ok || im.conn == 0 {
+		return nil
+	}
+	return im.m.clients.get(im.conn)
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+func TestClients(t *testing.T) {
+	var conf Config
+	conf.def()
+	m := machineInit(conf, 0, "", nil)
+	var killed []string
+	var conns [3]SendOptions
+	for i, addr := range []string{"1.1.1.1:1", "1.1.1.1:2", "2.2.2.2:1"} {
+		addr := addr
+		conns[i] = SendOptions{Addr: addr}
+		m.clients.register(&conns[i], func() { killed = append(killed, addr) })
+	}
+	conns[2].User = "admin"
+	m.clients.touch(&conns[2], "get")
+	im := intermediateMachine{m: m, conn: conns[0].ConnID}
+	resp, err := cmdCLIENT(im, nil, []string{"client", "setname", "worker"})
+	if err != nil || resp != redcon.SimpleString("OK") {
+		t.Fatalf("unexpected %v %v", resp, err)
+	}
+	if _, err := cmdCLIENT(im, nil, []string{"client", "setname",
+		"a b"}); err != errClientName {
+		t.Fatalf("expected %v, got %v", errClientName, err)
+	}
+	resp, _ = cmdCLIENT(im, nil, []string{"client", "getname"})
+	if resp != "worker" {
+		t.Fatalf("expected worker, got %v", resp)
+	}
+	resp, _ = cmdCLIENT(m, nil, []string{"client", "list"})
+	lines := strings.Split(strings.TrimSpace(resp.(string)), "\n")
+	if len(lines) != 3 ||
+		!strings.Contains(lines[0], " name=worker ") ||
+		!strings.HasSuffix(lines[1], " user=default cmd=NULL") ||
+		!strings.HasSuffix(lines[2], " user=admin cmd=get") {
+		t.Fatalf("unexpected %q", lines)
+	}
+
+	// kill
+	resp, err = cmdCLIENT(im, nil, []string{"client", "kill", "user",
+		"default"})
+	if err != nil || resp != redcon.SimpleInt(1) {
+		t.Fatalf("unexpected %v %v", resp, err)
+	}
+	if len(killed) != 1 || killed[0] != "1.1.1.1:2" {
+		t.Fatalf("unexpected %v", killed)
+	}
+	if _, err := cmdCLIENT(im, nil, []string{"client", "kill",
+		"1.1.1.1:2"}); err != errNoSuchClient {
+		t.Fatalf("expected %v, got %v", errNoSuchClient, err)
+	}
+	resp, _ = cmdCLIENT(im, nil, []string{"client", "kill", "addr",
+		"1.1.1.1:1"})
+	if resp != redcon.SimpleInt(0) {
+		t.Fatalf("expected 0, got %v", resp)
+	}
+	resp, err = cmdCLIENT(im, nil, []string{"client", "kill", "1.1.1.1:1"})
+	if err != nil || resp != redcon.SimpleString("OK") {
+		t.Fatalf("unexpected %v %v", resp, err)
+	}
+	if m.clients.get(conns[0].ConnID) != nil {
+		t.Fatal("expected unregistered connection")
+	}
+	resp, _ = cmdCLIENT(m, nil, []string{"client", "list", "id",
+		"1", "2"})
+	if resp != "" {
+		t.Fatalf("unexpected %q", resp)
+	}
+}
+
+func TestClientsPause(t *testing.T) {
+	ct := newClientTable()
+	ct.pause(time.Hour, true)
+	done := make(chan byte, 2)
+	for _, kind := range []byte{'r', 'w'} {
+		go func(kind byte) {
+			ct.wait(kind)
+			done <- kind
+		}(kind)
+	}
+	if kind := <-done; kind != 'r' {
+		t.Fatalf("expected read, got %c", kind)
+	}
+	select {
+	case <-done:
+		t.Fatal("expected paused write")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ct.unpause()
+	if kind := <-done; kind != 'w' {
+		t.Fatalf("expected write, got %c", kind)
+	}
+	start := time.Now()
+	ct.pause(20*time.Millisecond, false)
+	ct.wait('r')
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("expected paused read")
+	}
+}
@@ -1,7 +1,6 @@
 package app
 
 import (
-	"compress/gzip"
 	"errors"
 	"fmt"
 	"github.com/hashicorp/raft"
@@ -32,16 +31,17 @@ func cmdBARRIER(um Machine, ra *raftWrap, args []string) (interface{}, error) {
 	return redcon.SimpleString("OK"), nil
 }
 
-// TICK timestamp-int64 random-int64
+// TICK timestamp-int64 random-int64 [session-timeout-int64]
 // help: updates the machine timestamp and random seed. It's not possible to
 //       directly call this from a client service. It can only be called by
-//       its own internal server instance.
+//       its own internal server instance. The optional session timeout is
+//       the leader's SessionTimeout, in nanoseconds.
 func cmdTICK(um Machine, ra *raftWrap, args []string) (interface{}, error) {
 	m := getBaseMachine(um)
 	if m == nil {
 		return nil, ErrInvalid
 	}
-	if len(args) != 3 {
+	if len(args) != 3 && len(args) != 4 {
 		return nil, ErrWrongNumArgs
 	}
 	ts, err := strconv.ParseInt(args[1], 10, 64)
@@ -58,11 +58,24 @@ func cmdTICK(um Machine, ra *raftWrap, args []string) (interface{}, error) {
 	if seed == m.seed {
 		return nil, errors.New("random number has not changed")
 	}
+	if len(args) == 4 {
+		timeout, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil || timeout <= 0 {
+			return nil, errors.New("invalid session timeout")
+		}
+		m.sessionTimeout = time.Duration(timeout)
+	}
 	m.seed = seed
 	m.ts = ts
 	if m.start == 0 {
 		m.start = m.ts
 	}
+	// expire the client sessions that have been idle for too long
+	m.sessions.expire(m.ts - int64(m.sessionTimeout))
+	// free the locks with expired leases
+	m.locks.expire(m.ts)
+	// apply the scheduled jobs that are due
+	m.runSchedule()
 	if m.tick != nil {
 		// call the user defined tick function
 		m.tick(m)
@@ -289,7 +302,7 @@ func cmdRAFTSNAPSHOTNOW(m *machine, ra *raftWrap, args []string,
 		return nil, err
 	}
 	path := filepath.Join(m.dir, "snapshots", meta.ID, "state.bin")
-	info, err := readSnapInfo(meta.ID, path)
+	info, err := readSnapInfo(m.conf.keys, meta.ID, path)
 	if err != nil {
 		return nil, err
 	}
@@ -310,7 +323,7 @@ func cmdRAFTSNAPSHOTLIST(m *machine, ra *raftWrap, args []string,
 	var snaps []map[string]string
 	for _, meta := range list {
 		path := filepath.Join(m.dir, "snapshots", meta.ID, "state.bin")
-		info, err := readSnapInfo(meta.ID, path)
+		info, err := readSnapInfo(m.conf.keys, meta.ID, path)
 		if err != nil {
 			return nil, err
 		}
@@ -398,18 +411,19 @@ func cmdRAFTSNAPSHOTREAD(m *machine, ra *raftWrap, args []string,
 	return bytes, nil
 }
 
-func readSnapInfo(id, path string) (map[string]string, error) {
+func readSnapInfo(kr *KeyRing, id, path string,
+) (map[string]string, error) {
 	status := map[string]string{}
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	gr, err := gzip.NewReader(f)
+	gr, err := snapReader(kr, f)
 	if err != nil {
 		return nil, err
 	}
-	_, ts, _, err := readSnapHead(gr)
+	_, ts, _, _, err := readSnapHead(gr)
 	if err != nil {
 		return nil, err
 	}
@@ -424,10 +438,11 @@ func readSnapInfo(id, path string) (map[string]string, error) {
 }
 
 var clusterCommands = map[string]command{
-	"help":  {'s', cmdCLUSTERHELP},
-	"info":  {'s', cmdCLUSTERINFO},
-	"slots": {'s', cmdCLUSTERSLOTS},
-	"nodes": {'s', cmdCLUSTERNODES},
+	"help":    {'s', cmdCLUSTERHELP},
+	"info":    {'s', cmdCLUSTERINFO},
+	"slots":   {'s', cmdCLUSTERSLOTS},
+	"nodes":   {'s', cmdCLUSTERNODES},
+	"migrate": {'s', cmdCLUSTERMIGRATE},
 }
 
 // CLUSTER HELP
@@ -441,6 +456,7 @@ func cmdCLUSTERHELP(um Machine, ra *raftWrap, args []string,
 		"CLUSTER INFO",
 		"CLUSTER NODES",
 		"CLUSTER SLOTS",
+		"CLUSTER MIGRATE slot group",
 	}
 	return lines, nil
 }
@@ -449,16 +465,34 @@ func cmdCLUSTERHELP(um Machine, ra *raftWrap, args []string,
 // help: returns various redis cluster info; string
 func cmdCLUSTERINFO(um Machine, ra *raftWrap, args []string,
 ) (interface{}, error) {
-	slist, err := ra.getServerList()
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	groups := m.raftGroups(ra)
+	cgroups, err := getClusterGroups(groups)
 	if err != nil {
-		return nil, errRaftConvert(ra, err)
+		return nil, err
+	}
+	var size int
+	for _, cg := range cgroups {
+		size += len(cg.servers)
+	}
+	var assigned int
+	for _, owner := range slotOwners(groups) {
+		if owner != -1 {
+			assigned++
+		}
+	}
+	state := "ok"
+	if assigned != numSlots {
+		state = "fail"
 	}
-	size := len(slist)
 	epoch := ra.LastIndex()
 	return fmt.Sprintf(""+
-		"cluster_state:ok\n"+
-		"cluster_slots_assigned:16384\n"+
-		"cluster_slots_ok:16384\n"+
+		"cluster_state:%s\n"+
+		"cluster_slots_assigned:%d\n"+
+		"cluster_slots_ok:%d\n"+
 		"cluster_slots_pfail:0\n"+
 		"cluster_slots_fail:0\n"+
 		"cluster_known_nodes:%d\n"+
@@ -467,74 +501,111 @@ func cmdCLUSTERINFO(um Machine, ra *raftWrap, args []string,
 		"cluster_my_epoch:%d\n"+
 		"cluster_stats_messages_sent:0\n"+
 		"cluster_stats_messages_received:0\n",
-		size, size, epoch, epoch,
+		state, assigned, assigned, size, size, epoch, epoch,
 	), nil
 }
 
+// clusterGroup is the servers of a raft group.
+type clusterGroup struct {
+	servers []serverEntry
+	leader  serverEntry
+}
+
+func getClusterGroups(groups []*raftGroup) ([]clusterGroup, error) {
+	cgroups := make([]clusterGroup, len(groups))
+	for i, g := range groups {
+		slist, err := g.ra.getServerList()
+		if err != nil {
+			return nil, errRaftConvert(g.ra, err)
+		}
+		cgroups[i].servers = slist
+		for _, server := range slist {
+			if server.leader {
+				cgroups[i].leader = server
+				break
+			}
+		}
+	}
+	return cgroups, nil
+}
+
 // CLUSTER SLOTS
-// help: returns the cluster slots, which is always all slots being assigned
-// to the leader.
+// help: returns the cluster slots, which are the slot ranges of each raft
+// group and the leader of the group.
 func cmdCLUSTERSLOTS(um Machine, ra *raftWrap, args []string,
 ) (interface{}, error) {
-	slist, err := ra.getServerList()
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	groups := m.raftGroups(ra)
+	cgroups, err := getClusterGroups(groups)
 	if err != nil {
-		return nil, errRaftConvert(ra, err)
+		return nil, err
 	}
-	var leader serverEntry
-	for _, server := range slist {
-		if server.leader {
-			leader = server
-			break
+	var slots []interface{}
+	for _, r := range slotRanges(slotOwners(groups)) {
+		leader := cgroups[r.group].leader
+		if !leader.leader {
+			return nil, errors.New("CLUSTERDOWN The cluster is down")
 		}
-	}
-	if !leader.leader {
-		return nil, errors.New("CLUSTERDOWN The cluster is down")
-	}
-	return []interface{}{
-		[]interface{}{
-			redcon.SimpleInt(0),
-			redcon.SimpleInt(16383),
+		slots = append(slots, []interface{}{
+			redcon.SimpleInt(r.start),
+			redcon.SimpleInt(r.end),
 			[]interface{}{
 				leader.host(),
 				redcon.SimpleInt(leader.port()),
 				leader.clusterID(),
 			},
-		},
-	}, nil
+		})
+	}
+	if len(slots) == 0 {
+		return nil, errors.New("CLUSTERDOWN The cluster is down")
+	}
+	return slots, nil
 }
 
 // CLUSTER NODES
-// help: returns the cluster nodes
+// help: returns the cluster nodes, where each server of a raft group is a
+// node.
 func cmdCLUSTERNODES(um Machine, ra *raftWrap, args []string,
 ) (interface{}, error) {
-	slist, err := ra.getServerList()
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	groups := m.raftGroups(ra)
+	cgroups, err := getClusterGroups(groups)
 	if err != nil {
-		return nil, errRaftConvert(ra, err)
+		return nil, err
 	}
-	var leader serverEntry
-	for _, server := range slist {
-		if server.leader {
-			leader = server
-			break
+	slots := make([]string, len(groups))
+	for _, r := range slotRanges(slotOwners(groups)) {
+		if r.start == r.end {
+			slots[r.group] += fmt.Sprintf(" %d", r.start)
+		} else {
+			slots[r.group] += fmt.Sprintf(" %d-%d", r.start, r.end)
 		}
 	}
-	if !leader.leader {
-		return nil, errors.New("CLUSTERDOWN The cluster is down")
-	}
-	leaderID := leader.clusterID()
 	var result string
-	for _, server := range slist {
-		flags := "slave"
-		followerOf := leaderID
-		if server.leader {
-			flags = "master"
-			followerOf = "-"
+	for i, cg := range cgroups {
+		if !cg.leader.leader {
+			return nil, errors.New("CLUSTERDOWN The cluster is down")
+		}
+		leaderID := cg.leader.clusterID()
+		for _, server := range cg.servers {
+			flags := "slave"
+			followerOf := leaderID
+			if server.leader {
+				flags = "master"
+				followerOf = "-"
+			}
+			result += fmt.Sprintf("%s %s:%d@%d %s %s 0 0 connected%s\n",
+				server.clusterID(),
+				server.host(), server.port(), server.port(),
+				flags, followerOf, slots[i],
+			)
 		}
-		result += fmt.Sprintf("%s %s:%d@%d %s %s 0 0 connected 0-16383\n",
-			server.clusterID(),
-			server.host(), server.port(), server.port(),
-			flags, followerOf,
-		)
 	}
 	return result, nil
 }
@@ -2,6 +2,7 @@ package app
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io"
@@ -33,12 +34,26 @@ Basic options:
   -d dir           : data directory  (default: data)
   -j addr          : leader address of a cluster to join
   -l level         : log level  (default: info) [debug,verb,info,warn,silent]
+  --config path    : load the settings from a .toml or .yaml file
+
+Settings:
+  Every option can also be set in the config file, or with an environment
+  variable, using the names from "CONFIG GET *". For example, the file line
+  'data-dir = "/var/lib/app"' or the variable APP_DATA_DIR=/var/lib/app.
+  Flags override the environment, which overrides the config file. The
+  APP_CONFIG variable is the same as --config.
 
 Security options:
   --tls-cert path  : path to TLS certificate
   --tls-key path   : path to TLS private key
+  --tls-ca path    : path to CA certificate for verifying client certificates.
+                     Enables mutual TLS for clients and servers. The files
+                     are reloaded when they change or on SIGHUP.
   --auth auth      : cluster authorization, shared by all servers and clients
 
+Log tool:
+  {{NAME}} log help : inspect and replay the raft log of a stopped server
+
 Networking options: 
   --advertise addr : advertise address  (default: network bound address)
 
@@ -46,28 +61,81 @@ Advanced options:
   --nosync         : turn off syncing data to disk after every write. This leads
                      to faster write operations but opens up the chance for data
                      loss due to catastrophic events such as power failure.
+  --log-sync mode  : sync mode of the raft log. One of "default", "durable",
+                     "nometasync", or "safe-nosync".  (default: default)
+  --stable-sync mode : sync mode of the raft stable store.  (default: default)
+  --sync-interval d : flush the raft stores to disk in the background at
+                     this interval, which limits the data loss of --nosync.
+                     Zero is off.
+  --log-geometry g : size of the raft log, such as
+                     "lower=1MB,upper=4GB,growth=16MB,page=4KB". Each field
+                     is optional.
+  --stable-geometry g : size of the raft stable store.
+  --encrypt-key path : encrypt the raft log, the stable store, and the
+                     snapshots at rest using the keys in the file, which has
+                     an "id:base64-key" line for each key. The last key is
+                     used for new data, and older keys must be kept until
+                     their data is replaced. Keys are rotated by appending a
+                     line, which takes effect at the next snapshot.
+  --encrypt-migrate : allow reading the plaintext snapshots of a server that
+                     did not encrypt at rest, when turning on --encrypt-key.
   --openreads      : allow followers to process read commands, but with the 
                      possibility of returning stale data.
   --localtime      : have the raft machine time synchronized with the local
                      server rather than the public internet. This will run the 
                      risk of time shifts when the local server time is
                      drastically changed during live operation. 
+  --time-source src: source of the raft machine time. One of "internet",
+                     "local", "ntp://host[:port]", or an "http://" url that
+                     responds with a Date header.  (default: internet)
+  --time-timeout d : how long to wait for the time source at startup before
+                     falling back to the local time, which is used until the
+                     time source is ready. A negative duration waits forever.
+                     (default: 30s)
+  --max-drift d    : warn when the time source drifts from the raft machine
+                     time by more than the duration. Zero is off.
   --restore path   : restore a raft machine from a snapshot file. This will
                      start a brand new single-node cluster using the snapshot as
                      initial data. The other nodes must be re-joined. This
                      operation is ignored when a data directory already exists.
-                     Cannot be used with -j flag.
+                     Cannot be used with -j flag, or with more than one group.
   --init-run-quit  : initialize a bootstrap operation and then quit.
+  --write-queue n  : number of writes that can wait to be applied. Writes
+                     are rejected with a BUSY error when the queue is full.
+                     (default: 1024)
+  --max-inflight n : maximum number of writes that a single connection can
+                     have waiting to be applied. Zero is unlimited.
+  --write-batch n  : maximum number of writes that are applied together in
+                     a single raft log entry.  (default: 1024)
+  --snapshot-retain n : number of snapshots kept on disk.  (default: 3)
+  --audit          : record the applied writes that are sent through this
+                     server, along with the client identity, to rotating
+                     JSON files in the "audit" directory of the data dir.
+  --slowlog-threshold d : latency of a command before it's added to the
+                     slow log. Negative turns off the slow log.  (default: 10ms)
+  --slowlog-max-len n : number of entries kept in the slow log.
+                     (default: 128)
+  --groups n       : number of raft groups that each server runs. The hash
+                     slots are divided between the groups, and keys are sent
+                     to the group that serves their slot. This must be the
+                     same on all servers.  (default: 1)
+  --debug-fault    : turn on the DEBUG FAULT command, which injects network
+                     latency, dropped writes, and partitions into the raft
+                     connections, and delays into the disk syncs, for
+                     testing. Never use in production.
 `
 
 // Config is the configuration for managing the behavior of the application.
 // This must be fill out prior and then passed to the uhaha.Main() function.
 type Config struct {
-	cmds      map[string]command // appended by AddCommand
-	catchall  command            // set by AddCatchallCommand
-	services  []serviceEntry     // appended by AddService
-	jsonType  reflect.Type       // used by UseJSONSnapshots
-	jsonSnaps bool               // used by UseJSONSnapshots
+	cmds      map[string]command      // appended by AddCommand
+	specs     map[string]*CommandSpec // set by AddCommand
+	keySpecs  map[string]keySpec      // set by SetCommandKeys
+	catchall  command                 // set by AddCatchallCommand
+	services  []serviceEntry          // appended by AddService
+	jsonType  reflect.Type            // used by UseJSONSnapshots
+	jsonSnaps bool                    // used by UseJSONSnapshots
+	keys      *KeyRing                // set by keyRingInit
 
 	// Name gives the server application a name. Default "uhaha-app"
 	Name string
@@ -131,17 +199,49 @@ type Config struct {
 	// background connections to be made to self, if desired.
 	ServerReady func(addr, auth string, tlscfg *tls.Config)
 
+	// OnLeaderChange is an optional callback function that fires when this
+	// server gains or loses leadership, or when the leader changes. The
+	// leaderAddr is empty when the leader is unknown. It also fires once at
+	// startup with the initial state. Useful for starting and stopping
+	// leader-only background jobs.
+	OnLeaderChange func(isLeader bool, leaderAddr string)
+
+	// OnMembershipChange is an optional callback function that fires when
+	// servers are added to or removed from the cluster. It also fires once at
+	// startup with the initial servers.
+	OnMembershipChange func(servers []ClusterServer)
+
+	// OnSnapshotTaken is an optional callback function that fires after a
+	// snapshot has been written to disk.
+	OnSnapshotTaken func(meta SnapshotMeta)
+
+	// OnRestore is an optional callback function that fires after the
+	// machine has been restored from a snapshot, such as a snapshot that was
+	// installed from the leader.
+	OnRestore func(meta SnapshotMeta)
+
 	// ConnOpened is an optional callback function that fires when a new
 	// network connection was opened on this machine. You can accept or deny
 	// the connection, and optionally provide a client-specific context that
 	// stick around until the connection is closed with ConnClosed.
 	ConnOpened func(addr string) (context interface{}, accept bool)
 
+	// ConnOpenedUser is an optional callback function that fires in place of
+	// ConnOpened for connections that presented a verified TLS client
+	// certificate. The user is the identity that was mapped from the
+	// certificate by TLSUser.
+	ConnOpenedUser func(addr, user string) (context interface{}, accept bool)
+
 	// ConnClosed is an optional callback function that fires when a network
 	// connection has been closed on this machine.
 	ConnClosed func(context interface{}, addr string)
 
-	LocalTime   bool          // default false
+	// TLSUser is an optional function that maps a verified TLS client
+	// certificate to a user identity. The default is the certificate
+	// subject common name.
+	TLSUser func(cert *x509.Certificate) string
+
+	LocalTime   bool          // default false (same as LocalTime() source)
 	TickDelay   time.Duration // default 200ms
 	BackupPath  string        // default ""
 	InitialData interface{}   // default nil
@@ -157,10 +257,132 @@ type Config struct {
 	MaxPool     int           // default 8
 	TLSCertPath string        // default ""
 	TLSKeyPath  string        // default ""
+	TLSCAPath   string        // default ""
 	Auth        string        // default ""
 	Advertise   string        // default ""
 	TryErrors   bool          // default false (return TRY instead of MOVED)
 	InitRunQuit bool          // default false
+	Groups      int           // default 1
+
+	// GroupData returns the initial data for a raft group, and is used in
+	// place of InitialData. Each group must have its own data, so this is
+	// required when there is more than one group and InitialData is set.
+	GroupData func(group int) interface{}
+
+	// TimeSource is the source of the machine time. The built-in sources are
+	// LocalTime, InternetTime, NTPTime, HTTPDateTime, and ManualClock.
+	// Default InternetTime, or LocalTime when LocalTime is true.
+	TimeSource TimeSource
+
+	// TimeSourceTimeout is how long to wait at startup for the TimeSource to
+	// become ready, after which the local time is used until the TimeSource
+	// is ready. A negative value waits forever.
+	TimeSourceTimeout time.Duration // default 30s
+
+	// MaxTimeDrift is the largest allowed difference between the TimeSource
+	// and the machine time before TimeDrift fires. It should be larger than
+	// the TickDelay. Default 0, which is off.
+	MaxTimeDrift time.Duration
+
+	// TimeDrift is an optional callback function that fires on every tick
+	// while the TimeSource has drifted more than MaxTimeDrift from the
+	// machine time.
+	TimeDrift func(drift time.Duration)
+
+	// SessionTimeout is how long a client session used for deduplicating
+	// write commands is kept after its last write, in machine time. The
+	// leader replicates its value in every tick, so all members expire the
+	// sessions at the same time.
+	SessionTimeout time.Duration // default 1h
+
+	// WriteQueueSize is the number of writes that can wait to be applied
+	// before new writes are rejected with ErrBusy.
+	WriteQueueSize int // default 1024
+
+	// WriteBatchSize is the maximum number of writes that are applied
+	// together in a single raft log entry.
+	WriteBatchSize int // default 1024
+
+	// SnapshotRetain is the number of snapshots that are kept on disk.
+	SnapshotRetain int // default 3
+
+	// MaxInFlight is the maximum number of writes that a single client
+	// connection can have waiting to be applied. Zero is unlimited.
+	MaxInFlight int // default 0
+
+	// WriteLimit is an optional function that returns the token-bucket rate
+	// limit for the writes of a client. The context is from ConnOpened and
+	// the user is the ACL user. Clients that return the same key share a
+	// bucket, such as the user name for limiting per user. The rate is the
+	// writes per second, and the burst is the most writes allowed at once.
+	// A rate of zero is unlimited.
+	WriteLimit func(context interface{}, user string) (key string,
+		rate float64, burst int)
+
+	// Audit turns on the audit log of the applied writes that are sent
+	// through this server.
+	Audit bool // default false
+
+	// AuditMaxSize is the size in bytes of an audit file before it's
+	// rotated.
+	AuditMaxSize int64 // default 64MB
+
+	// AuditMaxFiles is the number of rotated audit files that are kept.
+	// A negative value keeps all files.
+	AuditMaxFiles int // default 10
+
+	// AuditRedact is an optional function that alters the command args
+	// prior to being written to the audit log or the slow log, such as for
+	// hiding secrets. It's also called for each command in a transaction or
+	// a scheduled job, and for a script run as an EVAL or EVALSHA.
+	AuditRedact func(args []string) []string
+
+	// SlowLogThreshold is the latency of a command before it's added to the
+	// slow log. The latency of a write includes the time waiting in the
+	// write queue and for the raft commit. Negative turns off the slow log.
+	SlowLogThreshold time.Duration // default 10ms
+
+	// SlowLogMaxLen is the number of entries that are kept in the slow log.
+	SlowLogMaxLen int // default 128
+
+	// PubSubRetain is the number of published messages that are kept for
+	// subscribers to resume from. This must be the same on all servers.
+	PubSubRetain int // default 10000
+
+	// DebugFault turns on the DEBUG FAULT command, which injects network
+	// and disk faults into the server for testing under partitions.
+	DebugFault bool // default false
+
+	// LogGeometry and StableGeometry are the MDBX sizes of the raft log and
+	// the stable store. The zero fields are from the DefaultLogGeometry and
+	// DefaultStableGeometry.
+	LogGeometry    StoreGeometry
+	StableGeometry StoreGeometry
+
+	// LogSync and StableSync are the MDBX sync modes of the raft log and the
+	// stable store.
+	LogSync    SyncMode // default SyncDefault
+	StableSync SyncMode // default SyncDefault
+
+	// SyncInterval is how often the raft stores are flushed to disk in the
+	// background, which limits the data loss of NoSync. Zero is off.
+	SyncInterval time.Duration // default 0
+
+	// EncryptKeyPath is the path to a key file for encrypting the raft log,
+	// the stable store, and the snapshots at rest with AES-GCM. See the
+	// FileKeyProvider for the file format.
+	EncryptKeyPath string // default ""
+
+	// EncryptMigrate allows for plaintext snapshots to be read when
+	// encrypting at rest, for migrating a server that did not encrypt.
+	// Otherwise a snapshot that is not encrypted is rejected.
+	EncryptMigrate bool // default false
+
+	// KeyProvider is an optional provider of the master keys for encrypting
+	// at rest, such as a KMS, which is used in place of EncryptKeyPath.
+	// Snapshots are sent between servers, so all servers must be able to
+	// unwrap the same keys.
+	KeyProvider KeyProvider
 }
 
 // The Backend database format used for storing Raft logs and meta data.
@@ -205,6 +427,39 @@ func (conf *Config) def() {
 	if conf.MaxPool == 0 {
 		conf.MaxPool = 8
 	}
+	if conf.SessionTimeout == 0 {
+		conf.SessionTimeout = time.Hour
+	}
+	if conf.PubSubRetain == 0 {
+		conf.PubSubRetain = 10000
+	}
+	if conf.Groups == 0 {
+		conf.Groups = 1
+	}
+	if conf.WriteQueueSize == 0 {
+		conf.WriteQueueSize = 1024
+	}
+	if conf.WriteBatchSize == 0 {
+		conf.WriteBatchSize = 1024
+	}
+	if conf.SnapshotRetain == 0 {
+		conf.SnapshotRetain = 3
+	}
+	if conf.AuditMaxSize == 0 {
+		conf.AuditMaxSize = 64 * 1024 * 1024
+	}
+	if conf.AuditMaxFiles == 0 {
+		conf.AuditMaxFiles = 10
+	}
+	if conf.SlowLogThreshold == 0 {
+		conf.SlowLogThreshold = 10 * time.Millisecond
+	}
+	if conf.SlowLogMaxLen == 0 {
+		conf.SlowLogMaxLen = 128
+	}
+	if conf.TimeSourceTimeout == 0 {
+		conf.TimeSourceTimeout = time.Second * 30
+	}
 }
 
 func confInit(conf *Config) {
@@ -238,27 +493,68 @@ func confInit(conf *Config) {
 			os.Exit(0)
 		}
 	}
-	var backend string
+	// The settings are applied in the order of the Config, the config file,
+	// the environment, and the flags, where the latter wins.
+	cpath := configPath(os.Args[1:])
+	loaded, err := loadSettings(conf, cpath, os.Environ())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(1)
+	}
+	backend := "mdbx"
+	if loaded["backend"] {
+		backend = backendNames[conf.Backend]
+	}
+	var timeSource string
+	storeSettings := map[string]*string{"log-sync": nil, "stable-sync": nil,
+		"log-geometry": nil, "stable-geometry": nil}
 	var testNode string
 	var vers bool
 	flag.BoolVar(&vers, "v", false, "")
+	flag.StringVar(&cpath, "config", cpath, "")
 	flag.StringVar(&conf.Addr, "a", conf.Addr, "")
 	flag.StringVar(&conf.NodeID, "n", conf.NodeID, "")
 	flag.StringVar(&conf.DataDir, "d", conf.DataDir, "")
 	flag.StringVar(&conf.JoinAddr, "j", conf.JoinAddr, "")
 	flag.StringVar(&conf.LogLevel, "l", conf.LogLevel, "")
-	flag.StringVar(&backend, "backend", "mdbx", "")
+	flag.StringVar(&backend, "backend", backend, "")
 	flag.StringVar(&conf.TLSCertPath, "tls-cert", conf.TLSCertPath, "")
 	flag.StringVar(&conf.TLSKeyPath, "tls-key", conf.TLSKeyPath, "")
+	flag.StringVar(&conf.TLSCAPath, "tls-ca", conf.TLSCAPath, "")
 	flag.BoolVar(&conf.NoSync, "nosync", conf.NoSync, "")
 	flag.BoolVar(&conf.OpenReads, "openreads", conf.OpenReads, "")
 	flag.StringVar(&conf.BackupPath, "restore", conf.BackupPath, "")
 	flag.BoolVar(&conf.LocalTime, "localtime", conf.LocalTime, "")
+	flag.StringVar(&timeSource, "time-source", "", "")
+	flag.DurationVar(&conf.TimeSourceTimeout, "time-timeout",
+		conf.TimeSourceTimeout, "")
+	flag.DurationVar(&conf.MaxTimeDrift, "max-drift", conf.MaxTimeDrift, "")
 	flag.StringVar(&conf.Auth, "auth", conf.Auth, "")
 	flag.StringVar(&conf.Advertise, "advertise", conf.Advertise, "")
 	flag.StringVar(&testNode, "t", "", "")
 	flag.BoolVar(&conf.TryErrors, "try-errors", conf.TryErrors, "")
 	flag.BoolVar(&conf.InitRunQuit, "init-run-quit", conf.InitRunQuit, "")
+	flag.IntVar(&conf.WriteQueueSize, "write-queue", conf.WriteQueueSize, "")
+	flag.IntVar(&conf.MaxInFlight, "max-inflight", conf.MaxInFlight, "")
+	flag.IntVar(&conf.WriteBatchSize, "write-batch", conf.WriteBatchSize, "")
+	flag.IntVar(&conf.SnapshotRetain, "snapshot-retain", conf.SnapshotRetain,
+		"")
+	flag.BoolVar(&conf.Audit, "audit", conf.Audit, "")
+	flag.DurationVar(&conf.SlowLogThreshold, "slowlog-threshold",
+		conf.SlowLogThreshold, "")
+	flag.IntVar(&conf.SlowLogMaxLen, "slowlog-max-len", conf.SlowLogMaxLen, "")
+	flag.IntVar(&conf.Groups, "groups", conf.Groups, "")
+	flag.BoolVar(&conf.DebugFault, "debug-fault", conf.DebugFault, "")
+	for name := range storeSettings {
+		storeSettings[name] = flag.String(name, findSetting(name).getValue(conf),
+			"")
+	}
+	flag.DurationVar(&conf.SyncInterval, "sync-interval", conf.SyncInterval,
+		"")
+	flag.StringVar(&conf.EncryptKeyPath, "encrypt-key", conf.EncryptKeyPath,
+		"")
+	flag.BoolVar(&conf.EncryptMigrate, "encrypt-migrate", conf.EncryptMigrate,
+		"")
 	if conf.Flag.PreParse != nil {
 		conf.Flag.PreParse()
 	}
@@ -302,6 +598,62 @@ func confInit(conf *Config) {
 			"flag --tls-cert cannot be empty when --tls-key is provided\n")
 		os.Exit(1)
 	}
+	if conf.TLSCAPath != "" && conf.TLSCertPath == "" {
+		fmt.Fprintf(os.Stderr,
+			"flag --tls-cert cannot be empty when --tls-ca is provided\n")
+		os.Exit(1)
+	}
+	for name, value := range storeSettings {
+		if err := findSetting(name).setValue(conf, *value); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --%s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+	if timeSource != "" {
+		src, err := parseTimeSource(timeSource)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "flag --time-source: %v\n", err)
+			os.Exit(1)
+		}
+		conf.TimeSource = src
+	}
+	if conf.WriteQueueSize < 1 {
+		fmt.Fprintf(os.Stderr, "flag --write-queue must be at least 1\n")
+		os.Exit(1)
+	}
+	if conf.WriteBatchSize < 1 {
+		fmt.Fprintf(os.Stderr, "flag --write-batch must be at least 1\n")
+		os.Exit(1)
+	}
+	if conf.SnapshotRetain < 1 {
+		fmt.Fprintf(os.Stderr, "flag --snapshot-retain must be at least 1\n")
+		os.Exit(1)
+	}
+	if conf.MaxInFlight < 0 {
+		fmt.Fprintf(os.Stderr, "flag --max-inflight cannot be negative\n")
+		os.Exit(1)
+	}
+	if conf.SlowLogMaxLen < 0 {
+		fmt.Fprintf(os.Stderr, "flag --slowlog-max-len cannot be negative\n")
+		os.Exit(1)
+	}
+	if conf.Groups < 1 || conf.Groups > numSlots {
+		fmt.Fprintf(os.Stderr, "flag --groups must be between 1 and %d\n",
+			numSlots)
+		os.Exit(1)
+	}
+	if conf.Groups > 1 && conf.InitialData != nil && conf.GroupData == nil {
+		fmt.Fprintf(os.Stderr,
+			"flag --groups requires GroupData when InitialData is set\n")
+		os.Exit(1)
+	}
+	if conf.Groups > 1 && conf.BackupPath != "" {
+		// The backup holds the data of a single machine, which can't be
+		// split between the groups by hash slot.
+		fmt.Fprintf(os.Stderr,
+			"flag --restore cannot be used with more than one group\n")
+		os.Exit(1)
+	}
 	if conf.Advertise != "" {
 		colon := strings.IndexByte(conf.Advertise, ':')
 		if colon == -1 {
@@ -317,6 +669,11 @@ func confInit(conf *Config) {
 	if conf.Flag.PostParse != nil {
 		conf.Flag.PostParse()
 	}
+	conf.jsonInit()
+}
+
+// jsonInit prepares the machine for UseJSONSnapshots.
+func (conf *Config) jsonInit() {
 	if conf.UseJSONSnapshots {
 		if conf.Restore != nil || conf.Snapshot != nil {
 			fmt.Fprintf(os.Stderr,
@@ -343,6 +700,8 @@ func (conf *Config) addCommand(kind byte, name string,
 	if conf.cmds == nil {
 		conf.cmds = make(map[string]command)
 	}
+	// a spec is replaced by a command without a spec
+	delete(conf.specs, name)
 	conf.cmds[name] = command{kind, func(m Machine, ra *raftWrap,
 		args []string) (interface{}, error) {
 		return fn(m, args)
@@ -19,6 +19,11 @@ var ErrWrongNumArgs = errors.New("wrong number of arguments")
 // ErrUnauthorized is returned when a client connection has not been authorized
 var ErrUnauthorized = errors.New("unauthorized")
 
+// ErrNoPermission is returned when the client user is not permitted to run
+// the command
+var ErrNoPermission = errors.New("NOPERM this user has no permissions to " +
+	"run this command")
+
 // ErrUnknownCommand is returned when a command is not known
 var ErrUnknownCommand = errors.New("unknown command")
 
@@ -28,11 +33,55 @@ var ErrInvalid = errors.New("invalid")
 // ErrCorrupt is returned when a data is invalid or corrupt
 var ErrCorrupt = errors.New("corrupt")
 
+// ErrBusy is returned when a write is rejected because the write queue is
+// full. The client should try again later.
+var ErrBusy = errors.New("BUSY the write queue is full, try again later")
+
+// ErrStaleSequence is returned when a write request has a sequence number
+// that is older than the responses kept by the client session.
+var ErrStaleSequence = errors.New("stale session sequence number")
+
+// ErrWatchFailed is returned by Exec when a watched key was changed by
+// another write prior to the transaction being applied.
+var ErrWatchFailed = errors.New("watched keys changed")
+
 var errWrongNumArgsRaft = errors.New("wrong number of arguments, try RAFT HELP")
 
 var errWrongNumArgsCluster = errors.New("wrong number of arguments, " +
 	"try CLUSTER HELP")
 
+var errWrongNumArgsACL = errors.New("wrong number of arguments, try ACL HELP")
+
+var errWrongNumArgsSchedule = errors.New("wrong number of arguments, " +
+	"try SCHEDULE HELP")
+
+var errWrongNumArgsLock = errors.New("wrong number of arguments, " +
+	"try LOCK HELP")
+
+var errWrongNumArgsConfig = errors.New("wrong number of arguments, " +
+	"try CONFIG HELP")
+
+var errWrongNumArgsPlugin = errors.New("wrong number of arguments, " +
+	"try PLUGIN HELP")
+
+var errWrongNumArgsScript = errors.New("wrong number of arguments, " +
+	"try SCRIPT HELP")
+
+var errWrongNumArgsCommand = errors.New("wrong number of arguments, " +
+	"try COMMAND HELP")
+
+var errWrongNumArgsSlowlog = errors.New("wrong number of arguments, " +
+	"try SLOWLOG HELP")
+
+var errWrongNumArgsLatency = errors.New("wrong number of arguments, " +
+	"try LATENCY HELP")
+
+var errWrongNumArgsClient = errors.New("wrong number of arguments, " +
+	"try CLIENT HELP")
+
+var errWrongNumArgsDebug = errors.New("wrong number of arguments, " +
+	"try DEBUG HELP")
+
 func errUnknownRaftCommand(args []string) error {
 	var cmd string
 	for _, arg := range args {
@@ -51,3 +100,102 @@ func errUnknownClusterCommand(args []string) error {
 		"'%s', try CLUSTER HELP",
 		strings.TrimSpace(cmd))
 }
+
+func errUnknownACLCommand(args []string) error {
+	var cmd string
+	for _, arg := range args {
+		cmd += arg + " "
+	}
+	return fmt.Errorf("unknown acl command '%s', try ACL HELP",
+		strings.TrimSpace(cmd))
+}
+
+func errUnknownScheduleCommand(args []string) error {
+	var cmd string
+	for _, arg := range args {
+		cmd += arg + " "
+	}
+	return fmt.Errorf("unknown schedule command '%s', try SCHEDULE HELP",
+		strings.TrimSpace(cmd))
+}
+
+func errUnknownLockCommand(args []string) error {
+	var cmd string
+	for _, arg := range args {
+		cmd += arg + " "
+	}
+	return fmt.Errorf("unknown lock command '%s', try LOCK HELP",
+		strings.TrimSpace(cmd))
+}
+
+func errUnknownConfigCommand(args []string) error {
+	var cmd string
+	for _, arg := range args {
+		cmd += arg + " "
+	}
+	return fmt.Errorf("unknown config command '%s', try CONFIG HELP",
+		strings.TrimSpace(cmd))
+}
+
+func errUnknownPluginCommand(args []string) error {
+	var cmd string
+	for _, arg := range args {
+		cmd += arg + " "
+	}
+	return fmt.Errorf("unknown plugin command '%s', try PLUGIN HELP",
+		strings.TrimSpace(cmd))
+}
+
+func errUnknownScriptCommand(args []string) error {
+	var cmd string
+	for _, arg := range args {
+		cmd += arg + " "
+	}
+	return fmt.Errorf("unknown script command '%s', try SCRIPT HELP",
+		strings.TrimSpace(cmd))
+}
+
+func errUnknownCommandCommand(args []string) error {
+	var cmd string
+	for _, arg := range args {
+		cmd += arg + " "
+	}
+	return fmt.Errorf("unknown command subcommand '%s', try COMMAND HELP",
+		strings.TrimSpace(cmd))
+}
+
+func errUnknownSlowlogCommand(args []string) error {
+	var cmd string
+	for _, arg := range args {
+		cmd += arg + " "
+	}
+	return fmt.Errorf("unknown slowlog command '%s', try SLOWLOG HELP",
+		strings.TrimSpace(cmd))
+}
+
+func errUnknownLatencyCommand(args []string) error {
+	var cmd string
+	for _, arg := range args {
+		cmd += arg + " "
+	}
+	return fmt.Errorf("unknown latency command '%s', try LATENCY HELP",
+		strings.TrimSpace(cmd))
+}
+
+func errUnknownClientCommand(args []string) error {
+	var cmd string
+	for _, arg := range args {
+		cmd += arg + " "
+	}
+	return fmt.Errorf("unknown client command '%s', try CLIENT HELP",
+		strings.TrimSpace(cmd))
+}
+
+func errUnknownDebugCommand(args []string) error {
+	var cmd string
+	for _, arg := range args {
+		cmd += arg + " "
+	}
+	return fmt.Errorf("unknown debug command '%s', try DEBUG HELP",
+		strings.TrimSpace(cmd))
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// ClusterServer is a member of the raft cluster.
+type ClusterServer struct {
+	ID      string
+	Address string
+	Voter   bool
+}
+
+// SnapshotMeta describes a snapshot that was taken or restored.
+type SnapshotMeta struct {
+	ID    string
+	Index uint64
+	Term  uint64
+	Size  int64
+	// Path is the snapshot file on disk.
+	Path string
+}
+
+// snapshotMeta returns the meta of a snapshot in the store, or the latest
+// snapshot when the id is empty.
+func (m *machine) snapshotMeta(id string) (SnapshotMeta, bool) {
+	list, err := m.snaps.List()
+	if err != nil {
+		return SnapshotMeta{}, false
+	}
+	for _, meta := range list {
+		if id == "" || meta.ID == id {
+			return SnapshotMeta{
+				ID:    meta.ID,
+				Index: meta.Index,
+				Term:  meta.Term,
+				Size:  meta.Size,
+				Path: filepath.Join(m.dir, "snapshots", meta.ID,
+					"state.bin"),
+			}, true
+		}
+	}
+	return SnapshotMeta{}, false
+}
+
+// snapshotTaken fires the OnSnapshotTaken event.
+func (m *machine) snapshotTaken(id string) {
+	if m.onSnapTaken == nil {
+		return
+	}
+	if meta, ok := m.snapshotMeta(id); ok {
+		m.onSnapTaken(meta)
+	}
+}
+
+// snapshotRestored fires the OnRestore event. The raft library always
+// stores a snapshot prior to restoring it, making it the latest snapshot.
+func (m *machine) snapshotRestored() {
+	if m.onRestore == nil {
+		return
+	}
+	if meta, ok := m.snapshotMeta(""); ok {
+		m.onRestore(meta)
+	}
+}
+
+// runEventObserver is a background routine that fires the leader and
+// membership events of the Config. Leader changes are observed from raft,
+// while the membership is also polled because raft only notifies the leader
+// about peer changes.
+func runEventObserver(conf Config, ra *raftWrap) {
+	if conf.OnLeaderChange == nil && conf.OnMembershipChange == nil {
+		return
+	}
+	obsC := make(chan raft.Observation, 64)
+	ra.RegisterObserver(raft.NewObserver(obsC, false,
+		func(o *raft.Observation) bool {
+			switch o.Data.(type) {
+			case raft.LeaderObservation, raft.PeerObservation:
+				return true
+			}
+			return false
+		}))
+	var isLeader, started bool
+	var leaderAddr string
+	var servers []ClusterServer
+	check := func() {
+		if conf.OnLeaderChange != nil {
+			leader := ra.State() == raft.Leader
+			addr := getLeaderAdvertiseAddr(ra)
+			if !started || leader != isLeader || addr != leaderAddr {
+				isLeader, leaderAddr = leader, addr
+				conf.OnLeaderChange(isLeader, leaderAddr)
+			}
+		}
+		if conf.OnMembershipChange != nil {
+			f := ra.GetConfiguration()
+			if f.Error() == nil {
+				next := clusterServers(f.Configuration())
+				if !started || !reflect.DeepEqual(next, servers) {
+					servers = next
+					conf.OnMembershipChange(servers)
+				}
+			}
+		}
+		started = true
+	}
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-obsC:
+		case <-tick.C:
+		}
+		check()
+	}
+}
+
+func clusterServers(cfg raft.Configuration) []ClusterServer {
+	servers := make([]ClusterServer, 0, len(cfg.Servers))
+	for _, s := range cfg.Servers {
+		servers = append(servers, ClusterServer{
+			ID:      string(s.ID),
+			Address: string(s.Address),
+			Voter:   s.Suffrage == raft.Voter,
+		})
+	}
+	return servers
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestSnapshotEvents(t *testing.T) {
+	dir := t.TempDir()
+	snaps, err := raft.NewFileSnapshotStore(dir, 3, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &machine{dir: dir, snaps: snaps}
+	var taken, restored []SnapshotMeta
+	m.onSnapTaken = func(meta SnapshotMeta) { taken = append(taken, meta) }
+	m.onRestore = func(meta SnapshotMeta) { restored = append(restored, meta) }
+	for i, index := range []uint64{10, 20} {
+		sink, err := snaps.Create(raft.SnapshotVersionMax, index, 2,
+			raft.Configuration{}, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sink.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+		m.snapshotTaken(sink.ID())
+		if len(taken) != i+1 || taken[i].ID != sink.ID() ||
+			taken[i].Index != index || taken[i].Term != 2 ||
+			taken[i].Size != 4 {
+			t.Fatalf("unexpected %+v", taken)
+		}
+	}
+	m.snapshotRestored()
+	if len(restored) != 1 || restored[0].Index != 20 {
+		t.Fatalf("unexpected %+v", restored)
+	}
+}
+
+func TestClusterServers(t *testing.T) {
+	servers := clusterServers(raft.Configuration{Servers: []raft.Server{
+		{Suffrage: raft.Voter, ID: "1", Address: "10.0.0.1:11001"},
+		{Suffrage: raft.Nonvoter, ID: "2", Address: "10.0.0.2:11001"},
+	}})
+	if len(servers) != 2 || !servers[0].Voter || servers[1].Voter ||
+		servers[1].ID != "2" || servers[1].Address != "10.0.0.2:11001" {
+		t.Fatalf("unexpected %+v", servers)
+	}
+}
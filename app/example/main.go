@@ -25,14 +25,30 @@ func main() {
 	conf.Name = "serverd"
 	conf.Version = "0.0.1"
 	conf.InitialData = new(database)
+	conf.GroupData = func(group int) interface{} { return new(database) }
 	conf.Snapshot = snapshot
 	conf.Restore = restore
 	conf.Tick = tick
 	conf.TickDelay = time.Minute
 
-	conf.AddWriteCommand("set", cmdSET)
+	conf.AddCommand(app.CommandSpec{
+		Name: "set", Kind: 'w', Arity: -3,
+		Args: []app.ArgSpec{
+			{Name: "key", Type: app.ArgKey},
+			{Name: "value"},
+			{Name: "seconds", Type: app.ArgDouble, Token: "EX", Optional: true},
+		},
+		Group: "string", Summary: "Set the string value of a key",
+		Fn: cmdSET,
+	})
 	conf.AddWriteCommand("del", cmdDEL)
-	conf.AddReadCommand("get", cmdGET)
+	conf.SetCommandKeys("del", 1, -1, 1)
+	conf.AddCommand(app.CommandSpec{
+		Name: "get", Kind: 'r', Arity: 2,
+		Args:  []app.ArgSpec{{Name: "key", Type: app.ArgKey}},
+		Group: "string", Summary: "Get the value of a key",
+		Fn: cmdGET,
+	})
 	conf.AddReadCommand("keys", cmdKEYS)
 	conf.AddReadCommand("dbsize", cmdDBSIZE)
 	conf.AddIntermediateCommand("monitor", cmdMONITOR)
@@ -53,6 +69,14 @@ type database struct {
 	//keys *tree.ART
 	keys tinybtree.BTree // (key)->(object)
 	exps tinybtree.BTree // [exp/key]->(nil)
+
+	saving bool   // a transaction is in progress
+	undo   []undo // previous objects, in the order they were changed
+}
+
+type undo struct {
+	key  string
+	prev *object // nil when the key did not exist
 }
 
 func tick(m app.Machine) {
@@ -74,6 +98,13 @@ func tick(m app.Machine) {
 
 func (db *database) set(o *object) (replaced bool) {
 	v, replaced := db.keys.Set(o.key, o)
+	if db.saving {
+		u := undo{key: o.key}
+		if replaced {
+			u.prev = v.(*object)
+		}
+		db.undo = append(db.undo, u)
+	}
 	if replaced {
 		prev := v.(*object)
 		if prev.expires > 0 {
@@ -95,6 +126,9 @@ func (db *database) del(key string) (prev *object, deleted bool) {
 	v, deleted := db.keys.Delete(key)
 	if deleted {
 		prev := v.(*object)
+		if db.saving {
+			db.undo = append(db.undo, undo{key: key, prev: prev})
+		}
 		if prev.expires > 0 {
 			_, deleted := db.exps.Delete(prev.exkey())
 			if !deleted {
@@ -106,6 +140,32 @@ func (db *database) del(key string) (prev *object, deleted bool) {
 	return nil, false
 }
 
+// The database implements app.Undoable, allowing for MULTI/EXEC
+// transactions with write commands.
+var _ app.Undoable = &database{}
+
+func (db *database) Savepoint() {
+	db.saving = true
+	db.undo = db.undo[:0]
+}
+
+func (db *database) Rollback() {
+	db.saving = false
+	for i := len(db.undo) - 1; i >= 0; i-- {
+		if db.undo[i].prev != nil {
+			db.set(db.undo[i].prev)
+		} else {
+			db.del(db.undo[i].key)
+		}
+	}
+	db.undo = db.undo[:0]
+}
+
+func (db *database) Release() {
+	db.saving = false
+	db.undo = db.undo[:0]
+}
+
 func (db *database) get(key string) (*object, bool) {
 	v, ok := db.keys.Get(key)
 	if ok {
@@ -114,33 +174,38 @@ func (db *database) get(key string) (*object, bool) {
 	return nil, false
 }
 
+// The database implements app.PluginData, allowing for plugins to read and
+// write keys.
+var _ app.PluginData = &database{}
+
+func (db *database) Get(key string) (string, bool) {
+	o, ok := db.get(key)
+	if !ok {
+		return "", false
+	}
+	return o.value, true
+}
+
+func (db *database) Set(key, value string) {
+	db.set(&object{key: key, value: value})
+}
+
+func (db *database) Delete(key string) bool {
+	_, deleted := db.del(key)
+	return deleted
+}
+
 // SET key value [EX seconds]
-func cmdSET(m app.Machine, args []string) (interface{}, error) {
+func cmdSET(m app.Machine, args *app.Args) (interface{}, error) {
 	db := m.Data().(*database)
-	if len(args) < 3 {
-		return nil, app.ErrWrongNumArgs
-	}
-	var ex float64
-	for i := 3; i < len(args); i++ {
-		switch strings.ToLower(string(args[i])) {
-		case "ex":
-			i++
-			if i == len(args) {
-				return nil, app.ErrSyntax
-			}
-			var err error
-			ex, err = strconv.ParseFloat(string(args[i]), 64)
-			if err != nil || ex <= 0 {
-				return nil, app.ErrSyntax
-			}
-		default:
-			return nil, app.ErrSyntax
-		}
+	ex := args.Float("seconds")
+	if args.Has("seconds") && ex <= 0 {
+		return nil, app.ErrSyntax
 	}
 	o := new(object)
 	o.created = m.Now().UnixNano()
-	o.key = string(args[1])
-	o.value = string(args[2])
+	o.key = args.String("key")
+	o.value = args.String("value")
 	if ex == 0 && strings.HasPrefix(o.key, "key:") && o.value == "xxx" {
 		r := m.Rand().Int()
 		if r%2 == 0 {
@@ -152,6 +217,7 @@ func cmdSET(m app.Machine, args []string) (interface{}, error) {
 		o.expires = o.created + int64(ex*1e9)
 	}
 	db.set(o)
+	m.Notify("__keyspace__:"+o.key, "set")
 	return redcon.SimpleString("OK"), nil
 }
 
@@ -214,12 +280,9 @@ func cmdDBSIZE(m app.Machine, args []string) (interface{}, error) {
 }
 
 // GET key
-func cmdGET(m app.Machine, args []string) (interface{}, error) {
+func cmdGET(m app.Machine, args *app.Args) (interface{}, error) {
 	db := m.Data().(*database)
-	if len(args) != 2 {
-		return nil, app.ErrWrongNumArgs
-	}
-	o, ok := db.get(string(args[1]))
+	o, ok := db.get(args.String("key"))
 	if ok {
 		return o.value, nil
 	}
@@ -267,6 +330,7 @@ func cmdDEL(m app.Machine, args []string) (interface{}, error) {
 	var n int
 	for i := 1; i < len(args); i++ {
 		if _, deleted := db.del(string(args[i])); deleted {
+			m.Notify("__keyspace__:"+args[i], "del")
 			n++
 		}
 	}
@@ -278,16 +342,55 @@ func multiPOWER(s app.Service) (interface{}, error) {
 	return resp, err
 }
 
-// MONITOR
-// help: monitors all of the commands from all clients
+// MONITOR [PATTERN pattern] [ADDR pattern] [ERRORS] [SLOWER usec] [APPLIED]
+// help: monitors all of the commands from all clients, or only the commands
+//       that pass the filters. APPLIED monitors the writes that are applied
+//       by this server, which also works on followers.
 func cmdMONITOR(m app.Machine, args []string) (interface{}, error) {
+	var opts app.ObserverOptions
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "pattern":
+			if i+1 == len(args) {
+				return nil, app.ErrSyntax
+			}
+			opts.Pattern = args[i+1]
+			i++
+		case "addr":
+			if i+1 == len(args) {
+				return nil, app.ErrSyntax
+			}
+			opts.Addr = args[i+1]
+			i++
+		case "slower":
+			if i+1 == len(args) {
+				return nil, app.ErrSyntax
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n < 0 {
+				return nil, app.ErrSyntax
+			}
+			opts.MinElapsed = time.Duration(n) * time.Microsecond
+			i++
+		case "errors":
+			opts.ErrOnly = true
+		case "applied":
+			opts.Applied = true
+		default:
+			return nil, app.ErrSyntax
+		}
+	}
 	// Here we'll return a Hijack type that is just a function that will
 	// take over the client connection in an isolated context.
-	return app.Hijack(hijackedMONITOR), nil
+	return app.Hijack(func(s app.Service, conn app.HijackedConn) {
+		hijackedMONITOR(s, conn, opts)
+	}), nil
 }
 
-func hijackedMONITOR(s app.Service, conn app.HijackedConn) {
-	obs := s.Monitor().NewObserver()
+func hijackedMONITOR(s app.Service, conn app.HijackedConn,
+	opts app.ObserverOptions,
+) {
+	obs := s.Monitor().NewFilteredObserver(opts)
 	logger.Print("hijack opened: %s", conn.RemoteAddr())
 	defer func() {
 		logger.Print("hijack closed: %s", conn.RemoteAddr())
@@ -312,8 +415,12 @@ func hijackedMONITOR(s app.Service, conn app.HijackedConn) {
 		for i := 0; i < len(msg.Args); i++ {
 			args += " " + strconv.Quote(msg.Args[i])
 		}
+		from := msg.Addr
+		if msg.Index > 0 {
+			from = "applied:" + strconv.FormatUint(msg.Index, 10)
+		}
 		conn.WriteAny(redcon.SimpleString(fmt.Sprintf("%0.6f [0 %s]%s",
-			float64(time.Now().UnixNano())/1e9, msg.Addr, args,
+			float64(time.Now().UnixNano())/1e9, from, args,
 		)))
 		conn.Flush()
 	}
@@ -0,0 +1,277 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/tidwall/redcon"
+)
+
+var errFaultDisabled = errors.New("fault injection is not enabled, " +
+	"use --debug-fault")
+
+var errFaultPartition = errors.New("fault: network partition")
+
+var errFaultDrop = errors.New("fault: dropped write")
+
+// faultTable holds the faults that are injected by DEBUG FAULT, for testing
+// applications under network partitions and slow disks. It's nil unless
+// the DebugFault option is on, and shared by all raft groups.
+type faultTable struct {
+	mu        sync.RWMutex
+	latency   time.Duration     // added to every network write
+	drop      float64           // chance that a network write is dropped
+	partition map[string]string // unreachable raft addresses to node ids
+	disk      time.Duration     // added to every store sync
+}
+
+func faultInit(conf Config) *faultTable {
+	if !conf.DebugFault {
+		return nil
+	}
+	return newFaultTable()
+}
+
+func newFaultTable() *faultTable {
+	return &faultTable{partition: make(map[string]string)}
+}
+
+// dial returns an error when the raft address is partitioned.
+func (ft *faultTable) dial(addr string) error {
+	if ft == nil {
+		return nil
+	}
+	ft.mu.RLock()
+	_, parted := ft.partition[addr]
+	ft.mu.RUnlock()
+	if parted {
+		return errFaultPartition
+	}
+	return nil
+}
+
+// wrap returns the connection with the faults injected. The addr is the
+// raft address of a dialed connection, or empty for an accepted connection.
+func (ft *faultTable) wrap(c net.Conn, addr string) net.Conn {
+	if ft == nil {
+		return c
+	}
+	return &faultConn{Conn: c, ft: ft, addr: addr}
+}
+
+// diskWait delays a store sync.
+func (ft *faultTable) diskWait() {
+	if ft == nil {
+		return
+	}
+	ft.mu.RLock()
+	disk := ft.disk
+	ft.mu.RUnlock()
+	if disk > 0 {
+		time.Sleep(disk)
+	}
+}
+
+func (ft *faultTable) reset() {
+	ft.mu.Lock()
+	ft.latency = 0
+	ft.drop = 0
+	ft.partition = make(map[string]string)
+	ft.disk = 0
+	ft.mu.Unlock()
+}
+
+// faultConn is a network connection with injected faults. A dropped or
+// partitioned write closes the connection, because a stream can not skip
+// the lost bytes.
+type faultConn struct {
+	net.Conn
+	ft   *faultTable
+	addr string
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	c.ft.mu.RLock()
+	latency, drop := c.ft.latency, c.ft.drop
+	_, parted := c.ft.partition[c.addr]
+	c.ft.mu.RUnlock()
+	if parted && c.addr != "" {
+		c.Conn.Close()
+		return 0, errFaultPartition
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if drop > 0 && rand.Float64() < drop {
+		c.Conn.Close()
+		return 0, errFaultDrop
+	}
+	return c.Conn.Write(p)
+}
+
+// faultNodeAddrs returns the raft addresses of the node ids.
+func faultNodeAddrs(ra *raftWrap, ids []string) (map[string]string, error) {
+	f := ra.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+	addrs := make(map[string]string)
+	for _, id := range ids {
+		var found bool
+		for _, s := range f.Configuration().Servers {
+			if s.ID == raft.ServerID(id) {
+				addrs[string(s.Address)] = id
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown node id '%s'", id)
+		}
+	}
+	return addrs, nil
+}
+
+// DEBUG subcommand args...
+// help: commands for testing. Only available with --debug-fault.
+func cmdDEBUG(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if m.faults == nil {
+		return nil, errFaultDisabled
+	}
+	if len(args) < 2 {
+		return nil, errWrongNumArgsDebug
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		return cmdDEBUGHELP(um, ra, args)
+	case "fault":
+		return cmdDEBUGFAULT(um, ra, args)
+	default:
+		return nil, errUnknownDebugCommand(args[:2])
+	}
+}
+
+// DEBUG HELP
+// help: returns the valid DEBUG related commands; []string
+func cmdDEBUGHELP(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsDebug
+	}
+	lines := []redcon.SimpleString{
+		"DEBUG FAULT LATENCY duration",
+		"DEBUG FAULT DROP probability",
+		"DEBUG FAULT PARTITION node-id [node-id ...]",
+		"DEBUG FAULT HEAL [node-id ...]",
+		"DEBUG FAULT DISK duration",
+		"DEBUG FAULT RESET",
+		"DEBUG FAULT LIST",
+	}
+	return lines, nil
+}
+
+// DEBUG FAULT subcommand args...
+// help: injects network and disk faults into this server. The network faults
+//       only affect the raft connections, and the disk delay only affects
+//       the syncs of the raft stores. Faults are not replicated. A partition only stops this server from reaching the
+//       other nodes, so run it on both sides for a full partition.
+func cmdDEBUGFAULT(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, errWrongNumArgsDebug
+	}
+	ft := getBaseMachine(um).faults
+	switch strings.ToLower(args[2]) {
+	case "latency", "disk":
+		// DEBUG FAULT LATENCY|DISK duration
+		if len(args) != 4 {
+			return nil, errWrongNumArgsDebug
+		}
+		d, err := time.ParseDuration(args[3])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid duration '%s'", args[3])
+		}
+		ft.mu.Lock()
+		if strings.ToLower(args[2]) == "latency" {
+			ft.latency = d
+		} else {
+			ft.disk = d
+		}
+		ft.mu.Unlock()
+	case "drop":
+		// DEBUG FAULT DROP probability
+		if len(args) != 4 {
+			return nil, errWrongNumArgsDebug
+		}
+		p, err := strconv.ParseFloat(args[3], 64)
+		if err != nil || p < 0 || p > 1 {
+			return nil, errors.New("probability must be between 0 and 1")
+		}
+		ft.mu.Lock()
+		ft.drop = p
+		ft.mu.Unlock()
+	case "partition", "heal":
+		// DEBUG FAULT PARTITION node-id [node-id ...]
+		// DEBUG FAULT HEAL [node-id ...]
+		partition := strings.ToLower(args[2]) == "partition"
+		if partition && len(args) < 4 {
+			return nil, errWrongNumArgsDebug
+		}
+		if !partition && len(args) == 3 {
+			ft.mu.Lock()
+			ft.partition = make(map[string]string)
+			ft.mu.Unlock()
+			break
+		}
+		addrs, err := faultNodeAddrs(ra, args[3:])
+		if err != nil {
+			return nil, err
+		}
+		ft.mu.Lock()
+		for addr, id := range addrs {
+			if partition {
+				ft.partition[addr] = id
+			} else {
+				delete(ft.partition, addr)
+			}
+		}
+		ft.mu.Unlock()
+	case "reset":
+		if len(args) != 3 {
+			return nil, errWrongNumArgsDebug
+		}
+		ft.reset()
+	case "list":
+		if len(args) != 3 {
+			return nil, errWrongNumArgsDebug
+		}
+		ft.mu.RLock()
+		defer ft.mu.RUnlock()
+		ids := []string{}
+		for _, id := range ft.partition {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return redisMap{
+			"latency", ft.latency.String(),
+			"drop", strconv.FormatFloat(ft.drop, 'f', -1, 64),
+			"partition", ids,
+			"disk", ft.disk.String(),
+		}, nil
+	default:
+		return nil, errUnknownDebugCommand(args[:3])
+	}
+	return redcon.SimpleString("OK"), nil
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/tidwall/redcon"
+)
+
+func TestFaultConn(t *testing.T) {
+	ft := newFaultTable()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			if _, err := c2.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	conn := ft.wrap(c1, "10.0.0.2:11001")
+	ft.latency = 20 * time.Millisecond
+	start := time.Now()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < ft.latency {
+		t.Fatal("expected latency")
+	}
+	ft.reset()
+	ft.partition["10.0.0.2:11001"] = "2"
+	if err := ft.dial("10.0.0.2:11001"); err != errFaultPartition {
+		t.Fatalf("expected %v, got %v", errFaultPartition, err)
+	}
+	if err := ft.dial("10.0.0.3:11001"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != errFaultPartition {
+		t.Fatalf("expected %v, got %v", errFaultPartition, err)
+	}
+	if _, err := c1.Write([]byte("hello")); err == nil {
+		t.Fatal("expected closed connection")
+	}
+	ft.reset()
+	ft.drop = 1
+	c3, c4 := net.Pipe()
+	defer c4.Close()
+	if _, err := ft.wrap(c3, "").Write([]byte("hello")); err != errFaultDrop {
+		t.Fatalf("expected %v, got %v", errFaultDrop, err)
+	}
+
+	// faults are off
+	var off *faultTable
+	if off.wrap(c1, "") != c1 || off.dial("10.0.0.2:11001") != nil {
+		t.Fatal("expected no faults")
+	}
+	off.diskWait()
+}
+
+func TestFaultScope(t *testing.T) {
+	ft := newFaultTable()
+	ft.drop = 1
+
+	// only the raft connections have faults
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	stream := &transportStream{Listener: ln, faults: ft}
+	go func() {
+		if c, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := stream.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*faultConn); !ok {
+		t.Fatalf("expected a fault connection, got %T", conn)
+	}
+	if _, err := conn.Write([]byte("hello")); err != errFaultDrop {
+		t.Fatalf("expected %v, got %v", errFaultDrop, err)
+	}
+
+	// only the syncs are delayed
+	ft.disk = 200 * time.Millisecond
+	store, err := OpenStoreOptions(t.TempDir(), StoreOptions{
+		LogFlags:       storeFlags(DefaultLogFlags, SyncDefault, true),
+		StableFlags:    storeFlags(DefaultStableFlags, SyncDefault, true),
+		LogGeometry:    DefaultLogGeometry,
+		StableGeometry: DefaultStableGeometry,
+		Mode:           0755,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.faults = ft
+	start := time.Now()
+	if err := store.StoreLogs([]*raft.Log{{Index: 1, Data: []byte("a")}}); err != nil {
+		t.Fatal(err)
+	}
+	var log raft.Log
+	if err := store.GetLog(1, &log); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUint64([]byte("k"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) >= ft.disk {
+		t.Fatal("expected no delay")
+	}
+	start = time.Now()
+	if err := store.SyncLog(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < ft.disk {
+		t.Fatal("expected a delay")
+	}
+}
+
+func TestDebugFault(t *testing.T) {
+	var conf Config
+	conf.def()
+	m := machineInit(conf, 0, "", nil)
+	if _, ok := m.commands["debug"]; ok {
+		t.Fatal("expected no debug command")
+	}
+	conf.DebugFault = true
+	m = machineInit(conf, 0, "", nil)
+	if _, err := cmdDEBUG(m, nil, []string{"debug", "help"}); err !=
+		errFaultDisabled {
+		t.Fatalf("expected %v, got %v", errFaultDisabled, err)
+	}
+	m.faults = newFaultTable()
+	m.faults.partition["10.0.0.2:11001"] = "2"
+	for _, args := range [][]string{
+		{"debug", "fault", "latency", "5ms"},
+		{"debug", "fault", "disk", "1s"},
+		{"debug", "fault", "drop", "0.25"},
+	} {
+		resp, err := cmdDEBUG(m, nil, args)
+		if err != nil || resp != redcon.SimpleString("OK") {
+			t.Fatalf("%v: unexpected %v %v", args, resp, err)
+		}
+	}
+	for _, args := range [][]string{
+		{"debug", "fault", "latency", "-1s"},
+		{"debug", "fault", "drop", "2"},
+		{"debug", "fault", "partition"},
+		{"debug", "fault", "nope"},
+	} {
+		if _, err := cmdDEBUG(m, nil, args); err == nil {
+			t.Fatalf("%v: expected error", args)
+		}
+	}
+	resp, _ := cmdDEBUG(m, nil, []string{"debug", "fault", "list"})
+	expect := redisMap{"latency", "5ms", "drop", "0.25",
+		"partition", []string{"2"}, "disk", "1s"}
+	if !reflect.DeepEqual(resp, expect) {
+		t.Fatalf("expected %v, got %v", expect, resp)
+	}
+	cmdDEBUG(m, nil, []string{"debug", "fault", "heal"})
+	cmdDEBUG(m, nil, []string{"debug", "fault", "reset"})
+	resp, _ = cmdDEBUG(m, nil, []string{"debug", "fault", "list"})
+	expect = redisMap{"latency", "0s", "drop", "0",
+		"partition", []string{}, "disk", "0s"}
+	if !reflect.DeepEqual(resp, expect) {
+		t.Fatalf("expected %v, got %v", expect, resp)
+	}
+}
@@ -0,0 +1,492 @@
+package app
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/moontrade/server/logger"
+	"github.com/tidwall/redcon"
+)
+
+// raftGroup is one of the raft groups running in this server. Every server
+// runs all of the groups, and each group has its own machine, log, snapshots,
+// and leader. The hash slots are divided between the groups.
+type raftGroup struct {
+	id int
+	m  *machine
+	ra *raftWrap
+}
+
+// groupsInit creates the machine and raft for every group. The first group
+// uses the data directory, while the others use a sub-directory.
+func groupsInit(conf Config, dir string, rdata *restoreData,
+	hclogger hclog.Logger, tlscfg *tls.Config, svr *splitServer,
+) []*raftGroup {
+	groups := make([]*raftGroup, conf.Groups)
+	for i := range groups {
+		gdir := dir
+		if i > 0 {
+			gdir = filepath.Join(dir, fmt.Sprintf("group-%d", i))
+			if err := os.MkdirAll(gdir, 0777); err != nil {
+				logger.Fatal(err)
+			}
+			// a backup is only allowed with a single group
+			rdata = nil
+		}
+		m := machineInit(conf, i, gdir, rdata)
+		trans := transportInit(conf, i, tlscfg, svr, hclogger)
+		lstore, sstore := storeInit(conf, gdir, svr.faults)
+		snaps := snapshotInit(conf, gdir, m, hclogger)
+		ra := raftInit(conf, i, hclogger, m, lstore, sstore, snaps, trans)
+		groups[i] = &raftGroup{id: i, m: m, ra: ra}
+	}
+	for _, g := range groups {
+		g.m.groups = groups
+		g.m.hclogger = hclogger
+		g.m.tracking = groups[0].m.tracking
+		g.m.latency = groups[0].m.latency
+		g.m.clients = groups[0].m.clients
+		g.m.mon = groups[0].m.mon
+		g.m.faults = svr.faults
+	}
+	return groups
+}
+
+// groupMarker returns the transport marker for a group. The first group
+// uses the original marker.
+func groupMarker(group int) string {
+	if group == 0 {
+		return transportMarker
+	}
+	sum := md5.Sum([]byte(transportMarker + ":" + strconv.Itoa(group)))
+	return hex.EncodeToString(sum[:])
+}
+
+// groupCmd prefixes the command with GROUP when the raft is not the first
+// group, for sending the command to another server.
+func (ra *raftWrap) groupCmd(cmd string, args ...interface{},
+) (string, []interface{}) {
+	if ra.group == 0 {
+		return cmd, args
+	}
+	return "group", append([]interface{}{ra.group, cmd}, args...)
+}
+
+// raftGroups returns all the groups of the machine.
+func (m *machine) raftGroups(ra *raftWrap) []*raftGroup {
+	if len(m.groups) == 0 {
+		return []*raftGroup{{m: m, ra: ra}}
+	}
+	return m.groups
+}
+
+const (
+	slotNone      = 0 // slot is not served by the group
+	slotOwned     = 1 // slot is served by the group
+	slotMigrating = 2 // slot is served, but writes are refused while moving
+)
+
+// slotTable is the state of every hash slot for a group. It's only altered
+// from inside of the Apply function and is persisted in snapshots.
+type slotTable [numSlots]byte
+
+// newSlotTable returns the initial slots of a group, which is an equal range
+// of slots for each group.
+func newSlotTable(group, groups int) *slotTable {
+	st := new(slotTable)
+	start := group * numSlots / groups
+	end := (group + 1) * numSlots / groups
+	for i := start; i < end; i++ {
+		st[i] = slotOwned
+	}
+	return st
+}
+
+// check returns a TRYAGAIN error when any of the keys are in a slot that
+// can not be written to by the group.
+func (st *slotTable) check(keys []string) error {
+	for _, key := range keys {
+		slot := KeySlot(key)
+		switch st[slot] {
+		case slotOwned:
+		case slotMigrating:
+			return fmt.Errorf("TRYAGAIN hash slot %d is being migrated", slot)
+		default:
+			return fmt.Errorf("TRYAGAIN hash slot %d is not served by "+
+				"this group", slot)
+		}
+	}
+	return nil
+}
+
+func (st *slotTable) encode() []byte {
+	return append([]byte(nil), st[:]...)
+}
+
+func decodeSlotTable(data []byte, group, groups int) (*slotTable, error) {
+	if len(data) == 0 {
+		return newSlotTable(group, groups), nil
+	}
+	if len(data) != numSlots {
+		return nil, ErrCorrupt
+	}
+	st := new(slotTable)
+	copy(st[:], data)
+	return st, nil
+}
+
+// slotOwners returns the index of the group that serves each slot, or -1
+// when no group serves the slot. A group that owns a slot takes priority
+// over a group that is migrating the slot.
+func slotOwners(groups []*raftGroup) [numSlots]int {
+	var owners [numSlots]int
+	for i := range owners {
+		owners[i] = -1
+	}
+	for _, state := range []byte{slotOwned, slotMigrating} {
+		for gi, g := range groups {
+			g.m.mu.RLock()
+			for i := range owners {
+				if owners[i] == -1 && g.m.slots[i] == state {
+					owners[i] = gi
+				}
+			}
+			g.m.mu.RUnlock()
+		}
+	}
+	return owners
+}
+
+// slotGroup returns the index of the group that serves the slot, or -1.
+func (m *machine) slotGroup(slot int) int {
+	for _, state := range []byte{slotOwned, slotMigrating} {
+		for i, g := range m.groups {
+			g.m.mu.RLock()
+			ok := g.m.slots[slot] == state
+			g.m.mu.RUnlock()
+			if ok {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// slotRange is a range of slots that are served by one group.
+type slotRange struct {
+	group int
+	start int
+	end   int
+}
+
+func slotRanges(owners [numSlots]int) []slotRange {
+	var ranges []slotRange
+	for i := 0; i < numSlots; i++ {
+		if owners[i] == -1 {
+			continue
+		}
+		if len(ranges) > 0 {
+			last := &ranges[len(ranges)-1]
+			if last.group == owners[i] && last.end == i-1 {
+				last.end = i
+				continue
+			}
+		}
+		ranges = append(ranges, slotRange{owners[i], i, i})
+	}
+	return ranges
+}
+
+var errCrossSlot = errors.New(
+	"CROSSSLOT Keys in request don't hash to the same slot")
+
+// route returns the service of the group that serves the keys, and the slot
+// of the first key. The slot is -1 when there are no keys.
+func (s *service) route(keys []string) (*service, int, error) {
+	if len(keys) == 0 || len(s.groups) <= 1 {
+		return s, keysSlot(keys), nil
+	}
+	group, slot, err := s.m.keysGroup(keys)
+	if err != nil {
+		return nil, slot, err
+	}
+	return s.groups[group], slot, nil
+}
+
+// keysSlot returns the slot of the first key, or -1 when there are no keys.
+func keysSlot(keys []string) int {
+	if len(keys) == 0 {
+		return -1
+	}
+	return KeySlot(keys[0])
+}
+
+// keysGroup returns the group that serves all of the keys. Commands with no
+// keys are served by the first group.
+func (m *machine) keysGroup(keys []string) (group, slot int, err error) {
+	slot = keysSlot(keys)
+	if slot == -1 {
+		return 0, slot, nil
+	}
+	group = m.slotGroup(slot)
+	if group == -1 {
+		return 0, slot, fmt.Errorf("CLUSTERDOWN Hash slot %d not served",
+			slot)
+	}
+	for _, key := range keys[1:] {
+		if m.slotGroup(KeySlot(key)) != group {
+			return 0, slot, errCrossSlot
+		}
+	}
+	return group, slot, nil
+}
+
+// SlotMigrator is an optional interface for the user data that allows for
+// hash slots to be moved between raft groups using CLUSTER MIGRATE.
+type SlotMigrator interface {
+	// SlotCommands returns the write commands that will recreate all of
+	// the keys in the slot. Use KeySlot to find the slot of a key.
+	SlotCommands(slot int) [][]string
+	// DeleteSlot deletes all of the keys in the slot.
+	DeleteSlot(slot int)
+}
+
+// GROUP index command [arg ...]
+// help: runs a system command, such as RAFT, on another raft group.
+func cmdGROUP(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 3 {
+		return nil, ErrWrongNumArgs
+	}
+	groups := m.raftGroups(ra)
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 || n >= len(groups) {
+		return nil, fmt.Errorf("invalid group '%s'", args[1])
+	}
+	g := groups[n]
+	name := strings.ToLower(args[2])
+	cmd, ok := g.m.commands[name]
+	if !ok || cmd.kind != 's' || name == "group" {
+		return nil, fmt.Errorf("%s '%s'", ErrUnknownCommand, args[2])
+	}
+	opts := sendOpts(um)
+	if err := m.allowed(opts.User, cmd.kind, name); err != nil {
+		return nil, err
+	}
+	pm := intermediateMachine{m: g.m, context: opts.Context, user: opts.User,
+		addr: opts.Addr, conn: opts.ConnID}
+	resp, err := cmd.fn(pm, g.ra, args[2:])
+	return resp, errRaftConvert(g.ra, err)
+}
+
+// CLUSTER MIGRATE slot group
+// help: moves a hash slot and its keys to another raft group. The leaders
+// of both groups must be on this server, and the user data must implement
+// the SlotMigrator interface. Returns the number of commands that were used
+// to move the keys.
+func cmdCLUSTERMIGRATE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) != 4 {
+		return nil, errWrongNumArgsCluster
+	}
+	slot, err := strconv.Atoi(args[2])
+	if err != nil || slot < 0 || slot >= numSlots {
+		return nil, errors.New("invalid slot")
+	}
+	groups := m.raftGroups(ra)
+	n, err := strconv.Atoi(args[3])
+	if err != nil || n < 0 || n >= len(groups) {
+		return nil, fmt.Errorf("invalid group '%s'", args[3])
+	}
+	var src *raftGroup
+	dst := groups[n]
+	for _, g := range groups {
+		g.m.mu.RLock()
+		owned := g.m.slots[slot] == slotOwned
+		g.m.mu.RUnlock()
+		if owned {
+			src = g
+			break
+		}
+	}
+	if src == nil {
+		return nil, fmt.Errorf("slot %d is not served", slot)
+	}
+	if src == dst {
+		return nil, fmt.Errorf("slot %d is already served by group %d",
+			slot, n)
+	}
+	if src.ra.State() != raft.Leader || dst.ra.State() != raft.Leader {
+		return nil, fmt.Errorf("the leaders of group %d and group %d "+
+			"must be on this server", src.id, dst.id)
+	}
+	src.m.mu.RLock()
+	mig, ok := src.m.data.(SlotMigrator)
+	src.m.mu.RUnlock()
+	if !ok {
+		return nil, errors.New("slot migration is not supported")
+	}
+	sslot := strconv.Itoa(slot)
+	opts := sendOpts(um)
+
+	// Refuse new writes to the slot on the source group. All of the writes
+	// prior to this point have been applied once it returns.
+	if _, err := src.m.writeInternal(
+		[]string{"slotmigrate", sslot, "start"}, opts); err != nil {
+		return nil, errRaftConvert(src.ra, err)
+	}
+	src.m.mu.RLock()
+	atomic.AddInt32(&src.m.readers, 1)
+	cmds := mig.SlotCommands(slot)
+	atomic.AddInt32(&src.m.readers, -1)
+	src.m.mu.RUnlock()
+
+	// Import the keys into the destination group, which then serves the
+	// slot.
+	iargs := appendTxnCommands([]string{"slotimport", sslot}, cmds)
+	if _, err := dst.m.writeInternal(iargs, opts); err != nil {
+		if _, aerr := src.m.writeInternal(
+			[]string{"slotmigrate", sslot, "abort"}, opts); aerr != nil {
+			logger.Error(fmt.Errorf("slot %d abort: %v", slot, aerr))
+		}
+		return nil, errRaftConvert(dst.ra, err)
+	}
+
+	// Remove the keys from the source group.
+	if _, err := src.m.writeInternal(
+		[]string{"slotdrop", sslot}, opts); err != nil {
+		return nil, errRaftConvert(src.ra, err)
+	}
+	return redcon.SimpleInt(len(cmds)), nil
+}
+
+func parseSlotArg(arg string) (int, error) {
+	slot, err := strconv.Atoi(arg)
+	if err != nil || slot < 0 || slot >= numSlots {
+		return 0, ErrSyntax
+	}
+	return slot, nil
+}
+
+// SLOTMIGRATE slot START|ABORT
+// help: starts or aborts moving a slot out of the group. It's not possible
+//       to directly call this from a client service.
+func cmdSLOTMIGRATE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) != 3 {
+		return nil, ErrWrongNumArgs
+	}
+	slot, err := parseSlotArg(args[1])
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(args[2]) {
+	case "start":
+		if m.slots[slot] != slotOwned {
+			return nil, fmt.Errorf("slot %d is not served by this group",
+				slot)
+		}
+		m.slots[slot] = slotMigrating
+	case "abort":
+		if m.slots[slot] == slotMigrating {
+			m.slots[slot] = slotOwned
+		}
+	default:
+		return nil, ErrSyntax
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+// SLOTIMPORT slot count (count arg...)...
+// help: applies the commands that recreate the keys of a slot and takes
+//       ownership of it. When a command fails, the keys of the slot are
+//       deleted and the slot is not served. It's not possible to directly
+//       call this from a client service.
+func cmdSLOTIMPORT(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 3 {
+		return nil, ErrWrongNumArgs
+	}
+	slot, err := parseSlotArg(args[1])
+	if err != nil {
+		return nil, err
+	}
+	cmds, err := parseTxnCommands(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	if m.slots[slot] == slotOwned {
+		return nil, fmt.Errorf("slot %d is already served by this group",
+			slot)
+	}
+	fns := make([]command, len(cmds))
+	for i, cargs := range cmds {
+		name := strings.ToLower(cargs[0])
+		cmd, ok := m.command(name)
+		if !ok || cmd.kind != 'w' || internalCommands[name] {
+			return nil, fmt.Errorf("%s '%s'", ErrUnknownCommand, cargs[0])
+		}
+		fns[i] = cmd
+	}
+	for i, cargs := range cmds {
+		m.touchKeys(m.commandKeys(strings.ToLower(cargs[0]), cargs), m.index)
+		if _, err := fns[i].fn(m, nil, cargs); err != nil {
+			// remove the keys that were imported, leaving the slot to the
+			// source group
+			if mig, ok := m.data.(SlotMigrator); ok {
+				mig.DeleteSlot(slot)
+			}
+			return nil, err
+		}
+	}
+	m.slots[slot] = slotOwned
+	return redcon.SimpleString("OK"), nil
+}
+
+// SLOTDROP slot
+// help: removes a slot and its keys from the group. It's not possible to
+//       directly call this from a client service.
+func cmdSLOTDROP(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) != 2 {
+		return nil, ErrWrongNumArgs
+	}
+	slot, err := parseSlotArg(args[1])
+	if err != nil {
+		return nil, err
+	}
+	m.slots[slot] = slotNone
+	if mig, ok := m.data.(SlotMigrator); ok {
+		mig.DeleteSlot(slot)
+	}
+	return redcon.SimpleString("OK"), nil
+}
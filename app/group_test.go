@@ -0,0 +1,129 @@
+package app
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSlotTable(t *testing.T) {
+	var owners [numSlots]int
+	for g := 0; g < 3; g++ {
+		st := newSlotTable(g, 3)
+		for i := range st {
+			if st[i] == slotOwned {
+				owners[i] = g
+			}
+		}
+	}
+	ranges := slotRanges(owners)
+	expect := []slotRange{{0, 0, 5460}, {1, 5461, 10921}, {2, 10922, 16383}}
+	if !reflect.DeepEqual(ranges, expect) {
+		t.Fatalf("expected %v, got %v", expect, ranges)
+	}
+	st := newSlotTable(0, 2)
+	key := "a" // slot 15495
+	if err := st.check([]string{key}); err == nil {
+		t.Fatal("expected error")
+	}
+	st[KeySlot(key)] = slotOwned
+	if err := st.check([]string{key}); err != nil {
+		t.Fatal(err)
+	}
+	st2, err := decodeSlotTable(st.encode(), 0, 2)
+	if err != nil || *st2 != *st {
+		t.Fatal("mismatch")
+	}
+}
+
+// slotMap is a map that implements SlotMigrator.
+type slotMap map[string]string
+
+func (s slotMap) SlotCommands(slot int) [][]string {
+	var cmds [][]string
+	for k, v := range s {
+		if KeySlot(k) == slot {
+			cmds = append(cmds, []string{"set", k, v})
+		}
+	}
+	return cmds
+}
+
+func (s slotMap) DeleteSlot(slot int) {
+	for k := range s {
+		if KeySlot(k) == slot {
+			delete(s, k)
+		}
+	}
+}
+
+func TestSlotImport(t *testing.T) {
+	m := machineInit(Config{Groups: 2}, 1, "", nil)
+	data := slotMap{}
+	m.data = data
+	m.commands["set"] = command{'w', func(um Machine, ra *raftWrap,
+		args []string) (interface{}, error) {
+		if args[2] == "fail" {
+			return nil, errors.New("failed")
+		}
+		um.Data().(slotMap)[args[1]] = args[2]
+		return nil, nil
+	}}
+	slot := KeySlot("a")     // slot 15495, which is served by group 1
+	m.slots[slot] = slotNone // until it's imported
+	key := "{a}b"
+	imp := func(cmds ...[]string) error {
+		m.index++
+		args := appendTxnCommands([]string{"slotimport",
+			strconv.Itoa(slot)}, cmds)
+		_, err := cmdSLOTIMPORT(m, nil, args)
+		return err
+	}
+
+	// invalid commands are refused prior to any change
+	for _, cmd := range [][]string{{"nope", key}, {"get", key},
+		{"tick", "0"}} {
+		if err := imp([]string{"set", "a", "1"}, cmd); err == nil {
+			t.Fatalf("%v: expected error", cmd)
+		}
+		if len(data) != 0 || m.slots[slot] != slotNone {
+			t.Fatalf("%v: unexpected %v %v", cmd, data, m.slots[slot])
+		}
+	}
+
+	// a failed command removes the imported keys
+	if err := imp([]string{"set", "a", "1"}, []string{"set", key,
+		"fail"}); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(data) != 0 || m.slots[slot] != slotNone {
+		t.Fatalf("unexpected %v %v", data, m.slots[slot])
+	}
+
+	if err := imp([]string{"set", "a", "1"}, []string{"set", key,
+		"2"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || m.slots[slot] != slotOwned {
+		t.Fatalf("unexpected %v %v", data, m.slots[slot])
+	}
+	if err := imp([]string{"set", "a", "3"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestTxnCommands(t *testing.T) {
+	cmds := [][]string{{"set", "a", "1"}, {"del", "a", "b"}}
+	args := appendTxnCommands([]string{"slotimport", "1"}, cmds)
+	cmds2, err := parseTxnCommands(args[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cmds, cmds2) {
+		t.Fatalf("expected %v, got %v", cmds, cmds2)
+	}
+	if _, err := parseTxnCommands(args[2 : len(args)-1]); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,532 @@
+package app
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/moontrade/server/logger"
+)
+
+var errKeyRingNone = errors.New("data is encrypted, but no key provider " +
+	"was configured")
+
+var errKeyRingPlain = errors.New("snapshot is not encrypted, use " +
+	"--encrypt-migrate to read plaintext snapshots")
+
+var errKeyRingInvalid = errors.New("invalid encrypted data")
+
+const (
+	keyRingMagic       = "\x00KR1" // prefix of a sealed value
+	keyRingStreamMagic = "\x00KS1" // prefix of a sealed stream
+	keyRingChunkSize   = 64 * 1024 // plaintext bytes in each stream chunk
+	keyRingChunkFinal  = 1 << 31   // chunk header flag for the last chunk
+)
+
+// A KeyProvider supplies the master keys for encryption at rest, such as
+// from a key file or a KMS. The data is encrypted with AES-GCM data keys.
+// Each data key is stored along with the data after being wrapped by a
+// master key, so the provider only ever sees the data keys.
+type KeyProvider interface {
+	// KeyID returns the id of the master key that wraps new data keys.
+	KeyID() (string, error)
+	// WrapKey encrypts a data key with a master key.
+	WrapKey(id string, key []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key that was wrapped by a master key.
+	UnwrapKey(id string, wrapped []byte) ([]byte, error)
+}
+
+// FileKeyProvider is a KeyProvider that reads the master keys from a file
+// with a line for each key in the form "id:base64-key". The keys must be
+// 16, 24, or 32 bytes. The last key wraps new data keys, and the others are
+// kept for reading older data. The file is read again at every rotation, so
+// a key is rotated by appending a new line.
+type FileKeyProvider struct {
+	path string
+	mu   sync.Mutex
+	last string
+	keys map[string]cipher.AEAD
+}
+
+// NewFileKeyProvider returns a provider for the key file at path.
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{path: path}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *FileKeyProvider) load() error {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var last string
+	keys := make(map[string]cipher.AEAD)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("key file: line %d: expected 'id:key'", i+1)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return fmt.Errorf("key file: line %d: invalid base64", i+1)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return fmt.Errorf("key file: line %d: %v", i+1, err)
+		}
+		last = parts[0]
+		keys[last] = aead
+	}
+	if last == "" {
+		return errors.New("key file: no keys")
+	}
+	p.mu.Lock()
+	p.last, p.keys = last, keys
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *FileKeyProvider) key(id string) (cipher.AEAD, error) {
+	p.mu.Lock()
+	aead, ok := p.keys[id]
+	p.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("key file: unknown key id '%s'", id)
+	}
+	return aead, nil
+}
+
+// KeyID reads the key file and returns the id of the last key.
+func (p *FileKeyProvider) KeyID() (string, error) {
+	if err := p.load(); err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last, nil
+}
+
+// WrapKey encrypts a data key with the master key.
+func (p *FileKeyProvider) WrapKey(id string, key []byte) ([]byte, error) {
+	aead, err := p.key(id)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, []byte(id)), nil
+}
+
+// UnwrapKey decrypts a data key that was wrapped by the master key.
+func (p *FileKeyProvider) UnwrapKey(id string, wrapped []byte) ([]byte,
+	error,
+) {
+	aead, err := p.key(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errKeyRingInvalid
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, wrapped[:n], wrapped[n:], []byte(id))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// KeyRing encrypts data at rest with AES-GCM data keys from a KeyProvider.
+// It's used for the raft log, the stable store values, and the snapshots,
+// and is shared by all raft groups. A new data key is made at every
+// snapshot, which also picks up a new master key from the provider. Older
+// data is read with the data key that's stored along with it, until it's
+// replaced by a snapshot.
+type KeyRing struct {
+	kp   KeyProvider
+	mu   sync.RWMutex
+	cur  *dataKey
+	keys map[string]*dataKey // unwrapped keys by their header
+
+	migrate bool // plaintext snapshots can be read
+}
+
+// dataKey is an unwrapped data key.
+type dataKey struct {
+	head []byte // master key id and wrapped data key
+	aead cipher.AEAD
+}
+
+// dataKeyHead returns the header that's stored with the data.
+// (id, wrapped)
+//   - id: (count, byte...)
+//   - wrapped: (count, byte...)
+func dataKeyHead(id, wrapped []byte) []byte {
+	var head []byte
+	head = appendUvarint(head, uint64(len(id)))
+	head = append(head, id...)
+	head = appendUvarint(head, uint64(len(wrapped)))
+	head = append(head, wrapped...)
+	return head
+}
+
+// NewKeyRing returns a KeyRing with a new data key.
+func NewKeyRing(kp KeyProvider) (*KeyRing, error) {
+	kr := &KeyRing{kp: kp, keys: make(map[string]*dataKey)}
+	if err := kr.Rotate(); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// keyRingInit returns the KeyRing of the Config, or nil when encryption at
+// rest is off.
+func keyRingInit(conf Config) *KeyRing {
+	kr, err := confKeyRing(conf)
+	if err != nil {
+		logger.Fatal(fmt.Errorf("encryption key: %v", err))
+	}
+	return kr
+}
+
+func confKeyRing(conf Config) (*KeyRing, error) {
+	kp := conf.KeyProvider
+	if kp == nil {
+		if conf.EncryptKeyPath == "" {
+			return nil, nil
+		}
+		var err error
+		if kp, err = NewFileKeyProvider(conf.EncryptKeyPath); err != nil {
+			return nil, err
+		}
+	}
+	kr, err := NewKeyRing(kp)
+	if err != nil {
+		return nil, err
+	}
+	kr.migrate = conf.EncryptMigrate
+	return kr, nil
+}
+
+// Rotate makes a new data key, which is wrapped by the current master key
+// of the provider.
+func (kr *KeyRing) Rotate() error {
+	id, err := kr.kp.KeyID()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	wrapped, err := kr.kp.WrapKey(id, key)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	head := dataKeyHead([]byte(id), wrapped)
+	dk := &dataKey{head: head, aead: aead}
+	kr.mu.Lock()
+	kr.cur = dk
+	kr.keys[string(head)] = dk
+	kr.mu.Unlock()
+	return nil
+}
+
+// rotate is Rotate for the snapshots, which keep using the current data
+// key when the provider is unavailable.
+func (kr *KeyRing) rotate() {
+	if err := kr.Rotate(); err != nil {
+		logger.Warn("encryption key rotation: %v", err)
+	}
+}
+
+func (kr *KeyRing) current() *dataKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.cur
+}
+
+// readHead reads the data key header and returns the unwrapped key.
+func (kr *KeyRing) readHead(r byteReader) (*dataKey, error) {
+	id, err := readUvarintBytes(r)
+	if err != nil {
+		return nil, errKeyRingInvalid
+	}
+	wrapped, err := readUvarintBytes(r)
+	if err != nil {
+		return nil, errKeyRingInvalid
+	}
+	head := dataKeyHead(id, wrapped)
+	kr.mu.RLock()
+	dk, ok := kr.keys[string(head)]
+	kr.mu.RUnlock()
+	if ok {
+		return dk, nil
+	}
+	key, err := kr.kp.UnwrapKey(string(id), wrapped)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	dk = &dataKey{head: head, aead: aead}
+	kr.mu.Lock()
+	kr.keys[string(head)] = dk
+	kr.mu.Unlock()
+	return dk, nil
+}
+
+// isSealed returns true when the value was sealed by a KeyRing.
+func isSealed(b []byte) bool {
+	return len(b) >= len(keyRingMagic) &&
+		string(b[:len(keyRingMagic)]) == keyRingMagic
+}
+
+// Seal encrypts and authenticates the plaintext and the additional data,
+// and appends the result to dst.
+// (magic, head, nonce, ciphertext)
+func (kr *KeyRing) Seal(dst, plaintext, ad []byte) ([]byte, error) {
+	dk := kr.current()
+	dst = append(dst, keyRingMagic...)
+	dst = append(dst, dk.head...)
+	i := len(dst)
+	dst = append(dst, make([]byte, dk.aead.NonceSize())...)
+	nonce := dst[i:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return dk.aead.Seal(dst, nonce, plaintext, ad), nil
+}
+
+// Open decrypts and authenticates a value from Seal with the same
+// additional data, and appends the plaintext to dst.
+func (kr *KeyRing) Open(dst, sealed, ad []byte) ([]byte, error) {
+	if !isSealed(sealed) {
+		return nil, errKeyRingInvalid
+	}
+	r := &sliceReader{b: sealed[len(keyRingMagic):]}
+	dk, err := kr.readHead(byteReader{r})
+	if err != nil {
+		return nil, err
+	}
+	n := dk.aead.NonceSize()
+	if len(r.b) < n {
+		return nil, errKeyRingInvalid
+	}
+	return dk.aead.Open(dst, r.b[:n], r.b[n:], ad)
+}
+
+type sliceReader struct{ b []byte }
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
+
+// NewWriter returns a writer that encrypts a stream, such as a snapshot,
+// in chunks. The last chunk is written by Close, which guards against a
+// truncated stream. Close does not close w. The stream is the magic, the
+// data key header, a nonce prefix, and the chunks. Each chunk is a uint32
+// ciphertext size with the final flag, followed by the ciphertext.
+func (kr *KeyRing) NewWriter(w io.Writer) io.WriteCloser {
+	return &sealWriter{w: w, dk: kr.current()}
+}
+
+type sealWriter struct {
+	w      io.Writer
+	dk     *dataKey
+	prefix [4]byte
+	count  uint64
+	buf    []byte
+	out    []byte
+	err    error
+	closed bool
+}
+
+func (w *sealWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		m := keyRingChunkSize - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		if len(w.buf) == keyRingChunkSize {
+			if w.err = w.flush(false); w.err != nil {
+				return 0, w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *sealWriter) flush(final bool) error {
+	if w.count == 0 {
+		if _, err := rand.Read(w.prefix[:]); err != nil {
+			return err
+		}
+		w.out = append(w.out[:0], keyRingStreamMagic...)
+		w.out = append(w.out, w.dk.head...)
+		w.out = append(w.out, w.prefix[:]...)
+	} else {
+		w.out = w.out[:0]
+	}
+	size := uint32(len(w.buf) + w.dk.aead.Overhead())
+	if final {
+		size |= keyRingChunkFinal
+	}
+	i := len(w.out)
+	w.out = append(w.out, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(w.out[i:], size)
+	w.out = w.dk.aead.Seal(w.out, chunkNonce(w.prefix, w.count, w.dk),
+		w.buf, w.out[i:i+4])
+	w.count++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(w.out)
+	return err
+}
+
+func (w *sealWriter) Close() error {
+	if w.err != nil || w.closed {
+		return w.err
+	}
+	w.closed = true
+	w.err = w.flush(true)
+	return w.err
+}
+
+func chunkNonce(prefix [4]byte, count uint64, dk *dataKey) []byte {
+	nonce := make([]byte, dk.aead.NonceSize())
+	copy(nonce, prefix[:])
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], count)
+	return nonce
+}
+
+// NewReader returns a reader that decrypts a stream from NewWriter.
+func (kr *KeyRing) NewReader(r io.Reader) (io.Reader, error) {
+	var magic [len(keyRingStreamMagic)]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if string(magic[:]) != keyRingStreamMagic {
+		return nil, errKeyRingInvalid
+	}
+	dk, err := kr.readHead(byteReader{r})
+	if err != nil {
+		return nil, err
+	}
+	sr := &sealReader{r: r, dk: dk}
+	if _, err := io.ReadFull(r, sr.prefix[:]); err != nil {
+		return nil, errKeyRingInvalid
+	}
+	return sr, nil
+}
+
+type sealReader struct {
+	r      io.Reader
+	dk     *dataKey
+	prefix [4]byte
+	count  uint64
+	buf    []byte
+	final  bool
+}
+
+func (r *sealReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *sealReader) next() error {
+	var head [4]byte
+	if _, err := io.ReadFull(r.r, head[:]); err != nil {
+		// the final chunk is missing
+		return io.ErrUnexpectedEOF
+	}
+	size := binary.LittleEndian.Uint32(head[:])
+	final := size&keyRingChunkFinal != 0
+	size &^= keyRingChunkFinal
+	if size > keyRingChunkSize+uint32(r.dk.aead.Overhead()) {
+		return errKeyRingInvalid
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	buf, err := r.dk.aead.Open(data[:0],
+		chunkNonce(r.prefix, r.count, r.dk), data, head[:])
+	if err != nil {
+		return err
+	}
+	r.count++
+	r.buf = buf
+	r.final = final
+	return nil
+}
+
+// snapReader returns a reader of the snapshot data, which is decrypted
+// when the snapshot was sealed by a KeyRing. A plaintext snapshot is
+// rejected when there is a KeyRing, unless it allows for migrating.
+func snapReader(kr *KeyRing, r io.Reader) (*gzip.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(keyRingStreamMagic))
+	if string(magic) != keyRingStreamMagic {
+		if kr != nil && !kr.migrate {
+			return nil, errKeyRingPlain
+		}
+		return gzip.NewReader(br)
+	}
+	if kr == nil {
+		return nil, errKeyRingNone
+	}
+	sr, err := kr.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	return gzip.NewReader(sr)
+}
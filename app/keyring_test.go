@@ -0,0 +1,233 @@
+package app
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/moontrade/mdbx-go"
+)
+
+func testKeyLine(id string) string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return id + ":" + base64.StdEncoding.EncodeToString(key) + "\n"
+}
+
+func TestKeyRing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	for _, data := range []string{"", "k1", "k1:x", "k1:" +
+		base64.StdEncoding.EncodeToString([]byte("short"))} {
+		ioutil.WriteFile(path, []byte(data), 0600)
+		if _, err := NewFileKeyProvider(path); err == nil {
+			t.Fatalf("%q: expected error", data)
+		}
+	}
+	k1 := testKeyLine("k1")
+	ioutil.WriteFile(path, []byte(k1), 0600)
+	kp, err := NewFileKeyProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := NewKeyRing(kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed1, err := kr.Seal(nil, []byte("hello"), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed1) || bytes.Contains(sealed1, []byte("hello")) {
+		t.Fatalf("unexpected %q", sealed1)
+	}
+	if _, err := kr.Open(nil, sealed1, []byte("other")); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// rotate to a new master key, the older data is still readable
+	ioutil.WriteFile(path, []byte(k1+"# rotated\n"+testKeyLine("k2")), 0600)
+	if err := kr.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	sealed2, _ := kr.Seal(nil, []byte("world"), nil)
+	if !bytes.Contains(sealed2, []byte("k2")) {
+		t.Fatalf("expected key k2, got %q", sealed2)
+	}
+	kr, _ = NewKeyRing(kp)
+	for _, tc := range []struct {
+		sealed, ad []byte
+		expect     string
+	}{{sealed1, []byte("ad"), "hello"}, {sealed2, nil, "world"}} {
+		data, err := kr.Open(nil, tc.sealed, tc.ad)
+		if err != nil || string(data) != tc.expect {
+			t.Fatalf("expected %s, got %q %v", tc.expect, data, err)
+		}
+	}
+
+	// streams are sealed in chunks
+	plain := make([]byte, keyRingChunkSize*2+100)
+	rand.Read(plain)
+	var buf bytes.Buffer
+	w := kr.NewWriter(&buf)
+	w.Write(plain[:10])
+	w.Write(plain[10:])
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := kr.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(r); err != nil ||
+		!bytes.Equal(data, plain) {
+		t.Fatalf("unexpected %d %v", len(data), err)
+	}
+	r, _ = kr.NewReader(bytes.NewReader(buf.Bytes()[:keyRingChunkSize+200]))
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestKeyRingStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keys")
+	ioutil.WriteFile(path, []byte(testKeyLine("k1")), 0600)
+	var conf Config
+	conf.def()
+	conf.EncryptKeyPath = path
+	kr, err := confKeyRing(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(keys *KeyRing) (*Store, error) {
+		return OpenStoreOptions(filepath.Join(dir, "store"), StoreOptions{
+			LogFlags:       DefaultLogFlags,
+			StableFlags:    DefaultStableFlags,
+			LogGeometry:    DefaultLogGeometry,
+			StableGeometry: DefaultStableGeometry,
+			Mode:           0755,
+			Keys:           keys,
+		})
+	}
+
+	// an entry from before the encryption was turned on
+	store, err := open(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.StoreLog(&raft.Log{Index: 1, Data: []byte("plain")})
+	store.Close()
+
+	store, err = open(kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StoreLogs([]*raft.Log{{Index: 2, Data: []byte("secret")},
+		{Index: 3, Data: []byte("secret")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set([]byte(keyLastVoteCand), []byte("10.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	for index, expect := range map[uint64]string{1: "plain", 2: "secret",
+		3: "secret"} {
+		var log raft.Log
+		if err := store.GetLog(index, &log); err != nil ||
+			string(log.Data) != expect {
+			t.Fatalf("expected %s, got %q %v", expect, log.Data, err)
+		}
+	}
+	store.logStore.View(func(tx *mdbx.Tx) error {
+		index := uint64(2)
+		key, val := mdbx.U64(&index), mdbx.Val{}
+		tx.Get(store.logDBI, &key, &val)
+		if !isSealed(val.UnsafeBytes()) ||
+			bytes.Contains(val.UnsafeBytes(), []byte("secret")) {
+			t.Fatal("expected sealed entry")
+		}
+		return nil
+	})
+	store.Close()
+
+	// the stable values are decrypted when loaded
+	store, err = open(kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cand, _ := store.Get([]byte(keyLastVoteCand)); string(cand) !=
+		"10.0.0.1" {
+		t.Fatalf("unexpected %q", cand)
+	}
+	store.Close()
+	if _, err := open(nil); err != errKeyRingNone {
+		t.Fatalf("expected %v, got %v", errKeyRingNone, err)
+	}
+
+	// snapshots
+	conf.keys = kr
+	conf.UseJSONSnapshots = true
+	conf.InitialData = &map[string]string{"a": "secret"}
+	conf.jsonInit()
+	m := machineInit(conf, 0, dir, nil)
+	snap, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := snap.(*fsmSnap).Persist(&bufSink{&buf}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte(keyRingStreamMagic)) {
+		t.Fatal("expected sealed snapshot")
+	}
+	m2 := machineInit(conf, 0, dir, nil)
+	m2.data = nil
+	if err := m2.Restore(ioutil.NopCloser(bytes.NewReader(
+		buf.Bytes()))); err != nil {
+		t.Fatal(err)
+	}
+	if (*m2.data.(*map[string]string))["a"] != "secret" {
+		t.Fatalf("unexpected %v", m2.data)
+	}
+	conf.keys = nil
+	m2 = machineInit(conf, 0, dir, nil)
+	if err := m2.Restore(ioutil.NopCloser(bytes.NewReader(
+		buf.Bytes()))); err != errKeyRingNone {
+		t.Fatalf("expected %v, got %v", errKeyRingNone, err)
+	}
+
+	// plaintext snapshots are only read when migrating
+	if snap, err = m2.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	var plain bytes.Buffer
+	if err := snap.(*fsmSnap).Persist(&bufSink{&plain}); err != nil {
+		t.Fatal(err)
+	}
+	conf.keys = kr
+	m2 = machineInit(conf, 0, dir, nil)
+	if err := m2.Restore(ioutil.NopCloser(bytes.NewReader(
+		plain.Bytes()))); err != errKeyRingPlain {
+		t.Fatalf("expected %v, got %v", errKeyRingPlain, err)
+	}
+	conf.EncryptMigrate = true
+	if conf.keys, err = confKeyRing(conf); err != nil {
+		t.Fatal(err)
+	}
+	m2 = machineInit(conf, 0, dir, nil)
+	if err := m2.Restore(ioutil.NopCloser(bytes.NewReader(
+		plain.Bytes()))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type bufSink struct{ *bytes.Buffer }
+
+func (s *bufSink) ID() string    { return "test" }
+func (s *bufSink) Cancel() error { return nil }
+func (s *bufSink) Close() error  { return nil }
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// numSlots is the number of hash slots in a Redis cluster.
+const numSlots = 16384
+
+// crc16tab is the CRC16-CCITT (XMODEM) table used by Redis Cluster.
+var crc16tab [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16tab[i] = crc
+	}
+}
+
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16tab[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// KeySlot returns the Redis Cluster hash slot for a key. When the key has a
+// hash tag, such as "{user1000}.following", only the tag is hashed.
+func KeySlot(key string) int {
+	if s := strings.IndexByte(key, '{'); s != -1 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key)) & (numSlots - 1)
+}
+
+// keySpec is the position of the keys in the command arguments, which uses
+// the same rules as the Redis COMMAND first-key, last-key, and step values.
+// Commands such as EVAL instead have the number of keys at the count
+// position, which is followed by the keys.
+type keySpec struct {
+	first int // first key position, zero when there are no keys
+	last  int // last key position, negative counts back from the end
+	step  int // step between keys
+	count int // position of the number of keys, zero when not used
+}
+
+// defKeySpec is used for write commands that have not defined their key
+// positions. The key is the first argument.
+var defKeySpec = keySpec{first: 1, last: 1, step: 1}
+
+func (ks keySpec) keys(args []string) []string {
+	if ks.count > 0 {
+		if ks.count >= len(args) {
+			return nil
+		}
+		n, err := strconv.Atoi(args[ks.count])
+		if err != nil || n <= 0 || n > len(args)-ks.count-1 {
+			return nil
+		}
+		return args[ks.count+1 : ks.count+1+n]
+	}
+	if ks.first <= 0 || ks.first >= len(args) {
+		return nil
+	}
+	last := ks.last
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	step := ks.step
+	if step <= 0 {
+		step = 1
+	}
+	var keys []string
+	for i := ks.first; i <= last; i += step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// SetCommandKeys sets the positions of the keys in the arguments for a
+// command, which are used by WATCH to detect changed keys. The first is the
+// position of the first key, or zero for commands with no keys. The last is
+// the position of the last key, where -1 is the last argument. The step is
+// the number of arguments between keys. For example, "DEL key [key ...]" is
+// (1, -1, 1) and "MSET key value [key value ...]" is (1, -1, 2). By default,
+// write commands have one key at the first argument.
+func (conf *Config) SetCommandKeys(name string, first, last, step int) {
+	name = strings.ToLower(name)
+	if conf.keySpecs == nil {
+		conf.keySpecs = make(map[string]keySpec)
+	}
+	conf.keySpecs[name] = keySpec{first: first, last: last, step: step}
+}
+
+// keyVersions holds the raft index of the last write for every hash slot.
+// It's only altered from inside of the Apply function and is persisted in
+// snapshots.
+type keyVersions [numSlots]uint64
+
+func (kv *keyVersions) touch(keys []string, index uint64) {
+	for _, key := range keys {
+		kv[KeySlot(key)] = index
+	}
+}
+
+// changed returns true when any of the keys may have been written to after
+// the index. Keys that share a slot may be reported as changed.
+func (kv *keyVersions) changed(keys []string, index uint64) bool {
+	for _, key := range keys {
+		if kv[KeySlot(key)] > index {
+			return true
+		}
+	}
+	return false
+}
+
+func (kv *keyVersions) encode() []byte {
+	var data []byte
+	for _, index := range kv {
+		data = appendUvarint(data, index)
+	}
+	return data
+}
+
+func decodeKeyVersions(data []byte) (*keyVersions, error) {
+	kv := new(keyVersions)
+	if len(data) == 0 {
+		return kv, nil
+	}
+	for i := range kv {
+		index, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, ErrCorrupt
+		}
+		kv[i] = index
+		data = data[n:]
+	}
+	return kv, nil
+}
@@ -0,0 +1,36 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	if slot := KeySlot("foo"); slot != 12182 {
+		t.Fatalf("expected 12182, got %d", slot)
+	}
+	if slot := KeySlot("123456789"); slot != 0x31C3&(numSlots-1) {
+		t.Fatalf("got %d", slot)
+	}
+	if KeySlot("{user1000}.following") != KeySlot("{user1000}.followers") {
+		t.Fatal("hash tags must share a slot")
+	}
+	if KeySlot("foo{}{bar}") != int(crc16("foo{}{bar}"))&(numSlots-1) {
+		t.Fatal("empty hash tag must hash the whole key")
+	}
+}
+
+func TestKeySpec(t *testing.T) {
+	args := []string{"mset", "a", "1", "b", "2"}
+	if keys := (keySpec{first: 1, last: -1, step: 2}).keys(args); !reflect.DeepEqual(keys,
+		[]string{"a", "b"}) {
+		t.Fatalf("got %v", keys)
+	}
+	if keys := defKeySpec.keys(args); !reflect.DeepEqual(keys,
+		[]string{"a"}) {
+		t.Fatalf("got %v", keys)
+	}
+	if keys := (keySpec{}).keys(args); keys != nil {
+		t.Fatalf("got %v", keys)
+	}
+}
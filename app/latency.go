@@ -0,0 +1,417 @@
+package app
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// latencyBuckets is the number of histogram buckets. Bucket i counts the
+// durations of up to 2^i microseconds, and the last bucket also counts
+// everything that is longer.
+const latencyBuckets = 32
+
+// slowlogMaxArgs and slowlogMaxArgLen limit the size of a slow log entry.
+const (
+	slowlogMaxArgs   = 32
+	slowlogMaxArgLen = 128
+)
+
+type latencyHist [latencyBuckets]uint64
+
+func (h *latencyHist) add(d time.Duration) {
+	var i int
+	if us := d.Microseconds(); us > 1 {
+		i = bits.Len64(uint64(us - 1))
+	}
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	h[i]++
+}
+
+// resp returns the cumulative counts of the buckets, from the first bucket
+// that has a duration to the last, keyed by the bucket microseconds.
+func (h *latencyHist) resp() redisMap {
+	first, last := -1, -1
+	for i, n := range h {
+		if n > 0 {
+			if first == -1 {
+				first = i
+			}
+			last = i
+		}
+	}
+	resp := redisMap{}
+	if first == -1 {
+		return resp
+	}
+	var total uint64
+	for i := 0; i <= last; i++ {
+		total += h[i]
+		if i >= first {
+			resp = append(resp, redcon.SimpleInt(1<<i),
+				redcon.SimpleInt(total))
+		}
+	}
+	return resp
+}
+
+// cmdLatency are the latencies of a command. Writes are in the write queue,
+// then in the raft log until committed, and then are applied. Reads and
+// intermediate commands only have the apply time, which is the time to run
+// the command.
+type cmdLatency struct {
+	calls  uint64
+	total  latencyHist
+	queue  latencyHist
+	commit latencyHist
+	apply  latencyHist
+}
+
+type slowlogEntry struct {
+	id   int64
+	ts   time.Time
+	dur  time.Duration
+	args []string
+	addr string
+	name string
+}
+
+// latencyStats holds the command latencies and the slow log of this server.
+// It's shared by all raft groups of a server, and is not replicated.
+type latencyStats struct {
+	threshold int64 // slow log threshold, atomic time.Duration
+	maxLen    int32 // slow log max length, atomic
+	redact    func(args []string) []string
+
+	mu      sync.Mutex
+	cmds    map[string]*cmdLatency
+	slowlog []slowlogEntry // oldest first
+	nextID  int64
+}
+
+func newLatencyStats(conf Config) *latencyStats {
+	return &latencyStats{
+		threshold: int64(conf.SlowLogThreshold),
+		maxLen:    int32(conf.SlowLogMaxLen),
+		redact:    conf.AuditRedact,
+		cmds:      make(map[string]*cmdLatency),
+	}
+}
+
+// record adds the latencies of a command. The command is added to the slow
+// log when the total of the latencies reaches the threshold.
+func (ls *latencyStats) record(args []string, addr, client string, queue,
+	commit, apply time.Duration,
+) {
+	if len(args) == 0 {
+		return
+	}
+	name := strings.ToLower(args[0])
+	total := queue + commit + apply
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	cl := ls.cmds[name]
+	if cl == nil {
+		cl = new(cmdLatency)
+		ls.cmds[name] = cl
+	}
+	cl.calls++
+	cl.total.add(total)
+	cl.queue.add(queue)
+	cl.commit.add(commit)
+	cl.apply.add(apply)
+	threshold := time.Duration(atomic.LoadInt64(&ls.threshold))
+	maxLen := int(atomic.LoadInt32(&ls.maxLen))
+	if threshold < 0 || total < threshold || maxLen <= 0 {
+		return
+	}
+	args = redactArgs(args, aclRedactArgs)
+	if ls.redact != nil {
+		args = redactArgs(args, ls.redact)
+	}
+	ls.nextID++
+	ls.slowlog = append(ls.slowlog, slowlogEntry{
+		id:   ls.nextID - 1,
+		ts:   time.Now(),
+		dur:  total,
+		args: slowlogArgs(args),
+		addr: addr,
+		name: client,
+	})
+	ls.trim(maxLen)
+}
+
+// trim removes the oldest slow log entries.
+func (ls *latencyStats) trim(maxLen int) {
+	if len(ls.slowlog) > maxLen {
+		n := copy(ls.slowlog, ls.slowlog[len(ls.slowlog)-maxLen:])
+		for i := n; i < len(ls.slowlog); i++ {
+			ls.slowlog[i] = slowlogEntry{}
+		}
+		ls.slowlog = ls.slowlog[:n]
+	}
+}
+
+// slowlogArgs copies the args, truncating long args and long commands.
+func slowlogArgs(args []string) []string {
+	n := len(args)
+	if n > slowlogMaxArgs {
+		n = slowlogMaxArgs - 1
+	}
+	out := make([]string, 0, n+1)
+	for _, arg := range args[:n] {
+		if len(arg) > slowlogMaxArgLen {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen],
+				len(arg)-slowlogMaxArgLen)
+		}
+		out = append(out, arg)
+	}
+	if n < len(args) {
+		out = append(out, fmt.Sprintf("... (%d more arguments)",
+			len(args)-n))
+	}
+	return out
+}
+
+// recordWrites adds the latencies of the writes that were applied together
+// in a raft log entry, which started at start and took elapsed.
+func (ls *latencyStats) recordWrites(reqs []*writeRequestFuture,
+	res *applyResult, start time.Time, elapsed time.Duration,
+) {
+	// the commit time is the raft time that was not spent applying
+	commit := elapsed
+	for _, resp := range res.resps {
+		commit -= resp.elap
+	}
+	if commit < 0 {
+		commit = 0
+	}
+	for i, r := range reqs {
+		if len(r.args) == 0 || strings.ToLower(r.args[0]) == "tick" {
+			continue
+		}
+		var queue time.Duration
+		if !r.queued.IsZero() {
+			queue = start.Sub(r.queued)
+		}
+		ls.record(scriptEvalArgs(r.args), r.addr, r.name, queue, commit,
+			res.resps[i].elap)
+	}
+}
+
+func liveSlowLogThreshold(m *machine, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid value '%s'", value)
+	}
+	atomic.StoreInt64(&m.latency.threshold, int64(d))
+	return nil
+}
+
+func liveSlowLogMaxLen(m *machine, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid value '%s'", value)
+	}
+	atomic.StoreInt32(&m.latency.maxLen, int32(n))
+	m.latency.mu.Lock()
+	m.latency.trim(n)
+	m.latency.mu.Unlock()
+	return nil
+}
+
+// SLOWLOG subcommand args...
+// help: reads and resets the slow log of this server.
+func cmdSLOWLOG(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 2 {
+		return nil, errWrongNumArgsSlowlog
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		return cmdSLOWLOGHELP(um, ra, args)
+	case "get":
+		return cmdSLOWLOGGET(um, ra, args)
+	case "len":
+		return cmdSLOWLOGLEN(um, ra, args)
+	case "reset":
+		return cmdSLOWLOGRESET(um, ra, args)
+	default:
+		return nil, errUnknownSlowlogCommand(args[:2])
+	}
+}
+
+// SLOWLOG HELP
+// help: returns the valid SLOWLOG related commands; []string
+func cmdSLOWLOGHELP(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsSlowlog
+	}
+	lines := []redcon.SimpleString{
+		"SLOWLOG GET [count]",
+		"SLOWLOG LEN",
+		"SLOWLOG RESET",
+	}
+	return lines, nil
+}
+
+// SLOWLOG GET [count]
+// help: returns the newest entries, or all entries when the count is -1.
+//       Each entry is the id, unix time, microseconds, args, client address,
+//       and client name.
+func cmdSLOWLOGGET(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	count := 10
+	if len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < -1 {
+			return nil, errNotInteger
+		}
+		count = n
+	} else if len(args) != 2 {
+		return nil, errWrongNumArgsSlowlog
+	}
+	ls := getBaseMachine(um).latency
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if count == -1 || count > len(ls.slowlog) {
+		count = len(ls.slowlog)
+	}
+	resp := []interface{}{}
+	for i := len(ls.slowlog) - 1; i >= len(ls.slowlog)-count; i-- {
+		e := ls.slowlog[i]
+		resp = append(resp, []interface{}{
+			redcon.SimpleInt(e.id),
+			redcon.SimpleInt(e.ts.Unix()),
+			redcon.SimpleInt(e.dur.Microseconds()),
+			e.args,
+			e.addr,
+			e.name,
+		})
+	}
+	return resp, nil
+}
+
+// SLOWLOG LEN
+// help: returns the number of entries in the slow log.
+func cmdSLOWLOGLEN(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsSlowlog
+	}
+	ls := getBaseMachine(um).latency
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return redcon.SimpleInt(len(ls.slowlog)), nil
+}
+
+// SLOWLOG RESET
+// help: removes all entries from the slow log.
+func cmdSLOWLOGRESET(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsSlowlog
+	}
+	ls := getBaseMachine(um).latency
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.slowlog = nil
+	return redcon.SimpleString("OK"), nil
+}
+
+// LATENCY subcommand args...
+// help: returns the command latencies of this server.
+func cmdLATENCY(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 2 {
+		return nil, errWrongNumArgsLatency
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		return cmdLATENCYHELP(um, ra, args)
+	case "histogram":
+		return cmdLATENCYHISTOGRAM(um, ra, args)
+	case "reset":
+		return cmdLATENCYRESET(um, ra, args)
+	default:
+		return nil, errUnknownLatencyCommand(args[:2])
+	}
+}
+
+// LATENCY HELP
+// help: returns the valid LATENCY related commands; []string
+func cmdLATENCYHELP(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsLatency
+	}
+	lines := []redcon.SimpleString{
+		"LATENCY HISTOGRAM [command ...]",
+		"LATENCY RESET",
+	}
+	return lines, nil
+}
+
+// LATENCY HISTOGRAM [command ...]
+// help: returns the calls and latency histograms of the commands. The
+//       histogram_usec is the total latency, which is the sum of the
+//       queue_usec, commit_usec, and apply_usec latencies.
+func cmdLATENCYHISTOGRAM(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	ls := getBaseMachine(um).latency
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	names := args[2:]
+	if len(names) == 0 {
+		for name := range ls.cmds {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	resp := redisMap{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		cl := ls.cmds[name]
+		if cl == nil {
+			continue
+		}
+		resp = append(resp, name, redisMap{
+			"calls", redcon.SimpleInt(cl.calls),
+			"histogram_usec", cl.total.resp(),
+			"queue_usec", cl.queue.resp(),
+			"commit_usec", cl.commit.resp(),
+			"apply_usec", cl.apply.resp(),
+		})
+	}
+	return resp, nil
+}
+
+// LATENCY RESET
+// help: removes the latencies of all commands.
+func cmdLATENCYRESET(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsLatency
+	}
+	ls := getBaseMachine(um).latency
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.cmds = make(map[string]*cmdLatency)
+	return redcon.SimpleString("OK"), nil
+}
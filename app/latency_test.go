@@ -0,0 +1,110 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+func TestLatencyHist(t *testing.T) {
+	var h latencyHist
+	for _, d := range []time.Duration{0, time.Microsecond, 3 * time.Microsecond,
+		4 * time.Microsecond, 5 * time.Microsecond, time.Hour} {
+		h.add(d)
+	}
+	expect := redisMap{}
+	counts := map[int]int{1: 2, 2: 0, 4: 2, 8: 1}
+	var total int
+	for us := 1; us <= 8; us *= 2 {
+		total += counts[us]
+		expect = append(expect, redcon.SimpleInt(us), redcon.SimpleInt(total))
+	}
+	resp := h.resp()
+	if !reflect.DeepEqual(resp[:8], expect) {
+		t.Fatalf("expected %v, got %v", expect, resp[:8])
+	}
+	last := resp[len(resp)-2:]
+	if last[0] != redcon.SimpleInt(1<<(latencyBuckets-1)) ||
+		last[1] != redcon.SimpleInt(6) {
+		t.Fatalf("unexpected %v", last)
+	}
+}
+
+func TestSlowLog(t *testing.T) {
+	var conf Config
+	conf.def()
+	conf.SlowLogMaxLen = 2
+	conf.AuditRedact = func(args []string) []string {
+		if len(args) > 2 && args[0] == "auth" {
+			args[2] = "***"
+		}
+		return args
+	}
+	m := machineInit(conf, 0, "", nil)
+	ls := m.latency
+	ls.record([]string{"get", "a"}, "1.1.1.1:1", "", 0, 0, time.Millisecond)
+	ls.record([]string{"set", "a", "1"}, "1.1.1.1:1", "", 5*time.Millisecond,
+		4*time.Millisecond, 2*time.Millisecond)
+	ls.record([]string{"auth", "u", "secret"}, "1.1.1.1:2", "worker", 0, 0,
+		time.Second)
+	ls.record(append([]string{"mset"}, make([]string, 40)...), "", "", 0, 0,
+		time.Second)
+	resp, err := cmdSLOWLOG(m, nil, []string{"slowlog", "get", "-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := resp.([]interface{})
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	mset := entries[0].([]interface{})
+	auth := entries[1].([]interface{})
+	if mset[0] != redcon.SimpleInt(2) || auth[0] != redcon.SimpleInt(1) {
+		t.Fatalf("unexpected ids %v %v", mset[0], auth[0])
+	}
+	if !reflect.DeepEqual(auth[3], []string{"auth", aclRedacted, "***"}) {
+		t.Fatalf("unexpected %v", auth[3])
+	}
+	if auth[4] != "1.1.1.1:2" || auth[5] != "worker" || mset[5] != "" {
+		t.Fatalf("unexpected client %v %v %v", auth[4], auth[5], mset[5])
+	}
+	margs := mset[3].([]string)
+	if len(margs) != slowlogMaxArgs ||
+		!strings.HasPrefix(margs[slowlogMaxArgs-1], "... (10 more") {
+		t.Fatalf("unexpected %v", margs)
+	}
+	if _, err := cmdCONFIG(m, nil, []string{"config", "set",
+		"slowlog-max-len", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ = cmdSLOWLOG(m, nil, []string{"slowlog", "len"})
+	if resp != redcon.SimpleInt(1) {
+		t.Fatalf("expected 1, got %v", resp)
+	}
+	cmdSLOWLOG(m, nil, []string{"slowlog", "reset"})
+	resp, _ = cmdSLOWLOG(m, nil, []string{"slowlog", "len"})
+	if resp != redcon.SimpleInt(0) {
+		t.Fatalf("expected 0, got %v", resp)
+	}
+
+	resp, err = cmdLATENCY(m, nil, []string{"latency", "histogram", "set",
+		"nope"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hist := resp.(redisMap)
+	if len(hist) != 2 || hist[0] != "set" {
+		t.Fatalf("unexpected %v", hist)
+	}
+	set := hist[1].(redisMap)
+	if set[1] != redcon.SimpleInt(1) ||
+		!reflect.DeepEqual(set[3], redisMap{redcon.SimpleInt(16384),
+			redcon.SimpleInt(1)}) ||
+		!reflect.DeepEqual(set[5], redisMap{redcon.SimpleInt(8192),
+			redcon.SimpleInt(1)}) {
+		t.Fatalf("unexpected %v", set)
+	}
+}
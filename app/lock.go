@@ -0,0 +1,336 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// errLockNotHeld is returned when renewing a lock that the owner does not
+// hold, such as when the lease has already expired.
+var errLockNotHeld = errors.New("NOTHELD the lock is not held by the owner")
+
+// lease is a held lock. The token is the raft index of the entry that
+// acquired the lock, which is always increasing and can be used as a
+// fencing token by the owner.
+type lease struct {
+	Name    string `json:"name"`
+	Owner   string `json:"owner"`
+	Token   uint64 `json:"token"`
+	Expires int64  `json:"expires"` // machine timestamp
+}
+
+// lockTable is the replicated set of held locks. It's only altered from
+// inside of the Apply function and is persisted in snapshots.
+type lockTable struct {
+	locks   map[string]*lease
+	waiters map[string]chan struct{} // closed when the named lock is freed
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{
+		locks:   make(map[string]*lease),
+		waiters: make(map[string]chan struct{}),
+	}
+}
+
+// wait returns a channel that is closed when the named lock is freed.
+func (t *lockTable) wait(name string) <-chan struct{} {
+	ch := t.waiters[name]
+	if ch == nil {
+		ch = make(chan struct{})
+		t.waiters[name] = ch
+	}
+	return ch
+}
+
+// wakeAll wakes the waiters of every lock.
+func (t *lockTable) wakeAll() {
+	for name, ch := range t.waiters {
+		close(ch)
+		delete(t.waiters, name)
+	}
+}
+
+// get returns the lock when it's held at the machine timestamp.
+func (t *lockTable) get(name string, ts int64) *lease {
+	l := t.locks[name]
+	if l == nil || l.Expires <= ts {
+		return nil
+	}
+	return l
+}
+
+func (t *lockTable) free(name string) {
+	delete(t.locks, name)
+	if ch := t.waiters[name]; ch != nil {
+		close(ch)
+		delete(t.waiters, name)
+	}
+}
+
+// expire frees the locks that have expired at the machine timestamp.
+func (t *lockTable) expire(ts int64) {
+	for name, l := range t.locks {
+		if l.Expires <= ts {
+			t.free(name)
+		}
+	}
+}
+
+func (t *lockTable) encode() ([]byte, error) {
+	locks := make([]*lease, 0, len(t.locks))
+	for _, l := range t.locks {
+		locks = append(locks, l)
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Name < locks[j].Name
+	})
+	return json.Marshal(locks)
+}
+
+func decodeLockTable(data []byte) (*lockTable, error) {
+	t := newLockTable()
+	if len(data) == 0 {
+		return t, nil
+	}
+	var locks []*lease
+	if err := json.Unmarshal(data, &locks); err != nil {
+		return nil, err
+	}
+	for _, l := range locks {
+		t.locks[l.Name] = l
+	}
+	return t, nil
+}
+
+func parseLockTTL(arg string) (time.Duration, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("invalid ttl")
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+// LOCK subcommand args...
+// help: manages the replicated locks.
+func cmdLOCK(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 2 {
+		return nil, errWrongNumArgsLock
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		return cmdLOCKHELP(um, ra, args)
+	case "acquire":
+		return cmdLOCKACQUIRE(um, ra, args)
+	case "renew":
+		return cmdLOCKRENEW(um, ra, args)
+	case "release":
+		return cmdLOCKRELEASE(um, ra, args)
+	case "info":
+		return cmdLOCKINFO(um, ra, args)
+	default:
+		return nil, errUnknownLockCommand(args[:2])
+	}
+}
+
+// LOCK HELP
+// help: returns the valid LOCK related commands; []string
+func cmdLOCKHELP(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsLock
+	}
+	lines := []redcon.SimpleString{
+		"LOCK ACQUIRE name owner ttl [WAIT timeout]",
+		"LOCK RENEW name owner ttl",
+		"LOCK RELEASE name owner",
+		"LOCK INFO name",
+	}
+	return lines, nil
+}
+
+// LOCK ACQUIRE name owner ttl [WAIT timeout]
+// help: acquires the lock for the owner, which expires after ttl
+//       milliseconds of machine time. Returns the fencing token, or nil when
+//       the lock is held by another owner. Acquiring a lock that the owner
+//       already holds extends the lease and returns the same token. With
+//       WAIT the connection blocks until the lock is acquired or the timeout
+//       in milliseconds elapses. A zero timeout waits forever.
+func cmdLOCKACQUIRE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 5 && len(args) != 7 {
+		return nil, errWrongNumArgsLock
+	}
+	if _, err := parseLockTTL(args[4]); err != nil {
+		return nil, err
+	}
+	m := getBaseMachine(um)
+	wargs := []string{"lockwrite", "acquire", args[2], args[3], args[4]}
+	if len(args) == 5 {
+		return m.writeInternal(wargs, sendOpts(um))
+	}
+	if strings.ToLower(args[5]) != "wait" {
+		return nil, ErrSyntax
+	}
+	timeout, err := strconv.ParseInt(args[6], 10, 64)
+	if err != nil || timeout < 0 {
+		return nil, errors.New("invalid timeout")
+	}
+	w := &lockWaiter{m: m, ra: ra, name: args[2], args: wargs,
+		opts:    sendOpts(um),
+		timeout: time.Duration(timeout) * time.Millisecond}
+	return redisBlock(w.wait), nil
+}
+
+// LOCK RENEW name owner ttl
+// help: extends the lease of a lock held by the owner to ttl milliseconds
+//       from now. Returns the fencing token, or a NOTHELD error when the
+//       owner does not hold the lock.
+func cmdLOCKRENEW(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 5 {
+		return nil, errWrongNumArgsLock
+	}
+	if _, err := parseLockTTL(args[4]); err != nil {
+		return nil, err
+	}
+	wargs := []string{"lockwrite", "renew", args[2], args[3], args[4]}
+	return getBaseMachine(um).writeInternal(wargs, sendOpts(um))
+}
+
+// LOCK RELEASE name owner
+// help: releases a lock held by the owner; returns 1 if released, otherwise
+//       0.
+func cmdLOCKRELEASE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 4 {
+		return nil, errWrongNumArgsLock
+	}
+	wargs := []string{"lockwrite", "release", args[2], args[3]}
+	return getBaseMachine(um).writeInternal(wargs, sendOpts(um))
+}
+
+// LOCK INFO name
+// help: returns the owner, token, and expiration of a held lock as
+//       field-value pairs, or nil when the lock is not held.
+func cmdLOCKINFO(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumArgsLock
+	}
+	m := getBaseMachine(um)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	l := m.locks.get(args[2], m.ts)
+	if l == nil {
+		return nil, nil
+	}
+	return []interface{}{
+		"owner", l.Owner,
+		"token", redcon.SimpleInt(l.Token),
+		"expires", time.Unix(0, l.Expires).UTC().Format(time.RFC3339Nano),
+	}, nil
+}
+
+// LOCKWRITE acquire name owner ttl
+// LOCKWRITE renew name owner ttl
+// LOCKWRITE release name owner
+// help: applies a lock change. It's not possible to directly call this from
+//       a client service. It can only be called by its own internal server
+//       instance.
+func cmdLOCKWRITE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 4 {
+		return nil, ErrWrongNumArgs
+	}
+	name, owner := args[2], args[3]
+	l := m.locks.get(name, m.ts)
+	switch args[1] {
+	case "acquire", "renew":
+		if len(args) != 5 {
+			return nil, ErrWrongNumArgs
+		}
+		ttl, err := parseLockTTL(args[4])
+		if err != nil {
+			return nil, err
+		}
+		if l == nil || l.Owner != owner {
+			if args[1] == "renew" {
+				return nil, errLockNotHeld
+			}
+			if l != nil {
+				// held by another owner
+				return nil, nil
+			}
+			l = &lease{Name: name, Owner: owner, Token: m.index}
+			m.locks.locks[name] = l
+		}
+		l.Expires = m.ts + int64(ttl)
+		return redcon.SimpleInt(l.Token), nil
+	case "release":
+		if len(args) != 4 {
+			return nil, ErrWrongNumArgs
+		}
+		if l == nil || l.Owner != owner {
+			return redcon.SimpleInt(0), nil
+		}
+		m.locks.free(name)
+		return redcon.SimpleInt(1), nil
+	}
+	return nil, ErrSyntax
+}
+
+// lockWaiter is a blocking acquire. It retries the acquire every time the
+// lock is freed, until the lock is acquired or the timeout elapses.
+type lockWaiter struct {
+	m       *machine
+	ra      *raftWrap
+	name    string
+	args    []string
+	opts    *SendOptions // client of the acquire
+	timeout time.Duration
+}
+
+// wait blocks the client connection until the acquire completes. The done
+// channel is closed when the client goes away.
+func (w *lockWaiter) wait(done <-chan struct{}) (interface{}, error) {
+	var deadline <-chan time.Time
+	if w.timeout > 0 {
+		tmr := time.NewTimer(w.timeout)
+		defer tmr.Stop()
+		deadline = tmr.C
+	}
+	for {
+		w.m.mu.Lock()
+		notify := w.m.locks.wait(w.name)
+		w.m.mu.Unlock()
+		resp, err := w.m.writeInternal(w.args, w.opts)
+		if err != nil {
+			return nil, errRaftConvert(w.ra, err)
+		}
+		if resp != nil {
+			return resp, nil
+		}
+		select {
+		case <-notify:
+		case <-deadline:
+			return nil, nil
+		case <-done:
+			return nil, errors.New("connection closed")
+		}
+	}
+}
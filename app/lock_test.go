@@ -0,0 +1,81 @@
+package app
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+func TestLockLease(t *testing.T) {
+	m := machineInit(Config{}, 0, "", nil)
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	tick := func(d time.Duration) {
+		ts += int64(d)
+		m.index++
+		_, err := cmdTICK(m, nil, []string{"tick",
+			strconv.FormatInt(ts, 10), strconv.FormatUint(m.index, 10)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(args ...string) (interface{}, error) {
+		m.index++
+		return cmdLOCKWRITE(m, nil, append([]string{"lockwrite"}, args...))
+	}
+	tick(0)
+	resp, err := write("acquire", "job", "a", "1000")
+	if err != nil || resp != redcon.SimpleInt(m.index) {
+		t.Fatalf("unexpected %v %v", resp, err)
+	}
+	token := resp
+	if resp, _ := write("acquire", "job", "b", "1000"); resp != nil {
+		t.Fatalf("expected nil, got %v", resp)
+	}
+	if resp, _ := write("acquire", "job", "a", "1000"); resp != token {
+		t.Fatalf("expected %v, got %v", token, resp)
+	}
+	if _, err := write("renew", "job", "b", "1000"); err != errLockNotHeld {
+		t.Fatalf("expected %v, got %v", errLockNotHeld, err)
+	}
+	notify, other := m.locks.wait("job"), m.locks.wait("other")
+	tick(time.Second)
+	select {
+	case <-notify:
+	default:
+		t.Fatal("expected notify")
+	}
+	select {
+	case <-other:
+		t.Fatal("unexpected notify for another lock")
+	default:
+	}
+	if len(m.locks.locks) != 0 {
+		t.Fatal("expected expired lock")
+	}
+	if _, err := write("renew", "job", "a", "1000"); err != errLockNotHeld {
+		t.Fatalf("expected %v, got %v", errLockNotHeld, err)
+	}
+	resp, _ = write("acquire", "job", "b", "1000")
+	if resp.(redcon.SimpleInt) <= token.(redcon.SimpleInt) {
+		t.Fatalf("expected token greater than %v, got %v", token, resp)
+	}
+	data, err := m.locks.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt, err := decodeLockTable(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := lt.get("job", ts); l == nil || l.Owner != "b" {
+		t.Fatalf("unexpected %v", l)
+	}
+	if resp, _ := write("release", "job", "a"); resp != redcon.SimpleInt(0) {
+		t.Fatalf("expected 0, got %v", resp)
+	}
+	if resp, _ := write("release", "job", "b"); resp != redcon.SimpleInt(1) {
+		t.Fatalf("expected 1, got %v", resp)
+	}
+}
@@ -10,20 +10,8 @@ import (
 )
 
 func logInit(conf Config) hclog.Logger {
-	level := hclog.Error
-	switch conf.LogLevel {
-	case "debug":
-		level = hclog.Debug
-	case "verbose", "verb":
-		level = hclog.Trace
-	case "notice", "info":
-		level = hclog.Info
-	case "warning", "warn":
-		level = hclog.Warn
-	case "quiet", "silent":
-		level = hclog.NoLevel
-		//wr = ioutil.Discard
-	default:
+	level, ok := parseLogLevel(conf.LogLevel)
+	if !ok {
 		fmt.Fprintf(os.Stderr, "invalid -loglevel: %s\n", conf.LogLevel)
 		os.Exit(1)
 	}
@@ -0,0 +1,387 @@
+package app
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const logToolUsage = `Usage: {{NAME}} log command [options]
+
+Inspects the raft log of a stopped server.
+
+Commands:
+  list             : show the first and last index, and the ranges of
+                     entries grouped by term.
+  dump             : print the entries as readable commands.
+  stable           : show the stable store keys.
+  verify           : check that the indexes are continuous and the terms
+                     never decrease.
+  replay           : apply the log onto a new machine up to an index,
+                     starting from the latest snapshot prior to the index.
+
+Options:
+  -d dir           : data directory  (default: data)
+  -n id            : node ID  (default: 1)
+  -g group         : raft group  (default: 0)
+  --from index     : first index for dump  (default: first index)
+  --to index       : last index for dump and replay  (default: last index)
+  --out path       : write the replayed machine to a snapshot file, which
+                     can be used with --restore.
+  -v               : print the responses of the replayed commands.
+  --encrypt-key path : key file of a server that encrypts at rest.
+  --config path    : load the settings from the config file of the server.
+  --nosync         : the --nosync of the server.
+  --log-sync mode  : the --log-sync of the server.
+  --stable-sync mode : the --stable-sync of the server.
+  --log-geometry g : the --log-geometry of the server.
+  --stable-geometry g : the --stable-geometry of the server.
+
+The store settings are loaded from the config file and the environment
+variables, like the server.
+`
+
+// LogTool runs the offline raft log inspection tool with the args, such as
+// "list" or "dump --from 10". The server must not be running. Main runs the
+// tool when the first argument is "log", while applications with custom
+// flags may call it directly.
+func LogTool(conf Config, args []string) error {
+	return logTool(conf, args, os.Stdout)
+}
+
+func logTool(conf Config, args []string, w io.Writer) error {
+	conf.def()
+	conf.jsonInit()
+	usage := strings.Replace(logToolUsage, "{{NAME}}", conf.Name, -1)
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" ||
+		args[0] == "--help" {
+		fmt.Fprint(w, usage)
+		return nil
+	}
+	cmd := args[0]
+	// The store is opened with the same settings as the server, which are
+	// from the Config, the config file, the environment, and the flags.
+	cpath := configPath(args[1:])
+	if _, err := loadSettings(&conf, cpath, os.Environ()); err != nil {
+		return err
+	}
+	storeSettings := map[string]*string{"log-sync": nil, "stable-sync": nil,
+		"log-geometry": nil, "stable-geometry": nil}
+	var group int
+	var from, to uint64
+	var out string
+	var verbose bool
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&conf.DataDir, "d", conf.DataDir, "")
+	fs.StringVar(&conf.NodeID, "n", conf.NodeID, "")
+	fs.IntVar(&group, "g", 0, "")
+	fs.Uint64Var(&from, "from", 0, "")
+	fs.Uint64Var(&to, "to", 0, "")
+	fs.StringVar(&out, "out", "", "")
+	fs.BoolVar(&verbose, "v", false, "")
+	fs.StringVar(&conf.EncryptKeyPath, "encrypt-key", conf.EncryptKeyPath, "")
+	fs.StringVar(&cpath, "config", cpath, "")
+	fs.BoolVar(&conf.NoSync, "nosync", conf.NoSync, "")
+	for name := range storeSettings {
+		storeSettings[name] = fs.String(name, findSetting(name).getValue(&conf),
+			"")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	for name, value := range storeSettings {
+		if err := findSetting(name).setValue(&conf, *value); err != nil {
+			return fmt.Errorf("invalid --%s: %v", name, err)
+		}
+	}
+	var err error
+	if conf.keys, err = confKeyRing(conf); err != nil {
+		return err
+	}
+	dir := filepath.Join(conf.DataDir, conf.Name, conf.NodeID)
+	if group > 0 {
+		dir = filepath.Join(dir, fmt.Sprintf("group-%d", group))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "log")); err != nil {
+		return fmt.Errorf("no raft log found in %s", dir)
+	}
+	store, err := OpenStoreOptions(dir, StoreOptions{
+		LogFlags: storeFlags(DefaultLogFlags, conf.LogSync,
+			conf.NoSync),
+		StableFlags: storeFlags(DefaultStableFlags, conf.StableSync,
+			conf.NoSync),
+		LogGeometry:    conf.LogGeometry.geometry(DefaultLogGeometry),
+		StableGeometry: conf.StableGeometry.geometry(DefaultStableGeometry),
+		Mode:           0755,
+		Keys:           conf.keys,
+	})
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	first, _ := store.FirstIndex()
+	last, _ := store.LastIndex()
+	if from == 0 || from < first {
+		from = first
+	}
+	if to == 0 || to > last {
+		to = last
+	}
+	switch cmd {
+	case "list":
+		return logToolList(w, store, first, last)
+	case "dump":
+		return logToolDump(w, store, from, to)
+	case "stable":
+		return logToolStable(w, store)
+	case "verify":
+		return logToolVerify(w, store, first, last)
+	case "replay":
+		return logToolReplay(w, conf, group, dir, store, to, out, verbose)
+	}
+	return fmt.Errorf("unknown log command '%s', try '%s log help'",
+		cmd, conf.Name)
+}
+
+func logToolList(w io.Writer, store *Store, first, last uint64) error {
+	fmt.Fprintf(w, "first index: %d\n", first)
+	fmt.Fprintf(w, "last index:  %d\n", last)
+	if last == 0 {
+		return nil
+	}
+	var start, term uint64
+	flush := func(end uint64) {
+		if start != 0 {
+			fmt.Fprintf(w, "term %d: %d-%d (%d entries)\n", term, start,
+				end, end-start+1)
+		}
+	}
+	for index := first; index <= last; index++ {
+		var l raft.Log
+		if err := store.GetLog(index, &l); err != nil {
+			flush(index - 1)
+			fmt.Fprintf(w, "missing: %d\n", index)
+			start = 0
+			continue
+		}
+		if start == 0 || l.Term != term {
+			flush(index - 1)
+			start, term = index, l.Term
+		}
+	}
+	flush(last)
+	return nil
+}
+
+func logToolDump(w io.Writer, store *Store, from, to uint64) error {
+	for index := from; index <= to && index != 0; index++ {
+		var l raft.Log
+		if err := store.GetLog(index, &l); err != nil {
+			return fmt.Errorf("index %d: %w", index, err)
+		}
+		fmt.Fprintf(w, "%d %d %s", l.Index, l.Term, l.Type)
+		if !l.AppendedAt.IsZero() {
+			fmt.Fprintf(w, " %s", l.AppendedAt.UTC().Format(time.RFC3339Nano))
+		}
+		fmt.Fprintln(w)
+		switch l.Type {
+		case raft.LogCommand:
+			cmds, err := decodeBatch(l.Data)
+			if err != nil {
+				fmt.Fprintf(w, "  invalid batch: %v\n", err)
+				continue
+			}
+			for _, c := range cmds {
+				fmt.Fprint(w, " ")
+				if c.clientID != "" {
+					fmt.Fprintf(w, " [%s %d]", c.clientID, c.seq)
+				}
+				for _, arg := range c.args {
+					fmt.Fprintf(w, " %s", quoteArg(arg))
+				}
+				fmt.Fprintln(w)
+			}
+		case raft.LogConfiguration:
+			cfg := raft.DecodeConfiguration(l.Data)
+			for _, s := range cfg.Servers {
+				fmt.Fprintf(w, "  %s %s %s\n", s.ID, s.Address, s.Suffrage)
+			}
+		}
+	}
+	return nil
+}
+
+// quoteArg quotes the arg when it's empty or has spaces or non-printable
+// characters.
+func quoteArg(arg string) string {
+	q := strconv.Quote(arg)
+	if arg == "" || q[1:len(q)-1] != arg || strings.ContainsAny(arg, " \"") {
+		return q
+	}
+	return arg
+}
+
+func logToolStable(w io.Writer, store *Store) error {
+	for _, key := range []string{keyCurrentTerm, keyLastVoteTerm} {
+		n, err := store.GetUint64([]byte(key))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: %d\n", key, n)
+	}
+	cand, err := store.Get([]byte(keyLastVoteCand))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: %s\n", keyLastVoteCand, cand)
+	return nil
+}
+
+func logToolVerify(w io.Writer, store *Store, first, last uint64) error {
+	var problems int
+	var term uint64
+	for index := first; index <= last && index != 0; index++ {
+		var l raft.Log
+		if err := store.GetLog(index, &l); err != nil {
+			fmt.Fprintf(w, "index %d: %v\n", index, err)
+			problems++
+			continue
+		}
+		if l.Index != index {
+			fmt.Fprintf(w, "index %d: entry has index %d\n", index, l.Index)
+			problems++
+		}
+		if l.Term < term {
+			fmt.Fprintf(w, "index %d: term %d is less than %d\n", index,
+				l.Term, term)
+			problems++
+		}
+		term = l.Term
+		if l.Type == raft.LogCommand {
+			if _, err := decodeBatch(l.Data); err != nil {
+				fmt.Fprintf(w, "index %d: %v\n", index, err)
+				problems++
+			}
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problems found", problems)
+	}
+	var count uint64
+	if last > 0 {
+		count = last - first + 1
+	}
+	fmt.Fprintf(w, "ok: %d entries\n", count)
+	return nil
+}
+
+func logToolReplay(w io.Writer, conf Config, group int, dir string,
+	store *Store, to uint64, out string, verbose bool,
+) error {
+	m := machineInit(conf, group, dir, nil)
+	snaps, err := raft.NewFileSnapshotStore(dir, conf.SnapshotRetain,
+		ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	m.snaps = snaps
+	metas, err := snaps.List()
+	if err != nil {
+		return err
+	}
+	var applied uint64
+	for _, meta := range metas {
+		// newest first
+		if meta.Index > to {
+			continue
+		}
+		_, rc, err := snaps.Open(meta.ID)
+		if err != nil {
+			return err
+		}
+		err = m.Restore(rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", meta.ID, err)
+		}
+		fmt.Fprintf(w, "restored snapshot %s\n", meta.ID)
+		applied = meta.Index
+		m.appliedIndex = applied
+		break
+	}
+	first, _ := store.FirstIndex()
+	if applied+1 < first {
+		return errors.New("log was compacted and there is no snapshot " +
+			"prior to the index")
+	}
+	for index := applied + 1; index <= to; index++ {
+		var l raft.Log
+		if err := store.GetLog(index, &l); err != nil {
+			return fmt.Errorf("index %d: %w", index, err)
+		}
+		if l.Type != raft.LogCommand {
+			continue
+		}
+		res := m.Apply(&l).(*applyResult)
+		if !verbose {
+			continue
+		}
+		cmds, _ := decodeBatch(l.Data)
+		for i, c := range cmds {
+			if len(c.args) == 0 || c.args[0] == "tick" {
+				continue
+			}
+			resp := res.resps[i]
+			fmt.Fprintf(w, "%d", index)
+			for _, arg := range c.args {
+				fmt.Fprintf(w, " %s", quoteArg(arg))
+			}
+			fmt.Fprint(w, " -> ")
+			if resp.err != nil {
+				fmt.Fprintf(w, "(error) %v\n", resp.err)
+			} else {
+				fmt.Fprintf(w, "%v\n", auditValue(resp.resp))
+			}
+		}
+	}
+	fmt.Fprintf(w, "applied index: %d\n", m.appliedIndex)
+	fmt.Fprintf(w, "machine time:  %s\n",
+		time.Unix(0, m.ts).UTC().Format(time.RFC3339Nano))
+	if out == "" {
+		return nil
+	}
+	snap, err := m.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := snap.Persist(&fileSink{File: f}); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "snapshot written: %s\n", out)
+	return f.Sync()
+}
+
+// fileSink is a raft.SnapshotSink that writes to a file.
+type fileSink struct {
+	*os.File
+}
+
+func (s *fileSink) ID() string    { return "replay" }
+func (s *fileSink) Cancel() error { return nil }
+func (s *fileSink) Close() error  { return nil }
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestLogTool(t *testing.T) {
+	var conf Config
+	conf.Name = "test"
+	conf.DataDir = t.TempDir()
+	conf.InitialData = new(int)
+	conf.UseJSONSnapshots = true
+	conf.AddWriteCommand("incr", func(m Machine, args []string,
+	) (interface{}, error) {
+		n := m.Data().(*int)
+		*n++
+		return *n, nil
+	})
+	dir := filepath.Join(conf.DataDir, conf.Name, "1")
+	store, err := OpenStore(dir, DefaultLogFlags, DefaultStableFlags, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs []*raft.Log
+	for i := 1; i <= 4; i++ {
+		reqs := []*writeRequestFuture{{args: []string{"tick",
+			strconv.Itoa(i * 1000), strconv.Itoa(i)}}}
+		if i > 1 {
+			reqs = append(reqs, &writeRequestFuture{
+				args: []string{"incr", "a b"}, clientID: "c", seq: uint64(i)})
+		}
+		logs = append(logs, &raft.Log{Index: uint64(i), Term: 1 + uint64(i/3),
+			Type: raft.LogCommand, Data: encodeBatch(reqs)})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUint64([]byte(keyCurrentTerm), 2); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	run := func(args ...string) string {
+		var buf bytes.Buffer
+		if err := logTool(conf, args, &buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	expect := func(out string, lines ...string) {
+		for _, line := range lines {
+			if !strings.Contains(out, line) {
+				t.Fatalf("expected %q in:\n%s", line, out)
+			}
+		}
+	}
+	expect(run("list"), "first index: 1", "term 1: 1-2 (2 entries)",
+		"term 2: 3-4 (2 entries)")
+	expect(run("dump", "--from", "2", "--to", "2"), "2 1 LogCommand",
+		"  tick 2000 2", `  [c 2] incr "a b"`)
+	expect(run("stable"), "CurrentTerm: 2")
+	expect(run("verify"), "ok: 4 entries")
+	out := filepath.Join(t.TempDir(), "snap")
+	expect(run("replay", "--to", "3", "-v", "--out", out),
+		`3 incr "a b" -> 2`, "applied index: 3")
+	if _, err := os.Stat(out); err != nil {
+		t.Fatal(err)
+	}
+
+	// the store settings of the server are used
+	expect(run("list", "--log-geometry", "upper=64MB", "--log-sync",
+		"durable"), "first index: 1")
+	if err := logTool(conf, []string{"list", "--log-sync", "x"},
+		&bytes.Buffer{}); err == nil {
+		t.Fatal("expected error")
+	}
+	t.Setenv("APP_STABLE_GEOMETRY", "upper=x")
+	if err := logTool(conf, []string{"list"}, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -1,10 +1,10 @@
 package app
 
 import (
+	"crypto/x509"
 	"encoding/binary"
-	"errors"
 	"fmt"
-	"github.com/golang/snappy"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 	"github.com/moontrade/server/logger"
 	"io"
@@ -15,38 +15,117 @@ import (
 	"time"
 )
 
-func machineInit(conf Config, dir string, rdata *restoreData) *machine {
+func machineInit(conf Config, group int, dir string, rdata *restoreData,
+) *machine {
 	m := new(machine)
+	m.group = group
+	m.numGroups = conf.Groups
+	if m.numGroups < 1 {
+		m.numGroups = 1
+	}
 	m.dir = dir
 	m.vers = versline(conf)
 	m.tickedSig = sync.NewCond(&m.mu)
 	m.created = time.Now().UnixNano()
-	m.wrC = make(chan *writeRequestFuture, 1024)
+	m.wrC = make(chan *writeRequestFuture, conf.WriteQueueSize)
+	m.conf = conf
 	m.tickDelay = conf.TickDelay
-	m.openReads = conf.OpenReads
+	if conf.OpenReads {
+		m.openReads = 1
+	}
+	m.acl = newACLTable()
+	m.sessions = newSessionTable()
+	m.keys = new(keyVersions)
+	m.slots = newSlotTable(m.group, m.numGroups)
+	m.schedule = newScheduleTable()
+	m.locks = newLockTable()
+	m.tracking = newTrackingTable()
+	m.latency = newLatencyStats(conf)
+	m.clients = newClientTable()
+	m.mon = newMonitor()
+	m.plugins = newPluginTable(newPluginRuntime())
+	m.scripts = newScriptTable()
+	m.pubsubRetain = conf.PubSubRetain
+	m.pubsub = newPubsubLog(m.pubsubRetain)
+	m.sessionTimeout = conf.SessionTimeout
 	if rdata != nil {
 		m.data = rdata.data
 		m.start = rdata.start
 		m.seed = rdata.seed
 		m.ts = rdata.ts
+		if err := m.restoreSections(rdata.sections); err != nil {
+			logger.Fatal(err)
+		}
+	} else if conf.GroupData != nil {
+		m.data = conf.GroupData(group)
 	} else {
 		m.data = conf.InitialData
 	}
 
 	m.connClosed = conf.ConnClosed
 	m.connOpened = conf.ConnOpened
+	m.connOpenedUser = conf.ConnOpenedUser
+	m.tlsUser = conf.TLSUser
 	m.snapshot = conf.Snapshot
 	m.restore = conf.Restore
 	m.jsonSnaps = conf.jsonSnaps
 	m.jsonType = conf.jsonType
 	m.tick = conf.Tick
+	if group == 0 {
+		// the snapshot events are for the first group only
+		m.onSnapTaken = conf.OnSnapshotTaken
+		m.onRestore = conf.OnRestore
+	}
 	m.commands = map[string]command{
-		"tick":    {'w', cmdTICK},
-		"barrier": {'w', cmdBARRIER},
-		"raft":    {'s', cmdRAFT},
-		"cluster": {'s', cmdCLUSTER},
-		"machine": {'r', cmdMACHINE},
-		"version": {'s', cmdVERSION},
+		"tick":          {'w', cmdTICK},
+		"barrier":       {'w', cmdBARRIER},
+		"raft":          {'s', cmdRAFT},
+		"cluster":       {'s', cmdCLUSTER},
+		"machine":       {'r', cmdMACHINE},
+		"version":       {'s', cmdVERSION},
+		"acl":           {'s', cmdACL},
+		"aclwrite":      {'w', cmdACLWRITE},
+		"txn":           {'w', cmdTXN},
+		"publish":       {'w', cmdPUBLISH},
+		"subscribe":     {'s', cmdSUBSCRIBE},
+		"psubscribe":    {'s', cmdPSUBSCRIBE},
+		"group":         {'s', cmdGROUP},
+		"slotmigrate":   {'w', cmdSLOTMIGRATE},
+		"slotimport":    {'w', cmdSLOTIMPORT},
+		"slotdrop":      {'w', cmdSLOTDROP},
+		"schedule":      {'s', cmdSCHEDULE},
+		"schedulewrite": {'w', cmdSCHEDULEWRITE},
+		"lock":          {'s', cmdLOCK},
+		"lockwrite":     {'w', cmdLOCKWRITE},
+		"config":        {'s', cmdCONFIG},
+		"plugin":        {'s', cmdPLUGIN},
+		"pluginwrite":   {'w', cmdPLUGINWRITE},
+		"eval":          {'w', cmdEVAL},
+		"evalsha":       {'w', cmdEVALSHA},
+		"script":        {'s', cmdSCRIPT},
+		"scriptwrite":   {'w', cmdSCRIPTWRITE},
+		"command":       {'s', cmdCOMMAND},
+		"slowlog":       {'s', cmdSLOWLOG},
+		"latency":       {'s', cmdLATENCY},
+		"client":        {'s', cmdCLIENT},
+	}
+	if conf.DebugFault {
+		m.commands["debug"] = command{'s', cmdDEBUG}
+	}
+	m.keySpecs = make(map[string]keySpec)
+	for name, cmd := range m.commands {
+		if cmd.kind == 'w' {
+			// builtin write commands do not have keys
+			m.keySpecs[name] = keySpec{}
+		}
+	}
+	// the keys of a script follow the number of keys
+	m.keySpecs["eval"] = keySpec{count: 2}
+	m.keySpecs["evalsha"] = keySpec{count: 2}
+	for k, v := range conf.keySpecs {
+		if _, ok := m.keySpecs[k]; !ok {
+			m.keySpecs[k] = v
+		}
 	}
 	if conf.TryErrors {
 		delete(m.commands, "cluster")
@@ -99,40 +178,76 @@ type Machine interface {
 	// Config.ConnOpened callback. Only available for Intermediate commands.
 	// Returns nil for Read and Write Commands.
 	Context() interface{}
+	// Notify publishes a message to the subscribers of a channel on every
+	// server, along with the raft index of the write. The message is only
+	// published after the write command succeeds, and is dropped when the
+	// command returns an error. Subscribers can resume from an index using
+	// SUBSCRIBE FROM. Only available for Write commands.
+	Notify(channel, message string)
 }
 
 type machine struct {
-	snapshot   func(data interface{}) (Snapshot, error)
-	restore    func(rd io.Reader) (data interface{}, err error)
-	connOpened func(addr string) (context interface{}, accept bool)
-	connClosed func(context interface{}, addr string)
-	jsonSnaps  bool               //
-	jsonType   reflect.Type       //
-	snaps      raft.SnapshotStore //
-	dir        string             //
-	vers       string             // version line
-	tick       func(m Machine)    //
-	created    int64              // machine instance created timestamp
-	commands   map[string]command // command table
-	catchall   command            // catchall command
-	openReads  bool               // open reads on by default
-	tickDelay  time.Duration      // ticker delay
+	snapshot       func(data interface{}) (Snapshot, error)
+	restore        func(rd io.Reader) (data interface{}, err error)
+	connOpened     func(addr string) (context interface{}, accept bool)
+	connClosed     func(context interface{}, addr string)
+	connOpenedUser func(addr, user string) (context interface{}, accept bool)
+	tlsUser        func(cert *x509.Certificate) string
+	onSnapTaken    func(meta SnapshotMeta)
+	onRestore      func(meta SnapshotMeta)
+	jsonSnaps      bool               //
+	jsonType       reflect.Type       //
+	snaps          raft.SnapshotStore //
+	dir            string             //
+	vers           string             // version line
+	tick           func(m Machine)    //
+	created        int64              // machine instance created timestamp
+	commands       map[string]command // command table
+	catchall       command            // catchall command
+	keySpecs       map[string]keySpec // command key positions
+	openReads      int32              // open reads on by default (atomic)
+	tickDelay      time.Duration      // ticker delay (atomic)
+	conf           Config             // settings, changed by CONFIG SET
+	hclogger       hclog.Logger       // raft logger
+	sessionTimeout time.Duration      // client session expiration, from tick
+	pubsubRetain   int                // number of published messages kept
+	group          int                // index of the raft group
+	numGroups      int                // number of raft groups
+	groups         []*raftGroup       // all raft groups in this server
 
-	mu           sync.RWMutex // protect all things in group
-	firstIndex   uint64       // first applied index
-	appliedIndex uint64       // last applied index (stable state)
-	readers      int32        // (atomic counter) number of current readers
-	tickedIndex  uint64       // index of last tick
-	tickedTerm   uint64       // term of last tick
-	tickedSig    *sync.Cond   // signal when ticked
-	logPercent   float64      // percentage of log loaded
-	logRemain    uint64       // non-applied log entries
-	logLoaded    int32        // (atomic bool) log is loaded, allow open reads
-	snap         bool         // snapshot in progress
-	start        int64        // !! PERSISTED !! first non-zero timestamp
-	ts           int64        // !! PERSISTED !! current timestamp
-	seed         int64        // !! PERSISTED !! current seed
-	data         interface{}  // !! PERSISTED !! user data
+	mu           sync.RWMutex   // protect all things in group
+	firstIndex   uint64         // first applied index
+	appliedIndex uint64         // last applied index (stable state)
+	readers      int32          // (atomic counter) number of current readers
+	tickedIndex  uint64         // index of last tick
+	tickedTerm   uint64         // term of last tick
+	tickedSig    *sync.Cond     // signal when ticked
+	logPercent   float64        // percentage of log loaded
+	logRemain    uint64         // non-applied log entries
+	logLoaded    int32          // (atomic bool) log is loaded, allow open reads
+	snap         bool           // snapshot in progress
+	start        int64          // !! PERSISTED !! first non-zero timestamp
+	ts           int64          // !! PERSISTED !! current timestamp
+	seed         int64          // !! PERSISTED !! current seed
+	data         interface{}    // !! PERSISTED !! user data
+	acl          *aclTable      // !! PERSISTED !! users and permissions
+	sessions     *sessionTable  // !! PERSISTED !! client sessions
+	keys         *keyVersions   // !! PERSISTED !! last write index per slot
+	pubsub       *pubsubLog     // !! PERSISTED !! published messages
+	slots        *slotTable     // !! PERSISTED !! hash slots of the group
+	schedule     *scheduleTable // !! PERSISTED !! scheduled jobs
+	locks        *lockTable     // !! PERSISTED !! held locks
+	plugins      *pluginTable   // !! PERSISTED !! loaded wasm modules
+	scripts      *scriptTable   // !! PERSISTED !! loaded lua scripts
+	index        uint64         // index of the log entry being applied
+	tracking     *trackingTable // client-side caching connections
+	latency      *latencyStats  // command latencies and slow log
+	clients      *clientTable   // client connection registry
+	mon          *monitor       // command observers
+	faults       *faultTable    // injected faults, nil when off
+	touched      []string       // keys written by the entry being applied
+	applying     bool           // an entry is being applied
+	savepoint    bool           // a transaction holds a data Savepoint
 
 	wrC chan *writeRequestFuture
 }
@@ -145,72 +260,101 @@ type applyResp struct {
 	err  error
 }
 
+// applyResult is returned by Apply for every log entry.
+type applyResult struct {
+	resps []applyResp
+	index uint64
+	term  uint64
+	ts    int64 // machine timestamp prior to applying the entry
+}
+
 func (m *machine) Context() interface{} {
 	return nil
 }
 
 func (m *machine) Apply(l *raft.Log) interface{} {
-	packet, err := snappy.Decode(nil, l.Data)
+	cmds, err := decodeBatch(l.Data)
 	if err != nil {
 		logger.Panic(err)
 	}
 	m.mu.Lock()
+	m.index = l.Index
+	m.applying = true
 	defer func() {
 		m.appliedIndex = l.Index
 		if m.firstIndex == 0 {
 			m.firstIndex = m.appliedIndex
 		}
+		m.tracking.invalidate(m.touched)
+		m.touched = nil
+		m.pubsub.flush()
+		m.applying = false
 		m.mu.Unlock()
 	}()
-	numReqs, n := binary.Uvarint(packet)
-	if n <= 0 {
-		logger.Panic(errors.New("invalid apply"))
-	}
-	packet = packet[n:]
-	resps := make([]applyResp, numReqs)
-	for i := 0; i < int(numReqs); i++ {
-		numArgs, n := binary.Uvarint(packet)
-		if n <= 0 {
-			logger.Panic(errors.New("invalid apply"))
-		}
-		packet = packet[n:]
-		args := make([]string, numArgs)
-		for i := 0; i < len(args); i++ {
-			argLen, n := binary.Uvarint(packet)
-			if n <= 0 {
-				logger.Panic(errors.New("invalid apply"))
-			}
-			packet = packet[n:]
-			args[i] = string(packet[:argLen])
-			packet = packet[argLen:]
-		}
+	ts := m.ts
+	resps := make([]applyResp, len(cmds))
+	for i, c := range cmds {
+		args := c.args
 		if len(args) == 0 {
 			resps[i] = applyResp{nil, 0, nil}
-		} else {
-			cmdName := strings.ToLower(string(args[0]))
-			cmd := m.commands[cmdName]
-			if cmd.kind != 'w' {
-				logger.Panic(fmt.Errorf("invalid apply '%c', command: '%s'",
-					cmd.kind, cmdName))
-			}
-			tick := cmdName == "tick"
-			if m.start == 0 && !tick {
-				// This is in fact the leader, but because the machine has yet
-				// to receive a valid tick command, we'll treat this as if the
-				// server *is not* the leader.
-				resps[i] = applyResp{nil, 0, raft.ErrNotLeader}
-			} else {
-				start := time.Now()
-				res, err := cmd.fn(m, nil, args)
-				if tick {
-					// return only the index and term
-					res = raft.Log{Index: l.Index, Term: l.Term}
-				}
-				resps[i] = applyResp{res, time.Since(start), err}
+			continue
+		}
+		cmdName := strings.ToLower(string(args[0]))
+		cmd, ok := m.command(cmdName)
+		if !ok {
+			// a plugin command that was unloaded after it was proposed
+			resps[i] = applyResp{nil, 0, ErrUnknownCommand}
+			continue
+		}
+		if cmd.kind != 'w' {
+			logger.Panic(fmt.Errorf("invalid apply '%c', command: '%s'",
+				cmd.kind, cmdName))
+		}
+		tick := cmdName == "tick"
+		if m.start == 0 && !tick {
+			// This is in fact the leader, but because the machine has yet
+			// to receive a valid tick command, we'll treat this as if the
+			// server *is not* the leader.
+			resps[i] = applyResp{nil, 0, raft.ErrNotLeader}
+			continue
+		}
+		if c.clientID != "" {
+			if resp, dup := m.sessions.lookup(c.clientID, c.seq); dup {
+				// Duplicate request from a client retry. Return the
+				// original response without applying the command again.
+				resps[i] = resp
+				continue
 			}
 		}
+		keys := m.commandKeys(cmdName, args)
+		if err := m.slots.check(keys); err != nil {
+			// The slot belongs to another group. Not stored in the client
+			// session, allowing for the client to retry.
+			resps[i] = applyResp{nil, 0, err}
+			continue
+		}
+		m.touchKeys(keys, l.Index)
+		notes := len(m.pubsub.pending)
+		start := time.Now()
+		res, err := cmd.fn(m, nil, args)
+		if err != nil {
+			// drop the notifications of the failed command
+			m.pubsub.pending = m.pubsub.pending[:notes]
+		}
+		if tick {
+			// return only the index and term
+			res = raft.Log{Index: l.Index, Term: l.Term}
+		}
+		resps[i] = applyResp{res, time.Since(start), err}
+		if c.clientID != "" {
+			m.sessions.store(c.clientID, c.seq, m.ts, resps[i])
+		}
+		if !tick && !internalCommands[cmdName] {
+			m.mon.sendApplied(Message{Args: args, Resp: res, Err: err,
+				Elapsed: resps[i].elap, Index: l.Index})
+		}
 	}
-	return resps
+	return &applyResult{resps: resps, index: l.Index, term: l.Term, ts: ts}
 }
 
 func (m *machine) Data() interface{} {
@@ -271,12 +415,57 @@ func (m *machine) Now() time.Time {
 	return time.Unix(0, ts).UTC()
 }
 
+// writeInternal sends a write command that was generated by the server
+// itself through the raft log and waits for the response. The opts are the
+// client that the write is made for, which is recorded by the audit log, or
+// nil when the write is made by the server alone.
+func (m *machine) writeInternal(args []string, opts *SendOptions,
+) (interface{}, error) {
+	if opts == nil {
+		opts = defSendOpts
+	}
+	req := &writeRequestFuture{args: args, queued: time.Now(),
+		addr: opts.Addr, user: opts.User, context: opts.Context}
+	req.wg.Add(1)
+	m.wrC <- req
+	req.wg.Wait()
+	return req.resp, req.err
+}
+
+// internalCommands can only be called by the server itself, and never
+// directly by a service client.
+var internalCommands = map[string]bool{
+	"tick":          true,
+	"aclwrite":      true,
+	"txn":           true,
+	"slotmigrate":   true,
+	"slotimport":    true,
+	"slotdrop":      true,
+	"schedulewrite": true,
+	"lockwrite":     true,
+	"pluginwrite":   true,
+	"scriptwrite":   true,
+}
+
 // intermediateMachine wraps the machine in a connection context
 type intermediateMachine struct {
 	context interface{}
+	user    string
+	addr    string // client address
+	conn    uint64 // client connection id
 	m       *machine
 }
 
+// sendOpts returns the client of a system command, for the internal writes
+// that are made by the command.
+func sendOpts(um Machine) *SendOptions {
+	if im, ok := um.(intermediateMachine); ok {
+		return &SendOptions{Context: im.context, User: im.user,
+			Addr: im.addr, ConnID: im.conn}
+	}
+	return defSendOpts
+}
+
 var _ Machine = intermediateMachine{}
 
 func (m intermediateMachine) Now() time.Time       { return time.Time{} }
@@ -284,6 +473,8 @@ func (m intermediateMachine) Context() interface{} { return m.context }
 func (m intermediateMachine) Rand() Rand           { return nil }
 func (m intermediateMachine) Data() interface{}    { return nil }
 
+func (m intermediateMachine) Notify(channel, message string) {}
+
 func getBaseMachine(m Machine) *machine {
 	switch m := m.(type) {
 	case intermediateMachine:
@@ -1,6 +1,13 @@
 package app
 
-import "sync"
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/match"
+)
 
 // An Observer holds a channel that delivers the messages for all commands
 // processed by a Service.
@@ -9,8 +16,30 @@ type Observer interface {
 	C() <-chan Message
 }
 
+// ObserverOptions are the server-side filters of an observer. A message is
+// delivered only when it passes all of the filters.
+type ObserverOptions struct {
+	// Pattern is a glob pattern that the command name must match.
+	Pattern string
+	// Addr is a glob pattern that the client address must match, such as
+	// "10.0.0.1:*".
+	Addr string
+	// ErrOnly delivers only the commands that returned an error.
+	ErrOnly bool
+	// MinElapsed is the minimum time that the command took to process.
+	MinElapsed time.Duration
+	// Applied delivers the writes that are applied by the state machine of
+	// this server, including the writes that are replicated from the
+	// leader, instead of the commands that are received by the services.
+	// The applied messages do not have an Addr. The messages are dropped
+	// when the observer falls behind, which keeps a slow observer from
+	// holding up the state machine.
+	Applied bool
+}
+
 type observer struct {
 	mon  *monitor
+	opts ObserverOptions
 	msgC chan Message
 }
 
@@ -24,9 +53,31 @@ func (o *observer) Stop() {
 	if _, ok := o.mon.obs[o]; ok {
 		delete(o.mon.obs, o)
 		close(o.msgC)
+		if o.opts.Applied {
+			atomic.AddInt32(&o.mon.napplied, -1)
+		} else {
+			atomic.AddInt32(&o.mon.nrecv, -1)
+		}
 	}
 }
 
+func (o *observer) match(msg Message) bool {
+	if o.opts.ErrOnly && msg.Err == nil {
+		return false
+	}
+	if msg.Elapsed < o.opts.MinElapsed {
+		return false
+	}
+	if o.opts.Pattern != "" && (len(msg.Args) == 0 ||
+		!match.Match(strings.ToLower(msg.Args[0]), o.opts.Pattern)) {
+		return false
+	}
+	if o.opts.Addr != "" && !match.Match(msg.Addr, o.opts.Addr) {
+		return false
+	}
+	return true
+}
+
 // Monitor represents an interface for sending and consuming command
 // messages that are processed by a Service.
 type Monitor interface {
@@ -36,42 +87,86 @@ type Monitor interface {
 	// messages for every command processed by the service.
 	// Stop the observer to release associated resources.
 	NewObserver() Observer
+	// NewFilteredObserver is like NewObserver, but the messages are
+	// filtered by the server using the options.
+	NewFilteredObserver(opts ObserverOptions) Observer
 }
 
+// monitor is shared by the services of all raft groups.
 type monitor struct {
-	s    *service
-	obMu sync.Mutex
-	obs  map[*observer]struct{}
+	nrecv    int32 // (atomic) number of observers of received commands
+	napplied int32 // (atomic) number of observers of applied writes
+	obMu     sync.Mutex
+	obs      map[*observer]struct{}
 }
 
-func newMonitor(s *service) *monitor {
-	m := &monitor{s: s}
+func newMonitor() *monitor {
+	m := &monitor{}
 	m.obs = make(map[*observer]struct{})
 	return m
 }
 
-func (m *monitor) Send(msg Message) {
+// monitorHidden returns true for the system commands that can not be
+// monitored.
+func monitorHidden(msg Message) bool {
 	if len(msg.Args) > 0 {
-		// do not allow monitoring of certain system commands
 		switch msg.Args[0] {
-		case "raft", "machine", "auth", "cluster":
-			return
+		case "raft", "machine", "auth", "cluster", "group":
+			return true
+		}
+	}
+	return false
+}
+
+func (m *monitor) Send(msg Message) {
+	if atomic.LoadInt32(&m.nrecv) == 0 || monitorHidden(msg) {
+		return
+	}
+	msg.Args = aclRedactArgs(msg.Args)
+	m.obMu.Lock()
+	defer m.obMu.Unlock()
+	for o := range m.obs {
+		if !o.opts.Applied && o.match(msg) {
+			o.msgC <- msg
 		}
 	}
+}
 
+// sendApplied sends a write that was applied by the state machine.
+func (m *monitor) sendApplied(msg Message) {
+	if atomic.LoadInt32(&m.napplied) == 0 || monitorHidden(msg) {
+		return
+	}
+	msg.Args = aclRedactArgs(msg.Args)
 	m.obMu.Lock()
 	defer m.obMu.Unlock()
 	for o := range m.obs {
-		o.msgC <- msg
+		if o.opts.Applied && o.match(msg) {
+			select {
+			case o.msgC <- msg:
+			default:
+			}
+		}
 	}
 }
 
 func (m *monitor) NewObserver() Observer {
+	return m.NewFilteredObserver(ObserverOptions{})
+}
+
+func (m *monitor) NewFilteredObserver(opts ObserverOptions) Observer {
 	o := new(observer)
 	o.mon = m
+	o.opts = opts
+	o.opts.Pattern = strings.ToLower(opts.Pattern)
 	o.msgC = make(chan Message, 64)
 	m.obMu.Lock()
 	m.obs[o] = struct{}{}
+	if opts.Applied {
+		atomic.AddInt32(&m.napplied, 1)
+	} else {
+		atomic.AddInt32(&m.nrecv, 1)
+	}
 	m.obMu.Unlock()
 	return o
 }
@@ -0,0 +1,64 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMonitorFilters(t *testing.T) {
+	mon := newMonitor()
+	all := mon.NewObserver()
+	sets := mon.NewFilteredObserver(ObserverOptions{Pattern: "S*",
+		Addr: "10.0.0.1:*"})
+	slow := mon.NewFilteredObserver(ObserverOptions{ErrOnly: true,
+		MinElapsed: time.Millisecond})
+	applied := mon.NewFilteredObserver(ObserverOptions{Applied: true})
+	msgs := []Message{
+		{Args: []string{"set", "a"}, Addr: "10.0.0.1:100"},
+		{Args: []string{"SET", "b"}, Addr: "10.0.0.2:100"},
+		{Args: []string{"get", "a"}, Addr: "10.0.0.1:100",
+			Err: errors.New("x"), Elapsed: time.Second},
+		{Args: []string{"auth", "pass"}, Addr: "10.0.0.1:100"},
+	}
+	for _, msg := range msgs {
+		mon.Send(msg)
+	}
+	expect := func(o Observer, args ...string) {
+		t.Helper()
+		for _, arg := range args {
+			select {
+			case msg := <-o.C():
+				if msg.Args[1] != arg {
+					t.Fatalf("expected %s, got %v", arg, msg.Args)
+				}
+			default:
+				t.Fatalf("expected %s, got nothing", arg)
+			}
+		}
+		select {
+		case msg := <-o.C():
+			t.Fatalf("unexpected %v", msg.Args)
+		default:
+		}
+	}
+	expect(all, "a", "b", "a")
+	expect(sets, "a")
+	expect(slow, "a")
+	expect(applied)
+
+	// applied writes are dropped when the observer falls behind
+	for i := 0; i < 100; i++ {
+		mon.sendApplied(Message{Args: []string{"set", "c"}, Index: 1})
+	}
+	if len(applied.C()) != cap(applied.C()) || len(all.C()) != 0 {
+		t.Fatalf("unexpected %d %d", len(applied.C()), len(all.C()))
+	}
+	applied.Stop()
+	all.Stop()
+	sets.Stop()
+	slow.Stop()
+	if mon.nrecv != 0 || mon.napplied != 0 {
+		t.Fatalf("unexpected %d %d", mon.nrecv, mon.napplied)
+	}
+}
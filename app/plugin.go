@@ -0,0 +1,668 @@
+package app
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tidwall/redcon"
+)
+
+// PluginData is implemented by the machine data for allowing plugins to
+// access keys. Plugins that use the key-value host functions fail when the
+// data does not implement this interface.
+type PluginData interface {
+	Get(key string) (value string, ok bool)
+	Set(key, value string)
+	Delete(key string) (deleted bool)
+}
+
+var errPluginData = errors.New("machine data does not implement PluginData")
+
+var errPluginReadOnly = errors.New("plugin read commands can not alter data")
+
+// pluginMemoryPages is the most memory that a plugin instance can use, which
+// is 16 MB.
+const pluginMemoryPages = 256
+
+// pluginModule is a loaded WebAssembly module. A module adds a write command
+// for every exported "write_name" function and a read command for every
+// exported "read_name" function. The module must also export its "memory"
+// and an "alloc" function.
+//
+// A command function is called with a pointer and length of the args, which
+// are a little-endian uint32 count followed by each arg as a uint32 length
+// and its bytes. The function returns the pointer and length of the
+// response, packed as (ptr << 32 | len), where the response is RESP. Every
+// call runs in a new instance of the module, making the commands stateless.
+// The first arg after the command name is the key, which is used for routing
+// and WATCH. A call has a fixed amount of fuel, which is used by function
+// calls, loop iterations, and host calls. A call that runs out of fuel fails
+// with an error on every server, keeping the log deterministic.
+//
+// The host functions imported from the "env" module are:
+//
+//	get(key, keylen, dst, dstcap i32) i32 : copies the value into dst and
+//	                                        returns its length, or -1 when
+//	                                        the key does not exist.
+//	set(key, keylen, val, vallen i32)     : sets the value of a key.
+//	del(key, keylen i32) i32              : deletes a key and returns 1, or
+//	                                        0 when it did not exist.
+//	now() i64                             : the machine time in nanoseconds.
+//	rand() i64                            : a deterministic random number.
+type pluginModule struct {
+	Name string `json:"name"`
+	Code []byte `json:"code"`
+
+	compiled wazero.CompiledModule
+	cmds     map[string]byte // command names and their kind, 'w' or 'r'
+}
+
+// pluginTable holds the loaded modules. It's only altered from inside of the
+// Apply function and the modules are persisted in snapshots. The compiled
+// modules are local to each server.
+type pluginTable struct {
+	rt   wazero.Runtime
+	mods map[string]*pluginModule
+	cmds map[string]*pluginModule // command name to module
+}
+
+type pluginCallKey struct{}
+
+// pluginCall is the machine that a plugin function is called on, which is
+// provided to the host functions.
+type pluginCall struct {
+	m     *machine
+	write bool
+}
+
+func newPluginRuntime() wazero.Runtime {
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx,
+		wazero.NewRuntimeConfig().WithMemoryLimitPages(pluginMemoryPages))
+	_, err := rt.NewHostModuleBuilder("env").
+		NewFunctionBuilder().WithFunc(pluginGet).Export("get").
+		NewFunctionBuilder().WithFunc(pluginSet).Export("set").
+		NewFunctionBuilder().WithFunc(pluginDel).Export("del").
+		NewFunctionBuilder().WithFunc(pluginNow).Export("now").
+		NewFunctionBuilder().WithFunc(pluginRand).Export("rand").
+		Instantiate(ctx)
+	if err != nil {
+		panic(err)
+	}
+	return rt
+}
+
+func newPluginTable(rt wazero.Runtime) *pluginTable {
+	return &pluginTable{
+		rt:   rt,
+		mods: make(map[string]*pluginModule),
+		cmds: make(map[string]*pluginModule),
+	}
+}
+
+// compilePlugin compiles the code and checks that the module is usable.
+func compilePlugin(rt wazero.Runtime, name string, code []byte,
+) (*pluginModule, error) {
+	ctx := context.Background()
+	metered, err := meterPlugin(code)
+	if err != nil {
+		return nil, fmt.Errorf("plugin '%s': %v", name, err)
+	}
+	compiled, err := rt.CompileModule(ctx, metered)
+	if err != nil {
+		return nil, fmt.Errorf("plugin '%s': %v", name, err)
+	}
+	p := &pluginModule{Name: name, Code: code, compiled: compiled,
+		cmds: make(map[string]byte)}
+	fail := func(format string, args ...interface{}) (*pluginModule, error) {
+		compiled.Close(ctx)
+		return nil, fmt.Errorf("plugin '%s': "+format,
+			append([]interface{}{name}, args...)...)
+	}
+	for _, def := range compiled.ImportedFunctions() {
+		mod, fn, _ := def.Import()
+		if mod != "env" {
+			return fail("imports from unknown module '%s'", mod)
+		}
+		switch fn {
+		case "get", "set", "del", "now", "rand":
+		default:
+			return fail("imports unknown function '%s'", fn)
+		}
+	}
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		return fail("does not export memory")
+	}
+	fns := compiled.ExportedFunctions()
+	if !pluginSig(fns["alloc"], []api.ValueType{api.ValueTypeI32},
+		[]api.ValueType{api.ValueTypeI32}) {
+		return fail("does not export alloc(i32) i32")
+	}
+	for fn, def := range fns {
+		var kind byte
+		var cmd string
+		if strings.HasPrefix(fn, "write_") {
+			kind, cmd = 'w', fn[6:]
+		} else if strings.HasPrefix(fn, "read_") {
+			kind, cmd = 'r', fn[5:]
+		} else {
+			continue
+		}
+		if cmd == "" || cmd != strings.ToLower(cmd) {
+			return fail("invalid command function '%s'", fn)
+		}
+		if !pluginSig(def,
+			[]api.ValueType{api.ValueTypeI32, api.ValueTypeI32},
+			[]api.ValueType{api.ValueTypeI64}) {
+			return fail("command function '%s' must be (i32, i32) i64", fn)
+		}
+		if _, ok := p.cmds[cmd]; ok {
+			return fail("command '%s' is exported twice", cmd)
+		}
+		p.cmds[cmd] = kind
+	}
+	if len(p.cmds) == 0 {
+		return fail("does not export any commands")
+	}
+	return p, nil
+}
+
+func pluginSig(def api.FunctionDefinition, params, results []api.ValueType,
+) bool {
+	if def == nil {
+		return false
+	}
+	return string(def.ParamTypes()) == string(params) &&
+		string(def.ResultTypes()) == string(results)
+}
+
+// command returns the plugin command.
+func (t *pluginTable) command(name string) (command, bool) {
+	p := t.cmds[name]
+	if p == nil {
+		return command{}, false
+	}
+	kind := p.cmds[name]
+	return command{kind, func(um Machine, ra *raftWrap, args []string,
+	) (interface{}, error) {
+		m := getBaseMachine(um)
+		if m == nil {
+			return nil, ErrInvalid
+		}
+		return p.call(t.rt, m, kind, args)
+	}}, true
+}
+
+// add adds the module, replacing an existing module with the same name.
+// Returns an error when a command is already defined.
+func (t *pluginTable) add(p *pluginModule, builtin map[string]command,
+) error {
+	if err := t.check(p, builtin); err != nil {
+		return err
+	}
+	t.remove(p.Name)
+	t.mods[p.Name] = p
+	for cmd := range p.cmds {
+		t.cmds[cmd] = p
+	}
+	return nil
+}
+
+// check returns an error when a command of the module is already defined by
+// another module or is a builtin command.
+func (t *pluginTable) check(p *pluginModule, builtin map[string]command,
+) error {
+	for cmd := range p.cmds {
+		if _, ok := builtin[cmd]; ok {
+			return fmt.Errorf("plugin '%s': command '%s' already exists",
+				p.Name, cmd)
+		}
+		if other := t.cmds[cmd]; other != nil && other.Name != p.Name {
+			return fmt.Errorf("plugin '%s': command '%s' already exists "+
+				"in plugin '%s'", p.Name, cmd, other.Name)
+		}
+	}
+	return nil
+}
+
+func (t *pluginTable) remove(name string) bool {
+	p := t.mods[name]
+	if p == nil {
+		return false
+	}
+	for cmd := range p.cmds {
+		delete(t.cmds, cmd)
+	}
+	delete(t.mods, name)
+	// The compiled code is not closed because it may be in use by a read.
+	return true
+}
+
+func (t *pluginTable) encode() ([]byte, error) {
+	mods := make([]*pluginModule, 0, len(t.mods))
+	for _, p := range t.mods {
+		mods = append(mods, p)
+	}
+	sort.Slice(mods, func(i, j int) bool {
+		return mods[i].Name < mods[j].Name
+	})
+	return json.Marshal(mods)
+}
+
+func decodePluginTable(data []byte, rt wazero.Runtime) (*pluginTable, error) {
+	t := newPluginTable(rt)
+	if len(data) == 0 {
+		return t, nil
+	}
+	var mods []*pluginModule
+	if err := json.Unmarshal(data, &mods); err != nil {
+		return nil, err
+	}
+	for _, m := range mods {
+		p, err := compilePlugin(rt, m.Name, m.Code)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.add(p, nil); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// call runs a command function in a new instance of the module.
+func (p *pluginModule) call(rt wazero.Runtime, m *machine, kind byte,
+	args []string,
+) (interface{}, error) {
+	ctx := context.WithValue(context.Background(), pluginCallKey{},
+		&pluginCall{m: m, write: kind == 'w'})
+	mod, err := rt.InstantiateModule(ctx, p.compiled,
+		wazero.NewModuleConfig().WithName("").WithStartFunctions())
+	if err != nil {
+		return nil, fmt.Errorf("plugin '%s': %v", p.Name, err)
+	}
+	defer mod.Close(ctx)
+	resp, err := p.run(ctx, mod, kind, args)
+	if err != nil {
+		fuel := mod.ExportedGlobal(pluginFuelExport)
+		if fuel != nil && int64(fuel.Get()) < 0 {
+			err = errPluginFuel
+		}
+		return nil, fmt.Errorf("plugin '%s': %v", p.Name, err)
+	}
+	return pluginValue(resp)
+}
+
+// run calls the command function on the instance and returns its response.
+func (p *pluginModule) run(ctx context.Context, mod api.Module, kind byte,
+	args []string,
+) (redcon.RESP, error) {
+	// the start function is called here for it to be charged fuel
+	if fn := mod.ExportedFunction("_initialize"); fn != nil {
+		if _, err := fn.Call(ctx); err != nil {
+			return redcon.RESP{}, err
+		}
+	}
+	var in []byte
+	in = binary.LittleEndian.AppendUint32(in, uint32(len(args)))
+	for _, arg := range args {
+		in = binary.LittleEndian.AppendUint32(in, uint32(len(arg)))
+		in = append(in, arg...)
+	}
+	res, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return redcon.RESP{}, err
+	}
+	ptr := uint32(res[0])
+	if !mod.Memory().Write(ptr, in) {
+		return redcon.RESP{}, errors.New("alloc out of range")
+	}
+	fn := "write_"
+	if kind == 'r' {
+		fn = "read_"
+	}
+	res, err = mod.ExportedFunction(fn+strings.ToLower(args[0])).
+		Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return redcon.RESP{}, err
+	}
+	out, ok := mod.Memory().Read(uint32(res[0]>>32), uint32(res[0]))
+	if !ok {
+		return redcon.RESP{}, errors.New("response out of range")
+	}
+	n, resp := redcon.ReadNextRESP(out)
+	if n == 0 {
+		return redcon.RESP{}, errors.New("invalid response")
+	}
+	return resp, nil
+}
+
+// pluginValue converts the RESP response of a plugin into a command
+// response.
+func pluginValue(resp redcon.RESP) (interface{}, error) {
+	switch resp.Type {
+	case redcon.String:
+		return redcon.SimpleString(resp.Data), nil
+	case redcon.Error:
+		return nil, errors.New(string(resp.Data))
+	case redcon.Integer:
+		n, _ := strconv.ParseInt(string(resp.Data), 10, 64)
+		return redcon.SimpleInt(n), nil
+	case redcon.Bulk:
+		if resp.Data == nil {
+			return nil, nil
+		}
+		return string(resp.Data), nil
+	case redcon.Array:
+		if resp.Count < 0 {
+			return nil, nil
+		}
+		vals := make([]interface{}, 0, resp.Count)
+		data := resp.Data
+		for i := 0; i < resp.Count; i++ {
+			n, item := redcon.ReadNextRESP(data)
+			data = data[n:]
+			v, err := pluginValue(item)
+			if err != nil {
+				v = err
+			}
+			vals = append(vals, v)
+		}
+		return vals, nil
+	}
+	return nil, errors.New("invalid response")
+}
+
+// pluginHostCall uses the fuel of a host call and returns the call.
+func pluginHostCall(ctx context.Context, mod api.Module) *pluginCall {
+	fuel := mod.ExportedGlobal(pluginFuelExport).(api.MutableGlobal)
+	n := int64(fuel.Get()) - pluginHostFuel
+	fuel.Set(uint64(n))
+	if n < 0 {
+		panic(errPluginFuel)
+	}
+	return ctx.Value(pluginCallKey{}).(*pluginCall)
+}
+
+func pluginCallData(ctx context.Context, mod api.Module, write bool,
+) (*pluginCall, PluginData) {
+	call := pluginHostCall(ctx, mod)
+	if write && !call.write {
+		panic(errPluginReadOnly)
+	}
+	data, ok := call.m.data.(PluginData)
+	if !ok {
+		panic(errPluginData)
+	}
+	return call, data
+}
+
+func pluginRead(mod api.Module, ptr, n uint32) string {
+	b, ok := mod.Memory().Read(ptr, n)
+	if !ok {
+		panic(errors.New("memory out of range"))
+	}
+	return string(b)
+}
+
+func pluginGet(ctx context.Context, mod api.Module, key, keylen, dst,
+	dstcap uint32,
+) int32 {
+	_, data := pluginCallData(ctx, mod, false)
+	value, ok := data.Get(pluginRead(mod, key, keylen))
+	if !ok {
+		return -1
+	}
+	if len(value) <= int(dstcap) {
+		if !mod.Memory().WriteString(dst, value) {
+			panic(errors.New("memory out of range"))
+		}
+	}
+	return int32(len(value))
+}
+
+func pluginSet(ctx context.Context, mod api.Module, key, keylen, val,
+	vallen uint32,
+) {
+	_, data := pluginCallData(ctx, mod, true)
+	data.Set(pluginRead(mod, key, keylen), pluginRead(mod, val, vallen))
+}
+
+func pluginDel(ctx context.Context, mod api.Module, key, keylen uint32,
+) int32 {
+	_, data := pluginCallData(ctx, mod, true)
+	if data.Delete(pluginRead(mod, key, keylen)) {
+		return 1
+	}
+	return 0
+}
+
+func pluginNow(ctx context.Context, mod api.Module) int64 {
+	return pluginHostCall(ctx, mod).m.ts
+}
+
+func pluginRand(ctx context.Context, mod api.Module) int64 {
+	return int64(pluginHostCall(ctx, mod).m.Uint64())
+}
+
+// command returns a builtin, user, or plugin command. The caller must hold
+// the machine lock.
+func (m *machine) command(name string) (command, bool) {
+	if cmd, ok := m.commands[name]; ok {
+		return cmd, true
+	}
+	return m.plugins.command(name)
+}
+
+// lookupCommand is like command, but for callers that do not hold the
+// machine lock.
+func (m *machine) lookupCommand(name string) (command, bool) {
+	if cmd, ok := m.commands[name]; ok {
+		return cmd, true
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.plugins.command(name)
+}
+
+// PLUGIN subcommand args...
+// help: manages the WebAssembly command plugins.
+func cmdPLUGIN(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 2 {
+		return nil, errWrongNumArgsPlugin
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		return cmdPLUGINHELP(um, ra, args)
+	case "load":
+		return cmdPLUGINLOAD(um, ra, args)
+	case "unload":
+		return cmdPLUGINUNLOAD(um, ra, args)
+	case "list":
+		return cmdPLUGINLIST(um, ra, args)
+	default:
+		return nil, errUnknownPluginCommand(args[:2])
+	}
+}
+
+// PLUGIN HELP
+// help: returns the valid PLUGIN related commands; []string
+func cmdPLUGINHELP(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsPlugin
+	}
+	lines := []redcon.SimpleString{
+		"PLUGIN LOAD name wasm",
+		"PLUGIN UNLOAD name",
+		"PLUGIN LIST",
+	}
+	return lines, nil
+}
+
+// PLUGIN LOAD name wasm
+// help: loads a WebAssembly module, which adds its commands to all servers.
+//       A module with the same name is replaced. Returns a TRYAGAIN error
+//       when it was not loaded by every group.
+func cmdPLUGINLOAD(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 4 {
+		return nil, errWrongNumArgsPlugin
+	}
+	m := getBaseMachine(um)
+	// check the module and its commands in every group prior to replicating
+	// it, so that it's not loaded by only some of the groups
+	p, err := compilePlugin(m.plugins.rt, args[2], []byte(args[3]))
+	if err != nil {
+		return nil, err
+	}
+	p.compiled.Close(context.Background())
+	for _, g := range m.raftGroups(ra) {
+		g.m.mu.RLock()
+		err := g.m.plugins.check(p, g.m.commands)
+		g.m.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m.writeAllGroups([]string{"pluginwrite", "load", args[2], args[3]},
+		sendOpts(um))
+}
+
+// PLUGIN UNLOAD name
+// help: unloads a module and removes its commands; returns 1 if unloaded,
+//       otherwise 0. Returns a TRYAGAIN error when it was not unloaded by
+//       every group.
+func cmdPLUGINUNLOAD(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumArgsPlugin
+	}
+	m := getBaseMachine(um)
+	return m.writeAllGroups([]string{"pluginwrite", "unload", args[2]},
+		sendOpts(um))
+}
+
+// writeAllGroups writes the internal command to every raft group, for
+// changes that must be seen by the commands of all groups. The response is
+// from the group of the machine. The groups can not be written atomically,
+// so the command is written to the other groups when one fails, and a
+// TRYAGAIN error lists the failed groups. The command must be safe to
+// write again. The opts are passed to writeInternal.
+func (m *machine) writeAllGroups(args []string, opts *SendOptions,
+) (interface{}, error) {
+	if len(m.groups) == 0 {
+		return m.writeInternal(args, opts)
+	}
+	var resp interface{}
+	var failed []string
+	var ferr error
+	for _, g := range m.groups {
+		gresp, err := g.m.writeInternal(args, opts)
+		if err != nil {
+			failed = append(failed, strconv.Itoa(g.id))
+			if ferr == nil {
+				ferr = err
+			}
+			continue
+		}
+		if g.m == m {
+			resp = gresp
+		}
+	}
+	if len(failed) == len(m.groups) {
+		return nil, ferr
+	}
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("TRYAGAIN not applied to groups %s: %v",
+			strings.Join(failed, ","), ferr)
+	}
+	return resp, nil
+}
+
+// PLUGIN LIST
+// help: returns the name, SHA-1 digest, and commands of every module.
+func cmdPLUGINLIST(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsPlugin
+	}
+	m := getBaseMachine(um)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := make([]string, 0, len(m.plugins.mods))
+	for name := range m.plugins.mods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var resp []interface{}
+	for _, name := range names {
+		p := m.plugins.mods[name]
+		sum := sha1.Sum(p.Code)
+		var cmds []string
+		for cmd, kind := range p.cmds {
+			cmds = append(cmds, fmt.Sprintf("%s (%c)", cmd, kind))
+		}
+		sort.Strings(cmds)
+		resp = append(resp, []interface{}{
+			"name", p.Name,
+			"sha1", hex.EncodeToString(sum[:]),
+			"size", redcon.SimpleInt(len(p.Code)),
+			"commands", cmds,
+		})
+	}
+	return resp, nil
+}
+
+// PLUGINWRITE load name wasm
+// PLUGINWRITE unload name
+// help: applies a plugin change. It's not possible to directly call this
+//       from a client service. It can only be called by its own internal
+//       server instance.
+func cmdPLUGINWRITE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 3 {
+		return nil, ErrWrongNumArgs
+	}
+	switch args[1] {
+	case "load":
+		if len(args) != 4 {
+			return nil, ErrWrongNumArgs
+		}
+		p, err := compilePlugin(m.plugins.rt, args[2], []byte(args[3]))
+		if err != nil {
+			return nil, err
+		}
+		if err := m.plugins.add(p, m.commands); err != nil {
+			return nil, err
+		}
+		return redcon.SimpleString("OK"), nil
+	case "unload":
+		if len(args) != 3 {
+			return nil, ErrWrongNumArgs
+		}
+		if m.plugins.remove(args[2]) {
+			return redcon.SimpleInt(1), nil
+		}
+		return redcon.SimpleInt(0), nil
+	}
+	return nil, ErrSyntax
+}
@@ -0,0 +1,337 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// pluginFuel is the fuel of a plugin call. One unit is used by every
+// function call and loop iteration, and pluginHostFuel by every call to a
+// host function. The fuel is the same on every server, so running out is a
+// deterministic command error.
+const pluginFuel = 10000000
+
+// pluginHostFuel is the fuel used by a call to a host function.
+const pluginHostFuel = 100
+
+// pluginFuelExport is the name of the exported global that holds the
+// remaining fuel of an instance.
+const pluginFuelExport = "__fuel"
+
+var errPluginFuel = errors.New("ran out of fuel")
+
+// meterPlugin returns the module with fuel metering. A mutable i64 global
+// that starts at pluginFuel is added and exported, and the fuel is taken at
+// the start of every function and loop. The instance traps when the fuel
+// drops below zero.
+func meterPlugin(code []byte) ([]byte, error) {
+	if len(code) < 8 || string(code[:4]) != "\x00asm" {
+		return nil, errors.New("invalid module")
+	}
+	var sects []pluginSection
+	for b := code[8:]; len(b) > 0; {
+		id := b[0]
+		n, sz := binary.Uvarint(b[1:])
+		if sz <= 0 || n > uint64(len(b)-1-sz) {
+			return nil, errors.New("invalid section")
+		}
+		sects = append(sects, pluginSection{id, b[1+sz : 1+sz+int(n)]})
+		b = b[1+sz+int(n):]
+	}
+	// the fuel global is the last, after the imported and defined globals
+	var nglobals uint64
+	var hasGlobals, hasExports bool
+	for _, s := range sects {
+		switch s.id {
+		case 2:
+			n, err := wasmImportedGlobals(s.body)
+			if err != nil {
+				return nil, err
+			}
+			nglobals += n
+		case 6:
+			n, _ := binary.Uvarint(s.body)
+			nglobals += n
+			hasGlobals = true
+		case 7:
+			hasExports = true
+		}
+	}
+	global := wasmAppendULEB(nil, nglobals)
+	// charge is global.get, i64.const 1, i64.sub, global.set, and then
+	// global.get, i64.const 0, i64.lt_s, if, unreachable, end.
+	charge := func(b []byte) []byte {
+		b = append(b, 0x23)
+		b = append(b, global...)
+		b = append(b, 0x42, 0x01, 0x7d, 0x24)
+		b = append(b, global...)
+		b = append(b, 0x23)
+		b = append(b, global...)
+		return append(b, 0x42, 0x00, 0x53, 0x04, 0x40, 0x00, 0x0b)
+	}
+	// add the missing sections prior to the sections that must follow them
+	if !hasGlobals {
+		sects = insertPluginSection(sects, 6, 7, 8, 9, 12, 10, 11)
+	}
+	if !hasExports {
+		sects = insertPluginSection(sects, 7, 8, 9, 12, 10, 11)
+	}
+	out := append([]byte(nil), code[:8]...)
+	for _, s := range sects {
+		body := s.body
+		var err error
+		switch s.id {
+		case 6:
+			n, sz := binary.Uvarint(body)
+			b := wasmAppendULEB(nil, n+1)
+			b = append(b, body[sz:]...)
+			b = append(b, 0x7e, 0x01, 0x42) // mut i64 = i64.const
+			b = wasmAppendSLEB(b, pluginFuel)
+			body = append(b, 0x0b)
+		case 7:
+			n, sz := binary.Uvarint(body)
+			b := wasmAppendULEB(nil, n+1)
+			b = append(b, body[sz:]...)
+			b = wasmAppendULEB(b, uint64(len(pluginFuelExport)))
+			b = append(b, pluginFuelExport...)
+			b = append(b, 0x03) // global
+			body = append(b, global...)
+		case 10:
+			body, err = wasmMeterCode(body, charge)
+			if err != nil {
+				return nil, err
+			}
+		}
+		out = append(out, s.id)
+		out = wasmAppendULEB(out, uint64(len(body)))
+		out = append(out, body...)
+	}
+	return out, nil
+}
+
+type pluginSection struct {
+	id   byte
+	body []byte
+}
+
+// insertPluginSection inserts an empty section prior to the first of the
+// sections that follow it.
+func insertPluginSection(sects []pluginSection, id byte, next ...byte,
+) []pluginSection {
+	i := 0
+	for ; i < len(sects); i++ {
+		if bytes.IndexByte(next, sects[i].id) != -1 {
+			break
+		}
+	}
+	sects = append(sects, pluginSection{})
+	copy(sects[i+1:], sects[i:])
+	sects[i] = pluginSection{id, []byte{0}}
+	return sects
+}
+
+// wasmImportedGlobals returns the number of imported globals.
+func wasmImportedGlobals(b []byte) (uint64, error) {
+	r := wasmReader{b: b}
+	var n uint64
+	for i, count := uint64(0), r.u32(); i < count && r.err == nil; i++ {
+		r.skip(int(r.u32())) // module
+		r.skip(int(r.u32())) // name
+		switch r.byte() {
+		case 0x00: // func
+			r.u32()
+		case 0x01: // table
+			r.byte()
+			r.limits()
+		case 0x02: // memory
+			r.limits()
+		case 0x03: // global
+			r.skip(2)
+			n++
+		default:
+			r.fail()
+		}
+	}
+	return n, r.err
+}
+
+// wasmMeterCode adds the fuel charges to the start of every function body
+// and loop in the code section.
+func wasmMeterCode(b []byte, charge func(b []byte) []byte) ([]byte, error) {
+	r := wasmReader{b: b}
+	count := r.u32()
+	out := wasmAppendULEB(nil, count)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		size := int(r.u32())
+		start := r.i
+		r.skip(size)
+		if r.err != nil {
+			break
+		}
+		fr := wasmReader{b: b[start : start+size]}
+		for j, n := uint64(0), fr.u32(); j < n && fr.err == nil; j++ {
+			fr.u32()  // count
+			fr.byte() // type
+		}
+		fn := append([]byte(nil), fr.b[:fr.i]...)
+		fn = charge(fn)
+		for fr.err == nil && fr.i < len(fr.b) {
+			at := fr.i
+			op := fr.byte()
+			fr.immediates(op)
+			fn = append(fn, fr.b[at:fr.i]...)
+			if op == 0x03 { // loop
+				fn = charge(fn)
+			}
+		}
+		if fr.err != nil {
+			return nil, fr.err
+		}
+		out = wasmAppendULEB(out, uint64(len(fn)))
+		out = append(out, fn...)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return out, nil
+}
+
+type wasmReader struct {
+	b   []byte
+	i   int
+	err error
+}
+
+func (r *wasmReader) fail() {
+	if r.err == nil {
+		r.err = errors.New("invalid code")
+	}
+	r.i = len(r.b)
+}
+
+func (r *wasmReader) byte() byte {
+	if r.i >= len(r.b) {
+		r.fail()
+		return 0
+	}
+	r.i++
+	return r.b[r.i-1]
+}
+
+func (r *wasmReader) skip(n int) {
+	if n < 0 || n > len(r.b)-r.i {
+		r.fail()
+		return
+	}
+	r.i += n
+}
+
+func (r *wasmReader) u32() uint64 {
+	n, sz := binary.Uvarint(r.b[r.i:])
+	if sz <= 0 {
+		r.fail()
+		return 0
+	}
+	r.i += sz
+	return n
+}
+
+// leb skips a signed or unsigned LEB128 number.
+func (r *wasmReader) leb() {
+	for r.err == nil && r.byte()&0x80 != 0 {
+	}
+}
+
+func (r *wasmReader) limits() {
+	if r.byte()&1 != 0 {
+		r.u32()
+	}
+	r.u32()
+}
+
+// immediates skips the immediates of the instruction.
+func (r *wasmReader) immediates(op byte) {
+	switch {
+	case op == 0x02 || op == 0x03 || op == 0x04: // block, loop, if
+		switch r.byte() {
+		case 0x40, 0x7f, 0x7e, 0x7d, 0x7c, 0x7b, 0x70, 0x6f:
+		default:
+			r.i--
+			r.leb() // type index
+		}
+	case op == 0x0c || op == 0x0d: // br, br_if
+		r.u32()
+	case op == 0x0e: // br_table
+		for i, n := uint64(0), r.u32(); i <= n && r.err == nil; i++ {
+			r.u32()
+		}
+	case op == 0x10: // call
+		r.u32()
+	case op == 0x11: // call_indirect
+		r.u32()
+		r.u32()
+	case op == 0x1c: // select t*
+		r.skip(int(r.u32()))
+	case op >= 0x20 && op <= 0x26: // local, global, table get/set
+		r.u32()
+	case op >= 0x28 && op <= 0x3e: // memory load/store
+		r.u32()
+		r.u32()
+	case op == 0x3f || op == 0x40: // memory.size, memory.grow
+		r.byte()
+	case op == 0x41 || op == 0x42: // i32.const, i64.const
+		r.leb()
+	case op == 0x43: // f32.const
+		r.skip(4)
+	case op == 0x44: // f64.const
+		r.skip(8)
+	case op == 0xd0: // ref.null
+		r.byte()
+	case op == 0xd2: // ref.func
+		r.u32()
+	case op == 0xfc:
+		switch sub := r.u32(); {
+		case sub <= 7: // saturating truncation
+		case sub == 8: // memory.init
+			r.u32()
+			r.byte()
+		case sub == 9 || sub == 13 || sub >= 15 && sub <= 17:
+			r.u32()
+		case sub == 10: // memory.copy
+			r.byte()
+			r.byte()
+		case sub == 11: // memory.fill
+			r.byte()
+		case sub == 12 || sub == 14: // table.init, table.copy
+			r.u32()
+			r.u32()
+		default:
+			r.fail()
+		}
+	case op <= 0x01, op == 0x05, op == 0x0b, op == 0x0f, op == 0x1a,
+		op == 0x1b, op >= 0x45 && op <= 0xc4, op == 0xd1:
+		// no immediates
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unsupported instruction 0x%02x", op)
+		}
+		r.i = len(r.b)
+	}
+}
+
+func wasmAppendULEB(b []byte, n uint64) []byte {
+	return binary.AppendUvarint(b, n)
+}
+
+func wasmAppendSLEB(b []byte, n int64) []byte {
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if (n == 0 && c&0x40 == 0) || (n == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
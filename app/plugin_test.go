@@ -0,0 +1,209 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+type pluginTestData map[string]string
+
+func (d pluginTestData) Get(key string) (string, bool) {
+	value, ok := d[key]
+	return value, ok
+}
+
+func (d pluginTestData) Set(key, value string) {
+	d[key] = value
+}
+
+func (d pluginTestData) Delete(key string) bool {
+	_, ok := d[key]
+	delete(d, key)
+	return ok
+}
+
+func wasmULEB(n uint64) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func wasmSLEB(n int64) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if (n == 0 && c&0x40 == 0) || (n == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func wasmVec(items ...[]byte) []byte {
+	b := wasmULEB(uint64(len(items)))
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+func wasmName(s string) []byte {
+	return append(wasmULEB(uint64(len(s))), s...)
+}
+
+func wasmSection(id byte, body []byte) []byte {
+	return append(append([]byte{id}, wasmULEB(uint64(len(body)))...), body...)
+}
+
+func wasmCat(parts ...[]byte) []byte {
+	var b []byte
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
+
+// testPluginModule returns a module with the commands "setx key value" and
+// "getx key", where the key and value must be a single byte, and "spin key",
+// which never returns.
+func testPluginModule() []byte {
+	const i32, i64 = 0x7f, 0x7e
+	i32c := func(n int64) []byte { return append([]byte{0x41}, wasmSLEB(n)...) }
+	i64c := func(n int64) []byte { return append([]byte{0x42}, wasmSLEB(n)...) }
+	arg := func(off int64) []byte { // local.get 0; i32.const off; i32.add
+		return wasmCat([]byte{0x20, 0x00}, i32c(off), []byte{0x6a})
+	}
+	body := func(code ...[]byte) []byte {
+		b := wasmCat(append([][]byte{{0x00}}, append(code, []byte{0x0b})...)...)
+		return append(wasmULEB(uint64(len(b))), b...)
+	}
+	// args: count | len "setx" | len key | len value
+	const key, value = 4 + 4 + 4 + 4, 4 + 4 + 4 + 4 + 1 + 4
+	return wasmCat(
+		[]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00},
+		wasmSection(1, wasmVec(
+			[]byte{0x60, 4, i32, i32, i32, i32, 1, i32}, // get
+			[]byte{0x60, 4, i32, i32, i32, i32, 0},      // set
+			[]byte{0x60, 1, i32, 1, i32},                // alloc
+			[]byte{0x60, 2, i32, i32, 1, i64},           // commands
+		)),
+		wasmSection(2, wasmVec(
+			wasmCat(wasmName("env"), wasmName("get"), []byte{0x00, 0}),
+			wasmCat(wasmName("env"), wasmName("set"), []byte{0x00, 1}),
+		)),
+		wasmSection(3, wasmVec([]byte{2}, []byte{3}, []byte{3}, []byte{3})),
+		wasmSection(5, wasmVec([]byte{0x00, 1})),
+		wasmSection(7, wasmVec(
+			wasmCat(wasmName("memory"), []byte{0x02, 0}),
+			wasmCat(wasmName("alloc"), []byte{0x00, 2}),
+			wasmCat(wasmName("write_setx"), []byte{0x00, 3}),
+			wasmCat(wasmName("read_getx"), []byte{0x00, 4}),
+			wasmCat(wasmName("write_spin"), []byte{0x00, 5}),
+		)),
+		wasmSection(10, wasmVec(
+			body(i32c(1024)),
+			body(arg(key), i32c(1), arg(value), i32c(1),
+				[]byte{0x10, 1}, i64c(100<<32|5)),
+			// the value is copied into the "_" of the response
+			body(arg(key), i32c(1), i32c(204), i32c(1),
+				[]byte{0x10, 0, 0x1a}, i64c(200<<32|7)),
+			body([]byte{0x03, 0x40, 0x0c, 0x00, 0x0b}, i64c(0)),
+		)),
+		wasmSection(11, wasmVec(
+			wasmCat([]byte{0x00}, i32c(100), []byte{0x0b},
+				wasmName("+OK\r\n")),
+			wasmCat([]byte{0x00}, i32c(200), []byte{0x0b},
+				wasmName("$1\r\n_\r\n")),
+		)),
+	)
+}
+
+func TestPlugins(t *testing.T) {
+	var conf Config
+	conf.def()
+	m := machineInit(conf, 0, "", nil)
+	data := pluginTestData{}
+	m.data = data
+	code := string(testPluginModule())
+	resp, err := cmdPLUGINWRITE(m, nil,
+		[]string{"pluginwrite", "load", "kv", code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cmdPLUGINWRITE(m, nil,
+		[]string{"pluginwrite", "load", "kv2", code})
+	if err == nil {
+		t.Fatal("expected command conflict error")
+	}
+	_, err = cmdPLUGINWRITE(m, nil,
+		[]string{"pluginwrite", "load", "bad", "\x00asm"})
+	if err == nil {
+		t.Fatal("expected compile error")
+	}
+	setx, ok := m.command("setx")
+	if !ok || setx.kind != 'w' {
+		t.Fatal("expected setx write command")
+	}
+	resp, err = setx.fn(m, nil, []string{"setx", "a", "1"})
+	if err != nil || resp != redcon.SimpleString("OK") {
+		t.Fatalf("unexpected %v %v", resp, err)
+	}
+	if !reflect.DeepEqual(data, pluginTestData{"a": "1"}) {
+		t.Fatalf("unexpected data %v", data)
+	}
+	getx, ok := m.command("getx")
+	if !ok || getx.kind != 'r' {
+		t.Fatal("expected getx read command")
+	}
+	resp, err = getx.fn(m, nil, []string{"getx", "a"})
+	if err != nil || resp != "1" {
+		t.Fatalf("unexpected %v %v", resp, err)
+	}
+
+	spin, ok := m.command("spin")
+	if !ok {
+		t.Fatal("expected spin command")
+	}
+	_, err = spin.fn(m, nil, []string{"spin", "a"})
+	if err == nil || !strings.Contains(err.Error(), errPluginFuel.Error()) {
+		t.Fatalf("expected fuel error, got %v", err)
+	}
+
+	// snapshot
+	snap, err := m.plugins.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugins, err := decodePluginTable(snap, m.plugins.rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := plugins.command("setx"); !ok || len(plugins.mods) != 1 {
+		t.Fatal("expected restored plugin")
+	}
+
+	resp, _ = cmdPLUGINWRITE(m, nil, []string{"pluginwrite", "unload", "kv"})
+	if resp != redcon.SimpleInt(1) {
+		t.Fatalf("expected 1, got %v", resp)
+	}
+	if _, ok := m.command("setx"); ok {
+		t.Fatal("expected unloaded command")
+	}
+	resp, _ = cmdPLUGINWRITE(m, nil, []string{"pluginwrite", "unload", "kv"})
+	if resp != redcon.SimpleInt(0) {
+		t.Fatalf("expected 0, got %v", resp)
+	}
+}
@@ -0,0 +1,372 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+// pubsubMessage is a published message and the index of the raft log entry
+// that it was published with.
+type pubsubMessage struct {
+	Index   uint64 `json:"index"`
+	Channel string `json:"channel"`
+	Message string `json:"message"`
+}
+
+// pubsubLog holds the most recent published messages in the order that they
+// were applied. It's only altered from inside of the Apply function and is
+// persisted in snapshots, which allows for subscribers to resume from an
+// index on any server.
+type pubsubLog struct {
+	msgs    []pubsubMessage
+	trimmed uint64 // index of the last message removed from the log
+	retain  int
+	notify  chan struct{}   // closed and replaced on every publish
+	pending []pubsubMessage // from Notify, published after the apply
+}
+
+func newPubsubLog(retain int) *pubsubLog {
+	return &pubsubLog{retain: retain, notify: make(chan struct{})}
+}
+
+// publish appends the messages and trims the log to the retain size. The
+// messages already in the log are never moved or overwritten, because the
+// slices returned by since are read by the subscribers without the lock.
+func (pl *pubsubLog) publish(msgs ...pubsubMessage) {
+	pl.msgs = append(pl.msgs, msgs...)
+	if len(pl.msgs) > pl.retain {
+		n := len(pl.msgs) - pl.retain
+		pl.trimmed = pl.msgs[n-1].Index
+		pl.msgs = pl.msgs[n:]
+	}
+	close(pl.notify)
+	pl.notify = make(chan struct{})
+}
+
+// flush publishes the pending messages.
+func (pl *pubsubLog) flush() {
+	if len(pl.pending) > 0 {
+		pl.publish(pl.pending...)
+		pl.pending = nil
+	}
+}
+
+// since returns the messages with an index that is greater than or equal to
+// the provided index. Returns false when messages have been trimmed from the
+// log that would have been in the result. The messages in the result are not
+// changed by later publishes.
+func (pl *pubsubLog) since(index uint64) ([]pubsubMessage, bool) {
+	if index <= pl.trimmed {
+		return nil, false
+	}
+	i := len(pl.msgs)
+	for i > 0 && pl.msgs[i-1].Index >= index {
+		i--
+	}
+	return pl.msgs[i:], true
+}
+
+type pubsubLogJSON struct {
+	Trimmed uint64          `json:"trimmed"`
+	Msgs    []pubsubMessage `json:"msgs"`
+}
+
+func (pl *pubsubLog) encode() ([]byte, error) {
+	return json.Marshal(pubsubLogJSON{pl.trimmed, pl.msgs})
+}
+
+func decodePubsubLog(data []byte, retain int) (*pubsubLog, error) {
+	pl := newPubsubLog(retain)
+	if len(data) == 0 {
+		return pl, nil
+	}
+	var js pubsubLogJSON
+	if err := json.Unmarshal(data, &js); err != nil {
+		return nil, err
+	}
+	pl.trimmed = js.Trimmed
+	pl.msgs = js.Msgs
+	if len(pl.msgs) > pl.retain {
+		n := len(pl.msgs) - pl.retain
+		pl.trimmed = pl.msgs[n-1].Index
+		pl.msgs = pl.msgs[n:]
+	}
+	return pl, nil
+}
+
+// PUBLISH channel message
+// help: publishes a message to a channel through the raft log. Returns the
+//       raft index of the message in the first group, which can be used to
+//       resume a subscription when there is only one group.
+func cmdPUBLISH(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) != 3 {
+		return nil, ErrWrongNumArgs
+	}
+	m.Notify(args[1], args[2])
+	return redcon.SimpleInt(m.index), nil
+}
+
+// Notify buffers the message until the log entry has been applied, which
+// allows for dropping the messages of a failed command.
+func (m *machine) Notify(channel, message string) {
+	if !m.applying {
+		// not a write command
+		return
+	}
+	m.pubsub.pending = append(m.pubsub.pending, pubsubMessage{
+		Index:   m.index,
+		Channel: channel,
+		Message: message,
+	})
+}
+
+// SUBSCRIBE [FROM index] channel [channel ...]
+// help: subscribes to channels. Each message is sent as an array of
+//       "message", channel, payload, and index. Providing FROM will first
+//       send the retained messages starting at the index, which allows for a
+//       client to resume after reconnecting. With multiple raft groups the
+//       index is a comma-separated raft index for each group, such as
+//       "10,25,7", and the index of a message resumes from the message.
+func cmdSUBSCRIBE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	return subscribe(um, args, false)
+}
+
+// PSUBSCRIBE [FROM index] pattern [pattern ...]
+// help: subscribes to channels matching the patterns. Each message is sent
+//       as an array of "pmessage", pattern, channel, payload, and index.
+func cmdPSUBSCRIBE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	return subscribe(um, args, true)
+}
+
+func subscribe(um Machine, args []string, patterns bool,
+) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	// The messages are published to the log of the group that applies the
+	// write, so the subscriber reads the logs of all groups.
+	var ms []*machine
+	for _, g := range m.raftGroups(nil) {
+		ms = append(ms, g.m)
+	}
+	var from []uint64
+	if len(args) > 3 && strings.ToLower(args[1]) == "from" {
+		var err error
+		from, err = parsePubsubIndex(args[2], len(ms))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args[:1:1], args[3:]...)
+	}
+	if len(args) < 2 {
+		return nil, ErrWrongNumArgs
+	}
+	sub := &subscriber{ms: ms, patterns: patterns, from: from,
+		names: make(map[string]bool)}
+	for _, name := range args[1:] {
+		sub.names[name] = true
+	}
+	return Hijack(sub.run), nil
+}
+
+// parsePubsubIndex parses the FROM index, which has a raft index for each
+// of the groups.
+func parsePubsubIndex(s string, groups int) ([]uint64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != groups {
+		return nil, fmt.Errorf("FROM index must have a raft index for each "+
+			"of the %d groups", groups)
+	}
+	from := make([]uint64, len(parts))
+	for i, part := range parts {
+		var err error
+		from[i], err = strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, ErrSyntax
+		}
+	}
+	return from, nil
+}
+
+// pubsubIndex returns the index of a message that was published by the
+// group, which is the FROM index that resumes from the message.
+func pubsubIndex(next []uint64, group int, index uint64) interface{} {
+	if len(next) == 1 {
+		return redcon.SimpleInt(index)
+	}
+	parts := make([]string, len(next))
+	for i, n := range next {
+		if i == group {
+			n = index
+		}
+		parts[i] = strconv.FormatUint(n, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// subscriber sends published messages to a hijacked connection.
+type subscriber struct {
+	ms       []*machine // machine of each group
+	patterns bool
+	from     []uint64 // nil when not resuming
+
+	mu    sync.Mutex
+	names map[string]bool // channels or patterns
+	conn  HijackedConn
+}
+
+func (sub *subscriber) kind() string {
+	if sub.patterns {
+		return "psubscribe"
+	}
+	return "subscribe"
+}
+
+func (sub *subscriber) run(s Service, conn HijackedConn) {
+	sub.conn = conn
+	defer conn.Close()
+	sub.mu.Lock()
+	for name := range sub.names {
+		conn.WriteAny([]interface{}{sub.kind(), name,
+			redcon.SimpleInt(len(sub.names))})
+	}
+	err := conn.Flush()
+	sub.mu.Unlock()
+	if err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sub.readCommands()
+	}()
+	next := sub.from
+	if next == nil {
+		next = make([]uint64, len(sub.ms))
+		for i, m := range sub.ms {
+			m.mu.RLock()
+			next[i] = m.appliedIndex + 1
+			m.mu.RUnlock()
+		}
+	}
+	// wait for a publish on any of the groups, or the end of the commands
+	cases := make([]reflect.SelectCase, len(sub.ms)+1)
+	cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv,
+		Chan: reflect.ValueOf(done)}
+	for {
+		for i, m := range sub.ms {
+			m.mu.RLock()
+			msgs, ok := m.pubsub.since(next[i])
+			notify := m.pubsub.notify
+			trimmed := m.pubsub.trimmed
+			m.mu.RUnlock()
+			cases[i+1] = reflect.SelectCase{Dir: reflect.SelectRecv,
+				Chan: reflect.ValueOf(notify)}
+			sub.mu.Lock()
+			if !ok {
+				if len(sub.ms) == 1 {
+					conn.WriteAny(fmt.Errorf("TRIMMED messages up to index "+
+						"%d are no longer available", trimmed))
+				} else {
+					conn.WriteAny(fmt.Errorf("TRIMMED messages up to index "+
+						"%d of group %d are no longer available", trimmed, i))
+				}
+				conn.Flush()
+				sub.mu.Unlock()
+				return
+			}
+			for _, msg := range msgs {
+				sub.write(msg, pubsubIndex(next, i, msg.Index))
+				next[i] = msg.Index + 1
+			}
+			sub.mu.Unlock()
+		}
+		sub.mu.Lock()
+		err := conn.Flush()
+		empty := len(sub.names) == 0
+		sub.mu.Unlock()
+		if err != nil || empty {
+			return
+		}
+		if chosen, _, _ := reflect.Select(cases); chosen == 0 {
+			return
+		}
+	}
+}
+
+// write sends the message if it matches the subscription.
+func (sub *subscriber) write(msg pubsubMessage, index interface{}) {
+	if !sub.patterns {
+		if sub.names[msg.Channel] {
+			sub.conn.WriteAny([]interface{}{"message", msg.Channel,
+				msg.Message, index})
+		}
+		return
+	}
+	for pattern := range sub.names {
+		if match.Match(msg.Channel, pattern) {
+			sub.conn.WriteAny([]interface{}{"pmessage", pattern,
+				msg.Channel, msg.Message, index})
+		}
+	}
+}
+
+// readCommands handles the commands that are allowed while subscribed.
+func (sub *subscriber) readCommands() {
+	unsub := "unsubscribe"
+	if sub.patterns {
+		unsub = "punsubscribe"
+	}
+	for {
+		args, err := sub.conn.ReadCommand()
+		if err != nil {
+			return
+		}
+		sub.mu.Lock()
+		switch args[0] {
+		case "ping":
+			sub.conn.WriteAny(redcon.SimpleString("PONG"))
+		case unsub:
+			names := args[1:]
+			if len(names) == 0 {
+				for name := range sub.names {
+					names = append(names, name)
+				}
+			}
+			for _, name := range names {
+				delete(sub.names, name)
+				sub.conn.WriteAny([]interface{}{unsub, name,
+					redcon.SimpleInt(len(sub.names))})
+			}
+		case "quit":
+			sub.conn.WriteAny(redcon.SimpleString("OK"))
+			sub.conn.Flush()
+			sub.mu.Unlock()
+			return
+		default:
+			sub.conn.WriteAny(fmt.Errorf("only (P)SUBSCRIBE / "+
+				"(P)UNSUBSCRIBE / PING / QUIT are allowed in this context, "+
+				"got '%s'", args[0]))
+		}
+		err = sub.conn.Flush()
+		empty := len(sub.names) == 0
+		sub.mu.Unlock()
+		if err != nil || empty {
+			return
+		}
+	}
+}
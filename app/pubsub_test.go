@@ -0,0 +1,189 @@
+package app
+
+import (
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/tidwall/redcon"
+)
+
+func TestPubsubLog(t *testing.T) {
+	pl := newPubsubLog(2)
+	for i := uint64(1); i <= 3; i++ {
+		pl.publish(pubsubMessage{Index: i * 10, Channel: "ch", Message: "m"})
+	}
+	if _, ok := pl.since(10); ok {
+		t.Fatal("expected trimmed")
+	}
+	msgs, ok := pl.since(11)
+	if !ok || len(msgs) != 2 || msgs[0].Index != 20 {
+		t.Fatalf("unexpected %v %v", msgs, ok)
+	}
+	// a subscriber's messages are not moved by later publishes
+	for i := uint64(4); i <= 6; i++ {
+		pl.publish(pubsubMessage{Index: i * 10, Channel: "ch", Message: "m"})
+	}
+	if msgs[0].Index != 20 || msgs[1].Index != 30 {
+		t.Fatalf("unexpected %v", msgs)
+	}
+	data, err := pl.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl2, err := decodePubsubLog(data, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pl2.since(50); ok {
+		t.Fatal("expected trimmed after decode")
+	}
+	if msgs, ok := pl2.since(51); !ok || len(msgs) != 1 || msgs[0].Index != 60 {
+		t.Fatalf("unexpected %v %v", msgs, ok)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var conf Config
+	conf.def()
+	conf.AddWriteCommand("set", func(m Machine, args []string,
+	) (interface{}, error) {
+		m.Notify("keys", args[1])
+		if args[1] == "bad" {
+			return nil, ErrInvalid
+		}
+		return nil, nil
+	})
+	m := machineInit(conf, 0, "", nil)
+	m.start = 1
+	m.Notify("keys", "ignored")
+	apply := func(index uint64, keys ...string) {
+		var reqs []*writeRequestFuture
+		for _, key := range keys {
+			reqs = append(reqs, &writeRequestFuture{args: []string{"set", key}})
+		}
+		m.Apply(&raft.Log{Index: index, Data: encodeBatch(reqs)})
+	}
+	apply(10, "a", "bad", "b")
+	msgs, _ := m.pubsub.since(10)
+	if len(msgs) != 2 || msgs[0].Message != "a" || msgs[1].Message != "b" ||
+		msgs[1].Index != 10 {
+		t.Fatalf("unexpected %v", msgs)
+	}
+	apply(11, "c")
+	msgs, _ = m.pubsub.since(11)
+	if len(msgs) != 1 || msgs[0].Message != "c" || msgs[0].Index != 11 {
+		t.Fatalf("unexpected %v", msgs)
+	}
+}
+
+// testHijackedConn is a HijackedConn that sends the flushed writes to a
+// channel.
+type testHijackedConn struct {
+	cmds chan []string
+	out  chan []interface{}
+	mu   sync.Mutex
+	buf  []interface{}
+}
+
+func newTestHijackedConn() *testHijackedConn {
+	return &testHijackedConn{cmds: make(chan []string),
+		out: make(chan []interface{}, 100)}
+}
+
+func (c *testHijackedConn) RemoteAddr() string { return "" }
+func (c *testHijackedConn) ReadCommands(func(args []string) bool) error {
+	return nil
+}
+func (c *testHijackedConn) ReadCommand() ([]string, error) {
+	args, ok := <-c.cmds
+	if !ok {
+		return nil, io.EOF
+	}
+	return args, nil
+}
+func (c *testHijackedConn) WriteAny(v interface{}) {
+	c.mu.Lock()
+	c.buf = append(c.buf, v)
+	c.mu.Unlock()
+}
+func (c *testHijackedConn) WriteRaw(data []byte) {}
+func (c *testHijackedConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, v := range c.buf {
+		c.out <- v.([]interface{})
+	}
+	c.buf = nil
+	return nil
+}
+func (c *testHijackedConn) Close() error { return nil }
+
+func TestSubscribeGroups(t *testing.T) {
+	var conf Config
+	conf.def()
+	conf.Groups = 2
+	conf.AddWriteCommand("set", func(m Machine, args []string,
+	) (interface{}, error) {
+		m.Notify("keys", args[1])
+		return nil, nil
+	})
+	var groups []*raftGroup
+	for i := 0; i < conf.Groups; i++ {
+		m := machineInit(conf, i, "", nil)
+		m.start = 1
+		groups = append(groups, &raftGroup{id: i, m: m})
+	}
+	for _, g := range groups {
+		g.m.groups = groups
+	}
+	apply := func(group int, index uint64, key string) {
+		reqs := []*writeRequestFuture{{args: []string{"set", key}}}
+		groups[group].m.Apply(&raft.Log{Index: index,
+			Data: encodeBatch(reqs)})
+	}
+	// "b" and "c" are served by the first group, and "a" and "d" by the
+	// second group
+	apply(0, 10, "b")
+	apply(1, 5, "a")
+
+	if _, err := cmdSUBSCRIBE(groups[0].m, nil,
+		[]string{"subscribe", "from", "1", "keys"}); err == nil {
+		t.Fatal("expected error")
+	}
+	resp, err := cmdSUBSCRIBE(groups[0].m, nil,
+		[]string{"subscribe", "from", "1,1", "keys"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := newTestHijackedConn()
+	done := make(chan struct{})
+	go func() {
+		resp.(Hijack)(nil, conn)
+		close(done)
+	}()
+	expect := func(v ...interface{}) {
+		t.Helper()
+		select {
+		case out := <-conn.out:
+			if !reflect.DeepEqual(out, v) {
+				t.Fatalf("expected %v, got %v", v, out)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("expected %v", v)
+		}
+	}
+	expect("subscribe", "keys", redcon.SimpleInt(1))
+	// the index of a message resumes from the message in every group
+	expect("message", "keys", "b", "10,1")
+	expect("message", "keys", "a", "11,5")
+	apply(1, 6, "d")
+	expect("message", "keys", "d", "11,6")
+	apply(0, 11, "c")
+	expect("message", "keys", "c", "11,7")
+	close(conn.cmds)
+	<-done
+}
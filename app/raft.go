@@ -21,6 +21,7 @@ var errLeaderUnknown = errors.New("leader unknown")
 type raftWrap struct {
 	*raft.Raft
 	conf      Config
+	group     int
 	advertise string
 	mu        sync.RWMutex
 	extra     map[string]serverExtra
@@ -41,7 +42,7 @@ func (ra *raftWrap) getExtraForAddr(addr string) (extra serverExtra, ok bool) {
 	return extra, false
 }
 
-func raftInit(conf Config, hclogger hclog.Logger, fsm raft.FSM,
+func raftInit(conf Config, group int, hclogger hclog.Logger, fsm raft.FSM,
 	logStore raft.LogStore, stableStore raft.StableStore,
 	snaps raft.SnapshotStore, trans raft.Transport,
 ) *raftWrap {
@@ -68,6 +69,7 @@ func raftInit(conf Config, hclogger hclog.Logger, fsm raft.FSM,
 	return &raftWrap{
 		Raft:      ra,
 		conf:      conf,
+		group:     group,
 		advertise: conf.Advertise,
 	}
 }
@@ -88,6 +90,15 @@ func getLeaderAdvertiseAddr(ra *raftWrap) string {
 }
 
 func errRaftConvert(ra *raftWrap, err error) error {
+	return errRaftConvertSlot(ra, err, 0)
+}
+
+// errRaftConvertSlot is like errRaftConvert, but the MOVED error includes
+// the hash slot of the command keys.
+func errRaftConvertSlot(ra *raftWrap, err error, slot int) error {
+	if slot < 0 {
+		slot = 0
+	}
 	if ra.conf.TryErrors {
 		if err == raft.ErrNotLeader {
 			leader := getLeaderAdvertiseAddr(ra)
@@ -102,7 +113,7 @@ func errRaftConvert(ra *raftWrap, err error) error {
 		raft.ErrLeadershipTransferInProgress:
 		leader := getLeaderAdvertiseAddr(ra)
 		if leader != "" {
-			return fmt.Errorf("MOVED 0 %s", leader)
+			return fmt.Errorf("MOVED %d %s", slot, leader)
 		}
 		fallthrough
 	case raft.ErrRaftShutdown, raft.ErrTransportShutdown:
@@ -160,8 +171,9 @@ func joinClusterIfNeeded(conf Config, ra *raftWrap, addr net.Addr, tlscfg *tls.C
 						return err
 					}
 					defer conn.Close()
-					res, err := redis.String(conn.Do("raft", "server", "add",
-						conf.NodeID, addrStr))
+					cmd, args := ra.groupCmd("raft", "server", "add",
+						conf.NodeID, addrStr)
+					res, err := redis.String(conn.Do(cmd, args...))
 					if err != nil {
 						if strings.HasPrefix(err.Error(), "MOVED ") {
 							parts := strings.Split(err.Error(), " ")
@@ -227,7 +239,8 @@ func getClusterLastIndex(ra *raftWrap, tlscfg *tls.Config, auth string,
 		return 0, err
 	}
 	defer conn.Close()
-	args, err := redis.Strings(conn.Do("raft", "info", "last_log_index"))
+	cmd, cargs := ra.groupCmd("raft", "info", "last_log_index")
+	args, err := redis.Strings(conn.Do(cmd, cargs...))
 	if err != nil {
 		return 0, err
 	}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"encoding/binary"
 	"errors"
 	"github.com/moontrade/server/logger"
 	"io"
@@ -83,9 +84,34 @@ type Store struct {
 	lastVoteTerm uint64
 	lastVoteCand []byte
 	mu           sync.RWMutex
+	faults       *faultTable // injected disk delays, nil when off
+	keys         *KeyRing    // encryption at rest, nil when off
+	logNoSync    bool        // log commits are not synced to disk
+	stableNoSync bool        // stable commits are not synced to disk
+}
+
+// StoreOptions are the MDBX environment options of a Store.
+type StoreOptions struct {
+	LogFlags       mdbx.EnvFlags
+	StableFlags    mdbx.EnvFlags
+	LogGeometry    mdbx.Geometry
+	StableGeometry mdbx.Geometry
+	Mode           os.FileMode
+	Keys           *KeyRing // encryption at rest, nil when off
 }
 
 func OpenStore(path string, logFlags, stableFlags mdbx.EnvFlags, mode os.FileMode) (*Store, error) {
+	return OpenStoreOptions(path, StoreOptions{
+		LogFlags:       logFlags,
+		StableFlags:    stableFlags,
+		LogGeometry:    DefaultLogGeometry,
+		StableGeometry: DefaultStableGeometry,
+		Mode:           mode,
+	})
+}
+
+func OpenStoreOptions(path string, opts StoreOptions) (*Store, error) {
+	logFlags, stableFlags, mode := opts.LogFlags, opts.StableFlags, opts.Mode
 	stat, err := os.Stat(path)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -101,6 +127,9 @@ func OpenStore(path string, logFlags, stableFlags mdbx.EnvFlags, mode os.FileMod
 	s := &Store{
 		stableCache:  make(map[string][]byte),
 		stableUint64: make(map[string]uint64),
+		keys:         opts.Keys,
+		logNoSync:    logFlags&mdbx.EnvSafeNoSync != 0,
+		stableNoSync: stableFlags&mdbx.EnvSafeNoSync != 0,
 	}
 
 	if s.logStore, err = mdbx.Open(filepath.Join(path, "log"), logFlags, mode,
@@ -110,7 +139,7 @@ func OpenStore(path string, logFlags, stableFlags mdbx.EnvFlags, mode os.FileMod
 				return e
 			}
 			// Set geometry
-			if e := env.SetGeometry(DefaultLogGeometry); e != mdbx.ErrSuccess {
+			if e := env.SetGeometry(opts.LogGeometry); e != mdbx.ErrSuccess {
 				return e
 			}
 			//}
@@ -133,7 +162,7 @@ func OpenStore(path string, logFlags, stableFlags mdbx.EnvFlags, mode os.FileMod
 				return e
 			}
 			// Set geometry
-			if e := env.SetGeometry(DefaultStableGeometry); e != mdbx.ErrSuccess {
+			if e := env.SetGeometry(opts.StableGeometry); e != mdbx.ErrSuccess {
 				return e
 			}
 			return nil
@@ -153,12 +182,12 @@ func OpenStore(path string, logFlags, stableFlags mdbx.EnvFlags, mode os.FileMod
 	// Load stable store
 	if e := s.loadStableStore(); e != nil && e != mdbx.ErrSuccess {
 		_ = s.Close()
-		return nil, err
+		return nil, e
 	}
 	// Load first and last index
 	if e := s.loadFirstAndLastIndex(); e != nil && e != mdbx.ErrSuccess {
 		_ = s.Close()
-		return nil, err
+		return nil, e
 	}
 	return s, nil
 }
@@ -245,18 +274,48 @@ func (s *Store) loadStableStore() error {
 				return err
 			}
 		} else if data.Base != nil && data.Len > 0 {
-			s.lastVoteCand = make([]byte, data.Len)
-			copy(s.lastVoteCand, data.UnsafeBytes())
+			var err error
+			s.lastVoteCand, err = s.openStable(key.UnsafeBytes(),
+				data.UnsafeBytes())
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	})
 }
 
+// sealStable returns the stable store value encrypted by the key ring. The
+// uint64 values, which are only terms, are not encrypted.
+func (s *Store) sealStable(key, val []byte) ([]byte, error) {
+	if s.keys == nil {
+		return val, nil
+	}
+	return s.keys.Seal(nil, val, key)
+}
+
+// openStable returns a copy of the stored value, which is decrypted when
+// it was encrypted.
+func (s *Store) openStable(key, val []byte) ([]byte, error) {
+	if !isSealed(val) {
+		return append([]byte{}, val...), nil
+	}
+	if s.keys == nil {
+		return nil, errKeyRingNone
+	}
+	return s.keys.Open(nil, val, key)
+}
+
 func (s *Store) Set(key []byte, val []byte) error {
+	s.syncWait(s.stableNoSync)
+	sealed, err := s.sealStable(key, val)
+	if err != nil {
+		return err
+	}
 	if e := s.stableStore.Update(func(tx *mdbx.Tx) error {
 		var (
 			k = mdbx.Bytes(&key)
-			v = mdbx.Bytes(&val)
+			v = mdbx.Bytes(&sealed)
 		)
 		return tx.Put(s.stableDBI, &k, &v, 0)
 	}); e != nil && e != mdbx.ErrSuccess {
@@ -299,9 +358,9 @@ func (s *Store) Get(key []byte) (result []byte, err error) {
 		if e != mdbx.ErrSuccess {
 			return e
 		}
-		result = make([]byte, v.Len)
-		copy(result, v.UnsafeBytes())
-		return nil
+		var err error
+		result, err = s.openStable(key, v.UnsafeBytes())
+		return err
 	}); e != nil {
 		if e == mdbx.ErrNotFound {
 			return nil, nil
@@ -316,6 +375,7 @@ func (s *Store) Get(key []byte) (result []byte, err error) {
 }
 
 func (s *Store) SetUint64(key []byte, val uint64) error {
+	s.syncWait(s.stableNoSync)
 	if e := s.stableStore.Update(func(tx *mdbx.Tx) error {
 		var (
 			k = mdbx.Bytes(&key)
@@ -411,7 +471,17 @@ func (s *Store) GetLog(index uint64, log *raft.Log) error {
 		}
 
 		if val.Base != nil {
-			if err := unmarshalLog(val.UnsafeBytes(), log); err != nil {
+			b := val.UnsafeBytes()
+			if !plainLog(b, index) && isSealed(b) {
+				if s.keys == nil {
+					return errKeyRingNone
+				}
+				var err error
+				if b, err = s.keys.Open(nil, b, logAD(index)); err != nil {
+					return err
+				}
+			}
+			if err := unmarshalLog(b, log); err != nil {
 				return err
 			}
 		}
@@ -428,6 +498,7 @@ func (s *Store) GetLog(index uint64, log *raft.Log) error {
 
 // StoreLog stores a log entry.
 func (s *Store) StoreLog(log *raft.Log) error {
+	s.syncWait(s.logNoSync)
 	if err := s.logStore.Update(func(tx *mdbx.Tx) error {
 		var (
 			k = mdbx.U64(&log.Index)
@@ -435,6 +506,14 @@ func (s *Store) StoreLog(log *raft.Log) error {
 				Len: uint64(SerializedSize(log)),
 			}
 		)
+		if s.keys != nil {
+			b, err := s.sealLog(log)
+			if err != nil {
+				return err
+			}
+			v = mdbx.Bytes(&b)
+			return tx.Put(s.logDBI, &k, &v, mdbx.PutAppend)
+		}
 
 		// PutReserve to save a Go allocation.
 		if e := tx.Put(s.logDBI, &k, &v, mdbx.PutReserve|mdbx.PutAppend); e != mdbx.ErrSuccess {
@@ -456,7 +535,9 @@ func (s *Store) StoreLog(log *raft.Log) error {
 	return nil
 }
 
-// StoreLogs stores multiple log entries.
+// StoreLogs stores multiple log entries. The log is synced to disk, unless
+// the log is in a no-sync mode, where the syncing is left to the operating
+// system or to the SyncInterval.
 func (s *Store) StoreLogs(logs []*raft.Log) error {
 	if len(logs) == 0 {
 		return nil
@@ -480,6 +561,18 @@ func (s *Store) StoreLogs(logs []*raft.Log) error {
 				}
 			)
 
+			if s.keys != nil {
+				b, err := s.sealLog(log)
+				if err != nil {
+					return err
+				}
+				v = mdbx.Bytes(&b)
+				if e = cursor.Put(&k, &v, mdbx.PutAppend); e != mdbx.ErrSuccess {
+					return e
+				}
+				continue
+			}
+
 			// PutReserve to save a Go allocation.
 			if err = cursor.Put(&k, &v, mdbx.PutReserve|mdbx.PutAppend); e != mdbx.ErrSuccess {
 				return err
@@ -497,14 +590,18 @@ func (s *Store) StoreLogs(logs []*raft.Log) error {
 	atomic.StoreUint64(&s.lastIndex, logs[len(logs)-1].Index)
 
 	// sync to disk
-	if err := s.logStore.Sync(); err != nil {
-		logger.WarnErr(err)
+	if !s.logNoSync {
+		s.faults.diskWait()
+		if err := s.logStore.Sync(); err != nil {
+			logger.WarnErr(err)
+		}
 	}
 	return nil
 }
 
 // DeleteRange deletes a range of log entries. The range is inclusive.
 func (s *Store) DeleteRange(min, max uint64) error {
+	s.syncWait(s.logNoSync)
 	if err := s.logStore.Update(func(tx *mdbx.Tx) error {
 		cursor, err := tx.OpenCursor(s.logDBI)
 		if err != mdbx.ErrSuccess {
@@ -543,27 +640,38 @@ func (s *Store) DeleteRange(min, max uint64) error {
 	return nil
 }
 
+// syncWait delays a commit by the injected disk delay, unless the commit is
+// not synced to disk.
+func (s *Store) syncWait(nosync bool) {
+	if !nosync {
+		s.faults.diskWait()
+	}
+}
+
 func (s *Store) Sync() error {
+	s.faults.diskWait()
 	err := s.stableStore.Env().Sync(true, false)
 	err2 := s.logStore.Env().Sync(true, false)
-	if err != mdbx.ErrSuccess {
+	if err := syncErr(err); err != nil {
 		return err
 	}
-	if err2 != mdbx.ErrSuccess {
-		return err2
-	}
-	return nil
+	return syncErr(err2)
 }
 
 func (s *Store) SyncStable() error {
-	if err := s.stableStore.Env().Sync(true, true); err != mdbx.ErrSuccess {
-		return err
-	}
-	return nil
+	s.faults.diskWait()
+	return syncErr(s.stableStore.Env().Sync(true, true))
 }
 
 func (s *Store) SyncLog() error {
-	if err := s.stableStore.Env().Sync(true, false); err != mdbx.ErrSuccess {
+	s.faults.diskWait()
+	return syncErr(s.logStore.Env().Sync(true, false))
+}
+
+// syncErr returns nil for a successful sync. MDBX returns ErrResultTrue when
+// there was nothing to sync.
+func syncErr(err mdbx.Error) error {
+	if err != mdbx.ErrSuccess && err != mdbx.ErrResultTrue {
 		return err
 	}
 	return nil
@@ -603,6 +711,31 @@ func marshalLog(log *raft.Log, b []byte) ([]byte, error) {
 	return b, nil
 }
 
+// sealLog returns the log entry encrypted by the key ring. The index is
+// authenticated, so entries can not be swapped.
+func (s *Store) sealLog(log *raft.Log) ([]byte, error) {
+	b, err := marshalLog(log, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.keys.Seal(nil, b, logAD(log.Index))
+}
+
+func logAD(index uint64) []byte {
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], index)
+	return ad[:]
+}
+
+// plainLog returns true when the stored value is an unencrypted log entry,
+// such as one that was written before the encryption was turned on.
+func plainLog(b []byte, index uint64) bool {
+	return len(b) >= 33 &&
+		*(*uint64)(unsafe.Pointer(&b[0])) == index &&
+		33+uint64(*(*uint32)(unsafe.Pointer(&b[25])))+
+			uint64(*(*uint32)(unsafe.Pointer(&b[29]))) == uint64(len(b))
+}
+
 func unmarshalLog(b []byte, log *raft.Log) error {
 	if len(b) < 33 {
 		return errors.New("malformed log message")
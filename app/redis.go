@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -19,6 +20,93 @@ func redisService() (func(io.Reader) bool, func(Service, net.Listener)) {
 type redisClient struct {
 	authorized bool
 	opts       SendOptions
+	resp       int // protocol version, 2 or 3
+
+	tracking *redisTracking // invalidations for CLIENT TRACKING
+	detached bool           // served by redisServeDetached
+	cmds     chan []string  // commands read from a detached connection
+	gone     chan struct{}  // closed when a detached connection is closed
+	stop     chan struct{}  // stops reading a detached connection
+
+	multi      bool       // MULTI was called
+	queued     [][]string // commands queued for EXEC
+	watch      []string   // keys from WATCH
+	watchIndex uint64     // index at the first WATCH
+}
+
+func (client *redisClient) resetMulti() {
+	client.multi = false
+	client.queued = nil
+	client.watch = nil
+	client.watchIndex = 0
+}
+
+// redisServiceMulti handles the MULTI, EXEC, DISCARD, WATCH, and UNWATCH
+// commands, and queues the commands while in a MULTI. Returns false when the
+// command is not handled.
+func redisServiceMulti(s Service, client *redisClient, args []string,
+) (Receiver, bool) {
+	switch args[0] {
+	case "multi":
+		if len(args) != 1 {
+			return Response(nil, 0, ErrWrongNumArgs), true
+		}
+		if client.multi {
+			return Response(nil, 0,
+				errors.New("MULTI calls can not be nested")), true
+		}
+		client.multi = true
+		return Response(redcon.SimpleString("OK"), 0, nil), true
+	case "exec":
+		if len(args) != 1 {
+			return Response(nil, 0, ErrWrongNumArgs), true
+		}
+		if !client.multi {
+			return Response(nil, 0, errors.New("EXEC without MULTI")), true
+		}
+		queued, watch, watchIndex := client.queued, client.watch,
+			client.watchIndex
+		client.resetMulti()
+		if len(queued) == 0 {
+			return Response([]interface{}{}, 0, nil), true
+		}
+		return s.Exec(queued, watch, watchIndex, &client.opts), true
+	case "discard":
+		if len(args) != 1 {
+			return Response(nil, 0, ErrWrongNumArgs), true
+		}
+		if !client.multi {
+			return Response(nil, 0,
+				errors.New("DISCARD without MULTI")), true
+		}
+		client.resetMulti()
+		return Response(redcon.SimpleString("OK"), 0, nil), true
+	case "watch":
+		if len(args) < 2 {
+			return Response(nil, 0, ErrWrongNumArgs), true
+		}
+		if client.multi {
+			return Response(nil, 0,
+				errors.New("WATCH inside MULTI is not allowed")), true
+		}
+		if len(client.watch) == 0 {
+			client.watchIndex = s.WatchIndex(args[1:], &client.opts)
+		}
+		client.watch = append(client.watch, args[1:]...)
+		return Response(redcon.SimpleString("OK"), 0, nil), true
+	case "unwatch":
+		if len(args) != 1 {
+			return Response(nil, 0, ErrWrongNumArgs), true
+		}
+		client.watch = nil
+		client.watchIndex = 0
+		return Response(redcon.SimpleString("OK"), 0, nil), true
+	}
+	if client.multi {
+		client.queued = append(client.queued, args)
+		return Response(redcon.SimpleString("QUEUED"), 0, nil), true
+	}
+	return nil, false
 }
 
 func redisCommandToArgs(cmd redcon.Command) []string {
@@ -44,15 +132,31 @@ func redisServiceExecArgs(s Service, client *redisClient, conn redcon.Conn,
 			r = Response(redisQuitClose{}, 0, nil)
 			close = true
 		case "auth":
-			if len(args) != 2 {
+			var err error
+			var user string
+			switch len(args) {
+			case 2:
+				err = s.Auth(args[1])
+			case 3:
+				user = args[1]
+				err = s.AuthUser(args[1], args[2])
+			default:
 				r = Response(nil, 0, ErrWrongNumArgs)
-			} else if err := s.Auth(args[1]); err != nil {
+			}
+			if r != nil {
+				break
+			}
+			if err != nil {
 				client.authorized = false
+				client.opts.User = ""
 				r = Response(nil, 0, err)
 			} else {
 				client.authorized = true
+				client.opts.User = user
 				r = Response(redcon.SimpleString("OK"), 0, nil)
 			}
+		case "hello":
+			r = redisServiceHello(s, client, args)
 		default:
 			if !client.authorized {
 				if err := s.Auth(""); err != nil {
@@ -63,6 +167,10 @@ func redisServiceExecArgs(s Service, client *redisClient, conn redcon.Conn,
 				}
 			}
 			if client.authorized {
+				if mr, ok := redisServiceMulti(s, client, args); ok {
+					r = mr
+					break
+				}
 				switch args[0] {
 				case "ping":
 					if len(args) == 1 {
@@ -73,8 +181,30 @@ func redisServiceExecArgs(s Service, client *redisClient, conn redcon.Conn,
 						r = Response(nil, 0, ErrWrongNumArgs)
 					}
 				case "shutdown":
+					err := s.Allowed('s', "shutdown", &client.opts)
+					if err != nil {
+						r = Response(nil, 0, err)
+						break
+					}
 					logger.Error(errors.New("shutting down"))
 					os.Exit(0)
+				case "session":
+					// SESSION client-id seq command [arg ...]
+					if len(args) < 4 {
+						r = Response(nil, 0, ErrWrongNumArgs)
+						break
+					}
+					seq, err := strconv.ParseUint(args[2], 10, 64)
+					if err != nil || seq == 0 || args[1] == "" {
+						r = Response(nil, 0, ErrSyntax)
+						break
+					}
+					opts := client.opts
+					opts.ClientID = args[1]
+					opts.Seq = seq
+					r = s.Send(args[3:], &opts)
+				case "client":
+					r = redisServiceClient(s, client, args)
 				case "echo":
 					if len(args) != 2 {
 						r = Response(nil, 0, ErrWrongNumArgs)
@@ -93,8 +223,25 @@ func redisServiceExecArgs(s Service, client *redisClient, conn redcon.Conn,
 	}
 	// receive responses
 	var filteredArgs [][]string
+	var detach, serve bool
 	for i, r := range recvs {
 		resp, elapsed, err := r.Recv()
+		if block, ok := resp.(redisBlock); ok && err == nil {
+			// The connection is detached, which allows for the client
+			// to be observed while blocked, and it stays detached.
+			if !client.detached {
+				conn = client.detach(conn)
+				serve = true
+			}
+			resp = nil
+			if err = conn.(redcon.DetachedConn).Flush(); err == nil {
+				resp, err = block(client.gone)
+			}
+		}
+		if err == ErrWatchFailed {
+			// EXEC returns nil when a watched key has changed
+			resp, err = nil, nil
+		}
 		if err != nil {
 			if err == ErrUnknownCommand {
 				err = fmt.Errorf("%s '%s'", err, args[i][0])
@@ -105,8 +252,20 @@ func redisServiceExecArgs(s Service, client *redisClient, conn redcon.Conn,
 			case FilterArgs:
 				filteredArgs = append(filteredArgs, v)
 			case Hijack:
-				conn := newRedisHijackedConn(conn.Detach())
+				if client.detached {
+					conn.WriteError(fmt.Sprintf(
+						"ERR '%s' is not allowed in this context", args[i][0]))
+					break
+				}
+				conn := newRedisHijackedConn(conn.Detach(), func() {
+					s.Unregister(&client.opts)
+				})
 				go v(s, conn)
+			case redisMap:
+				redisWriteMap(conn, client.resp, v)
+			case redisTrackingOn:
+				conn.WriteString("OK")
+				detach = true
 			case redisQuitClose:
 				conn.WriteString("OK")
 				conn.Close()
@@ -126,6 +285,13 @@ func redisServiceExecArgs(s Service, client *redisClient, conn redcon.Conn,
 	if len(filteredArgs) > 0 {
 		redisServiceExecArgs(s, client, conn, filteredArgs)
 	}
+	if detach && !client.detached {
+		conn = client.detach(conn)
+		serve = true
+	}
+	if serve {
+		go redisServeDetached(s, client, conn.(redcon.DetachedConn))
+	}
 }
 
 func redisServiceHandler(s Service, ln net.Listener) {
@@ -142,13 +308,23 @@ func redisServiceHandler(s Service, ln net.Listener) {
 		},
 		// handle opened connection
 		func(conn redcon.Conn) bool {
-			context, accept := s.Opened(conn.RemoteAddr())
+			user := s.ConnUser(conn.NetConn())
+			context, accept := s.OpenedUser(conn.RemoteAddr(), user)
 			if !accept {
 				return false
 			}
 			client := new(redisClient)
+			client.resp = 2
+			if user != "" {
+				// verified client certificate
+				client.authorized = true
+				client.opts.User = user
+			}
 			client.opts.From = client
+			client.opts.Addr = conn.RemoteAddr()
 			client.opts.Context = context
+			nc := conn.NetConn()
+			s.Register(&client.opts, func() { nc.Close() })
 			conn.SetContext(client)
 			return true
 		},
@@ -158,6 +334,11 @@ func redisServiceHandler(s Service, ln net.Listener) {
 				return
 			}
 			client := conn.Context().(*redisClient)
+			if client.detached {
+				// closed by redisServeDetached
+				return
+			}
+			s.Unregister(&client.opts)
 			s.Closed(client.opts.Context, conn.RemoteAddr())
 		}),
 	)
@@ -166,6 +347,11 @@ func redisServiceHandler(s Service, ln net.Listener) {
 // FilterArgs ...
 type FilterArgs []string
 
+// redisBlock is the response of a command that blocks the client until it
+// completes, such as LOCK ACQUIRE with WAIT. The done channel is closed when
+// the client goes away.
+type redisBlock func(done <-chan struct{}) (interface{}, error)
+
 // Hijack is a function type that can be used to "hijack" a service client
 // connection and allowing to perform I/O operations outside the standard
 // network loop. An example of it's usage can be found in the examples/kvdb
@@ -197,12 +383,14 @@ type HijackedConn interface {
 }
 
 type redisHijackConn struct {
-	dconn redcon.DetachedConn
-	cmds  []redcon.Command
+	dconn  redcon.DetachedConn
+	cmds   []redcon.Command
+	closed func() // called by Close
 }
 
-func newRedisHijackedConn(dconn redcon.DetachedConn) *redisHijackConn {
-	return &redisHijackConn{dconn: dconn}
+func newRedisHijackedConn(dconn redcon.DetachedConn, closed func(),
+) *redisHijackConn {
+	return &redisHijackConn{dconn: dconn, closed: closed}
 }
 
 func (conn *redisHijackConn) ReadCommands(iter func(args []string) bool) error {
@@ -239,7 +427,9 @@ func (conn *redisHijackConn) Flush() error {
 }
 
 func (conn *redisHijackConn) Close() error {
-	return conn.dconn.Close()
+	err := conn.dconn.Close()
+	conn.closed()
+	return err
 }
 
 func (conn *redisHijackConn) RemoteAddr() string {
@@ -0,0 +1,475 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moontrade/server/logger"
+	"github.com/tidwall/redcon"
+)
+
+// cronSchedule is a parsed cron expression. Each field is a bitset of the
+// allowed values. All times are in UTC.
+type cronSchedule struct {
+	sec, min, hour, dom, month, dow uint64
+	every                           time.Duration // for @every
+}
+
+type cronField struct {
+	min, max int
+}
+
+var cronFields = [...]cronField{
+	{0, 59}, // second
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 7},  // day of week, both 0 and 7 are Sunday
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a standard five field cron expression "min hour dom month
+// dow", an expression with a leading seconds field, one of the macros such
+// as @daily, or "@every duration".
+func parseCron(spec string) (*cronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[7:]))
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("invalid cron expression '%s'", spec)
+		}
+		return &cronSchedule{every: d}, nil
+	}
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("invalid cron expression '%s'", spec)
+	}
+	var bits [6]uint64
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression '%s': %v",
+				spec, err)
+		}
+	}
+	if bits[5]&(1<<7) != 0 {
+		bits[5] = (bits[5] | 1) &^ (1 << 7)
+	}
+	return &cronSchedule{
+		sec: bits[0], min: bits[1], hour: bits[2],
+		dom: bits[3], month: bits[4], dow: bits[5],
+	}, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges, and steps,
+// such as "*", "*/15", "1-5", or "0,30".
+func parseCronField(field string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step '%s'", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		start, end := f.min, f.max
+		if part != "*" {
+			var err error
+			if i := strings.IndexByte(part, '-'); i != -1 {
+				start, err = strconv.Atoi(part[:i])
+				if err == nil {
+					end, err = strconv.Atoi(part[i+1:])
+				}
+			} else {
+				start, err = strconv.Atoi(part)
+				end = start
+				if step > 1 {
+					end = f.max
+				}
+			}
+			if err != nil || start < f.min || end > f.max || start > end {
+				return 0, fmt.Errorf("invalid value '%s'", part)
+			}
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first scheduled time that is after the provided time.
+// Returns false when the schedule never fires, such as Feb 30.
+func (s *cronSchedule) next(after time.Time) (time.Time, bool) {
+	after = after.UTC()
+	if s.every > 0 {
+		return after.Truncate(time.Second).Add(s.every), true
+	}
+	t := after.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0,
+				time.UTC)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if s.min&(1<<uint(t.Minute())) == 0 {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		if s.sec&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// dayMatches follows the cron rule where a day matches either the day of
+// month or the day of week when both are restricted.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	const allDom = 0xFFFFFFFE // 1-31
+	const allDow = 0x7F       // 0-6
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.dom&allDom == allDom || s.dow&allDow == allDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// scheduleJob is a command that is applied when the machine time reaches the
+// next scheduled time.
+type scheduleJob struct {
+	ID   string   `json:"id"`
+	Spec string   `json:"spec"`
+	Args []string `json:"args"`
+	Next int64    `json:"next"` // machine timestamp of the next run
+	Last int64    `json:"last"` // machine timestamp of the last run
+	Runs uint64   `json:"runs"` // number of times the job ran
+	Err  string   `json:"err"`  // error from the last run
+
+	sched *cronSchedule
+}
+
+// scheduleTable is the replicated set of scheduled jobs. It's only altered
+// from inside of the Apply function and is persisted in snapshots.
+type scheduleTable struct {
+	jobs map[string]*scheduleJob
+}
+
+func newScheduleTable() *scheduleTable {
+	return &scheduleTable{jobs: make(map[string]*scheduleJob)}
+}
+
+// due returns the jobs that are ready to run at the machine timestamp,
+// ordered by their scheduled time and then by id.
+func (t *scheduleTable) due(ts int64) []*scheduleJob {
+	var jobs []*scheduleJob
+	for _, job := range t.jobs {
+		if job.Next != 0 && job.Next <= ts {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].Next != jobs[j].Next {
+			return jobs[i].Next < jobs[j].Next
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+// sorted returns all jobs ordered by id.
+func (t *scheduleTable) sorted() []*scheduleJob {
+	jobs := make([]*scheduleJob, 0, len(t.jobs))
+	for _, job := range t.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+func (t *scheduleTable) encode() ([]byte, error) {
+	return json.Marshal(t.sorted())
+}
+
+func decodeScheduleTable(data []byte) (*scheduleTable, error) {
+	t := newScheduleTable()
+	if len(data) == 0 {
+		return t, nil
+	}
+	var jobs []*scheduleJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		sched, err := parseCron(job.Spec)
+		if err != nil {
+			return nil, err
+		}
+		job.sched = sched
+		t.jobs[job.ID] = job
+	}
+	return t, nil
+}
+
+// runSchedule applies the jobs that are due. It's called from the tick
+// command, which makes the schedule deterministic on every server.
+func (m *machine) runSchedule() {
+	ts := m.ts
+	for _, job := range m.schedule.due(ts) {
+		err := m.runJob(job)
+		job.Last = ts
+		job.Runs++
+		job.Err = ""
+		if err != nil {
+			job.Err = err.Error()
+			logger.Debug("schedule: job '%s': %v", job.ID, err)
+		}
+		job.Next = 0
+		if next, ok := job.sched.next(time.Unix(0, ts)); ok &&
+			next.UnixNano() > ts {
+			job.Next = next.UnixNano()
+		}
+	}
+}
+
+func (m *machine) runJob(job *scheduleJob) error {
+	// the command may alter the args
+	args := append([]string(nil), job.Args...)
+	name := strings.ToLower(args[0])
+	cmd, ok := m.commands[name]
+	if !ok || cmd.kind != 'w' {
+		return fmt.Errorf("%s '%s'", ErrUnknownCommand, args[0])
+	}
+	keys := m.commandKeys(name, args)
+	if err := m.slots.check(keys); err != nil {
+		return err
+	}
+	m.touchKeys(keys, m.index)
+	_, err := cmd.fn(m, nil, args)
+	return err
+}
+
+// checkJobCommand returns an error when the command can not be scheduled.
+// Only non-internal write commands are allowed.
+func (m *machine) checkJobCommand(args []string) error {
+	name := strings.ToLower(args[0])
+	cmd, ok := m.commands[name]
+	if !ok || internalCommands[name] {
+		return fmt.Errorf("%s '%s'", ErrUnknownCommand, args[0])
+	}
+	if cmd.kind != 'w' {
+		return fmt.Errorf("command '%s' is not a write command", args[0])
+	}
+	if scriptCommand(name) {
+		return fmt.Errorf("command '%s' can not be scheduled", args[0])
+	}
+	return nil
+}
+
+// SCHEDULE subcommand args...
+// help: manages the replicated command schedule.
+func cmdSCHEDULE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 2 {
+		return nil, errWrongNumArgsSchedule
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		return cmdSCHEDULEHELP(um, ra, args)
+	case "add":
+		return cmdSCHEDULEADD(um, ra, args)
+	case "del":
+		return cmdSCHEDULEDEL(um, ra, args)
+	case "list":
+		return cmdSCHEDULELIST(um, ra, args)
+	default:
+		return nil, errUnknownScheduleCommand(args[:2])
+	}
+}
+
+// SCHEDULE HELP
+// help: returns the valid SCHEDULE related commands; []string
+func cmdSCHEDULEHELP(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsSchedule
+	}
+	lines := []redcon.SimpleString{
+		"SCHEDULE ADD id cron-expr command [arg ...]",
+		"SCHEDULE DEL id [id ...]",
+		"SCHEDULE LIST",
+	}
+	return lines, nil
+}
+
+// SCHEDULE ADD id cron-expr command [arg ...]
+// help: adds or replaces a job that applies a write command when the machine
+//       time matches the cron expression. The expression is "min hour dom
+//       month dow", with an optional leading seconds field, a macro such as
+//       @daily or @hourly, or "@every duration". All times are UTC. The keys
+//       of the command must belong to the raft group of the schedule, use
+//       GROUP to schedule in other groups.
+func cmdSCHEDULEADD(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) < 5 {
+		return nil, errWrongNumArgsSchedule
+	}
+	m := getBaseMachine(um)
+	// Validate the job prior to going through the raft log.
+	if _, err := parseCron(args[3]); err != nil {
+		return nil, err
+	}
+	if err := m.checkJobCommand(args[4:]); err != nil {
+		return nil, err
+	}
+	opts := sendOpts(um)
+	name := strings.ToLower(args[4])
+	if err := m.allowed(opts.User, 'w', name); err != nil {
+		return nil, err
+	}
+	wargs := append([]string{"schedulewrite", "add"}, args[2:]...)
+	return m.writeInternal(wargs, opts)
+}
+
+// SCHEDULE DEL id [id ...]
+// help: deletes jobs; returns the number of jobs deleted
+func cmdSCHEDULEDEL(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, errWrongNumArgsSchedule
+	}
+	wargs := append([]string{"schedulewrite", "del"}, args[2:]...)
+	return getBaseMachine(um).writeInternal(wargs, sendOpts(um))
+}
+
+// SCHEDULE LIST
+// help: returns the jobs. Each job is an array of field-value pairs for the
+//       id, spec, command, next, last, runs, and error of the last run.
+func cmdSCHEDULELIST(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsSchedule
+	}
+	m := getBaseMachine(um)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	fmtTime := func(ts int64) string {
+		if ts == 0 {
+			return ""
+		}
+		return time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+	}
+	jobs := []interface{}{}
+	for _, job := range m.schedule.sorted() {
+		jobs = append(jobs, []interface{}{
+			"id", job.ID,
+			"spec", job.Spec,
+			"command", job.Args,
+			"next", fmtTime(job.Next),
+			"last", fmtTime(job.Last),
+			"runs", redcon.SimpleInt(job.Runs),
+			"error", job.Err,
+		})
+	}
+	return jobs, nil
+}
+
+// SCHEDULEWRITE add id cron-expr command [arg ...]
+// SCHEDULEWRITE del id [id ...]
+// help: applies a schedule change. It's not possible to directly call this
+//       from a client service. It can only be called by its own internal
+//       server instance.
+func cmdSCHEDULEWRITE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 3 {
+		return nil, ErrWrongNumArgs
+	}
+	switch args[1] {
+	case "add":
+		if len(args) < 5 {
+			return nil, ErrWrongNumArgs
+		}
+		sched, err := parseCron(args[3])
+		if err != nil {
+			return nil, err
+		}
+		cargs := append([]string(nil), args[4:]...)
+		if err := m.checkJobCommand(cargs); err != nil {
+			return nil, err
+		}
+		keys := m.commandKeys(strings.ToLower(cargs[0]), cargs)
+		if err := m.slots.check(keys); err != nil {
+			return nil, err
+		}
+		next, ok := sched.next(time.Unix(0, m.ts))
+		if !ok || next.UnixNano() <= m.ts {
+			return nil, errors.New("cron expression never fires")
+		}
+		m.schedule.jobs[args[2]] = &scheduleJob{
+			ID:    args[2],
+			Spec:  args[3],
+			Args:  cargs,
+			Next:  next.UnixNano(),
+			sched: sched,
+		}
+		return redcon.SimpleString("OK"), nil
+	case "del":
+		var n int
+		for _, id := range args[2:] {
+			if _, ok := m.schedule.jobs[id]; ok {
+				delete(m.schedule.jobs, id)
+				n++
+			}
+		}
+		return redcon.SimpleInt(n), nil
+	}
+	return nil, ErrSyntax
+}
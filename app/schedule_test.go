@@ -0,0 +1,89 @@
+package app
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	base := time.Date(2024, 1, 31, 23, 59, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"*/15 * * * * *", time.Date(2024, 1, 31, 23, 59, 45, 0, time.UTC)},
+		{"30 17 * * 1-5", time.Date(2024, 2, 1, 17, 30, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2024, 2, 4, 12, 0, 0, 0, time.UTC)},
+		{"@every 1h", time.Date(2024, 2, 1, 0, 59, 30, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next, ok := s.next(base)
+		if ok != !tt.next.IsZero() || !next.Equal(tt.next) {
+			t.Fatalf("%s: expected %s, got %s %v", tt.spec, tt.next, next, ok)
+		}
+	}
+	for _, spec := range []string{"", "* * *", "60 * * * *", "5-1 * * * *",
+		"*/0 * * * *", "@every 1ms", "@often"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Fatalf("%s: expected error", spec)
+		}
+	}
+}
+
+func TestScheduleTick(t *testing.T) {
+	var count int
+	m := machineInit(Config{}, 0, "", nil)
+	m.commands["incr"] = command{'w', func(um Machine, ra *raftWrap,
+		args []string) (interface{}, error) {
+		count++
+		return nil, nil
+	}}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var seed int
+	tick := func(tm time.Time) {
+		seed++
+		_, err := cmdTICK(m, nil, []string{"tick",
+			strconv.FormatInt(tm.UnixNano(), 10), strconv.Itoa(seed)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tick(start)
+	_, err := cmdSCHEDULEWRITE(m, nil,
+		[]string{"schedulewrite", "add", "eod", "0 0 * * *", "incr"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tick(start.Add(time.Hour * 23))
+	if count != 0 {
+		t.Fatalf("expected 0, got %d", count)
+	}
+	// a late tick fires the job only once
+	tick(start.Add(time.Hour * 50))
+	if count != 1 {
+		t.Fatalf("expected 1, got %d", count)
+	}
+	data, err := m.schedule.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := decodeScheduleTable(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := st.jobs["eod"]
+	if job == nil || job.Runs != 1 || job.sched == nil ||
+		!time.Unix(0, job.Next).Equal(start.Add(time.Hour*72)) {
+		t.Fatalf("unexpected job %+v", job)
+	}
+}
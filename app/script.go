@@ -0,0 +1,627 @@
+package app
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var errNoScript = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+
+var errScriptCommand = errors.New("Unknown Redis command called from script")
+
+var errScriptNotAllowed = errors.New("This Redis command is not allowed " +
+	"from script")
+
+var errScriptArg = errors.New("Lua redis() command arguments must be " +
+	"strings or integers")
+
+// scriptTable holds the scripts that were loaded with SCRIPT LOAD, by the
+// SHA-1 digest of the script. It's only altered from inside of the Apply
+// function and is persisted in snapshots. The compiled scripts are local to
+// each server.
+type scriptTable struct {
+	scripts map[string]string
+	protos  map[string]*lua.FunctionProto
+}
+
+func newScriptTable() *scriptTable {
+	return &scriptTable{
+		scripts: make(map[string]string),
+		protos:  make(map[string]*lua.FunctionProto),
+	}
+}
+
+func (t *scriptTable) encode() ([]byte, error) {
+	scripts := make([]string, 0, len(t.scripts))
+	for _, script := range t.scripts {
+		scripts = append(scripts, script)
+	}
+	sort.Strings(scripts)
+	return json.Marshal(scripts)
+}
+
+func decodeScriptTable(data []byte) (*scriptTable, error) {
+	t := newScriptTable()
+	if len(data) == 0 {
+		return t, nil
+	}
+	var scripts []string
+	if err := json.Unmarshal(data, &scripts); err != nil {
+		return nil, err
+	}
+	for _, script := range scripts {
+		t.scripts[scriptSHA1(script)] = script
+	}
+	return t, nil
+}
+
+// proto returns the compiled script, which is cached for loaded scripts.
+func (t *scriptTable) proto(sha, script string) (*lua.FunctionProto, error) {
+	if proto := t.protos[sha]; proto != nil {
+		return proto, nil
+	}
+	proto, err := compileScript(script)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := t.scripts[sha]; ok {
+		t.protos[sha] = proto
+	}
+	return proto, nil
+}
+
+func scriptSHA1(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+func compileScript(script string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(script), "@user_script")
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling script: %v", err)
+	}
+	scriptConcatStmts(chunk)
+	proto, err := lua.Compile(chunk, "@user_script")
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling script: %v", err)
+	}
+	return proto, nil
+}
+
+// parseScriptKeys returns the keys and args of "numkeys key... arg...".
+func parseScriptKeys(args []string) (keys, argv []string, err error) {
+	if len(args) == 0 {
+		return nil, nil, ErrWrongNumArgs
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		return nil, nil, errors.New("Number of keys can't be negative")
+	}
+	if n > len(args)-1 {
+		return nil, nil, errors.New("Number of keys can't be greater " +
+			"than number of args")
+	}
+	return args[1 : 1+n], args[1+n:], nil
+}
+
+// scriptRun is a script that is running inside of the Apply function.
+type scriptRun struct {
+	m    *machine
+	user string
+}
+
+// run runs the script in a new sandbox, which only has the base, table,
+// string, and math libraries. The time and random numbers come from the
+// machine, making the results the same on every server. The script fails
+// when it runs out of its budget.
+func (r *scriptRun) run(proto *lua.FunctionProto, keys, argv []string,
+) (interface{}, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	budget := newScriptBudget()
+	L.SetContext(budget)
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load",
+		"loadstring", "require", "module", "print", "collectgarbage"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	budget.limit(L)
+	mathlib := L.GetGlobal(lua.MathLibName).(*lua.LTable)
+	L.SetField(mathlib, "random", L.NewFunction(r.random))
+	L.SetField(mathlib, "randomseed", L.NewFunction(func(*lua.LState) int {
+		return 0
+	}))
+	redis := L.NewTable()
+	L.SetField(redis, "call", L.NewFunction(func(L *lua.LState) int {
+		return r.call(L, false)
+	}))
+	L.SetField(redis, "pcall", L.NewFunction(func(L *lua.LState) int {
+		return r.call(L, true)
+	}))
+	L.SetField(redis, "error_reply", L.NewFunction(func(L *lua.LState) int {
+		t := L.NewTable()
+		L.SetField(t, "err", lua.LString(L.CheckString(1)))
+		L.Push(t)
+		return 1
+	}))
+	L.SetField(redis, "status_reply", L.NewFunction(func(L *lua.LState) int {
+		t := L.NewTable()
+		L.SetField(t, "ok", lua.LString(L.CheckString(1)))
+		L.Push(t)
+		return 1
+	}))
+	L.SetField(redis, "sha1hex", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(scriptSHA1(L.CheckString(1))))
+		return 1
+	}))
+	L.SetField(redis, "time", L.NewFunction(func(L *lua.LState) int {
+		now := r.m.Now()
+		t := L.NewTable()
+		t.Append(lua.LNumber(now.Unix()))
+		t.Append(lua.LNumber(now.Nanosecond() / 1000))
+		L.Push(t)
+		return 1
+	}))
+	L.SetGlobal("redis", redis)
+	L.SetGlobal("KEYS", scriptStrings(L, keys))
+	L.SetGlobal("ARGV", scriptStrings(L, argv))
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		if aerr, ok := err.(*lua.ApiError); ok {
+			return nil, fmt.Errorf("Error running script: %s",
+				aerr.Object.String())
+		}
+		return nil, fmt.Errorf("Error running script: %v", err)
+	}
+	if budget.err != nil {
+		// the error was caught by the script
+		return nil, fmt.Errorf("Error running script: %v", budget.err)
+	}
+	return scriptResponse(L.Get(-1))
+}
+
+// random is math.random, which uses the machine random numbers.
+func (r *scriptRun) random(L *lua.LState) int {
+	f := float64(r.m.Uint64()>>11) / (1 << 53)
+	switch L.GetTop() {
+	case 0:
+		L.Push(lua.LNumber(f))
+	case 1:
+		n := L.CheckInt64(1)
+		if n < 1 {
+			L.ArgError(1, "interval is empty")
+		}
+		L.Push(lua.LNumber(math.Floor(f*float64(n)) + 1))
+	default:
+		lo, hi := L.CheckInt64(1), L.CheckInt64(2)
+		if lo > hi {
+			L.ArgError(2, "interval is empty")
+		}
+		L.Push(lua.LNumber(math.Floor(f*float64(hi-lo+1)) + float64(lo)))
+	}
+	return 1
+}
+
+// call is redis.call and redis.pcall. Errors from a protected call are
+// returned as an error table, otherwise they stop the script.
+func (r *scriptRun) call(L *lua.LState, protected bool) int {
+	resp, err := r.exec(L)
+	if err != nil {
+		if protected {
+			t := L.NewTable()
+			L.SetField(t, "err", lua.LString(err.Error()))
+			L.Push(t)
+			return 1
+		}
+		L.Error(lua.LString(err.Error()), 0)
+		return 0
+	}
+	L.Push(scriptValue(L, resp))
+	return 1
+}
+
+func (r *scriptRun) exec(L *lua.LState) (interface{}, error) {
+	args := make([]string, L.GetTop())
+	for i := range args {
+		switch v := L.Get(i + 1).(type) {
+		case lua.LString:
+			args[i] = string(v)
+		case lua.LNumber:
+			args[i] = scriptNumber(float64(v))
+		default:
+			return nil, errScriptArg
+		}
+	}
+	if len(args) == 0 {
+		return nil, errors.New("Please specify at least one argument " +
+			"for redis.call()")
+	}
+	m := r.m
+	name := strings.ToLower(args[0])
+	cmd, ok := m.command(name)
+	if !ok || internalCommands[name] || (cmd.kind != 'r' && cmd.kind != 'w') {
+		return nil, errScriptCommand
+	}
+	if scriptCommand(name) {
+		return nil, errScriptNotAllowed
+	}
+	if !m.acl.allowed(r.user, cmd.kind, name) {
+		return nil, ErrNoPermission
+	}
+	if cmd.kind == 'w' {
+		keys := m.commandKeys(name, args)
+		if err := m.slots.check(keys); err != nil {
+			return nil, err
+		}
+		m.touchKeys(keys, m.index)
+	}
+	return cmd.fn(m, nil, args)
+}
+
+func scriptNumber(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', 17, 64)
+}
+
+func scriptStrings(L *lua.LState, vals []string) *lua.LTable {
+	t := L.NewTable()
+	for _, v := range vals {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+// scriptValue converts a command response to a Lua value, using the same
+// rules as Redis.
+func scriptValue(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case nil:
+		return lua.LFalse
+	case error:
+		t := L.NewTable()
+		L.SetField(t, "err", lua.LString(v.Error()))
+		return t
+	case redcon.SimpleString:
+		t := L.NewTable()
+		L.SetField(t, "ok", lua.LString(v))
+		return t
+	case redcon.SimpleInt:
+		return lua.LNumber(v)
+	case int:
+		return lua.LNumber(v)
+	case int64:
+		return lua.LNumber(v)
+	case uint64:
+		return lua.LNumber(v)
+	case bool:
+		if v {
+			return lua.LNumber(1)
+		}
+		return lua.LFalse
+	case string:
+		return lua.LString(v)
+	case []byte:
+		return lua.LString(v)
+	case []string:
+		t := L.NewTable()
+		for _, s := range v {
+			t.Append(lua.LString(s))
+		}
+		return t
+	case []redcon.SimpleString:
+		t := L.NewTable()
+		for _, s := range v {
+			t.Append(scriptValue(L, s))
+		}
+		return t
+	case []interface{}:
+		t := L.NewTable()
+		for _, item := range v {
+			t.Append(scriptValue(L, item))
+		}
+		return t
+	}
+	return lua.LString(fmt.Sprint(v))
+}
+
+// scriptResponse converts the Lua value that was returned by a script to a
+// command response, using the same rules as Redis.
+func scriptResponse(v lua.LValue) (interface{}, error) {
+	switch v := v.(type) {
+	case lua.LNumber:
+		return redcon.SimpleInt(int64(v)), nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LBool:
+		if v {
+			return redcon.SimpleInt(1), nil
+		}
+		return nil, nil
+	case *lua.LTable:
+		if s, ok := v.RawGetString("err").(lua.LString); ok {
+			return nil, errors.New(string(s))
+		}
+		if s, ok := v.RawGetString("ok").(lua.LString); ok {
+			return redcon.SimpleString(s), nil
+		}
+		var vals []interface{}
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			val, err := scriptResponse(item)
+			if err != nil {
+				val = err
+			}
+			vals = append(vals, val)
+		}
+		if vals == nil {
+			vals = []interface{}{}
+		}
+		return vals, nil
+	}
+	return nil, nil
+}
+
+// EVAL script numkeys key... arg...
+// help: runs a Lua script, which may call the read and write commands using
+//       redis.call. The script runs atomically in a single raft log entry.
+//       It fails when it runs more than 50 million Lua instructions or
+//       makes more than 512 MB of strings.
+func cmdEVAL(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	// the service sends the script as a SCRIPTWRITE run
+	return nil, errScriptNotAllowed
+}
+
+// EVALSHA sha1 numkeys key... arg...
+// help: runs a script that was loaded with SCRIPT LOAD.
+func cmdEVALSHA(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	// the service sends the script as a SCRIPTWRITE runsha
+	return nil, errScriptNotAllowed
+}
+
+// scriptCommand returns true for EVAL and EVALSHA, which are write commands
+// that the service sends to the raft log as SCRIPTWRITE run and runsha.
+// They can not be called from a script or a scheduled job.
+func scriptCommand(name string) bool {
+	return name == "eval" || name == "evalsha"
+}
+
+// scriptWriteArgs returns the SCRIPTWRITE command that runs the EVAL or
+// EVALSHA args as the user, whose permissions are checked for every command
+// that the script calls. The script and keys are checked prior to going
+// through the raft log.
+func scriptWriteArgs(args []string, user string) ([]string, error) {
+	if len(args) < 3 {
+		return nil, ErrWrongNumArgs
+	}
+	if _, _, err := parseScriptKeys(args[2:]); err != nil {
+		return nil, err
+	}
+	if strings.ToLower(args[0]) == "evalsha" {
+		return append([]string{"scriptwrite", "runsha", user,
+			strings.ToLower(args[1])}, args[2:]...), nil
+	}
+	if _, err := compileScript(args[1]); err != nil {
+		return nil, err
+	}
+	return append([]string{"scriptwrite", "run", user, args[1]},
+		args[2:]...), nil
+}
+
+// scriptRunArgs returns true for the SCRIPTWRITE run and runsha commands,
+// which are allowed in a transaction.
+func scriptRunArgs(args []string) bool {
+	return len(args) > 3 && strings.ToLower(args[0]) == "scriptwrite" &&
+		(args[1] == "run" || args[1] == "runsha")
+}
+
+// scriptEvalArgs returns the EVAL or EVALSHA args of a SCRIPTWRITE run or
+// runsha, for the latency stats and slow log. Other args are returned as is.
+func scriptEvalArgs(args []string) []string {
+	if !scriptRunArgs(args) {
+		return args
+	}
+	name := "eval"
+	if args[1] == "runsha" {
+		name = "evalsha"
+	}
+	return append([]string{name}, args[3:]...)
+}
+
+// SCRIPT subcommand args...
+// help: manages the loaded scripts.
+func cmdSCRIPT(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 2 {
+		return nil, errWrongNumArgsScript
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		return cmdSCRIPTHELP(um, ra, args)
+	case "load":
+		return cmdSCRIPTLOAD(um, ra, args)
+	case "exists":
+		return cmdSCRIPTEXISTS(um, ra, args)
+	case "flush":
+		return cmdSCRIPTFLUSH(um, ra, args)
+	default:
+		return nil, errUnknownScriptCommand(args[:2])
+	}
+}
+
+// SCRIPT HELP
+// help: returns the valid SCRIPT related commands; []string
+func cmdSCRIPTHELP(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsScript
+	}
+	lines := []redcon.SimpleString{
+		"SCRIPT LOAD script",
+		"SCRIPT EXISTS sha1 [sha1 ...]",
+		"SCRIPT FLUSH",
+	}
+	return lines, nil
+}
+
+// SCRIPT LOAD script
+// help: loads a script on all servers; returns the SHA-1 digest of the
+//       script.
+func cmdSCRIPTLOAD(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumArgsScript
+	}
+	if _, err := compileScript(args[2]); err != nil {
+		return nil, err
+	}
+	m := getBaseMachine(um)
+	return m.writeAllGroups([]string{"scriptwrite", "load", args[2]},
+		sendOpts(um))
+}
+
+// SCRIPT EXISTS sha1 [sha1 ...]
+// help: returns 1 for every script that is loaded, otherwise 0.
+func cmdSCRIPTEXISTS(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, errWrongNumArgsScript
+	}
+	m := getBaseMachine(um)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var resp []interface{}
+	for _, sha := range args[2:] {
+		if _, ok := m.scripts.scripts[strings.ToLower(sha)]; ok {
+			resp = append(resp, redcon.SimpleInt(1))
+		} else {
+			resp = append(resp, redcon.SimpleInt(0))
+		}
+	}
+	return resp, nil
+}
+
+// SCRIPT FLUSH
+// help: unloads all scripts.
+func cmdSCRIPTFLUSH(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsScript
+	}
+	m := getBaseMachine(um)
+	return m.writeAllGroups([]string{"scriptwrite", "flush"}, sendOpts(um))
+}
+
+// SCRIPTWRITE load script
+// SCRIPTWRITE flush
+// SCRIPTWRITE run user script numkeys key... arg...
+// SCRIPTWRITE runsha user sha1 numkeys key... arg...
+// help: applies a script change or runs a script. It's not possible to
+//       directly call this from a client service. It can only be called by
+//       its own internal server instance.
+func cmdSCRIPTWRITE(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 2 {
+		return nil, ErrWrongNumArgs
+	}
+	switch args[1] {
+	case "load":
+		if len(args) != 3 {
+			return nil, ErrWrongNumArgs
+		}
+		sha := scriptSHA1(args[2])
+		m.scripts.scripts[sha] = args[2]
+		return sha, nil
+	case "flush":
+		m.scripts = newScriptTable()
+		return redcon.SimpleString("OK"), nil
+	case "run", "runsha":
+		if len(args) < 5 {
+			return nil, ErrWrongNumArgs
+		}
+		script, sha := args[3], args[3]
+		if args[1] == "run" {
+			sha = scriptSHA1(script)
+		} else {
+			var ok bool
+			if script, ok = m.scripts.scripts[sha]; !ok {
+				return nil, errNoScript
+			}
+		}
+		keys, argv, err := parseScriptKeys(args[4:])
+		if err != nil {
+			return nil, err
+		}
+		if err := m.slots.check(keys); err != nil {
+			return nil, err
+		}
+		proto, err := m.scripts.proto(sha, script)
+		if err != nil {
+			return nil, err
+		}
+		return m.runScript(args[2], proto, keys, argv)
+	}
+	return nil, ErrSyntax
+}
+
+// runScript runs the script as the user. When the data is Undoable, the
+// changes that were made by a failed script are rolled back.
+func (m *machine) runScript(user string, proto *lua.FunctionProto,
+	keys, argv []string,
+) (interface{}, error) {
+	undo, _ := m.data.(Undoable)
+	if m.savepoint {
+		// the transaction rolls back the changes
+		undo = nil
+	}
+	if undo != nil {
+		undo.Savepoint()
+	}
+	ts, seed := m.ts, m.seed
+	r := &scriptRun{m: m, user: user}
+	resp, err := r.run(proto, keys, argv)
+	if undo != nil {
+		if err != nil {
+			undo.Rollback()
+			m.ts, m.seed = ts, seed
+		} else {
+			undo.Release()
+		}
+	}
+	return resp, err
+}
@@ -0,0 +1,352 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+)
+
+// scriptMaxSteps is the number of Lua instructions that a script can run.
+const scriptMaxSteps = 50000000
+
+// scriptMaxBytes is the total size of the strings that a script can make.
+const scriptMaxBytes = 512 << 20
+
+var errScriptSteps = errors.New("script ran out of steps")
+
+var errScriptBytes = errors.New("script ran out of string memory")
+
+// scriptConcatName is the global function that the ".." operator of a
+// script is compiled to call. It's not a valid Lua name, so a script can not
+// shadow it with a local.
+const scriptConcatName = " concat"
+
+// scriptBudget limits the work of a script, using counts that are the same
+// on every server, so a script that runs out fails with the same error
+// everywhere.
+//
+// It's the context of the Lua state, because the VM calls Done prior to
+// every instruction, which counts the steps. Tables grow by at most a few
+// entries for every step. Strings can grow much faster, so the string
+// functions and the ".." operator take the size of the strings that they
+// make from the bytes.
+type scriptBudget struct {
+	context.Context
+	steps int64 // remaining instructions
+	bytes int64 // remaining string bytes
+	err   error
+	done  chan struct{}
+}
+
+func newScriptBudget() *scriptBudget {
+	return &scriptBudget{
+		Context: context.Background(),
+		steps:   scriptMaxSteps,
+		bytes:   scriptMaxBytes,
+		done:    make(chan struct{}),
+	}
+}
+
+// Done uses one step. The returned channel is closed once the budget is
+// used up, which stops the script.
+func (b *scriptBudget) Done() <-chan struct{} {
+	if b.err == nil {
+		if b.steps--; b.steps >= 0 {
+			return nil
+		}
+		b.fail(errScriptSteps)
+	}
+	return b.done
+}
+
+func (b *scriptBudget) Err() error {
+	return b.err
+}
+
+func (b *scriptBudget) fail(err error) {
+	if b.err == nil {
+		b.err = err
+		close(b.done)
+	}
+}
+
+// check raises an error when a string of n bytes does not fit in the
+// budget.
+func (b *scriptBudget) check(L *lua.LState, n int64) {
+	if b.err == nil && n > b.bytes {
+		b.fail(errScriptBytes)
+	}
+	if b.err != nil {
+		L.RaiseError(b.err.Error())
+	}
+}
+
+// use takes a string of n bytes from the budget.
+func (b *scriptBudget) use(L *lua.LState, n int) {
+	b.check(L, int64(n))
+	b.bytes -= int64(n)
+}
+
+// limit replaces the functions of the state that make strings with ones
+// that use the budget.
+func (b *scriptBudget) limit(L *lua.LState) {
+	strlib := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	strlib.ForEach(func(k, v lua.LValue) {
+		fn, ok := v.(*lua.LFunction)
+		if !ok || !fn.IsG {
+			return
+		}
+		var check func(L *lua.LState)
+		switch k.String() {
+		case "rep":
+			check = b.checkRep
+		case "format":
+			check = b.checkFormat
+		case "gsub":
+			check = b.checkGsub
+		}
+		L.SetField(strlib, k.String(), L.NewFunction(b.wrap(fn.GFunction,
+			check)))
+	})
+	tablib := L.GetGlobal(lua.TabLibName).(*lua.LTable)
+	if fn, ok := L.GetField(tablib, "concat").(*lua.LFunction); ok && fn.IsG {
+		L.SetField(tablib, "concat", L.NewFunction(b.wrap(fn.GFunction,
+			b.checkTableConcat)))
+	}
+	L.SetGlobal(scriptConcatName, L.NewFunction(b.concat))
+}
+
+// wrap returns the function, which takes its string results from the
+// budget. The check is called first, for the functions that can make a
+// string that is much larger than their arguments.
+func (b *scriptBudget) wrap(fn lua.LGFunction, check func(L *lua.LState),
+) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if check != nil {
+			check(L)
+		}
+		n := fn(L)
+		for i := L.GetTop() - n + 1; i <= L.GetTop(); i++ {
+			if s, ok := L.Get(i).(lua.LString); ok {
+				b.use(L, len(s))
+			}
+		}
+		return n
+	}
+}
+
+// checkRep checks string.rep(s, n).
+func (b *scriptBudget) checkRep(L *lua.LState) {
+	s, n := L.CheckString(1), L.CheckInt(2)
+	if len(s) > 0 && n > 0 && int64(n) > b.bytes/int64(len(s)) {
+		b.fail(errScriptBytes)
+	}
+	b.check(L, 0)
+}
+
+// checkFormat checks string.format(fmt, ...). Like Lua, the width and
+// precision are at most two digits.
+func (b *scriptBudget) checkFormat(L *lua.LState) {
+	format := L.CheckString(1)
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			continue
+		}
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for part := 0; part < 2; part++ {
+			digits := 0
+			for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+				i++
+				digits++
+			}
+			if digits > 2 {
+				L.RaiseError("invalid format (width or precision too long)")
+			}
+			if part == 0 && i < len(format) && format[i] == '.' {
+				i++
+			} else {
+				break
+			}
+		}
+		if i == len(format) || !(format[i] >= 'a' && format[i] <= 'z' ||
+			format[i] >= 'A' && format[i] <= 'Z') {
+			L.RaiseError("invalid format")
+		}
+	}
+}
+
+// checkGsub checks string.gsub(s, pattern, repl [, n]). The matches do not
+// overlap, so a string replacement with captures is at most the length of
+// the replacement for each match plus the length of the string for every
+// capture. The results of a function or table replacement are taken from the
+// budget as they are made.
+func (b *scriptBudget) checkGsub(L *lua.LState) {
+	s := L.CheckString(1)
+	switch repl := L.Get(3).(type) {
+	case lua.LString:
+		n := int64(len(s)) + 1
+		b.check(L, int64(len(s))+n*int64(len(repl))+
+			int64(strings.Count(string(repl), "%"))*int64(len(s)))
+	case *lua.LFunction, *lua.LTable:
+		L.Replace(3, L.NewFunction(func(L *lua.LState) int {
+			if t, ok := repl.(*lua.LTable); ok {
+				L.Push(L.GetTable(t, L.Get(1)))
+			} else {
+				top := L.GetTop()
+				L.Push(repl)
+				for i := 1; i <= top; i++ {
+					L.Push(L.Get(i))
+				}
+				L.Call(top, 1)
+			}
+			if s, ok := L.Get(-1).(lua.LString); ok {
+				b.use(L, len(s))
+			}
+			return 1
+		}))
+	}
+}
+
+// checkTableConcat checks table.concat(t [, sep [, i [, j]]]).
+func (b *scriptBudget) checkTableConcat(L *lua.LState) {
+	t := L.CheckTable(1)
+	sep := L.OptString(2, "")
+	i := L.OptInt(3, 1)
+	j := L.OptInt(4, t.Len())
+	var n int64
+	for k := i; k <= j; k++ {
+		v := t.RawGetInt(k)
+		if !lua.LVCanConvToString(v) {
+			// table.concat fails with its own error
+			return
+		}
+		n += int64(len(lua.LVAsString(v)))
+		if k < j {
+			n += int64(len(sep))
+		}
+		b.check(L, n)
+	}
+}
+
+// concat is the ".." operator.
+func (b *scriptBudget) concat(L *lua.LState) int {
+	lhs, rhs := L.Get(1), L.Get(2)
+	if lua.LVCanConvToString(lhs) && lua.LVCanConvToString(rhs) {
+		ls, rs := lua.LVAsString(lhs), lua.LVAsString(rhs)
+		b.use(L, len(ls)+len(rs))
+		L.Push(lua.LString(ls + rs))
+		return 1
+	}
+	op := L.GetMetaField(lhs, "__concat")
+	if op == lua.LNil {
+		op = L.GetMetaField(rhs, "__concat")
+	}
+	if op.Type() != lua.LTFunction {
+		L.RaiseError("cannot perform concat operation between %v and %v",
+			lhs.Type().String(), rhs.Type().String())
+	}
+	L.Push(op)
+	L.Push(lhs)
+	L.Push(rhs)
+	L.Call(2, 1)
+	return 1
+}
+
+// scriptConcatStmts changes every ".." operator in the statements to a call
+// of the scriptConcatName function.
+func scriptConcatStmts(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.AssignStmt:
+			scriptConcatExprs(s.Lhs)
+			scriptConcatExprs(s.Rhs)
+		case *ast.LocalAssignStmt:
+			scriptConcatExprs(s.Exprs)
+		case *ast.FuncCallStmt:
+			s.Expr = scriptConcat(s.Expr)
+		case *ast.DoBlockStmt:
+			scriptConcatStmts(s.Stmts)
+		case *ast.WhileStmt:
+			s.Condition = scriptConcat(s.Condition)
+			scriptConcatStmts(s.Stmts)
+		case *ast.RepeatStmt:
+			s.Condition = scriptConcat(s.Condition)
+			scriptConcatStmts(s.Stmts)
+		case *ast.IfStmt:
+			s.Condition = scriptConcat(s.Condition)
+			scriptConcatStmts(s.Then)
+			scriptConcatStmts(s.Else)
+		case *ast.NumberForStmt:
+			s.Init = scriptConcat(s.Init)
+			s.Limit = scriptConcat(s.Limit)
+			s.Step = scriptConcat(s.Step)
+			scriptConcatStmts(s.Stmts)
+		case *ast.GenericForStmt:
+			scriptConcatExprs(s.Exprs)
+			scriptConcatStmts(s.Stmts)
+		case *ast.FuncDefStmt:
+			scriptConcatStmts(s.Func.Stmts)
+		case *ast.ReturnStmt:
+			scriptConcatExprs(s.Exprs)
+		}
+	}
+}
+
+func scriptConcatExprs(exprs []ast.Expr) {
+	for i := range exprs {
+		exprs[i] = scriptConcat(exprs[i])
+	}
+}
+
+func scriptConcat(expr ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.StringConcatOpExpr:
+		fn := &ast.IdentExpr{Value: scriptConcatName}
+		fn.SetLine(e.Line())
+		fn.SetLastLine(e.LastLine())
+		call := &ast.FuncCallExpr{Func: fn, AdjustRet: true,
+			Args: []ast.Expr{scriptConcat(e.Lhs), scriptConcat(e.Rhs)}}
+		call.SetLine(e.Line())
+		call.SetLastLine(e.LastLine())
+		return call
+	case *ast.AttrGetExpr:
+		e.Object = scriptConcat(e.Object)
+		e.Key = scriptConcat(e.Key)
+	case *ast.TableExpr:
+		for _, f := range e.Fields {
+			f.Key = scriptConcat(f.Key)
+			f.Value = scriptConcat(f.Value)
+		}
+	case *ast.FuncCallExpr:
+		e.Func = scriptConcat(e.Func)
+		e.Receiver = scriptConcat(e.Receiver)
+		scriptConcatExprs(e.Args)
+	case *ast.LogicalOpExpr:
+		e.Lhs = scriptConcat(e.Lhs)
+		e.Rhs = scriptConcat(e.Rhs)
+	case *ast.RelationalOpExpr:
+		e.Lhs = scriptConcat(e.Lhs)
+		e.Rhs = scriptConcat(e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		e.Lhs = scriptConcat(e.Lhs)
+		e.Rhs = scriptConcat(e.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		e.Expr = scriptConcat(e.Expr)
+	case *ast.UnaryNotOpExpr:
+		e.Expr = scriptConcat(e.Expr)
+	case *ast.UnaryLenOpExpr:
+		e.Expr = scriptConcat(e.Expr)
+	case *ast.FunctionExpr:
+		scriptConcatStmts(e.Stmts)
+	}
+	return expr
+}
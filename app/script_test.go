@@ -0,0 +1,181 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+func testScriptMachine() *machine {
+	var conf Config
+	conf.def()
+	conf.AddWriteCommand("set", func(m Machine, args []string,
+	) (interface{}, error) {
+		m.Data().(map[string]string)[args[1]] = args[2]
+		return redcon.SimpleString("OK"), nil
+	})
+	conf.AddReadCommand("get", func(m Machine, args []string,
+	) (interface{}, error) {
+		if v, ok := m.Data().(map[string]string)[args[1]]; ok {
+			return v, nil
+		}
+		return nil, nil
+	})
+	m := machineInit(conf, 0, "", nil)
+	m.data = map[string]string{}
+	return m
+}
+
+func TestScripts(t *testing.T) {
+	m := testScriptMachine()
+	run := func(script string, args ...string) (interface{}, error) {
+		return cmdSCRIPTWRITE(m, nil,
+			append([]string{"scriptwrite", "run", "", script}, args...))
+	}
+	for _, tc := range []struct {
+		script string
+		args   []string
+		expect interface{}
+	}{
+		{"redis.call('set', KEYS[1], ARGV[1]) return redis.call('get', KEYS[1])",
+			[]string{"1", "a", "5"}, "5"},
+		{"return redis.call('get', 'missing')", []string{"0"}, nil},
+		{"return {1, 'x', redis.call('set', 'b', 2), false, 'y', nil, 'z'}",
+			[]string{"0"}, []interface{}{redcon.SimpleInt(1), "x",
+				redcon.SimpleString("OK"), nil, "y"}},
+		{"local n = math.random(10) return n >= 1 and n <= 10", []string{"0"},
+			redcon.SimpleInt(1)},
+		{"return redis.pcall('scriptwrite', 'flush')['err']", []string{"0"},
+			errScriptCommand.Error()},
+		{"return redis.sha1hex('')", []string{"0"},
+			"da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+	} {
+		resp, err := run(tc.script, tc.args...)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.script, err)
+		}
+		if !reflect.DeepEqual(resp, tc.expect) {
+			t.Fatalf("%s: expected %#v, got %#v", tc.script, tc.expect, resp)
+		}
+	}
+	if v := m.data.(map[string]string)["b"]; v != "2" {
+		t.Fatalf("expected 2, got %q", v)
+	}
+	for _, script := range []string{
+		"return redis.call('nope')",
+		"return redis.error_reply('bad')",
+		"return os.time()",
+		"error('x')",
+	} {
+		if _, err := run(script, "0"); err == nil {
+			t.Fatalf("%s: expected error", script)
+		}
+	}
+	if _, err := run("return 1", "2", "a"); err == nil {
+		t.Fatal("expected numkeys error")
+	}
+
+	// loaded scripts
+	script := "return ARGV[1] .. KEYS[1]"
+	sha, err := cmdSCRIPTWRITE(m, nil, []string{"scriptwrite", "load", script})
+	if err != nil || sha != scriptSHA1(script) {
+		t.Fatalf("unexpected %v %v", sha, err)
+	}
+	resp, err := cmdSCRIPTWRITE(m, nil, []string{"scriptwrite", "runsha", "",
+		sha.(string), "1", "k", "v"})
+	if err != nil || resp != "vk" {
+		t.Fatalf("unexpected %v %v", resp, err)
+	}
+	data, err := m.scripts.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scripts, err := decodeScriptTable(data)
+	if err != nil || scripts.scripts[sha.(string)] != script {
+		t.Fatalf("expected restored script, got %v %v", scripts.scripts, err)
+	}
+	cmdSCRIPTWRITE(m, nil, []string{"scriptwrite", "flush"})
+	_, err = cmdSCRIPTWRITE(m, nil, []string{"scriptwrite", "runsha", "",
+		sha.(string), "0"})
+	if err != errNoScript {
+		t.Fatalf("expected %v, got %v", errNoScript, err)
+	}
+}
+
+func TestScriptBudget(t *testing.T) {
+	m := testScriptMachine()
+	run := func(script string) (interface{}, error) {
+		return cmdSCRIPTWRITE(m, nil,
+			[]string{"scriptwrite", "run", "", script, "0"})
+	}
+	for _, tc := range []struct {
+		script string
+		expect interface{}
+	}{
+		{"return ('a'):rep(3) .. 1 .. 'b'", "aaa1b"},
+		{"return table.concat({'a', 'b', 3}, ',')", "a,b,3"},
+		{"return string.format('%5.2f|%-3s|', 1.5, 'x')", " 1.50|x  |"},
+		{"return (string.gsub('abc', '%w', '<%0>'))", "<a><b><c>"},
+		{"return (string.gsub('abc', '%w', function(c) return c .. c end))",
+			"aabbcc"},
+		{"return (string.gsub('abc', '%w', {a = '1'}))", "1bc"},
+		{"local t = setmetatable({}, {__concat = function() return 'm' end}) " +
+			"return t .. 'x'", "m"},
+	} {
+		resp, err := run(tc.script)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.script, err)
+		}
+		if !reflect.DeepEqual(resp, tc.expect) {
+			t.Fatalf("%s: expected %#v, got %#v", tc.script, tc.expect, resp)
+		}
+	}
+	for _, tc := range []struct {
+		script string
+		expect error
+	}{
+		{"while true do end", errScriptSteps},
+		{"while true do pcall(function() while true do end end) end",
+			errScriptSteps},
+		{"pcall(function() while true do end end) return 1", errScriptSteps},
+		{"return string.rep('x', 1024 * 1024 * 1024)", errScriptBytes},
+		{"local s = 'x' for i = 1, 40 do s = s .. s end return #s",
+			errScriptBytes},
+		{"local s = string.rep('x', 1024 * 1024) local t = {} " +
+			"for i = 1, 1024 do t[i] = s end return #table.concat(t)",
+			errScriptBytes},
+		{"local s = string.rep('x', 1024 * 1024) " +
+			"return #string.gsub(s, 'x', function() return s end)",
+			errScriptBytes},
+	} {
+		_, err := run(tc.script)
+		if err == nil || !strings.Contains(err.Error(), tc.expect.Error()) {
+			t.Fatalf("%s: expected %v, got %v", tc.script, tc.expect, err)
+		}
+	}
+	if _, err := run("return string.format('%100d', 1)"); err == nil {
+		t.Fatal("expected format error")
+	}
+	if _, err := run("return redis.call('eval', 'return 1', '0')"); err == nil ||
+		!strings.Contains(err.Error(), errScriptNotAllowed.Error()) {
+		t.Fatalf("expected %v, got %v", errScriptNotAllowed, err)
+	}
+
+	// EVAL is sent as a SCRIPTWRITE run, with the keys after numkeys
+	args := []string{"eval", "return 1", "2", "a", "b", "c"}
+	if keys := m.commandKeys("eval", args); !reflect.DeepEqual(keys,
+		[]string{"a", "b"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	wargs, err := scriptWriteArgs(args, "bob")
+	if err != nil || !reflect.DeepEqual(wargs, []string{"scriptwrite", "run",
+		"bob", "return 1", "2", "a", "b", "c"}) {
+		t.Fatalf("unexpected %v %v", wargs, err)
+	}
+	if _, err := scriptWriteArgs([]string{"eval", "return 1", "3", "a"},
+		""); err == nil {
+		t.Fatal("expected numkeys error")
+	}
+}
@@ -27,10 +27,16 @@ type serverEntry struct {
 	address string
 	resolve string
 	leader  bool
+	group   int
 }
 
 func (e *serverEntry) clusterID() string {
-	src := sha1.Sum([]byte(e.id))
+	id := e.id
+	if e.group > 0 {
+		// each group is a separate node in the cluster
+		id += "/" + strconv.Itoa(e.group)
+	}
+	src := sha1.Sum([]byte(id))
 	return hex.EncodeToString(src[:])
 }
 
@@ -71,6 +77,7 @@ func (ra *raftWrap) getServerList() ([]serverEntry, error) {
 			entry.resolve = entry.address
 		}
 		entry.leader = entry.resolve == leader || entry.address == leader
+		entry.group = ra.group
 		servers = append(servers, entry)
 	}
 	return servers, nil
@@ -137,38 +144,64 @@ func serverInit(conf Config, tlscfg *tls.Config) (*splitServer, net.Addr) {
 	if conf.ServerReady != nil {
 		conf.ServerReady(ln.Addr().String(), conf.Auth, tlscfg)
 	}
-	return newSplitServer(ln), ln.Addr()
+	return newSplitServer(ln, faultInit(conf)), ln.Addr()
 }
 
-func parseTLSConfig(certFile, keyFile string) (*tls.Config, error) {
-	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+func parseTLSConfig(certFile, keyFile, caFile string) (*tls.Config,
+	*certReloader, error,
+) {
+	rl, err := newCertReloader(certFile, keyFile, caFile)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	tlscfg := &tls.Config{
-		Certificates: []tls.Certificate{pair},
+		GetCertificate:       rl.getCertificate,
+		GetClientCertificate: rl.getClientCertificate,
 	}
-	for _, cert := range pair.Certificate {
+	for _, cert := range rl.certificate().Certificate {
 		pcert, err := x509.ParseCertificate(cert)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if len(pcert.DNSNames) > 0 {
 			tlscfg.ServerName = pcert.DNSNames[0]
 			break
 		}
 	}
-	return tlscfg, nil
+	if caFile != "" {
+		// Mutual TLS. All incoming connections, including the raft
+		// transport, must present a client certificate that is signed by the
+		// CA. Outgoing connections verify the remote server using the same
+		// CA. The CA is reloaded along with the certificate, so the pool is
+		// taken from the reloader for every connection.
+		tlscfg.ClientCAs = rl.certPool()
+		tlscfg.ClientAuth = tls.RequireAndVerifyClientCert
+		tlscfg.RootCAs = rl.certPool()
+		tlscfg.InsecureSkipVerify = true // verified by VerifyConnection
+		tlscfg.VerifyConnection = rl.verifyServer
+		tlscfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config,
+			error,
+		) {
+			cfg := tlscfg.Clone()
+			cfg.ClientCAs = rl.certPool()
+			cfg.VerifyConnection = nil
+			cfg.GetConfigForClient = nil
+			return cfg, nil
+		}
+	}
+	return tlscfg, rl, nil
 }
 
 func tlsInit(conf Config) *tls.Config {
 	if conf.TLSCertPath == "" || conf.TLSKeyPath == "" {
 		return nil
 	}
-	tlscfg, err := parseTLSConfig(conf.TLSCertPath, conf.TLSKeyPath)
+	tlscfg, rl, err := parseTLSConfig(conf.TLSCertPath, conf.TLSKeyPath,
+		conf.TLSCAPath)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	go runCertReloader(rl)
 	return tlscfg
 }
 
@@ -179,10 +212,11 @@ type splitServer struct {
 	ln net.Listener
 	//log      zerolog.Logger
 	matchers []*matcher
+	faults   *faultTable // injected raft transport faults, nil when off
 }
 
-func newSplitServer(ln net.Listener) *splitServer {
-	return &splitServer{ln: ln}
+func newSplitServer(ln net.Listener, faults *faultTable) *splitServer {
+	return &splitServer{ln: ln, faults: faults}
 }
 
 func (m *splitServer) serve() error {
@@ -32,7 +32,7 @@ func startUserServices(conf Config, svr *splitServer, m *machine, ra *raftWrap)
 			}
 			return 0, s.sniff(rd)
 		})
-		go s.serve(newService(m, ra, conf.Auth), ln)
+		go s.serve(newService(conf, m, ra), ln)
 	}
 	if conf.InitRunQuit {
 		logger.Notice("init run quit")
@@ -51,6 +51,21 @@ type SendOptions struct {
 	From           interface{}
 	AllowOpenReads bool
 	DenyOpenReads  bool
+	// User is the ACL user that the client authenticated as. An empty User
+	// is the default user.
+	User string
+	// Addr is the remote address of the client connection.
+	Addr string
+	// ClientID and Seq are optional and used for deduplicating write
+	// commands. A client that retries a write with the same ClientID and
+	// Seq receives the original response, and the command is not applied a
+	// second time. Seq must be greater than zero and should increase with
+	// every new write from the client.
+	ClientID string
+	Seq      uint64
+	// ConnID is the id of the connection in the client registry, which is
+	// set by Service.Register.
+	ConnID uint64
 }
 
 var defSendOpts = &SendOptions{}
@@ -69,6 +84,9 @@ type Message struct {
 	// Addr is the remote TCP address of the connection that generated
 	// this message.
 	Addr string
+	// Index is the raft log index of an applied write, which is only set
+	// for observers with the Applied option.
+	Index uint64
 }
 
 // Service is a client facing service.
@@ -77,12 +95,38 @@ type Service interface {
 	Send(args []string, opts *SendOptions) Receiver
 	// Auth authorizes a client
 	Auth(auth string) error
+	// AuthUser authorizes a client as an ACL user
+	AuthUser(user, pass string) error
+	// Allowed returns ErrNoPermission when the client is not permitted to
+	// run the command. The kind is 'r' read, 'w' write, or 's' system.
+	Allowed(kind byte, name string, opts *SendOptions) error
+	// WatchIndex returns the index used for watching keys with Exec.
+	WatchIndex(keys []string, opts *SendOptions) uint64
+	// Exec sends multiple commands as a single atomic transaction.
+	Exec(cmds [][]string, watch []string, watchIndex uint64,
+		opts *SendOptions) Receiver
 	// Monitor returns a service monitor for observing client commands.
 	Monitor() Monitor
+	// Track turns on or off client-side caching for a connection.
+	Track(from interface{}, opts *TrackingOptions)
 	// Opened
 	Opened(addr string) (context interface{}, accept bool)
+	// OpenedUser is like Opened, but for a connection that has a user
+	// identity from a verified TLS client certificate.
+	OpenedUser(addr, user string) (context interface{}, accept bool)
+	// ConnUser returns the ACL user identity from the verified TLS client
+	// certificate of the connection. Returns an empty string when there is
+	// no certificate, or when the identity is not a known ACL user.
+	ConnUser(conn net.Conn) string
 	// Closed
 	Closed(context interface{}, addr string)
+	// Register adds a connection to the client registry, which makes it
+	// visible to CLIENT LIST and CLIENT KILL. The kill function is called by
+	// CLIENT KILL to close the connection. Sets opts.ConnID to the new
+	// connection id.
+	Register(opts *SendOptions, kill func())
+	// Unregister removes a connection from the client registry.
+	Unregister(opts *SendOptions)
 }
 
 type serviceEntry struct {
@@ -95,15 +139,31 @@ type service struct {
 	ra   *raftWrap
 	auth string
 	mon  *monitor
+	adm  *admission
+
+	// groups are the services for each raft group, where the first is the
+	// service itself.
+	groups []*service
 
 	writeMu sync.Mutex
 	write   map[interface{}]*writeRequestFuture
 }
 
-func newService(m *machine, ra *raftWrap, auth string) *service {
+func newService(conf Config, m *machine, ra *raftWrap) *service {
+	auth := conf.Auth
 	s := &service{m: m, ra: ra, auth: auth}
 	s.write = make(map[interface{}]*writeRequestFuture)
-	s.mon = newMonitor(s)
+	s.mon = m.mon
+	s.adm = newAdmission(conf)
+	s.groups = []*service{s}
+	for _, g := range m.raftGroups(ra)[1:] {
+		gs := &service{m: g.m, ra: g.ra, auth: auth, mon: s.mon, adm: s.adm}
+		gs.write = make(map[interface{}]*writeRequestFuture)
+		s.groups = append(s.groups, gs)
+	}
+	for _, gs := range s.groups[1:] {
+		gs.groups = s.groups
+	}
 	return s
 }
 
@@ -120,6 +180,28 @@ func (s *service) Auth(auth string) error {
 	return nil
 }
 
+// AuthUser authorizes a client as an ACL user. The "default" user falls back
+// to the shared auth when it's not defined in the ACL table.
+func (s *service) AuthUser(user, pass string) error {
+	err := s.m.authUser(user, pass)
+	if err != nil && user == aclDefaultUser {
+		s.m.mu.RLock()
+		_, ok := s.m.acl.users[user]
+		s.m.mu.RUnlock()
+		if !ok {
+			return s.Auth(pass)
+		}
+	}
+	return err
+}
+
+func (s *service) Allowed(kind byte, name string, opts *SendOptions) error {
+	if opts == nil {
+		opts = defSendOpts
+	}
+	return s.m.allowed(opts.User, kind, name)
+}
+
 // The Send function sends command args to the service and return a future
 // receiver for getting the response.
 // There are three type of commands: write, read, and system.
@@ -144,17 +226,17 @@ func (s *service) Send(args []string, opts *SendOptions) Receiver {
 		return Response(nil, 0, nil)
 	}
 	cmdName := strings.ToLower(args[0])
-	cmd, ok := s.m.commands[cmdName]
+	cmd, ok := s.m.lookupCommand(cmdName)
 	if !ok {
 		if s.m.catchall.kind == 0 {
 			return Response(nil, 0, ErrUnknownCommand)
 		}
 		cmd = s.m.catchall
 	}
-	if cmdName == "tick" {
-		// The "tick" command is explicitly denied from being called by a
-		// service. It must only be called from the runTicker function.
-		// Let's just pretend like it's an unknown command.
+	if internalCommands[cmdName] {
+		// Internal commands, such as "tick", are explicitly denied from being
+		// called by a service. They must only be called from the server
+		// itself. Let's just pretend like it's an unknown command.
 		return Response(nil, 0, ErrUnknownCommand)
 	}
 	if opts == nil {
@@ -162,29 +244,87 @@ func (s *service) Send(args []string, opts *SendOptions) Receiver {
 		// they want.
 		opts = defSendOpts
 	}
+	if err := s.m.allowed(opts.User, cmd.kind, cmdName); err != nil {
+		return Response(nil, 0, err)
+	}
+	s.m.clients.touch(opts, cmdName)
+	if cmd.kind != 's' {
+		// system commands are not paused by CLIENT PAUSE
+		s.m.clients.wait(cmd.kind)
+	}
 	switch cmd.kind {
 	case 'w': // write
-		r := &writeRequestFuture{args: args, s: s, from: opts.From}
-		r.wg.Add(1)
-		s.m.wrC <- r
-		s.addWrite(opts.From, r)
-		return r
+		if err := s.m.checkArgs(cmdName, args); err != nil {
+			return Response(nil, 0, err)
+		}
+		gs, slot, err := s.route(s.m.commandKeys(cmdName, args))
+		if err != nil {
+			return Response(nil, 0, err)
+		}
+		if scriptCommand(cmdName) {
+			if args, err = scriptWriteArgs(args, opts.User); err != nil {
+				return Response(nil, 0, err)
+			}
+		}
+		return gs.sendWrite(args, slot, opts)
 	case 'r': // read
-		s.waitWrite(opts.From)
+		gs, slot, err := s.route(s.m.commandKeys(cmdName, args))
+		if err != nil {
+			return Response(nil, 0, err)
+		}
+		gs.waitWrite(opts.From)
+		if s.m.tracking.active() {
+			s.m.tracking.track(opts.From, s.m.commandKeys(cmdName, args))
+		}
 		start := time.Now()
-		resp, err := s.execRead(cmd, args, opts)
-		return Response(resp, time.Since(start), errRaftConvert(s.ra, err))
+		resp, err := gs.execRead(cmd, args, opts)
+		elapsed := time.Since(start)
+		s.m.latency.record(args, opts.Addr, s.m.clients.name(opts.ConnID),
+			0, 0, elapsed)
+		return Response(resp, elapsed, errRaftConvertSlot(gs.ra, err, slot))
 	case 's': // intermediate/system
 		s.waitWrite(opts.From)
 		start := time.Now()
-		pm := intermediateMachine{m: s.m, context: opts.Context}
+		pm := intermediateMachine{m: s.m, context: opts.Context,
+			user: opts.User, addr: opts.Addr, conn: opts.ConnID}
 		resp, err := cmd.fn(pm, s.ra, args)
-		return Response(resp, time.Since(start), errRaftConvert(s.ra, err))
+		elapsed := time.Since(start)
+		s.m.latency.record(args, opts.Addr, s.m.clients.name(opts.ConnID),
+			0, 0, elapsed)
+		return Response(resp, elapsed, errRaftConvert(s.ra, err))
 	default:
 		return Response(nil, 0, errors.New("invalid request"))
 	}
 }
 
+// sendWrite sends a write command through the raft log. The response is
+// received from the returned future. The slot is used for MOVED errors.
+// Returns a BUSY error, without waiting, when the write is not admitted or
+// when the write queue is full.
+func (s *service) sendWrite(args []string, slot int, opts *SendOptions,
+) Receiver {
+	if err := s.adm.admit(opts); err != nil {
+		return Response(nil, 0, err)
+	}
+	r := &writeRequestFuture{args: args, s: s, from: opts.From, slot: slot,
+		addr: opts.Addr, name: s.m.clients.name(opts.ConnID), user: opts.User,
+		context: opts.Context}
+	if opts.ClientID != "" && opts.Seq > 0 {
+		r.clientID = opts.ClientID
+		r.seq = opts.Seq
+	}
+	r.wg.Add(1)
+	r.queued = time.Now()
+	select {
+	case s.m.wrC <- r:
+	default:
+		s.adm.reject(opts)
+		return Response(nil, 0, ErrBusy)
+	}
+	s.addWrite(opts.From, r)
+	return r
+}
+
 func (s *service) Opened(addr string) (context interface{}, accept bool) {
 	if s.m.connOpened != nil {
 		return s.m.connOpened(addr)
@@ -192,15 +332,45 @@ func (s *service) Opened(addr string) (context interface{}, accept bool) {
 	return nil, true
 }
 
+func (s *service) OpenedUser(addr, user string,
+) (context interface{}, accept bool) {
+	if user != "" && s.m.connOpenedUser != nil {
+		return s.m.connOpenedUser(addr, user)
+	}
+	return s.Opened(addr)
+}
+
+func (s *service) ConnUser(conn net.Conn) string {
+	user := tlsConnUser(conn, s.m.tlsUser)
+	if user == "" {
+		return ""
+	}
+	s.m.mu.RLock()
+	_, ok := s.m.acl.users[user]
+	s.m.mu.RUnlock()
+	if !ok {
+		return ""
+	}
+	return user
+}
+
 func (s *service) Closed(context interface{}, addr string) {
 	if s.m.connClosed != nil {
 		s.m.connClosed(context, addr)
 	}
 }
 
+func (s *service) Register(opts *SendOptions, kill func()) {
+	s.m.clients.register(opts, kill)
+}
+
+func (s *service) Unregister(opts *SendOptions) {
+	s.m.clients.unregister(opts.ConnID)
+}
+
 func (s *service) execRead(cmd command, args []string, opts *SendOptions,
 ) (interface{}, error) {
-	openReads := s.m.openReads
+	openReads := atomic.LoadInt32(&s.m.openReads) == 1
 	if opts.AllowOpenReads {
 		if opts.DenyOpenReads {
 			return nil, ErrInvalid
@@ -299,6 +469,25 @@ type writeRequestFuture struct {
 	wg   sync.WaitGroup
 	s    *service
 	from interface{}
+
+	clientID string // optional client session
+	seq      uint64 // client session sequence number
+	slot     int    // hash slot of the keys, or -1
+
+	queued time.Time // when the write was added to the write queue
+
+	addr    string      // client address, for the audit log
+	name    string      // client name, for the slow log
+	user    string      // client user, for the audit log
+	context interface{} // client context, for the audit log
+}
+
+// done is called by the write applier once the response is ready.
+func (r *writeRequestFuture) done() {
+	if r.s != nil {
+		r.s.adm.release(r.from)
+	}
+	r.wg.Done()
 }
 
 // Recv received the response and time elapsed to process the write. Or, it
@@ -0,0 +1,265 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// sessionWindow is the number of most recent responses that are kept for
+// each client session. This allows a client to pipeline up to this many
+// writes and still be able to safely retry all of them.
+const sessionWindow = 64
+
+// clientSession tracks the writes applied for a single client ID. It's only
+// altered from inside of the Apply function and is persisted in snapshots.
+type clientSession struct {
+	lastSeq uint64               // highest applied sequence number
+	seen    int64                // machine timestamp of the last write
+	resps   map[uint64]applyResp // recent responses by sequence number
+}
+
+// sessionTable is the replicated set of client sessions.
+type sessionTable struct {
+	sessions map[string]*clientSession
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{sessions: make(map[string]*clientSession)}
+}
+
+// lookup returns the cached response for a duplicate request.
+func (t *sessionTable) lookup(clientID string, seq uint64,
+) (resp applyResp, dup bool) {
+	s := t.sessions[clientID]
+	if s == nil {
+		return resp, false
+	}
+	if r, ok := s.resps[seq]; ok {
+		return r, true
+	}
+	if seq+sessionWindow <= s.lastSeq {
+		return applyResp{nil, 0, ErrStaleSequence}, true
+	}
+	return resp, false
+}
+
+// store saves the response for the client sequence number.
+func (t *sessionTable) store(clientID string, seq uint64, ts int64,
+	resp applyResp,
+) {
+	s := t.sessions[clientID]
+	if s == nil {
+		s = &clientSession{resps: make(map[uint64]applyResp)}
+		t.sessions[clientID] = s
+	}
+	s.seen = ts
+	s.resps[seq] = resp
+	if seq > s.lastSeq {
+		s.lastSeq = seq
+		for rseq := range s.resps {
+			if rseq+sessionWindow <= s.lastSeq {
+				delete(s.resps, rseq)
+			}
+		}
+	}
+}
+
+// expire removes the sessions that have not written anything since the
+// provided machine timestamp.
+func (t *sessionTable) expire(before int64) {
+	for id, s := range t.sessions {
+		if s.seen < before {
+			delete(t.sessions, id)
+		}
+	}
+}
+
+// sessionErrors are the errors that keep their identity when a cached
+// response is restored from a snapshot. Other errors are restored with the
+// same message.
+var sessionErrors = []error{ErrSyntax, ErrNotLeader, ErrWrongNumArgs,
+	ErrUnauthorized, ErrNoPermission, ErrUnknownCommand, ErrInvalid,
+	ErrCorrupt, ErrBusy, ErrStaleSequence, ErrWatchFailed}
+
+func decodeSessionError(msg string) error {
+	for _, err := range sessionErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+// sessionValueJSON is a cached response value along with its Go type, which
+// allows for the restored response to be the same value that was returned by
+// the command. Types that are not known are stored as the values of their
+// RESP format.
+type sessionValueJSON struct {
+	T string             `json:"t"`
+	S string             `json:"s,omitempty"`
+	I int64              `json:"i,omitempty"`
+	U uint64             `json:"u,omitempty"`
+	A []sessionValueJSON `json:"a,omitempty"`
+}
+
+func encodeSessionValue(v interface{}) sessionValueJSON {
+	switch v := v.(type) {
+	case nil:
+		return sessionValueJSON{T: "nil"}
+	case string:
+		return sessionValueJSON{T: "string", S: v}
+	case []byte:
+		return sessionValueJSON{T: "bytes", S: string(v)}
+	case redcon.SimpleString:
+		return sessionValueJSON{T: "simple", S: string(v)}
+	case redcon.SimpleInt:
+		return sessionValueJSON{T: "simpleint", I: int64(v)}
+	case bool:
+		if v {
+			return sessionValueJSON{T: "bool", I: 1}
+		}
+		return sessionValueJSON{T: "bool"}
+	case int:
+		return sessionValueJSON{T: "int", I: int64(v)}
+	case int64:
+		return sessionValueJSON{T: "int64", I: v}
+	case uint64:
+		return sessionValueJSON{T: "uint64", U: v}
+	case float64:
+		return sessionValueJSON{T: "float64",
+			S: strconv.FormatFloat(v, 'g', -1, 64)}
+	case error:
+		return sessionValueJSON{T: "error", S: v.Error()}
+	case []string:
+		jv := sessionValueJSON{T: "strings", A: []sessionValueJSON{}}
+		for _, s := range v {
+			jv.A = append(jv.A, sessionValueJSON{T: "string", S: s})
+		}
+		return jv
+	case []interface{}:
+		jv := sessionValueJSON{T: "array", A: []sessionValueJSON{}}
+		for _, v := range v {
+			jv.A = append(jv.A, encodeSessionValue(v))
+		}
+		return jv
+	default:
+		_, resp := redcon.ReadNextRESP(redcon.AppendAny(nil, v))
+		rv, err := pluginValue(resp)
+		if err != nil {
+			return encodeSessionValue(err)
+		}
+		return encodeSessionValue(rv)
+	}
+}
+
+func decodeSessionValue(jv sessionValueJSON) interface{} {
+	switch jv.T {
+	case "string":
+		return jv.S
+	case "bytes":
+		return []byte(jv.S)
+	case "simple":
+		return redcon.SimpleString(jv.S)
+	case "simpleint":
+		return redcon.SimpleInt(jv.I)
+	case "bool":
+		return jv.I != 0
+	case "int":
+		return int(jv.I)
+	case "int64":
+		return jv.I
+	case "uint64":
+		return jv.U
+	case "float64":
+		f, _ := strconv.ParseFloat(jv.S, 64)
+		return f
+	case "error":
+		return decodeSessionError(jv.S)
+	case "strings":
+		vals := make([]string, len(jv.A))
+		for i := range jv.A {
+			vals[i] = jv.A[i].S
+		}
+		return vals
+	case "array":
+		vals := make([]interface{}, len(jv.A))
+		for i := range jv.A {
+			vals[i] = decodeSessionValue(jv.A[i])
+		}
+		return vals
+	}
+	return nil
+}
+
+type sessionRespJSON struct {
+	Seq  uint64            `json:"seq"`
+	Val  *sessionValueJSON `json:"val,omitempty"`
+	Err  string            `json:"err,omitempty"`
+	Elap time.Duration     `json:"elap"`
+}
+
+type sessionJSON struct {
+	ID      string            `json:"id"`
+	LastSeq uint64            `json:"last_seq"`
+	Seen    int64             `json:"seen"`
+	Resps   []sessionRespJSON `json:"resps"`
+}
+
+func (t *sessionTable) encode() ([]byte, error) {
+	sessions := make([]sessionJSON, 0, len(t.sessions))
+	for id, s := range t.sessions {
+		js := sessionJSON{ID: id, LastSeq: s.lastSeq, Seen: s.seen}
+		for seq, r := range s.resps {
+			jr := sessionRespJSON{Seq: seq, Elap: r.elap}
+			if r.err != nil {
+				jr.Err = r.err.Error()
+			} else {
+				jv := encodeSessionValue(r.resp)
+				jr.Val = &jv
+			}
+			js.Resps = append(js.Resps, jr)
+		}
+		sort.Slice(js.Resps, func(i, j int) bool {
+			return js.Resps[i].Seq < js.Resps[j].Seq
+		})
+		sessions = append(sessions, js)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return json.Marshal(sessions)
+}
+
+func decodeSessions(data []byte) (*sessionTable, error) {
+	t := newSessionTable()
+	if len(data) == 0 {
+		return t, nil
+	}
+	var sessions []sessionJSON
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	for _, js := range sessions {
+		s := &clientSession{
+			lastSeq: js.LastSeq,
+			seen:    js.Seen,
+			resps:   make(map[uint64]applyResp),
+		}
+		for _, jr := range js.Resps {
+			r := applyResp{elap: jr.Elap}
+			if jr.Err != "" {
+				r.err = decodeSessionError(jr.Err)
+			} else if jr.Val != nil {
+				r.resp = decodeSessionValue(*jr.Val)
+			}
+			s.resps[jr.Seq] = r
+		}
+		t.sessions[js.ID] = s
+	}
+	return t, nil
+}
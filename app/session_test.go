@@ -0,0 +1,112 @@
+package app
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+func TestBatchEncoding(t *testing.T) {
+	for _, sessions := range []bool{false, true} {
+		reqs := []*writeRequestFuture{
+			{args: []string{"set", "a", "1"}},
+			{args: []string{"del", "a"}},
+		}
+		if sessions {
+			reqs[1].clientID = "client-1"
+			reqs[1].seq = 7
+		}
+		cmds, err := decodeBatch(encodeBatch(reqs))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cmds) != len(reqs) {
+			t.Fatalf("expected %d, got %d", len(reqs), len(cmds))
+		}
+		for i, c := range cmds {
+			if !reflect.DeepEqual(c.args, reqs[i].args) ||
+				c.clientID != reqs[i].clientID || c.seq != reqs[i].seq {
+				t.Fatalf("mismatch at %d", i)
+			}
+		}
+	}
+}
+
+func TestSessionTable(t *testing.T) {
+	st := newSessionTable()
+	if _, dup := st.lookup("c", 1); dup {
+		t.Fatal("unexpected duplicate")
+	}
+	st.store("c", 1, 100, applyResp{resp: redcon.SimpleString("OK")})
+	resp, dup := st.lookup("c", 1)
+	if !dup || resp.resp != redcon.SimpleString("OK") {
+		t.Fatal("expected cached response")
+	}
+	st.store("c", 1+sessionWindow, 200, applyResp{resp: "x"})
+	if resp, dup := st.lookup("c", 1); !dup || resp.err != ErrStaleSequence {
+		t.Fatal("expected stale sequence")
+	}
+	txnResp := []interface{}{redcon.SimpleString("OK"), redcon.SimpleInt(2), nil,
+		[]byte("b"), []string{"c"}, 1.5, ErrWrongNumArgs}
+	st.store("c", 2+sessionWindow, 200, applyResp{resp: txnResp})
+	st.store("c", 3+sessionWindow, 200, applyResp{err: ErrWatchFailed})
+	// types that are not known are restored as the values of their RESP
+	st.store("c", 4+sessionWindow, 200, applyResp{
+		resp: []redcon.SimpleString{"a", "b"}})
+	data, err := st.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2, err := decodeSessions(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, dup = st2.lookup("c", 1+sessionWindow)
+	if !dup || resp.resp != "x" {
+		t.Fatalf("expected restored response, got %#v", resp.resp)
+	}
+	resp, _ = st2.lookup("c", 2+sessionWindow)
+	if !reflect.DeepEqual(resp.resp, txnResp) {
+		t.Fatalf("expected %#v, got %#v", txnResp, resp.resp)
+	}
+	if resp, _ := st2.lookup("c", 3+sessionWindow); resp.err != ErrWatchFailed {
+		t.Fatalf("expected %v, got %v", ErrWatchFailed, resp.err)
+	}
+	resp, _ = st2.lookup("c", 4+sessionWindow)
+	expect := []interface{}{redcon.SimpleString("a"), redcon.SimpleString("b")}
+	if !reflect.DeepEqual(resp.resp, expect) {
+		t.Fatalf("expected %#v, got %#v", expect, resp.resp)
+	}
+	st2.expire(201)
+	if _, dup := st2.lookup("c", 1+sessionWindow); dup {
+		t.Fatal("expected expired session")
+	}
+}
+
+func TestSessionTimeoutTick(t *testing.T) {
+	m := machineInit(Config{SessionTimeout: time.Hour}, 0, "", nil)
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	tick := func(d time.Duration, args ...string) {
+		ts += int64(d)
+		m.index++
+		_, err := cmdTICK(m, nil, append([]string{"tick",
+			strconv.FormatInt(ts, 10), strconv.FormatUint(m.index, 10)},
+			args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tick(0)
+	m.sessions.store("c", 1, m.ts, applyResp{resp: "x"})
+	// the leader's timeout replaces the local one
+	tick(2*time.Second, strconv.FormatInt(int64(time.Second), 10))
+	if _, dup := m.sessions.lookup("c", 1); dup {
+		t.Fatal("expected expired session")
+	}
+	if m.sessionTimeout != time.Second {
+		t.Fatalf("expected %v, got %v", time.Second, m.sessionTimeout)
+	}
+}
@@ -0,0 +1,503 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables that override the
+// settings, such as APP_DATA_DIR for "data-dir".
+const envPrefix = "APP_"
+
+// setting is a Config field that can be loaded from a config file or the
+// environment, and read with CONFIG GET. The name is the key in the config
+// file.
+type setting struct {
+	name string
+	ptr  func(conf *Config) interface{}
+	// live is the setter for the runtime-adjustable settings, which are
+	// changed with CONFIG SET.
+	live func(m *machine, value string) error
+	// secret settings are never returned by CONFIG GET.
+	secret bool
+}
+
+var settings = []setting{
+	{name: "addr", ptr: func(c *Config) interface{} { return &c.Addr }},
+	{name: "node-id", ptr: func(c *Config) interface{} { return &c.NodeID }},
+	{name: "data-dir", ptr: func(c *Config) interface{} { return &c.DataDir }},
+	{name: "join", ptr: func(c *Config) interface{} { return &c.JoinAddr }},
+	{name: "log-level", ptr: func(c *Config) interface{} { return &c.LogLevel },
+		live: liveLogLevel},
+	{name: "backend", ptr: func(c *Config) interface{} { return &c.Backend }},
+	{name: "tls-cert", ptr: func(c *Config) interface{} { return &c.TLSCertPath }},
+	{name: "tls-key", ptr: func(c *Config) interface{} { return &c.TLSKeyPath },
+		secret: true},
+	{name: "tls-ca", ptr: func(c *Config) interface{} { return &c.TLSCAPath }},
+	{name: "auth", ptr: func(c *Config) interface{} { return &c.Auth },
+		secret: true},
+	{name: "advertise", ptr: func(c *Config) interface{} { return &c.Advertise }},
+	{name: "nosync", ptr: func(c *Config) interface{} { return &c.NoSync }},
+	{name: "openreads", ptr: func(c *Config) interface{} { return &c.OpenReads },
+		live: liveOpenReads},
+	{name: "restore", ptr: func(c *Config) interface{} { return &c.BackupPath }},
+	{name: "localtime", ptr: func(c *Config) interface{} { return &c.LocalTime }},
+	{name: "time-source", ptr: func(c *Config) interface{} { return &c.TimeSource }},
+	{name: "time-timeout",
+		ptr: func(c *Config) interface{} { return &c.TimeSourceTimeout }},
+	{name: "max-drift", ptr: func(c *Config) interface{} { return &c.MaxTimeDrift }},
+	{name: "tick-delay", ptr: func(c *Config) interface{} { return &c.TickDelay },
+		live: liveTickDelay},
+	{name: "max-pool", ptr: func(c *Config) interface{} { return &c.MaxPool }},
+	{name: "try-errors", ptr: func(c *Config) interface{} { return &c.TryErrors }},
+	{name: "init-run-quit",
+		ptr: func(c *Config) interface{} { return &c.InitRunQuit }},
+	{name: "groups", ptr: func(c *Config) interface{} { return &c.Groups }},
+	{name: "session-timeout",
+		ptr: func(c *Config) interface{} { return &c.SessionTimeout }},
+	{name: "write-queue",
+		ptr: func(c *Config) interface{} { return &c.WriteQueueSize }},
+	{name: "write-batch",
+		ptr: func(c *Config) interface{} { return &c.WriteBatchSize }},
+	{name: "max-inflight", ptr: func(c *Config) interface{} { return &c.MaxInFlight }},
+	{name: "snapshot-retain",
+		ptr: func(c *Config) interface{} { return &c.SnapshotRetain }},
+	{name: "audit", ptr: func(c *Config) interface{} { return &c.Audit }},
+	{name: "audit-max-size",
+		ptr: func(c *Config) interface{} { return &c.AuditMaxSize }},
+	{name: "audit-max-files",
+		ptr: func(c *Config) interface{} { return &c.AuditMaxFiles }},
+	{name: "pubsub-retain",
+		ptr: func(c *Config) interface{} { return &c.PubSubRetain }},
+	{name: "slowlog-threshold",
+		ptr:  func(c *Config) interface{} { return &c.SlowLogThreshold },
+		live: liveSlowLogThreshold},
+	{name: "slowlog-max-len",
+		ptr:  func(c *Config) interface{} { return &c.SlowLogMaxLen },
+		live: liveSlowLogMaxLen},
+	{name: "debug-fault", ptr: func(c *Config) interface{} { return &c.DebugFault }},
+	{name: "log-sync", ptr: func(c *Config) interface{} { return &c.LogSync }},
+	{name: "stable-sync", ptr: func(c *Config) interface{} { return &c.StableSync }},
+	{name: "sync-interval",
+		ptr: func(c *Config) interface{} { return &c.SyncInterval }},
+	{name: "log-geometry",
+		ptr: func(c *Config) interface{} { return &c.LogGeometry }},
+	{name: "stable-geometry",
+		ptr: func(c *Config) interface{} { return &c.StableGeometry }},
+	{name: "encrypt-key",
+		ptr:    func(c *Config) interface{} { return &c.EncryptKeyPath },
+		secret: true},
+	{name: "encrypt-migrate",
+		ptr: func(c *Config) interface{} { return &c.EncryptMigrate }},
+}
+
+func findSetting(name string) *setting {
+	name = strings.ToLower(name)
+	for i := range settings {
+		if settings[i].name == name {
+			return &settings[i]
+		}
+	}
+	return nil
+}
+
+var backendNames = map[Backend]string{
+	LevelDB: "leveldb",
+	Bolt:    "bolt",
+	MDBX:    "mdbx",
+}
+
+// setValue parses the value into the Config field of the setting.
+func (st *setting) setValue(conf *Config, value string) error {
+	var err error
+	switch p := st.ptr(conf).(type) {
+	case *string:
+		*p = value
+	case *bool:
+		*p, err = strconv.ParseBool(value)
+	case *int:
+		*p, err = strconv.Atoi(value)
+	case *int64:
+		*p, err = strconv.ParseInt(value, 10, 64)
+	case *time.Duration:
+		*p, err = time.ParseDuration(value)
+	case *Backend:
+		for b, name := range backendNames {
+			if name == value {
+				*p = b
+				return nil
+			}
+		}
+		err = errors.New("invalid backend")
+	case *TimeSource:
+		*p, err = parseTimeSource(value)
+	case *SyncMode:
+		for mode, name := range syncModeNames {
+			if name == value {
+				*p = mode
+				return nil
+			}
+		}
+		err = errors.New("invalid sync mode")
+	case *StoreGeometry:
+		*p, err = parseStoreGeometry(value)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value '%s'", value)
+	}
+	return nil
+}
+
+// getValue returns the Config field of the setting as a string.
+func (st *setting) getValue(conf *Config) string {
+	switch p := st.ptr(conf).(type) {
+	case *string:
+		return *p
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *int:
+		return strconv.Itoa(*p)
+	case *int64:
+		return strconv.FormatInt(*p, 10)
+	case *time.Duration:
+		return p.String()
+	case *Backend:
+		return backendNames[*p]
+	case *SyncMode:
+		return syncModeNames[*p]
+	case *StoreGeometry:
+		return p.String()
+	case *TimeSource:
+		if *p == nil {
+			return ""
+		}
+		return fmt.Sprint(*p)
+	}
+	return ""
+}
+
+// configPath returns the --config path from the command line, or from the
+// APP_CONFIG environment variable. This happens prior to parsing the flags
+// because the config file provides the flag defaults.
+func configPath(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		for _, name := range []string{"-config", "--config"} {
+			if arg == name && i+1 < len(args) {
+				return args[i+1]
+			}
+			if strings.HasPrefix(arg, name+"=") {
+				return arg[len(name)+1:]
+			}
+		}
+	}
+	return os.Getenv(envPrefix + "CONFIG")
+}
+
+// loadSettings applies the config file at path, followed by the environment
+// variables, to the Config. Returns the names of the settings that were
+// loaded.
+func loadSettings(conf *Config, path string, environ []string,
+) (map[string]bool, error) {
+	loaded := make(map[string]bool)
+	if path != "" {
+		vals, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range vals {
+			st := findSetting(name)
+			if st == nil {
+				return nil, fmt.Errorf("%s: unknown setting '%s'", path, name)
+			}
+			if err := st.setValue(conf, value); err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+			}
+			loaded[st.name] = true
+		}
+	}
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		eq := strings.IndexByte(kv, '=')
+		if eq == -1 {
+			continue
+		}
+		key := kv[len(envPrefix):eq]
+		if key == "CONFIG" {
+			continue
+		}
+		st := findSetting(strings.Replace(key, "_", "-", -1))
+		if st == nil {
+			// other variables may share the prefix
+			continue
+		}
+		if err := st.setValue(conf, kv[eq+1:]); err != nil {
+			return nil, fmt.Errorf("%s: %v", kv[:eq], err)
+		}
+		loaded[st.name] = true
+	}
+	return loaded, nil
+}
+
+// readConfigFile reads the key-value pairs of a TOML or YAML file. The
+// format is chosen by the file extension.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return parseTOML(data)
+	case ".yaml", ".yml", ".json":
+		return parseYAML(data)
+	}
+	return nil, fmt.Errorf("%s: unknown config file format, must be .toml "+
+		"or .yaml", path)
+}
+
+func parseYAML(data []byte) (map[string]string, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	vals := make(map[string]string)
+	for key, v := range doc {
+		switch v := v.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("%s: value must be a scalar", key)
+		case nil:
+			vals[key] = ""
+		default:
+			vals[key] = fmt.Sprint(v)
+		}
+	}
+	return vals, nil
+}
+
+// parseTOML parses the subset of TOML that is needed for settings, which is
+// top-level key-value pairs with string, number, and boolean values.
+func parseTOML(data []byte) (map[string]string, error) {
+	vals := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			return nil, fmt.Errorf("line %d: tables are not supported", i+1)
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		key := strings.TrimSpace(line[:eq])
+		if len(key) > 1 && key[0] == '"' && key[len(key)-1] == '"' {
+			key = key[1 : len(key)-1]
+		}
+		value := strings.TrimSpace(line[eq+1:])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			end := strings.LastIndexByte(value, '"')
+			s, err := strconv.Unquote(value[:end+1])
+			if err != nil || !tomlComment(value[end+1:]) {
+				return nil, fmt.Errorf("line %d: invalid string", i+1)
+			}
+			value = s
+		case strings.HasPrefix(value, "'"):
+			end := strings.IndexByte(value[1:], '\'') + 1
+			if end == 0 || !tomlComment(value[end+1:]) {
+				return nil, fmt.Errorf("line %d: invalid string", i+1)
+			}
+			value = value[1:end]
+		default:
+			if hash := strings.IndexByte(value, '#'); hash != -1 {
+				value = strings.TrimSpace(value[:hash])
+			}
+			value = strings.Replace(value, "_", "", -1)
+			if value == "" {
+				return nil, fmt.Errorf("line %d: missing value", i+1)
+			}
+		}
+		if _, ok := vals[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key '%s'", i+1, key)
+		}
+		vals[key] = value
+	}
+	return vals, nil
+}
+
+// tomlComment returns true when the remainder of a line is empty or a
+// comment.
+func tomlComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+// liveLogLevel changes the level of the raft logger.
+func liveLogLevel(m *machine, value string) error {
+	level, ok := parseLogLevel(value)
+	if !ok {
+		return fmt.Errorf("invalid log level '%s'", value)
+	}
+	if m.hclogger != nil {
+		m.hclogger.SetLevel(level)
+	}
+	return nil
+}
+
+func liveOpenReads(m *machine, value string) error {
+	on, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value '%s'", value)
+	}
+	var n int32
+	if on {
+		n = 1
+	}
+	atomic.StoreInt32(&m.openReads, n)
+	return nil
+}
+
+func liveTickDelay(m *machine, value string) error {
+	delay, err := time.ParseDuration(value)
+	if err != nil || delay <= 0 {
+		return fmt.Errorf("invalid value '%s'", value)
+	}
+	atomic.StoreInt64((*int64)(&m.tickDelay), int64(delay))
+	return nil
+}
+
+// CONFIG subcommand args...
+// help: reads and changes the server settings.
+func cmdCONFIG(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) < 2 {
+		return nil, errWrongNumArgsConfig
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		return cmdCONFIGHELP(um, ra, args)
+	case "get":
+		return cmdCONFIGGET(um, ra, args)
+	case "set":
+		return cmdCONFIGSET(um, ra, args)
+	default:
+		return nil, errUnknownConfigCommand(args[:2])
+	}
+}
+
+// CONFIG HELP
+// help: returns the valid CONFIG related commands; []string
+func cmdCONFIGHELP(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errWrongNumArgsConfig
+	}
+	lines := []redcon.SimpleString{
+		"CONFIG GET pattern",
+		"CONFIG SET name value",
+	}
+	return lines, nil
+}
+
+// CONFIG GET pattern
+// help: returns the settings of this server that match the pattern as
+//       name-value pairs. The auth, tls-key, and encrypt-key settings are
+//       never returned.
+func cmdCONFIGGET(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 3 {
+		return nil, errWrongNumArgsConfig
+	}
+	m := getBaseMachine(um)
+	pattern := strings.ToLower(args[2])
+	var names []string
+	for _, st := range settings {
+		if !st.secret && match.Match(st.name, pattern) {
+			names = append(names, st.name)
+		}
+	}
+	sort.Strings(names)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var resp []string
+	for _, name := range names {
+		resp = append(resp, name, findSetting(name).getValue(&m.conf))
+	}
+	return resp, nil
+}
+
+// CONFIG SET name value
+// help: changes a runtime-adjustable setting of this server, which are
+//       log-level, openreads, tick-delay, slowlog-threshold, and
+//       slowlog-max-len. The change is not replicated
+//       and is lost when the server restarts.
+func cmdCONFIGSET(um Machine, ra *raftWrap, args []string,
+) (interface{}, error) {
+	if len(args) != 4 {
+		return nil, errWrongNumArgsConfig
+	}
+	st := findSetting(args[2])
+	if st == nil || st.live == nil || st.secret {
+		return nil, fmt.Errorf("unsupported CONFIG parameter '%s'", args[2])
+	}
+	m := getBaseMachine(um)
+	ms := []*machine{m}
+	if m.groups != nil {
+		ms = ms[:0]
+		for _, g := range m.groups {
+			ms = append(ms, g.m)
+		}
+	}
+	for _, m := range ms {
+		m.mu.Lock()
+		err := st.live(m, args[3])
+		if err == nil {
+			err = st.setValue(&m.conf, args[3])
+		}
+		m.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return redcon.SimpleString("OK"), nil
+}
+
+// parseLogLevel returns the raft log level for a -l value.
+func parseLogLevel(s string) (hclog.Level, bool) {
+	switch s {
+	case "debug":
+		return hclog.Debug, true
+	case "verbose", "verb":
+		return hclog.Trace, true
+	case "notice", "info":
+		return hclog.Info, true
+	case "warning", "warn":
+		return hclog.Warn, true
+	case "quiet", "silent":
+		return hclog.NoLevel, true
+	}
+	return hclog.Error, false
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tomlPath := filepath.Join(dir, "app.toml")
+	ioutil.WriteFile(tomlPath, []byte(`
+# node settings
+data-dir = "/var/lib/app" # comment
+node-id = '2'
+tick-delay = "100ms"
+write-batch = 2_048
+openreads = true
+backend = "bolt"
+`), 0666)
+	yamlPath := filepath.Join(dir, "app.yaml")
+	ioutil.WriteFile(yamlPath, []byte(`
+data-dir: /var/lib/app
+node-id: "2"
+tick-delay: 100ms
+write-batch: 2048
+openreads: true
+backend: bolt
+`), 0666)
+	for _, path := range []string{tomlPath, yamlPath} {
+		var conf Config
+		conf.def()
+		loaded, err := loadSettings(&conf, path, []string{
+			"APP_NODE_ID=3", "APP_SNAPSHOT_RETAIN=5", "APP_OTHER=1", "HOME=/",
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if conf.DataDir != "/var/lib/app" || conf.NodeID != "3" ||
+			conf.TickDelay != 100*time.Millisecond ||
+			conf.WriteBatchSize != 2048 || !conf.OpenReads ||
+			conf.Backend != Bolt || conf.SnapshotRetain != 5 {
+			t.Fatalf("%s: unexpected %+v", path, conf)
+		}
+		if !loaded["backend"] || loaded["addr"] {
+			t.Fatalf("%s: unexpected %v", path, loaded)
+		}
+	}
+	var conf Config
+	ioutil.WriteFile(tomlPath, []byte("data-dri = \"x\"\n"), 0666)
+	if _, err := loadSettings(&conf, tomlPath, nil); err == nil {
+		t.Fatal("expected unknown setting error")
+	}
+	if _, err := loadSettings(&conf, "", []string{"APP_GROUPS=x"}); err == nil {
+		t.Fatal("expected invalid value error")
+	}
+	for _, bad := range []string{"[server]\n", "addr\n", "addr = \"x\" y\n",
+		"addr = 1\naddr = 2\n"} {
+		if _, err := parseTOML([]byte(bad)); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestConfigPath(t *testing.T) {
+	for _, args := range [][]string{
+		{"-n", "1", "--config", "a.toml"},
+		{"--config=a.toml"},
+		{"-config", "a.toml", "-d", "x"},
+	} {
+		if path := configPath(args); path != "a.toml" {
+			t.Fatalf("%v: expected a.toml, got %q", args, path)
+		}
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	var conf Config
+	conf.def()
+	m := machineInit(conf, 0, "", nil)
+	resp, err := cmdCONFIG(m, nil, []string{"config", "get", "tick-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"tick-delay", "500ms"}
+	if !reflect.DeepEqual(resp, expect) {
+		t.Fatalf("expected %v, got %v", expect, resp)
+	}
+	_, err = cmdCONFIG(m, nil, []string{"config", "set", "openreads", "yes"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	_, err = cmdCONFIG(m, nil, []string{"config", "set", "data-dir", "x"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	// secrets are never returned or changed
+	m.conf.Auth = "secret"
+	m.conf.EncryptKeyPath = "/keys/at-rest"
+	for _, pattern := range []string{"*", "auth", "encrypt-*", "tls-key"} {
+		resp, err := cmdCONFIG(m, nil, []string{"config", "get", pattern})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range resp.([]string) {
+			if s == "auth" || s == "secret" || s == "encrypt-key" ||
+				s == "/keys/at-rest" || s == "tls-key" {
+				t.Fatalf("%s: unexpected %v", pattern, resp)
+			}
+		}
+	}
+	_, err = cmdCONFIG(m, nil, []string{"config", "set", "auth", "x"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, args := range [][]string{
+		{"config", "set", "openreads", "true"},
+		{"config", "set", "tick-delay", "50ms"},
+		{"config", "set", "log-level", "debug"},
+	} {
+		if _, err := cmdCONFIG(m, nil, args); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	if atomic.LoadInt32(&m.openReads) != 1 || m.tickDelay != 50*time.Millisecond {
+		t.Fatal("settings were not applied")
+	}
+	resp, _ = cmdCONFIG(m, nil, []string{"config", "get", "log-level"})
+	expect = []string{"log-level", "debug"}
+	if !reflect.DeepEqual(resp, expect) {
+		t.Fatalf("expected %v, got %v", expect, resp)
+	}
+}
@@ -20,7 +20,8 @@ import (
 )
 
 func snapshotInit(conf Config, dir string, m *machine, hclogger hclog.Logger) raft.SnapshotStore {
-	snaps, err := raft.NewFileSnapshotStoreWithLogger(dir, 3, hclogger)
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(dir,
+		conf.SnapshotRetain, hclogger)
 	if err != nil {
 		logger.Fatal(err)
 	}
@@ -35,19 +36,37 @@ type Snapshot interface {
 }
 
 type fsmSnap struct {
-	id    string
-	dir   string
-	snap  Snapshot
-	ts    int64
-	seed  int64
-	start int64
+	m        *machine
+	id       string
+	dir      string
+	snap     Snapshot
+	ts       int64
+	seed     int64
+	start    int64
+	sections []snapSection
+}
+
+// snapSection is a named block of replicated system state, such as the ACL
+// users, that is stored in the snapshot between the header and the user data.
+type snapSection struct {
+	name string
+	data []byte
 }
 
 func (s *fsmSnap) Persist(sink raft.SnapshotSink) error {
 	s.id = sink.ID()
-	gw := gzip.NewWriter(sink)
+	var w io.Writer = sink
+	var sw io.WriteCloser
+	if kr := s.m.conf.keys; kr != nil {
+		// the snapshot replaces the older data, which makes it the time to
+		// switch to a new data key
+		kr.rotate()
+		sw = kr.NewWriter(sink)
+		w = sw
+	}
+	gw := gzip.NewWriter(w)
 	var head [32]byte
-	copy(head[:], "SNAP0001")
+	copy(head[:], "SNAP0002")
 	binary.LittleEndian.PutUint64(head[8:], uint64(s.start))
 	binary.LittleEndian.PutUint64(head[16:], uint64(s.ts))
 	binary.LittleEndian.PutUint64(head[24:], uint64(s.seed))
@@ -58,18 +77,43 @@ func (s *fsmSnap) Persist(sink raft.SnapshotSink) error {
 	if n != 32 {
 		return errors.New("invalid write")
 	}
+	// (count, section...)
+	//   - count: uvarint
+	//   - section: (name, data)
+	//     - name: (count, byte...)
+	//     - data: (count, byte...)
+	var sdata []byte
+	sdata = appendUvarint(sdata, uint64(len(s.sections)))
+	for _, sect := range s.sections {
+		sdata = appendUvarint(sdata, uint64(len(sect.name)))
+		sdata = append(sdata, sect.name...)
+		sdata = appendUvarint(sdata, uint64(len(sect.data)))
+		sdata = append(sdata, sect.data...)
+	}
+	if _, err := gw.Write(sdata); err != nil {
+		return err
+	}
 	if err := s.snap.Persist(gw); err != nil {
 		return err
 	}
-	return gw.Close()
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	if sw != nil {
+		return sw.Close()
+	}
+	return nil
 }
 
 func (s *fsmSnap) Release() {
 	path := filepath.Join(s.dir, "snapshots", s.id, "state.bin")
-	if _, err := readSnapInfo(s.id, path); err != nil {
+	if _, err := readSnapInfo(s.m.conf.keys, s.id, path); err != nil {
 		path = ""
 	}
 	s.snap.Done(path)
+	if path != "" {
+		s.m.snapshotTaken(s.id)
+	}
 }
 
 func (m *machine) Snapshot() (raft.FSMSnapshot, error) {
@@ -85,32 +129,194 @@ func (m *machine) Snapshot() (raft.FSMSnapshot, error) {
 	if err != nil {
 		return nil, err
 	}
+	sections, err := m.snapSections()
+	if err != nil {
+		return nil, err
+	}
 	snap := &fsmSnap{
-		dir:   m.dir,
-		snap:  usnap,
-		seed:  m.seed,
-		ts:    m.ts,
-		start: m.start,
+		m:        m,
+		dir:      m.dir,
+		snap:     usnap,
+		seed:     m.seed,
+		ts:       m.ts,
+		start:    m.start,
+		sections: sections,
 	}
 	return snap, nil
 }
 
-func readSnapHead(r io.Reader) (start, ts, seed int64, err error) {
+// snapSections returns the replicated system state that must be included in
+// every snapshot.
+func (m *machine) snapSections() ([]snapSection, error) {
+	var sections []snapSection
+	data, err := m.acl.encode()
+	if err != nil {
+		return nil, err
+	}
+	sections = append(sections, snapSection{"acl", data})
+	data, err = m.sessions.encode()
+	if err != nil {
+		return nil, err
+	}
+	sections = append(sections, snapSection{"sessions", data})
+	sections = append(sections, snapSection{"keys", m.keys.encode()})
+	data, err = m.pubsub.encode()
+	if err != nil {
+		return nil, err
+	}
+	sections = append(sections, snapSection{"pubsub", data})
+	sections = append(sections, snapSection{"slots", m.slots.encode()})
+	data, err = m.schedule.encode()
+	if err != nil {
+		return nil, err
+	}
+	sections = append(sections, snapSection{"schedule", data})
+	data, err = m.locks.encode()
+	if err != nil {
+		return nil, err
+	}
+	sections = append(sections, snapSection{"locks", data})
+	data, err = m.plugins.encode()
+	if err != nil {
+		return nil, err
+	}
+	sections = append(sections, snapSection{"plugins", data})
+	data, err = m.scripts.encode()
+	if err != nil {
+		return nil, err
+	}
+	sections = append(sections, snapSection{"scripts", data})
+	return sections, nil
+}
+
+// restoreSections loads the replicated system state that was read from a
+// snapshot. Missing sections are reset to their empty state.
+func (m *machine) restoreSections(sections map[string][]byte) error {
+	acl, err := decodeACL(sections["acl"])
+	if err != nil {
+		return err
+	}
+	sessions, err := decodeSessions(sections["sessions"])
+	if err != nil {
+		return err
+	}
+	keys, err := decodeKeyVersions(sections["keys"])
+	if err != nil {
+		return err
+	}
+	pubsub, err := decodePubsubLog(sections["pubsub"], m.pubsubRetain)
+	if err != nil {
+		return err
+	}
+	slots, err := decodeSlotTable(sections["slots"], m.group, m.numGroups)
+	if err != nil {
+		return err
+	}
+	schedule, err := decodeScheduleTable(sections["schedule"])
+	if err != nil {
+		return err
+	}
+	locks, err := decodeLockTable(sections["locks"])
+	if err != nil {
+		return err
+	}
+	plugins, err := decodePluginTable(sections["plugins"], m.plugins.rt)
+	if err != nil {
+		return err
+	}
+	scripts, err := decodeScriptTable(sections["scripts"])
+	if err != nil {
+		return err
+	}
+	if m.locks != nil {
+		// wake up any blocked acquires
+		m.locks.wakeAll()
+	}
+	if m.pubsub != nil {
+		// wake up any subscribers waiting on the previous log
+		close(m.pubsub.notify)
+	}
+	m.acl = acl
+	m.sessions = sessions
+	m.keys = keys
+	m.pubsub = pubsub
+	m.slots = slots
+	m.schedule = schedule
+	m.locks = locks
+	m.plugins = plugins
+	m.scripts = scripts
+	return nil
+}
+
+// readSnapHead reads the snapshot header along with the system sections.
+// Version 1 snapshots do not have any sections.
+func readSnapHead(r io.Reader) (start, ts, seed int64,
+	sections map[string][]byte, err error,
+) {
 	var head [32]byte
 	n, err := io.ReadFull(r, head[:])
 	if err != nil {
-		return 0, 0, 0, err
+		return 0, 0, 0, nil, err
 	}
 	if n != 32 {
-		return 0, 0, 0, errors.New("invalid read")
+		return 0, 0, 0, nil, errors.New("invalid read")
 	}
-	if string(head[:8]) != "SNAP0001" {
-		return 0, 0, 0, errors.New("invalid snapshot signature")
+	var vers int
+	switch string(head[:8]) {
+	case "SNAP0001":
+		vers = 1
+	case "SNAP0002":
+		vers = 2
+	default:
+		return 0, 0, 0, nil, errors.New("invalid snapshot signature")
 	}
 	start = int64(binary.LittleEndian.Uint64(head[8:]))
 	ts = int64(binary.LittleEndian.Uint64(head[16:]))
 	seed = int64(binary.LittleEndian.Uint64(head[24:]))
-	return start, ts, seed, nil
+	sections = make(map[string][]byte)
+	if vers >= 2 {
+		br := byteReader{r}
+		count, err := binary.ReadUvarint(br)
+		if err != nil {
+			return 0, 0, 0, nil, err
+		}
+		for i := uint64(0); i < count; i++ {
+			name, err := readUvarintBytes(br)
+			if err != nil {
+				return 0, 0, 0, nil, err
+			}
+			data, err := readUvarintBytes(br)
+			if err != nil {
+				return 0, 0, 0, nil, err
+			}
+			sections[string(name)] = data
+		}
+	}
+	return start, ts, seed, sections, nil
+}
+
+// byteReader reads one byte at a time without buffering past the end of the
+// section data, which is followed by the user snapshot data.
+type byteReader struct{ io.Reader }
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r.Reader, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func readUvarintBytes(r byteReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r.Reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
 func (m *machine) Restore(rc io.ReadCloser) error {
@@ -124,26 +330,35 @@ func (m *machine) Restore(rc io.ReadCloser) error {
 			return errors.New("snapshot restoring is disabled")
 		}
 	}
-	gr, err := gzip.NewReader(rc)
+	gr, err := snapReader(m.conf.keys, rc)
 	if err != nil {
 		return err
 	}
-	start, ts, seed, err := readSnapHead(gr)
+	start, ts, seed, sections, err := readSnapHead(gr)
 	if err != nil {
 		return err
 	}
 	m.start = start
 	m.ts = ts
 	m.seed = seed
+	if err := m.restoreSections(sections); err != nil {
+		return err
+	}
 	m.data, err = restore(gr)
-	return err
+	if err != nil {
+		return err
+	}
+	m.tracking.flush()
+	m.snapshotRestored()
+	return nil
 }
 
 type restoreData struct {
-	data  interface{}
-	ts    int64
-	seed  int64
-	start int64
+	data     interface{}
+	ts       int64
+	seed     int64
+	start    int64
+	sections map[string][]byte
 }
 
 func dataDirInit(conf Config) (string, *restoreData) {
@@ -183,11 +398,11 @@ func dataDirRestoreBackup(conf Config, dir string) (rdata *restoreData, err erro
 		return nil, err
 	}
 	defer f.Close()
-	gr, err := gzip.NewReader(f)
+	gr, err := snapReader(conf.keys, f)
 	if err != nil {
 		return nil, err
 	}
-	rdata.start, rdata.ts, rdata.seed, err = readSnapHead(gr)
+	rdata.start, rdata.ts, rdata.seed, rdata.sections, err = readSnapHead(gr)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,494 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+var errNotInteger = errors.New("value is not an integer or out of range")
+
+var errNotFloat = errors.New("value is not a valid float")
+
+// ArgType is the type of a command argument.
+type ArgType string
+
+const (
+	ArgString    ArgType = "string"     // any value
+	ArgKey       ArgType = "key"        // a key, which is a string
+	ArgInteger   ArgType = "integer"    // a 64-bit signed integer
+	ArgDouble    ArgType = "double"     // a 64-bit float
+	ArgPureToken ArgType = "pure-token" // a token without a value
+)
+
+// ArgSpec describes a command argument.
+type ArgSpec struct {
+	// Name is used for getting the value from the Args.
+	Name string
+	// Type of the value. The default is ArgString.
+	Type ArgType
+	// Token is the keyword that comes before the value, such as "EX" in
+	// "SET key value EX 10". Args with a token may be in any order, but must
+	// come after the args without a token.
+	Token string
+	// Optional args may be omitted.
+	Optional bool
+	// Multiple args may be repeated. An arg without a token takes all of
+	// the remaining values, up to the first token.
+	Multiple bool
+}
+
+// CommandSpec describes a command, which allows for the arguments to be
+// validated and parsed prior to calling the command function, and for the
+// command to be documented using COMMAND INFO and COMMAND DOCS.
+type CommandSpec struct {
+	// Name of the command.
+	Name string
+	// Kind is 'w' for a write command, 'r' for a read command, or 's' for an
+	// intermediate command. See AddWriteCommand, AddReadCommand, and
+	// AddIntermediateCommand.
+	Kind byte
+	// Arity is the number of args, including the command name. A negative
+	// arity is the minimum number of args. Zero is not checked.
+	Arity int
+	// Args are the arguments, not including the command name.
+	Args []ArgSpec
+	// Flags are extra command flags, such as "fast" or "noscript".
+	Flags []string
+	// FirstKey, LastKey, and KeyStep are the key positions, which are the
+	// same as SetCommandKeys. When zero, the keys are the leading ArgKey args.
+	FirstKey, LastKey, KeyStep int
+	// Group is the command group, such as "string" or "generic".
+	Group string
+	// Summary is a short description of the command.
+	Summary string
+	// Fn is called with the parsed args.
+	Fn func(m Machine, args *Args) (interface{}, error)
+}
+
+// Args are the parsed arguments of a command that was added with
+// AddCommand.
+type Args struct {
+	// Raw are the original args, including the command name.
+	Raw  []string
+	vals map[string]interface{}
+}
+
+// Has returns true when the arg is present.
+func (a *Args) Has(name string) bool {
+	_, ok := a.vals[name]
+	return ok
+}
+
+// String returns the value of a string or key arg, or the first value of a
+// multiple arg. Returns an empty string when the arg is not present.
+func (a *Args) String(name string) string {
+	vals := a.Strings(name)
+	if len(vals) == 0 {
+		return ""
+	}
+	return vals[0]
+}
+
+// Strings returns the values of a multiple arg.
+func (a *Args) Strings(name string) []string {
+	switch v := a.vals[name].(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	}
+	return nil
+}
+
+// Int returns the value of an integer arg, or zero when not present.
+func (a *Args) Int(name string) int64 {
+	s := a.String(name)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// Float returns the value of a double arg, or zero when not present.
+func (a *Args) Float(name string) float64 {
+	s := a.String(name)
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// parseArgs validates the args using the spec.
+func (spec *CommandSpec) parseArgs(args []string) (*Args, error) {
+	if (spec.Arity > 0 && len(args) != spec.Arity) ||
+		(spec.Arity < 0 && len(args) < -spec.Arity) {
+		return nil, fmt.Errorf("wrong number of arguments for '%s' command",
+			strings.ToLower(spec.Name))
+	}
+	a := &Args{Raw: args, vals: make(map[string]interface{})}
+	tokens := make(map[string]*ArgSpec)
+	for i := range spec.Args {
+		if arg := &spec.Args[i]; arg.Token != "" {
+			tokens[strings.ToUpper(arg.Token)] = arg
+		}
+	}
+	isToken := func(s string) bool {
+		return tokens[strings.ToUpper(s)] != nil
+	}
+	i := 1
+	for j := range spec.Args {
+		arg := &spec.Args[j]
+		if arg.Token != "" {
+			continue
+		}
+		if i == len(args) || (arg.Optional && isToken(args[i])) {
+			if !arg.Optional {
+				return nil, fmt.Errorf("wrong number of arguments for '%s' "+
+					"command", strings.ToLower(spec.Name))
+			}
+			continue
+		}
+		if arg.Multiple {
+			var vals []string
+			for ; i < len(args) && !isToken(args[i]); i++ {
+				if err := checkArg(arg.Type, args[i]); err != nil {
+					return nil, err
+				}
+				vals = append(vals, args[i])
+			}
+			if len(vals) == 0 && !arg.Optional {
+				return nil, fmt.Errorf("wrong number of arguments for '%s' "+
+					"command", strings.ToLower(spec.Name))
+			}
+			a.vals[arg.Name] = vals
+			continue
+		}
+		if err := checkArg(arg.Type, args[i]); err != nil {
+			return nil, err
+		}
+		a.vals[arg.Name] = args[i]
+		i++
+	}
+	for ; i < len(args); i++ {
+		arg := tokens[strings.ToUpper(args[i])]
+		if arg == nil {
+			return nil, ErrSyntax
+		}
+		_, dup := a.vals[arg.Name]
+		if dup && !arg.Multiple {
+			return nil, ErrSyntax
+		}
+		val := arg.Token
+		if arg.Type != ArgPureToken {
+			if i+1 == len(args) {
+				return nil, ErrSyntax
+			}
+			i++
+			val = args[i]
+			if err := checkArg(arg.Type, val); err != nil {
+				return nil, err
+			}
+		}
+		if arg.Multiple {
+			vals, _ := a.vals[arg.Name].([]string)
+			a.vals[arg.Name] = append(vals, val)
+		} else {
+			a.vals[arg.Name] = val
+		}
+	}
+	for j := range spec.Args {
+		arg := &spec.Args[j]
+		if !arg.Optional && !a.Has(arg.Name) {
+			return nil, ErrSyntax
+		}
+	}
+	return a, nil
+}
+
+func checkArg(typ ArgType, val string) error {
+	switch typ {
+	case ArgInteger:
+		if _, err := strconv.ParseInt(val, 10, 64); err != nil {
+			return errNotInteger
+		}
+	case ArgDouble:
+		// like Redis, NaN and infinity are not valid
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return errNotFloat
+		}
+	}
+	return nil
+}
+
+// checkArgs validates the args of a command that was added with AddCommand,
+// allowing for the service to reject malformed writes and transactions prior
+// to going through the raft log.
+func (m *machine) checkArgs(name string, args []string) error {
+	if spec, ok := m.conf.specs[name]; ok {
+		_, err := spec.parseArgs(args)
+		return err
+	}
+	return nil
+}
+
+// keySpec returns the key positions of the command.
+func (spec *CommandSpec) keySpec() keySpec {
+	if spec.FirstKey != 0 {
+		return keySpec{first: spec.FirstKey, last: spec.LastKey,
+			step: spec.KeyStep}
+	}
+	var ks keySpec
+	for i, arg := range spec.Args {
+		if arg.Type != ArgKey || arg.Token != "" {
+			break
+		}
+		if ks.first == 0 {
+			ks.first = i + 1
+		}
+		ks.last, ks.step = i+1, 1
+		if arg.Multiple {
+			ks.last = -1
+			break
+		}
+	}
+	return ks
+}
+
+// AddCommand adds a command that is described by a spec. The args are
+// validated and parsed prior to calling the spec function. The key positions
+// are set as if SetCommandKeys was called.
+func (conf *Config) AddCommand(spec CommandSpec) {
+	name := strings.ToLower(spec.Name)
+	switch spec.Kind {
+	case 'w', 'r', 's':
+	default:
+		panic(fmt.Sprintf("command '%s': invalid kind '%c'", name, spec.Kind))
+	}
+	fn := spec.Fn
+	conf.addCommand(spec.Kind, name, func(m Machine, args []string,
+	) (interface{}, error) {
+		a, err := spec.parseArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return fn(m, a)
+	})
+	if conf.specs == nil {
+		conf.specs = make(map[string]*CommandSpec)
+	}
+	conf.specs[name] = &spec
+	ks := spec.keySpec()
+	conf.SetCommandKeys(name, ks.first, ks.last, ks.step)
+}
+
+// builtinSpecs documents the builtin commands.
+var builtinSpecs = map[string]*CommandSpec{
+	"raft":       {Arity: -2, Group: "server", Summary: "raft commands"},
+	"cluster":    {Arity: -2, Group: "cluster", Summary: "cluster commands"},
+	"machine":    {Arity: 1, Group: "server", Summary: "machine info"},
+	"version":    {Arity: 1, Group: "server", Summary: "server version"},
+	"acl":        {Arity: -2, Group: "server", Summary: "access control"},
+	"publish":    {Arity: 3, Group: "pubsub", Summary: "publish a message"},
+	"subscribe":  {Arity: -2, Group: "pubsub", Summary: "subscribe to channels"},
+	"psubscribe": {Arity: -2, Group: "pubsub", Summary: "subscribe to patterns"},
+	"group":      {Arity: -3, Group: "cluster", Summary: "run in a raft group"},
+	"schedule":   {Arity: -2, Group: "generic", Summary: "scheduled jobs"},
+	"lock":       {Arity: -2, Group: "generic", Summary: "replicated locks"},
+	"config":     {Arity: -2, Group: "server", Summary: "server settings"},
+	"plugin":     {Arity: -2, Group: "scripting", Summary: "wasm plugins"},
+	"eval":       {Arity: -3, Group: "scripting", Summary: "run a lua script"},
+	"evalsha":    {Arity: -3, Group: "scripting", Summary: "run a loaded script"},
+	"script":     {Arity: -2, Group: "scripting", Summary: "lua scripts"},
+	"command":    {Arity: -1, Group: "server", Summary: "command info"},
+	"slowlog":    {Arity: -2, Group: "server", Summary: "slow commands"},
+	"latency":    {Arity: -2, Group: "server", Summary: "command latencies"},
+	"client":     {Arity: -2, Group: "connection", Summary: "client connections"},
+	"debug":      {Arity: -2, Group: "server", Summary: "fault injection"},
+}
+
+// commandSpec returns the spec of a command, with the key positions that are
+// in use. Commands that were not added with AddCommand have a spec that only
+// includes the kind and keys.
+func (m *machine) commandSpec(name string) (*CommandSpec, bool) {
+	cmd, ok := m.lookupCommand(name)
+	if !ok || internalCommands[name] {
+		return nil, false
+	}
+	spec := &CommandSpec{Arity: -1}
+	if cspec, ok := m.conf.specs[name]; ok {
+		*spec = *cspec
+	} else if bspec, ok := builtinSpecs[name]; ok {
+		*spec = *bspec
+	}
+	spec.Name, spec.Kind = name, cmd.kind
+	ks, ok := m.keySpecs[name]
+	if !ok && cmd.kind == 'w' {
+		ks = defKeySpec
+	}
+	spec.FirstKey, spec.LastKey, spec.KeyStep = ks.first, ks.last, ks.step
+	return spec, true
+}
+
+// commandNames returns the names of all commands that a client can call.
+func (m *machine) commandNames() []string {
+	var names []string
+	for name := range m.commands {
+		if !internalCommands[name] {
+			names = append(names, name)
+		}
+	}
+	m.mu.RLock()
+	for name := range m.plugins.cmds {
+		names = append(names, name)
+	}
+	m.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// info returns the COMMAND INFO of the command.
+func (spec *CommandSpec) info() []interface{} {
+	var flags []interface{}
+	var cats []interface{}
+	switch spec.Kind {
+	case 'w':
+		flags = append(flags, redcon.SimpleString("write"))
+		cats = append(cats, redcon.SimpleString("@write"))
+	case 'r':
+		flags = append(flags, redcon.SimpleString("readonly"))
+		cats = append(cats, redcon.SimpleString("@read"))
+	default:
+		flags = append(flags, redcon.SimpleString("admin"))
+		cats = append(cats, redcon.SimpleString("@admin"))
+	}
+	for _, flag := range spec.Flags {
+		flags = append(flags, redcon.SimpleString(strings.ToLower(flag)))
+	}
+	return []interface{}{
+		strings.ToLower(spec.Name),
+		redcon.SimpleInt(spec.Arity),
+		flags,
+		redcon.SimpleInt(spec.FirstKey),
+		redcon.SimpleInt(spec.LastKey),
+		redcon.SimpleInt(spec.KeyStep),
+		cats,
+	}
+}
+
+// docs returns the COMMAND DOCS of the command.
+func (spec *CommandSpec) docs() redisMap {
+	docs := redisMap{
+		"summary", spec.Summary,
+		"group", spec.Group,
+	}
+	if len(spec.Args) > 0 {
+		var args []interface{}
+		for _, arg := range spec.Args {
+			typ := arg.Type
+			if typ == "" {
+				typ = ArgString
+			}
+			doc := redisMap{"name", arg.Name, "type", string(typ)}
+			if arg.Token != "" {
+				doc = append(doc, "token", arg.Token)
+			}
+			var flags []string
+			if arg.Optional {
+				flags = append(flags, "optional")
+			}
+			if arg.Multiple {
+				flags = append(flags, "multiple")
+			}
+			if len(flags) > 0 {
+				doc = append(doc, "flags", flags)
+			}
+			args = append(args, doc)
+		}
+		docs = append(docs, "arguments", args)
+	}
+	return docs
+}
+
+// COMMAND [subcommand args...]
+// help: returns information about the commands.
+func cmdCOMMAND(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	if len(args) == 1 {
+		var resp []interface{}
+		for _, name := range m.commandNames() {
+			if spec, ok := m.commandSpec(name); ok {
+				resp = append(resp, spec.info())
+			}
+		}
+		return resp, nil
+	}
+	switch strings.ToLower(args[1]) {
+	case "help":
+		if len(args) != 2 {
+			return nil, errWrongNumArgsCommand
+		}
+		return []redcon.SimpleString{
+			"COMMAND",
+			"COMMAND COUNT",
+			"COMMAND LIST [FILTERBY PATTERN pattern]",
+			"COMMAND INFO [command ...]",
+			"COMMAND DOCS [command ...]",
+		}, nil
+	case "count":
+		if len(args) != 2 {
+			return nil, errWrongNumArgsCommand
+		}
+		return redcon.SimpleInt(len(m.commandNames())), nil
+	case "list":
+		pattern := "*"
+		if len(args) == 5 && strings.EqualFold(args[2], "filterby") &&
+			strings.EqualFold(args[3], "pattern") {
+			pattern = args[4]
+		} else if len(args) != 2 {
+			return nil, ErrSyntax
+		}
+		var resp []string
+		for _, name := range m.commandNames() {
+			if match.Match(name, pattern) {
+				resp = append(resp, name)
+			}
+		}
+		return resp, nil
+	case "info":
+		names := args[2:]
+		if len(names) == 0 {
+			names = m.commandNames()
+		}
+		var resp []interface{}
+		for _, name := range names {
+			if spec, ok := m.commandSpec(strings.ToLower(name)); ok {
+				resp = append(resp, spec.info())
+			} else {
+				resp = append(resp, nil)
+			}
+		}
+		return resp, nil
+	case "docs":
+		names := args[2:]
+		if len(names) == 0 {
+			names = m.commandNames()
+		}
+		var resp redisMap
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if spec, ok := m.commandSpec(name); ok {
+				resp = append(resp, name, spec.docs())
+			}
+		}
+		return resp, nil
+	default:
+		return nil, errUnknownCommandCommand(args[:2])
+	}
+}
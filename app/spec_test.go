@@ -0,0 +1,134 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+func TestParseArgs(t *testing.T) {
+	spec := &CommandSpec{
+		Name: "zadd", Arity: -3,
+		Args: []ArgSpec{
+			{Name: "key", Type: ArgKey},
+			{Name: "score", Type: ArgDouble},
+			{Name: "members", Multiple: true},
+			{Name: "nx", Type: ArgPureToken, Token: "NX", Optional: true},
+			{Name: "limit", Type: ArgInteger, Token: "LIMIT", Optional: true},
+			{Name: "tags", Token: "TAG", Optional: true, Multiple: true},
+		},
+	}
+	a, err := spec.parseArgs([]string{"zadd", "k", "1.5", "a", "b", "tag",
+		"x", "nx", "LIMIT", "10", "TAG", "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String("key") != "k" || a.Float("score") != 1.5 ||
+		!reflect.DeepEqual(a.Strings("members"), []string{"a", "b"}) ||
+		!a.Has("nx") || a.Int("limit") != 10 ||
+		!reflect.DeepEqual(a.Strings("tags"), []string{"x", "y"}) {
+		t.Fatalf("unexpected %v", a.vals)
+	}
+	for _, args := range [][]string{
+		{"zadd", "k"},                              // arity
+		{"zadd", "k", "x", "a"},                    // not a float
+		{"zadd", "k", "nan", "a"},                  // not a number
+		{"zadd", "k", "-inf", "a"},                 // infinite
+		{"zadd", "k", "1e999", "a"},                // out of range
+		{"zadd", "k", "1", "a", "limit", "x"},      // not an integer
+		{"zadd", "k", "1", "a", "limit"},           // missing value
+		{"zadd", "k", "1", "a", "nx", "nx"},        // duplicate
+		{"zadd", "k", "1", "nx"},                   // missing members
+		{"zadd", "k", "1", "a", "limit", "1", "z"}, // unknown token
+	} {
+		if _, err := spec.parseArgs(args); err == nil {
+			t.Fatalf("%v: expected error", args)
+		}
+	}
+	ks := spec.keySpec()
+	if ks != (keySpec{first: 1, last: 1, step: 1}) {
+		t.Fatalf("unexpected %v", ks)
+	}
+	ks = (&CommandSpec{Args: []ArgSpec{{Name: "keys", Type: ArgKey,
+		Multiple: true}}}).keySpec()
+	if ks != (keySpec{first: 1, last: -1, step: 1}) {
+		t.Fatalf("unexpected %v", ks)
+	}
+}
+
+func TestCommandCommand(t *testing.T) {
+	var conf Config
+	conf.def()
+	conf.AddCommand(CommandSpec{
+		Name: "SET", Kind: 'w', Arity: -3,
+		Args: []ArgSpec{
+			{Name: "key", Type: ArgKey},
+			{Name: "value"},
+			{Name: "seconds", Type: ArgInteger, Token: "EX", Optional: true},
+		},
+		Group: "string", Summary: "sets a key",
+		Fn: func(m Machine, args *Args) (interface{}, error) {
+			return args.Int("seconds"), nil
+		},
+	})
+	m := machineInit(conf, 0, "", nil)
+	resp, err := m.commands["set"].fn(m, nil,
+		[]string{"set", "k", "v", "ex", "10"})
+	if err != nil || resp != int64(10) {
+		t.Fatalf("unexpected %v %v", resp, err)
+	}
+	if _, err := m.commands["set"].fn(m, nil,
+		[]string{"set", "k", "v", "ex"}); err != ErrSyntax {
+		t.Fatalf("expected %v, got %v", ErrSyntax, err)
+	}
+	// the service rejects malformed writes prior to the raft log
+	s := newService(conf, m, nil)
+	if _, _, err := s.Send([]string{"set", "k", "v", "ex"},
+		nil).Recv(); err != ErrSyntax {
+		t.Fatalf("expected %v, got %v", ErrSyntax, err)
+	}
+	if _, _, err := s.Exec([][]string{{"set", "k", "v", "ex", "x"}}, nil, 0,
+		nil).Recv(); err == nil || !strings.Contains(err.Error(),
+		errNotInteger.Error()) {
+		t.Fatalf("expected %v, got %v", errNotInteger, err)
+	}
+	resp, err = cmdCOMMAND(m, nil, []string{"command", "info", "set",
+		"nope", "txn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []interface{}{
+		[]interface{}{"set", redcon.SimpleInt(-3),
+			[]interface{}{redcon.SimpleString("write")},
+			redcon.SimpleInt(1), redcon.SimpleInt(1), redcon.SimpleInt(1),
+			[]interface{}{redcon.SimpleString("@write")}},
+		nil, nil,
+	}
+	if !reflect.DeepEqual(resp, expect) {
+		t.Fatalf("expected %v, got %v", expect, resp)
+	}
+	resp, _ = cmdCOMMAND(m, nil, []string{"command", "docs", "set"})
+	docs := resp.(redisMap)
+	if len(docs) != 2 || docs[0] != "set" {
+		t.Fatalf("unexpected %v", docs)
+	}
+	args := docs[1].(redisMap)[5].([]interface{})
+	expectArg := redisMap{"name", "seconds", "type", "integer", "token", "EX",
+		"flags", []string{"optional"}}
+	if len(args) != 3 || !reflect.DeepEqual(args[2], expectArg) {
+		t.Fatalf("unexpected %v", args)
+	}
+	resp, _ = cmdCOMMAND(m, nil, []string{"command", "list", "filterby",
+		"pattern", "s*"})
+	for _, name := range resp.([]string) {
+		if internalCommands[name] {
+			t.Fatalf("unexpected internal command %s", name)
+		}
+	}
+	resp, _ = cmdCOMMAND(m, nil, []string{"command", "count"})
+	if resp != redcon.SimpleInt(len(m.commandNames())) {
+		t.Fatalf("unexpected %v", resp)
+	}
+}
@@ -3,11 +3,170 @@ package app
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/hashicorp/raft"
+	"github.com/moontrade/mdbx-go"
 	"github.com/moontrade/server/logger"
 )
 
-func storeInit(conf Config, dir string) (raft.LogStore, raft.StableStore) {
+// StoreGeometry is the MDBX geometry of a store environment, in bytes. A
+// zero field uses the default geometry.
+type StoreGeometry struct {
+	Lower    int64 // minimum size of the database
+	Upper    int64 // maximum size of the database
+	Growth   int64 // size of each increase of the database
+	PageSize int64 // size of a database page, a power of 2
+}
+
+// geometry returns the MDBX geometry with the zero fields from the default.
+func (g StoreGeometry) geometry(def mdbx.Geometry) mdbx.Geometry {
+	if g.Lower > 0 {
+		def.SizeLower = uintptr(g.Lower)
+		if def.SizeNow < def.SizeLower {
+			def.SizeNow = def.SizeLower
+		}
+	}
+	if g.Upper > 0 {
+		def.SizeUpper = uintptr(g.Upper)
+	}
+	if g.Growth > 0 {
+		def.GrowthStep = uintptr(g.Growth)
+		def.ShrinkThreshold = def.GrowthStep * 2
+	}
+	if g.PageSize > 0 {
+		def.PageSize = uintptr(g.PageSize)
+	}
+	return def
+}
+
+var storeSizeUnits = []struct {
+	suffix string
+	size   int64
+}{{"TB", Terabyte}, {"GB", Gigabyte}, {"MB", Megabyte}, {"KB", Kilobyte}}
+
+func parseStoreSize(s string) (int64, error) {
+	unit := int64(1)
+	for _, u := range storeSizeUnits {
+		if strings.HasSuffix(strings.ToUpper(s), u.suffix) {
+			s, unit = s[:len(s)-len(u.suffix)], u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size")
+	}
+	return n * unit, nil
+}
+
+func formatStoreSize(n int64) string {
+	for _, u := range storeSizeUnits {
+		if n > 0 && n%u.size == 0 {
+			return strconv.FormatInt(n/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// parseStoreGeometry parses the geometry in the format
+// "lower=1MB,upper=4GB,growth=16MB,page=4KB". Each field is optional.
+func parseStoreGeometry(s string) (StoreGeometry, error) {
+	var g StoreGeometry
+	if s == "" {
+		return g, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return g, fmt.Errorf("invalid geometry field '%s'", field)
+		}
+		n, err := parseStoreSize(kv[1])
+		if err != nil {
+			return g, fmt.Errorf("invalid geometry field '%s'", field)
+		}
+		switch strings.ToLower(kv[0]) {
+		case "lower":
+			g.Lower = n
+		case "upper":
+			g.Upper = n
+		case "growth":
+			g.Growth = n
+		case "page":
+			g.PageSize = n
+		default:
+			return g, fmt.Errorf("invalid geometry field '%s'", field)
+		}
+	}
+	return g, nil
+}
+
+func (g StoreGeometry) String() string {
+	var fields []string
+	for _, f := range []struct {
+		name string
+		n    int64
+	}{{"lower", g.Lower}, {"upper", g.Upper}, {"growth", g.Growth},
+		{"page", g.PageSize}} {
+		if f.n > 0 {
+			fields = append(fields, f.name+"="+formatStoreSize(f.n))
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// SyncMode is the MDBX sync mode of a store environment.
+type SyncMode int
+
+const (
+	// SyncDefault is SyncNoMetaSync for the raft log and SyncDurable for the
+	// stable store, or SyncSafeNoSync for both when NoSync is on.
+	SyncDefault SyncMode = iota
+	// SyncDurable syncs the data and the meta page on every commit.
+	SyncDurable
+	// SyncNoMetaSync syncs the data on every commit, and the meta page on
+	// the next sync. A crash may lose the last commit.
+	SyncNoMetaSync
+	// SyncSafeNoSync leaves the syncing to the operating system, or to the
+	// SyncInterval. A crash may lose the recent commits, but the database
+	// is not corrupted.
+	SyncSafeNoSync
+)
+
+var syncModeNames = map[SyncMode]string{
+	SyncDefault:    "default",
+	SyncDurable:    "durable",
+	SyncNoMetaSync: "nometasync",
+	SyncSafeNoSync: "safe-nosync",
+}
+
+// storeFlags returns the flags with the sync mode. The default mode keeps
+// the sync flags, unless nosync is on.
+func storeFlags(flags mdbx.EnvFlags, mode SyncMode, nosync bool,
+) mdbx.EnvFlags {
+	if mode == SyncDefault {
+		if !nosync {
+			return flags
+		}
+		mode = SyncSafeNoSync
+	}
+	flags &^= mdbx.EnvSyncDurable | mdbx.EnvNoMetaSync | mdbx.EnvSafeNoSync |
+		mdbx.EnvUtterlyNoSync
+	switch mode {
+	case SyncDurable:
+		flags |= mdbx.EnvSyncDurable
+	case SyncNoMetaSync:
+		flags |= mdbx.EnvNoMetaSync
+	case SyncSafeNoSync:
+		flags |= mdbx.EnvSafeNoSync
+	}
+	return flags
+}
+
+func storeInit(conf Config, dir string, faults *faultTable,
+) (raft.LogStore, raft.StableStore) {
 	//conf.Backend = MDBX
 	switch conf.Backend {
 	//case Bolt:
@@ -30,15 +189,23 @@ func storeInit(conf Config, dir string) (raft.LogStore, raft.StableStore) {
 	//	return store, store
 
 	case MDBX:
-		store, err := OpenStore(
-			dir,
-			DefaultLogFlags,
-			DefaultStableFlags,
-			0755,
-		)
+		store, err := OpenStoreOptions(dir, StoreOptions{
+			LogFlags: storeFlags(DefaultLogFlags, conf.LogSync,
+				conf.NoSync),
+			StableFlags: storeFlags(DefaultStableFlags, conf.StableSync,
+				conf.NoSync),
+			LogGeometry:    conf.LogGeometry.geometry(DefaultLogGeometry),
+			StableGeometry: conf.StableGeometry.geometry(DefaultStableGeometry),
+			Mode:           0755,
+			Keys:           conf.keys,
+		})
 		if err != nil {
 			logger.Fatal(fmt.Errorf("mdbx store open: %s", err))
 		}
+		store.faults = faults
+		if conf.SyncInterval > 0 {
+			go runStoreSync(store, conf.SyncInterval)
+		}
 		return store, store
 
 	default:
@@ -46,3 +213,12 @@ func storeInit(conf Config, dir string) (raft.LogStore, raft.StableStore) {
 	}
 	return nil, nil
 }
+
+// runStoreSync flushes the store to disk at every interval.
+func runStoreSync(store *Store, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := store.Sync(); err != nil {
+			logger.Error(fmt.Errorf("store sync: %v", err))
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/moontrade/mdbx-go"
+)
+
+func TestStoreGeometry(t *testing.T) {
+	g, err := parseStoreGeometry("lower=2MB, upper=1gb,growth=32MB,page=8KB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := StoreGeometry{2 * Megabyte, Gigabyte, 32 * Megabyte, 8 * Kilobyte}
+	if g != expect {
+		t.Fatalf("expected %v, got %v", expect, g)
+	}
+	if s := g.String(); s != "lower=2MB,upper=1GB,growth=32MB,page=8KB" {
+		t.Fatalf("unexpected %s", s)
+	}
+	for _, s := range []string{"lower", "lower=x", "size=1MB", "upper=-1"} {
+		if _, err := parseStoreGeometry(s); err == nil {
+			t.Fatalf("%s: expected error", s)
+		}
+	}
+	mg := StoreGeometry{Upper: 8 * Gigabyte}.geometry(DefaultLogGeometry)
+	if mg.SizeUpper != 8*Gigabyte ||
+		mg.SizeLower != DefaultLogGeometry.SizeLower ||
+		mg.PageSize != DefaultLogGeometry.PageSize {
+		t.Fatalf("unexpected %v", mg)
+	}
+
+	var conf Config
+	conf.def()
+	loaded, err := loadSettings(&conf, "", []string{"APP_LOG_SYNC=durable",
+		"APP_STABLE_GEOMETRY=upper=1MB"})
+	if err != nil || !loaded["log-sync"] || conf.LogSync != SyncDurable ||
+		conf.StableGeometry.Upper != Megabyte {
+		t.Fatalf("unexpected %v %v", conf, err)
+	}
+	if _, err := loadSettings(&conf, "", []string{"APP_LOG_SYNC=x"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestStoreFlags(t *testing.T) {
+	sync := mdbx.EnvNoMetaSync | mdbx.EnvSafeNoSync | mdbx.EnvUtterlyNoSync
+	for _, tc := range []struct {
+		flags  mdbx.EnvFlags
+		mode   SyncMode
+		nosync bool
+		expect mdbx.EnvFlags
+	}{
+		{DefaultLogFlags, SyncDefault, false, mdbx.EnvNoMetaSync},
+		{DefaultLogFlags, SyncDefault, true, mdbx.EnvSafeNoSync},
+		{DefaultLogFlags, SyncDurable, true, mdbx.EnvSyncDurable},
+		{DefaultStableFlags, SyncNoMetaSync, false, mdbx.EnvNoMetaSync},
+	} {
+		flags := storeFlags(tc.flags, tc.mode, tc.nosync)
+		if flags&sync != tc.expect ||
+			flags&^sync != tc.flags&^sync {
+			t.Fatalf("%v: unexpected %x", tc, flags)
+		}
+	}
+
+	dir := t.TempDir()
+	store, err := OpenStoreOptions(dir, StoreOptions{
+		LogFlags:       storeFlags(DefaultLogFlags, SyncDefault, true),
+		StableFlags:    storeFlags(DefaultStableFlags, SyncDefault, true),
+		LogGeometry:    StoreGeometry{Upper: 64 * Megabyte}.geometry(DefaultLogGeometry),
+		StableGeometry: DefaultStableGeometry,
+		Mode:           0755,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.StoreLogs([]*raft.Log{{Index: 1, Data: []byte("a")},
+		{Index: 2, Data: []byte("b")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SyncLog(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	var log raft.Log
+	if err := store.GetLog(2, &log); err != nil || string(log.Data) != "b" {
+		t.Fatalf("unexpected %v %v", log, err)
+	}
+}
+
+func TestStoreLogsSync(t *testing.T) {
+	// the injected disk delay is taken by every forced sync
+	ft := newFaultTable()
+	ft.disk = 100 * time.Millisecond
+	for _, nosync := range []bool{false, true} {
+		store, err := OpenStoreOptions(t.TempDir(), StoreOptions{
+			LogFlags:       storeFlags(DefaultLogFlags, SyncDefault, nosync),
+			StableFlags:    storeFlags(DefaultStableFlags, SyncDefault, nosync),
+			LogGeometry:    DefaultLogGeometry,
+			StableGeometry: DefaultStableGeometry,
+			Mode:           0755,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.faults = ft
+		start := time.Now()
+		for i := uint64(1); i <= 3; i++ {
+			if err := store.StoreLogs([]*raft.Log{{Index: i}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		elapsed := time.Since(start)
+		store.Close()
+		if nosync && elapsed >= ft.disk {
+			t.Fatalf("expected no forced sync, took %s", elapsed)
+		}
+		if !nosync && elapsed < 3*ft.disk {
+			t.Fatalf("expected a sync for every append, took %s", elapsed)
+		}
+	}
+}
@@ -6,17 +6,27 @@ import (
 	"github.com/hashicorp/raft"
 	"github.com/moontrade/server/logger"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
 // runTicker is a background routine that keeps the raft machine time and
 // random seed updated.
-func runTicker(conf Config, rt *remoteTime, m *machine, ra *raftWrap) {
+func runTicker(conf Config, c *clock, m *machine, ra *raftWrap) {
 	rbuf := make([]byte, 4096)
 	var rnb []byte
+	var drifting bool
 	for {
 		start := time.Now()
-		ts := rt.Now().UnixNano()
+		ts := c.Now().UnixNano()
+		m.mu.RLock()
+		if ts <= m.ts {
+			// The time source is behind the machine time, which may happen
+			// when a new leader has a slower clock. Keep the machine time
+			// moving forward.
+			ts = m.ts + 1
+		}
+		m.mu.RUnlock()
 		if len(rnb) == 0 {
 			n, err := rand.Read(rbuf[:])
 			if err != nil || n != len(rbuf) {
@@ -31,6 +41,7 @@ func runTicker(conf Config, rt *remoteTime, m *machine, ra *raftWrap) {
 			"tick",
 			strconv.FormatInt(ts, 10),
 			strconv.FormatInt(seed, 10),
+			strconv.FormatInt(int64(conf.SessionTimeout), 10),
 		}
 		req.wg.Add(1)
 		m.wrC <- req
@@ -46,8 +57,9 @@ func runTicker(conf Config, rt *remoteTime, m *machine, ra *raftWrap) {
 		}
 		m.tickedSig.Broadcast()
 		m.mu.Unlock()
+		c.checkDrift(conf, m, &drifting)
 		dur := time.Since(start)
-		delay := m.tickDelay - dur
+		delay := time.Duration(atomic.LoadInt64((*int64)(&m.tickDelay))) - dur
 		if delay < 1 {
 			delay = 1
 		}
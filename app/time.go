@@ -1,82 +1,318 @@
 package app
 
 import (
-	"github.com/moontrade/server/logger"
-	"github.com/tidwall/rtime"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
+
+	"github.com/moontrade/server/logger"
+	"github.com/tidwall/rtime"
 )
 
-type remoteTime struct {
-	remote bool       // use remote
-	mu     sync.Mutex // lock times
-	rtime  time.Time  // remote time
-	ltime  time.Time  // local time
-	ctime  time.Time  // calcd time
+// TimeSource is a source of time for the machine clock. The leader uses its
+// time source to generate the timestamps that are sent through the raft log
+// with every tick, which becomes the time returned by Machine.Now().
+type TimeSource interface {
+	// Now returns the current time. Returns an error when the time is not
+	// yet known, such as a remote time server that has not been reached.
+	Now() (time.Time, error)
 }
 
-func (rt *remoteTime) Now() time.Time {
-	if !rt.remote {
-		return time.Now()
+var errTimeNotSynced = errors.New("time not synchronized")
+
+// LocalTime returns a TimeSource that uses the local server time.
+func LocalTime() TimeSource {
+	return localTime{}
+}
+
+type localTime struct{}
+
+func (localTime) Now() (time.Time, error) { return time.Now(), nil }
+func (localTime) String() string          { return "local" }
+
+// InternetTime returns a TimeSource that is synchronized with the public
+// internet.
+func InternetTime() TimeSource {
+	return newSyncedTime("internet", func() (time.Time, error) {
+		tm := rtime.Now()
+		if tm.IsZero() {
+			return tm, errors.New("no internet connection")
+		}
+		return tm, nil
+	})
+}
+
+// NTPTime returns a TimeSource that is synchronized with an NTP server,
+// such as "10.0.0.1:123". The default port is 123.
+func NTPTime(addr string) TimeSource {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "123")
 	}
-	rt.mu.Lock()
-	ctime := rt.rtime.Add(time.Since(rt.ltime))
-	if !ctime.After(rt.ctime) {
+	return newSyncedTime("ntp "+addr, func() (time.Time, error) {
+		return ntpNow(addr, time.Second*5)
+	})
+}
+
+// HTTPDateTime returns a TimeSource that is synchronized with the Date
+// header of an HTTP server, such as "http://10.0.0.1/". The Date header has
+// a resolution of one second.
+func HTTPDateTime(url string) TimeSource {
+	return newSyncedTime("http "+url, func() (time.Time, error) {
+		return httpDateNow(url, time.Second*5)
+	})
+}
+
+// ManualClock is a TimeSource that only changes when it's Set or Add is
+// called, which is useful for tests.
+type ManualClock struct {
+	mu sync.Mutex
+	tm time.Time
+}
+
+// NewManualClock returns a ManualClock that starts at the provided time.
+func NewManualClock(tm time.Time) *ManualClock {
+	return &ManualClock{tm: tm}
+}
+
+// Now returns the time of the clock.
+func (c *ManualClock) Now() (time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tm, nil
+}
+
+// Set the time of the clock.
+func (c *ManualClock) Set(tm time.Time) {
+	c.mu.Lock()
+	c.tm = tm
+	c.mu.Unlock()
+}
+
+// Add moves the clock forward.
+func (c *ManualClock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.tm = c.tm.Add(d)
+	c.mu.Unlock()
+}
+
+func (c *ManualClock) String() string { return "manual" }
+
+// syncedTime is a TimeSource that periodically fetches the time from a
+// remote server, and adds the local elapsed time since the last fetch.
+type syncedTime struct {
+	name  string
+	fetch func() (time.Time, error)
+	once  sync.Once
+	mu    sync.Mutex
+	rtime time.Time // remote time
+	ltime time.Time // local time
+}
+
+func newSyncedTime(name string, fetch func() (time.Time, error),
+) *syncedTime {
+	return &syncedTime{name: name, fetch: fetch}
+}
+
+func (st *syncedTime) String() string { return st.name }
+
+func (st *syncedTime) Now() (time.Time, error) {
+	st.once.Do(func() { go st.run() })
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.rtime.IsZero() {
+		return time.Time{}, errTimeNotSynced
+	}
+	return st.rtime.Add(time.Since(st.ltime)), nil
+}
+
+func (st *syncedTime) run() {
+	for {
+		tm, err := st.fetch()
+		if err != nil {
+			logger.Debug("synchronize time: %s: %v", st.name, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		st.mu.Lock()
+		st.ltime = time.Now()
+		st.rtime = tm
+		st.mu.Unlock()
+		logger.Debug("synchronized time: %s", tm)
+		time.Sleep(time.Second * 30)
+	}
+}
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and
+// the Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+func ntpTime(b []byte) time.Time {
+	secs := int64(binary.BigEndian.Uint32(b)) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:]))
+	return time.Unix(secs, frac*1e9>>32)
+}
+
+// ntpNow returns the time from an NTP server using a simple SNTP request.
+func ntpNow(addr string, timeout time.Duration) (time.Time, error) {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	var packet [48]byte
+	packet[0] = 0x23 // version 4, client mode
+	t0 := time.Now()
+	if _, err := conn.Write(packet[:]); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := conn.Read(packet[:]); err != nil {
+		return time.Time{}, err
+	}
+	t3 := time.Now()
+	if packet[0]&0x7 != 4 || packet[1] == 0 {
+		return time.Time{}, errors.New("invalid ntp response")
+	}
+	t1 := ntpTime(packet[32:]) // server receive
+	t2 := ntpTime(packet[40:]) // server transmit
+	offset := (t1.Sub(t0) + t2.Sub(t3)) / 2
+	return t3.Add(offset), nil
+}
+
+// httpDateNow returns the time from the Date header of an HTTP server.
+func httpDateNow(url string, timeout time.Duration) (time.Time, error) {
+	client := http.Client{Timeout: timeout}
+	start := time.Now()
+	resp, err := client.Head(url)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+	tm, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date header: %v", err)
+	}
+	return tm.Add(time.Since(start) / 2), nil
+}
+
+// parseTimeSource returns the TimeSource for the --time-source flag.
+func parseTimeSource(s string) (TimeSource, error) {
+	switch {
+	case s == "local":
+		return LocalTime(), nil
+	case s == "internet":
+		return InternetTime(), nil
+	case strings.HasPrefix(s, "ntp://"):
+		return NTPTime(s[6:]), nil
+	case strings.HasPrefix(s, "http://"), strings.HasPrefix(s, "https://"):
+		return HTTPDateTime(s), nil
+	}
+	return nil, fmt.Errorf("invalid time source '%s'", s)
+}
+
+// clock is the time used by the ticker. It's always monotonic and
+// increasing.
+type clock struct {
+	src   TimeSource
+	mu    sync.Mutex // lock times
+	ctime time.Time  // calcd time
+}
+
+func (c *clock) Now() time.Time {
+	tm, err := c.src.Now()
+	if err != nil {
+		tm = time.Now()
+	}
+	c.mu.Lock()
+	if !tm.After(c.ctime) {
 		// ensure time is monotonic and increasing
-		ctime = rt.ctime.Add(1)
-		rt.ctime = ctime
+		tm = c.ctime.Add(1)
 	}
-	rt.mu.Unlock()
-	return ctime
+	c.ctime = tm
+	c.mu.Unlock()
+	return tm
 }
 
-// remoteTimeInit initializes the remote time fetching services, and
-// continueously runs it in the background to keep synchronized.
-func remoteTimeInit(conf Config) *remoteTime {
-	rt := new(remoteTime)
-	if conf.LocalTime {
+// timeInit initializes the time source, and waits for it to become ready.
+// The local time is used when the time source is not ready before the
+// timeout, and until the time source becomes ready.
+func timeInit(conf Config) *clock {
+	src := conf.TimeSource
+	if src == nil {
+		if conf.LocalTime {
+			src = LocalTime()
+		} else {
+			src = InternetTime()
+		}
+	}
+	name := fmt.Sprint(src)
+	if _, ok := src.(localTime); ok {
 		logger.Warn("using local time")
-		return rt
-	}
-	var wg sync.WaitGroup
-	var once int32
-	wg.Add(1)
-	go func() {
-		for {
-			tm := rtime.Now()
-			if tm.IsZero() {
-				time.Sleep(time.Second)
-				continue
-			}
-			rt.mu.Lock()
-			if tm.After(rt.rtime) {
-				rt.ltime = time.Now()
-				rt.rtime = tm
-				logger.Debug("synchronized time: %s", rt.rtime)
-				if atomic.LoadInt32(&once) == 0 {
-					atomic.StoreInt32(&once, 1)
-					wg.Done()
-				}
-			}
-			rt.mu.Unlock()
-			time.Sleep(time.Second * 30)
+		return &clock{src: src}
+	}
+	start := time.Now()
+	lastWarn := start
+	for {
+		if _, err := src.Now(); err == nil {
+			break
 		}
-	}()
-	go func() {
-		time.Sleep(time.Second * 2)
-		if atomic.LoadInt32(&once) != 0 {
-			return
+		if conf.TimeSourceTimeout > 0 &&
+			time.Since(start) > conf.TimeSourceTimeout {
+			logger.Warn("synchronized time: %s: timeout, "+
+				"using local time until it's ready", name)
+			return &clock{src: src}
 		}
-		for {
-			logger.Warn("synchronized time: waiting for internet connection")
-			if atomic.LoadInt32(&once) != 0 {
-				break
-			}
-			time.Sleep(time.Second * 5)
+		if time.Since(lastWarn) > time.Second*5 {
+			logger.Warn("synchronized time: waiting for %s", name)
+			lastWarn = time.Now()
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	logger.Print("synchronized time: %s", name)
+	return &clock{src: src}
+}
+
+// checkDrift compares the time source with the machine time, and fires the
+// alarm when the difference is larger than the max drift. The drifting is
+// the current state of the alarm.
+func (c *clock) checkDrift(conf Config, m *machine, drifting *bool) {
+	if conf.MaxTimeDrift <= 0 {
+		return
+	}
+	m.mu.RLock()
+	ts := m.ts
+	m.mu.RUnlock()
+	if ts == 0 {
+		return
+	}
+	// The source is read directly, because the clock time can't go back.
+	tm, err := c.src.Now()
+	if err != nil {
+		return
+	}
+	drift := tm.Sub(time.Unix(0, ts))
+	abs := drift
+	if abs < 0 {
+		abs = -abs
+	}
+	if abs <= conf.MaxTimeDrift {
+		if *drifting {
+			*drifting = false
+			logger.Notice("time drift recovered: %s", drift)
 		}
-	}()
-	wg.Wait()
-	logger.Print("synchronized time")
-	return rt
+		return
+	}
+	if !*drifting {
+		*drifting = true
+		logger.Warn("time drift: %s from the machine time, max is %s",
+			drift, conf.MaxTimeDrift)
+	}
+	if conf.TimeDrift != nil {
+		conf.TimeDrift(drift)
+	}
 }
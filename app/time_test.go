@@ -0,0 +1,60 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	mc := NewManualClock(time.Unix(100, 0))
+	c := &clock{src: mc}
+	if tm := c.Now(); !tm.Equal(time.Unix(100, 0)) {
+		t.Fatalf("unexpected %v", tm)
+	}
+	// the clock is always increasing, even when the source is not
+	if tm := c.Now(); !tm.Equal(time.Unix(100, 1)) {
+		t.Fatalf("unexpected %v", tm)
+	}
+	mc.Set(time.Unix(50, 0))
+	if tm := c.Now(); !tm.Equal(time.Unix(100, 2)) {
+		t.Fatalf("unexpected %v", tm)
+	}
+	mc.Add(time.Minute)
+	if tm := c.Now(); !tm.Equal(time.Unix(110, 0)) {
+		t.Fatalf("unexpected %v", tm)
+	}
+}
+
+func TestClockDrift(t *testing.T) {
+	mc := NewManualClock(time.Unix(100, 0))
+	c := &clock{src: mc}
+	m := machineInit(Config{}, 0, "", nil)
+	m.ts = time.Unix(100, 0).UnixNano()
+	var drifts []time.Duration
+	conf := Config{MaxTimeDrift: time.Second,
+		TimeDrift: func(drift time.Duration) { drifts = append(drifts, drift) }}
+	var drifting bool
+	c.checkDrift(conf, m, &drifting)
+	mc.Set(time.Unix(90, 0))
+	c.checkDrift(conf, m, &drifting)
+	if !drifting || len(drifts) != 1 || drifts[0] != -10*time.Second {
+		t.Fatalf("unexpected %v %v", drifting, drifts)
+	}
+	// checking the drift does not move the clock
+	mc.Set(time.Unix(100, 0))
+	if tm := c.Now(); !tm.Equal(time.Unix(100, 0)) {
+		t.Fatalf("unexpected %v", tm)
+	}
+}
+
+func TestParseTimeSource(t *testing.T) {
+	for _, s := range []string{"local", "internet", "ntp://10.0.0.1",
+		"http://10.0.0.1/"} {
+		if _, err := parseTimeSource(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := parseTimeSource("sundial"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/moontrade/server/logger"
+)
+
+// certReloadInterval is how often the certificate files are checked for
+// changes.
+const certReloadInterval = time.Second * 10
+
+// certReloader keeps the most recent certificate/key pair, and the optional
+// CA pool, loaded from disk. The files are reloaded when any of them changes
+// or on SIGHUP, which allows for certificates to be rotated without
+// restarting the server.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader,
+	error,
+) {
+	rl := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := rl.reload(); err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// modified returns the latest modification time of the cert, key, and CA
+// files.
+func (rl *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{rl.certFile, rl.keyFile, rl.caFile} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (rl *certReloader) reload() error {
+	modTime, err := rl.modified()
+	if err != nil {
+		return err
+	}
+	pair, err := tls.LoadX509KeyPair(rl.certFile, rl.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if rl.caFile != "" {
+		if pool, err = loadCertPool(rl.caFile); err != nil {
+			return err
+		}
+	}
+	rl.mu.Lock()
+	rl.cert = &pair
+	rl.pool = pool
+	rl.modTime = modTime
+	rl.mu.Unlock()
+	return nil
+}
+
+// reloadIfModified reloads the files when any of them has changed since the
+// last load.
+func (rl *certReloader) reloadIfModified() (bool, error) {
+	modTime, err := rl.modified()
+	if err != nil {
+		return false, err
+	}
+	rl.mu.RLock()
+	same := modTime.Equal(rl.modTime)
+	rl.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+	return true, rl.reload()
+}
+
+func (rl *certReloader) certificate() *tls.Certificate {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.cert
+}
+
+func (rl *certReloader) certPool() *x509.CertPool {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.pool
+}
+
+func (rl *certReloader) getCertificate(*tls.ClientHelloInfo,
+) (*tls.Certificate, error) {
+	return rl.certificate(), nil
+}
+
+func (rl *certReloader) getClientCertificate(*tls.CertificateRequestInfo,
+) (*tls.Certificate, error) {
+	return rl.certificate(), nil
+}
+
+// verifyServer verifies the certificate of a remote server with the current
+// CA pool. It takes the place of the standard verification, which only uses
+// the pool from when the config was made.
+func (rl *certReloader) verifyServer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: no server certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         rl.certPool(),
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// runCertReloader is a background routine that reloads the certificate when
+// the files change or when the process receives a SIGHUP.
+func runCertReloader(rl *certReloader) {
+	hupC := make(chan os.Signal, 1)
+	signal.Notify(hupC, syscall.SIGHUP)
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		reloaded := true
+		var err error
+		select {
+		case <-hupC:
+			err = rl.reload()
+		case <-ticker.C:
+			reloaded, err = rl.reloadIfModified()
+		}
+		if err != nil {
+			// Keep using the previous certificate. The files may be in the
+			// middle of being replaced.
+			logger.Warn("tls reload: %v", err)
+			continue
+		}
+		if reloaded {
+			logger.Print("tls certificate reloaded")
+		}
+	}
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no valid certificates in " + path)
+	}
+	return pool, nil
+}
+
+// tlsConnUser returns the user identity of a connection that has presented
+// a verified client certificate, or an empty string.
+func tlsConnUser(c net.Conn, mapUser func(cert *x509.Certificate) string,
+) string {
+	if sc, ok := c.(*conn); ok {
+		c = sc.Conn
+	}
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := state.VerifiedChains[0][0]
+	if mapUser != nil {
+		return mapUser(cert)
+	}
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,206 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert returns a certificate for the name, which is signed by the
+// parent, or self-signed as a CA when the parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey,
+		signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and the key to the PEM files. The
+// modification time is moved forward, so the change is always noticed.
+func (c *testCert) write(t *testing.T, certFile, keyFile string, mod int) {
+	t.Helper()
+	cpem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	kder, _ := x509.MarshalECPrivateKey(c.key)
+	kpem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	modTime := time.Now().Add(time.Duration(mod) * time.Minute)
+	for path, data := range map[string][]byte{certFile: cpem, keyFile: kpem} {
+		if path == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// handshake connects a client with the certificate to the server config,
+// and returns the server side of the connection.
+func handshake(t *testing.T, srv *tls.Config, client *testCert,
+	ca *testCert,
+) (*tls.Conn, error) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	c1.SetDeadline(time.Now().Add(time.Second))
+	c2.SetDeadline(time.Now().Add(time.Second))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cc := tls.Client(c2, &tls.Config{
+		ServerName:   "localhost",
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{client.tlsCert()},
+	})
+	go func() {
+		cc.Handshake()
+		cc.Close()
+	}()
+	sc := tls.Server(c1, srv)
+	return sc, sc.Handshake()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	ca1 := newTestCert(t, "ca1", nil)
+	ca1.write(t, caFile, "", 0)
+	newTestCert(t, "server1", ca1).write(t, certFile, keyFile, 0)
+	tlscfg, rl, err := parseTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := rl.reloadIfModified(); err != nil || reloaded {
+		t.Fatalf("unexpected %v %v", reloaded, err)
+	}
+
+	// the certificate/key pair is reloaded when changed
+	newTestCert(t, "server2", ca1).write(t, certFile, keyFile, 1)
+	if reloaded, err := rl.reloadIfModified(); err != nil || !reloaded {
+		t.Fatalf("unexpected %v %v", reloaded, err)
+	}
+	leaf, _ := x509.ParseCertificate(rl.certificate().Certificate[0])
+	if leaf.Subject.CommonName != "server2" {
+		t.Fatalf("unexpected %s", leaf.Subject.CommonName)
+	}
+
+	// a bad file keeps the previous certificate
+	ioutil.WriteFile(keyFile, []byte("bad"), 0600)
+	later := time.Now().Add(2 * time.Minute)
+	os.Chtimes(keyFile, later, later)
+	if _, err := rl.reloadIfModified(); err == nil {
+		t.Fatal("expected error")
+	}
+	if rl.certificate() == nil {
+		t.Fatal("expected the previous certificate")
+	}
+
+	// the CA is reloaded for client certificates
+	ca2 := newTestCert(t, "ca2", nil)
+	client2 := newTestCert(t, "alice", ca2)
+	if _, err := handshake(t, tlscfg, client2, ca1); err == nil {
+		t.Fatal("expected unknown authority")
+	}
+	ca2.write(t, caFile, "", 3)
+	newTestCert(t, "server3", ca2).write(t, certFile, keyFile, 3)
+	if _, err := rl.reloadIfModified(); err != nil {
+		t.Fatal(err)
+	}
+	sc, err := handshake(t, tlscfg, client2, ca2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and for verifying remote servers
+	state := sc.ConnectionState()
+	state.ServerName = "localhost"
+	state.PeerCertificates = []*x509.Certificate{client2.cert}
+	if err := rl.verifyServer(state); err != nil {
+		t.Fatal(err)
+	}
+	state.PeerCertificates = []*x509.Certificate{
+		newTestCert(t, "mallory", ca1).cert}
+	if err := rl.verifyServer(state); err == nil {
+		t.Fatal("expected unknown authority")
+	}
+}
+
+func TestTLSConnUser(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := newTestCert(t, "ca", nil)
+	ca.write(t, caFile, "", 0)
+	newTestCert(t, "server", ca).write(t, certFile, keyFile, 0)
+	tlscfg, _, err := parseTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := handshake(t, tlscfg, newTestCert(t, "Alice", ca), ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := tlsConnUser(sc, nil); user != "Alice" {
+		t.Fatalf("expected Alice, got %q", user)
+	}
+	lower := func(cert *x509.Certificate) string {
+		return strings.ToLower(cert.Subject.CommonName)
+	}
+	if user := tlsConnUser(&conn{Conn: sc}, lower); user != "alice" {
+		t.Fatalf("expected alice, got %q", user)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	if user := tlsConnUser(c1, lower); user != "" {
+		t.Fatalf("expected no user, got %q", user)
+	}
+}
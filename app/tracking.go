@@ -0,0 +1,179 @@
+package app
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// TrackingOptions are the client-side caching options of a connection,
+// which are provided to Service.Track.
+type TrackingOptions struct {
+	// BCast turns on broadcasting mode, where the client is sent the
+	// invalidations of all keys that match the Prefixes, rather than only
+	// the keys that the client has read.
+	BCast bool
+	// Prefixes limits the broadcasted keys. No prefixes is all keys.
+	Prefixes []string
+	// Push is called with the keys that were changed by a write, or with nil
+	// when the client must flush all of its cached keys, such as after a
+	// snapshot was restored. It's called from the apply routine and must not
+	// block.
+	Push func(keys []string)
+}
+
+// tracker is a connection that has tracking turned on.
+type tracker struct {
+	opts TrackingOptions
+	keys map[string]bool // keys that were read, when not broadcasting
+}
+
+// trackingTable holds the connections that use client-side caching, and the
+// keys that they have read. It's shared by all raft groups of a server, and
+// is not replicated. Each server invalidates the keys of its own
+// connections as the writes are applied.
+type trackingTable struct {
+	count int32 // number of trackers, atomic
+
+	mu       sync.Mutex
+	trackers map[interface{}]*tracker     // by SendOptions.From
+	keys     map[string]map[*tracker]bool // readers of each key
+}
+
+func newTrackingTable() *trackingTable {
+	return &trackingTable{
+		trackers: make(map[interface{}]*tracker),
+		keys:     make(map[string]map[*tracker]bool),
+	}
+}
+
+// active returns true when any connection has tracking turned on.
+func (t *trackingTable) active() bool {
+	return atomic.LoadInt32(&t.count) > 0
+}
+
+// set turns on tracking for the connection, or turns it off when opts is
+// nil. Changing the options forgets the keys that were read.
+func (t *trackingTable) set(from interface{}, opts *TrackingOptions) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tr := t.trackers[from]; tr != nil {
+		for key := range tr.keys {
+			t.forget(key, tr)
+		}
+		delete(t.trackers, from)
+	}
+	if opts != nil && opts.Push != nil {
+		t.trackers[from] = &tracker{opts: *opts, keys: make(map[string]bool)}
+	}
+	atomic.StoreInt32(&t.count, int32(len(t.trackers)))
+}
+
+func (t *trackingTable) forget(key string, tr *tracker) {
+	readers := t.keys[key]
+	delete(readers, tr)
+	if len(readers) == 0 {
+		delete(t.keys, key)
+	}
+}
+
+// track records the keys that are about to be read by the connection. This
+// happens prior to the read, which ensures that a concurrent write is not
+// missed.
+func (t *trackingTable) track(from interface{}, keys []string) {
+	if !t.active() || len(keys) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr := t.trackers[from]
+	if tr == nil || tr.opts.BCast {
+		return
+	}
+	for _, key := range keys {
+		readers := t.keys[key]
+		if readers == nil {
+			readers = make(map[*tracker]bool)
+			t.keys[key] = readers
+		}
+		readers[tr] = true
+		tr.keys[key] = true
+	}
+}
+
+// invalidate pushes the keys that were written to the connections that
+// read them, or that broadcast them. A key is only pushed once, after which
+// the connection must read it again to be notified.
+func (t *trackingTable) invalidate(keys []string) {
+	if !t.active() || len(keys) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	pushes := make(map[*tracker][]string)
+	for _, key := range keys {
+		for tr := range t.keys[key] {
+			pushes[tr] = append(pushes[tr], key)
+			delete(tr.keys, key)
+		}
+		delete(t.keys, key)
+	}
+	for _, tr := range t.trackers {
+		if !tr.opts.BCast {
+			continue
+		}
+		for _, key := range keys {
+			if hasAnyPrefix(key, tr.opts.Prefixes) {
+				pushes[tr] = append(pushes[tr], key)
+			}
+		}
+	}
+	for tr, keys := range pushes {
+		tr.opts.Push(keys)
+	}
+}
+
+// flush tells all connections to flush their cached keys.
+func (t *trackingTable) flush() {
+	if !t.active() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tr := range t.trackers {
+		tr.keys = make(map[string]bool)
+		tr.opts.Push(nil)
+	}
+	t.keys = make(map[string]map[*tracker]bool)
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// touchKeys records that the keys were written at the index, which is used
+// by WATCH, and collects the keys for invalidating the tracking
+// connections once the entry has been applied.
+func (m *machine) touchKeys(keys []string, index uint64) {
+	m.keys.touch(keys, index)
+	if m.tracking.active() {
+		m.touched = append(m.touched, keys...)
+	}
+}
+
+// Track turns on client-side caching for a connection, where the From is
+// the same as the SendOptions.From of the connection. The keys of the read
+// commands that are sent by the connection are remembered, and are pushed
+// to the connection after a write changes them. Pass nil opts to turn off
+// tracking, which must also happen when the connection is closed.
+func (s *service) Track(from interface{}, opts *TrackingOptions) {
+	s.m.tracking.set(from, opts)
+}
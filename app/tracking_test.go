@@ -0,0 +1,71 @@
+package app
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTrackingTable(t *testing.T) {
+	tt := newTrackingTable()
+	pushes := make(map[string][][]string)
+	push := func(name string) func(keys []string) {
+		return func(keys []string) {
+			pushes[name] = append(pushes[name], keys)
+		}
+	}
+	tt.track("a", []string{"k1"})
+	if tt.active() || len(tt.keys) != 0 {
+		t.Fatal("expected inactive table")
+	}
+	tt.set("a", &TrackingOptions{Push: push("a")})
+	tt.set("b", &TrackingOptions{BCast: true, Prefixes: []string{"user:"},
+		Push: push("b")})
+	tt.track("a", []string{"k1", "user:1"})
+	tt.track("b", []string{"k2"})
+	tt.invalidate([]string{"k1", "k2", "user:1"})
+	expect := map[string][][]string{
+		"a": {{"k1", "user:1"}},
+		"b": {{"user:1"}},
+	}
+	for _, keys := range pushes["a"] {
+		sort.Strings(keys)
+	}
+	if !reflect.DeepEqual(pushes, expect) {
+		t.Fatalf("expected %v, got %v", expect, pushes)
+	}
+	// keys are pushed once until read again
+	pushes = make(map[string][][]string)
+	tt.invalidate([]string{"k1"})
+	if len(pushes) != 0 {
+		t.Fatalf("expected no pushes, got %v", pushes)
+	}
+	tt.track("a", []string{"k1"})
+	tt.flush()
+	expect = map[string][][]string{"a": {nil}, "b": {nil}}
+	if !reflect.DeepEqual(pushes, expect) {
+		t.Fatalf("expected %v, got %v", expect, pushes)
+	}
+	tt.track("a", []string{"k1"})
+	tt.set("a", nil)
+	tt.set("b", nil)
+	if tt.active() || len(tt.keys) != 0 {
+		t.Fatal("expected empty table")
+	}
+}
+
+func TestRedisTrackingPush(t *testing.T) {
+	rt := &redisTracking{signal: make(chan struct{}, 1)}
+	rt.push([]string{"a"})
+	rt.push([]string{"b"})
+	keys, flush := rt.take()
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) || flush {
+		t.Fatalf("unexpected %v %v", keys, flush)
+	}
+	rt.push(make([]string, maxPendingInvalidations+1))
+	rt.push([]string{"c"})
+	keys, flush = rt.take()
+	if keys != nil || !flush {
+		t.Fatalf("unexpected %v %v", keys, flush)
+	}
+}
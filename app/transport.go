@@ -46,11 +46,26 @@ const transportMarker = "8e35747e37d192d9a819021ba2a02909"
 
 type transportStream struct {
 	net.Listener
+	marker string
 	auth   string
 	tlscfg *tls.Config
+	faults *faultTable
+}
+
+// Accept returns the next raft connection, with the faults injected. The
+// client connections of the same listener are not affected by the faults.
+func (s *transportStream) Accept() (net.Conn, error) {
+	conn, err := s.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return s.faults.wrap(conn, ""), nil
 }
 
 func (s *transportStream) Dial(addr raft.ServerAddress, timeout time.Duration) (conn net.Conn, err error) {
+	if err := s.faults.dial(string(addr)); err != nil {
+		return nil, err
+	}
 	if timeout <= 0 {
 		if s.tlscfg != nil {
 			conn, err = tls.Dial("tcp", string(addr), s.tlscfg)
@@ -68,7 +83,7 @@ func (s *transportStream) Dial(addr raft.ServerAddress, timeout time.Duration) (
 	if err != nil {
 		return nil, err
 	}
-	if _, err := conn.Write([]byte(transportMarker)); err != nil {
+	if _, err := conn.Write([]byte(s.marker)); err != nil {
 		conn.Close()
 		return nil, err
 	}
@@ -76,15 +91,16 @@ func (s *transportStream) Dial(addr raft.ServerAddress, timeout time.Duration) (
 		conn.Close()
 		return nil, err
 	}
-	return conn, nil
+	return s.faults.wrap(conn, string(addr)), nil
 }
 
-func transportInit(conf Config, tlscfg *tls.Config, svr *splitServer, hclogger hclog.Logger) raft.Transport {
+func transportInit(conf Config, group int, tlscfg *tls.Config, svr *splitServer, hclogger hclog.Logger) raft.Transport {
+	marker := groupMarker(group)
 	ln := svr.split(func(r io.Reader) (n int, ok bool) {
 		rd := bufio.NewReader(r)
-		for i := 0; i < len(transportMarker); i++ {
+		for i := 0; i < len(marker); i++ {
 			b, err := rd.ReadByte()
-			if err != nil || b != transportMarker[i] {
+			if err != nil || b != marker[i] {
 				return 0, false
 			}
 		}
@@ -94,11 +110,13 @@ func transportInit(conf Config, tlscfg *tls.Config, svr *splitServer, hclogger h
 				return 0, false
 			}
 		}
-		return len(transportMarker) + len(conf.Auth), true
+		return len(marker) + len(conf.Auth), true
 	})
 	stream := new(transportStream)
 	stream.Listener = ln
+	stream.marker = marker
 	stream.auth = conf.Auth
 	stream.tlscfg = tlscfg
+	stream.faults = svr.faults
 	return raft.NewNetworkTransport(stream, conf.MaxPool, 0, logger.RaftWriter)
 }
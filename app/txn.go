@@ -0,0 +1,267 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Undoable is an interface for the user data that allows for the changes
+// made by a MULTI/EXEC transaction to be rolled back when one of its commands
+// fails. A transaction with write commands is discarded by EXEC when the user
+// data does not implement Undoable.
+type Undoable interface {
+	// Savepoint is called prior to applying the commands of a transaction.
+	Savepoint()
+	// Rollback reverts the data to the state at the last Savepoint.
+	Rollback()
+	// Release is called when the transaction was successful and the last
+	// Savepoint is no longer needed.
+	Release()
+}
+
+var errTxnNotUndoable = errors.New("write commands in a transaction " +
+	"require the data to be Undoable")
+
+// commandKeys returns the keys from the arguments of a user write command.
+func (m *machine) commandKeys(name string, args []string) []string {
+	if ks, ok := m.keySpecs[name]; ok {
+		return ks.keys(args)
+	}
+	return defKeySpec.keys(args)
+}
+
+// WatchIndex returns the index that is used by Exec to detect if any of the
+// watched keys have changed. Any pending writes from the client are applied
+// first.
+//
+// The changes are tracked per hash slot, so a write to any key that shares a
+// slot with a watched key also fails the transaction. The keys of a write
+// command are found with its spec, and commands without a spec are tracked by
+// their first argument only.
+func (s *service) WatchIndex(keys []string, opts *SendOptions) uint64 {
+	if opts == nil {
+		opts = defSendOpts
+	}
+	gs, _, err := s.route(keys)
+	if err != nil {
+		// The keys are checked again by Exec
+		gs = s
+	}
+	gs.waitWrite(opts.From)
+	gs.m.mu.RLock()
+	defer gs.m.mu.RUnlock()
+	return gs.m.appliedIndex
+}
+
+// Exec sends multiple read and write commands that are applied atomically
+// as a single entry in the raft log. When any of the watched keys have
+// changed since the watch index, none of the commands are applied and the
+// response is ErrWatchFailed. Otherwise the response is an []interface{}
+// containing the response of each command. When any command fails, all of
+// the changes are rolled back. A transaction with write commands is discarded
+// when the user data is not Undoable.
+func (s *service) Exec(cmds [][]string, watch []string, watchIndex uint64,
+	opts *SendOptions,
+) Receiver {
+	if opts == nil {
+		opts = defSendOpts
+	}
+	s.m.clients.touch(opts, "exec")
+	// (txn, index, count, key..., count, cmd...)
+	//   - cmd: (count, arg...)
+	args := []string{"txn", strconv.FormatUint(watchIndex, 10),
+		strconv.Itoa(len(watch))}
+	args = append(args, watch...)
+	keys := append([]string(nil), watch...)
+	for i, cmd := range cmds {
+		if err := s.txnAllowed(cmd, opts); err != nil {
+			return Response(nil, 0, fmt.Errorf("EXECABORT Transaction "+
+				"discarded because of: %v", err))
+		}
+		name := strings.ToLower(cmd[0])
+		if c, _ := s.m.lookupCommand(name); c.kind == 'w' {
+			if !s.m.undoable() {
+				return Response(nil, 0, fmt.Errorf("EXECABORT Transaction "+
+					"discarded because of: %v", errTxnNotUndoable))
+			}
+			keys = append(keys, s.m.commandKeys(name, cmd)...)
+		}
+		if scriptCommand(name) {
+			wargs, err := scriptWriteArgs(cmd, opts.User)
+			if err != nil {
+				return Response(nil, 0, fmt.Errorf("EXECABORT Transaction "+
+					"discarded because of: %v", err))
+			}
+			cmds[i] = wargs
+		}
+	}
+	gs, slot, err := s.route(keys)
+	if err != nil {
+		return Response(nil, 0, fmt.Errorf("EXECABORT Transaction "+
+			"discarded because of: %v", err))
+	}
+	args = appendTxnCommands(args, cmds)
+	s.m.clients.wait('w')
+	return gs.sendWrite(args, slot, opts)
+}
+
+// appendTxnCommands appends the commands using the format:
+// (count, cmd...)
+//   - cmd: (count, arg...)
+func appendTxnCommands(args []string, cmds [][]string) []string {
+	args = append(args, strconv.Itoa(len(cmds)))
+	for _, cmd := range cmds {
+		args = append(args, strconv.Itoa(len(cmd)))
+		args = append(args, cmd...)
+	}
+	return args
+}
+
+// undoable returns true when the user data implements Undoable.
+func (m *machine) undoable() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.data.(Undoable)
+	return ok
+}
+
+func (s *service) txnAllowed(args []string, opts *SendOptions) error {
+	if len(args) == 0 {
+		return ErrSyntax
+	}
+	name := strings.ToLower(args[0])
+	cmd, ok := s.m.lookupCommand(name)
+	if !ok || internalCommands[name] {
+		return fmt.Errorf("%s '%s'", ErrUnknownCommand, args[0])
+	}
+	if cmd.kind != 'r' && cmd.kind != 'w' {
+		return fmt.Errorf("command '%s' not allowed in a transaction",
+			args[0])
+	}
+	if err := s.m.checkArgs(name, args); err != nil {
+		return err
+	}
+	return s.m.allowed(opts.User, cmd.kind, name)
+}
+
+// TXN index count key... count (count arg...)...
+// help: applies multiple commands as a single transaction. It's not
+//       possible to directly call this from a client service.
+func cmdTXN(um Machine, ra *raftWrap, args []string) (interface{}, error) {
+	m := getBaseMachine(um)
+	if m == nil {
+		return nil, ErrInvalid
+	}
+	watchIndex, watch, cmds, err := parseTxnArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if m.keys.changed(watch, watchIndex) {
+		return nil, ErrWatchFailed
+	}
+	undo, _ := m.data.(Undoable)
+	if undo == nil {
+		// A transaction with writes can't be rolled back, so none of its
+		// commands are applied.
+		for _, cargs := range cmds {
+			if cmd, _ := m.command(strings.ToLower(cargs[0])); cmd.kind == 'w' {
+				return nil, fmt.Errorf("EXECABORT Transaction discarded "+
+					"because of: %v", errTxnNotUndoable)
+			}
+		}
+	} else {
+		undo.Savepoint()
+		m.savepoint = true
+		defer func() { m.savepoint = false }()
+	}
+	ts, seed := m.ts, m.seed
+	resps := make([]interface{}, len(cmds))
+	for i, cargs := range cmds {
+		name := strings.ToLower(cargs[0])
+		cmd, _ := m.command(name)
+		if (cmd.kind != 'r' && cmd.kind != 'w') ||
+			(internalCommands[name] && !scriptRunArgs(cargs)) {
+			err = fmt.Errorf("%s '%s'", ErrUnknownCommand, cargs[0])
+		} else {
+			if cmd.kind == 'w' {
+				keys := m.commandKeys(name, cargs)
+				if err = m.slots.check(keys); err == nil {
+					m.touchKeys(keys, m.index)
+				}
+			}
+			if err == nil {
+				resps[i], err = cmd.fn(m, nil, cargs)
+			}
+		}
+		if err != nil {
+			if undo != nil {
+				undo.Rollback()
+				m.ts, m.seed = ts, seed
+			}
+			return nil, fmt.Errorf("EXECABORT Transaction rolled back "+
+				"because of: %v", err)
+		}
+	}
+	if undo != nil {
+		undo.Release()
+	}
+	return resps, nil
+}
+
+func parseTxnArgs(args []string) (watchIndex uint64, watch []string,
+	cmds [][]string, err error,
+) {
+	if len(args) < 4 {
+		return 0, nil, nil, ErrWrongNumArgs
+	}
+	watchIndex, err = strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return 0, nil, nil, ErrSyntax
+	}
+	args = args[2:]
+	n, err := nextTxnCount(&args)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	watch = args[:n]
+	if cmds, err = parseTxnCommands(args[n:]); err != nil {
+		return 0, nil, nil, err
+	}
+	return watchIndex, watch, cmds, nil
+}
+
+// parseTxnCommands parses the commands that were added by
+// appendTxnCommands.
+func parseTxnCommands(args []string) ([][]string, error) {
+	n, err := nextTxnCount(&args)
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([][]string, n)
+	for i := range cmds {
+		argc, err := nextTxnCount(&args)
+		if err != nil || argc == 0 {
+			return nil, ErrSyntax
+		}
+		cmds[i] = args[:argc]
+		args = args[argc:]
+	}
+	if len(args) != 0 {
+		return nil, ErrSyntax
+	}
+	return cmds, nil
+}
+
+func nextTxnCount(args *[]string) (int, error) {
+	if len(*args) == 0 {
+		return 0, ErrSyntax
+	}
+	n, err := strconv.Atoi((*args)[0])
+	if err != nil || n < 0 || n > len(*args)-1 {
+		return 0, ErrSyntax
+	}
+	*args = (*args)[1:]
+	return n, nil
+}
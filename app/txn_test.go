@@ -0,0 +1,65 @@
+package app
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// undoMap is a map that implements Undoable.
+type undoMap struct {
+	data map[string]string
+	save map[string]string
+}
+
+func (u *undoMap) Savepoint() {
+	u.save = make(map[string]string)
+	for k, v := range u.data {
+		u.save[k] = v
+	}
+}
+
+func (u *undoMap) Rollback() { u.data, u.save = u.save, nil }
+func (u *undoMap) Release()  { u.save = nil }
+
+func TestTxnAtomic(t *testing.T) {
+	m := machineInit(Config{}, 0, "", nil)
+	data := &undoMap{data: map[string]string{}}
+	m.commands["set"] = command{'w', func(um Machine, ra *raftWrap,
+		args []string) (interface{}, error) {
+		if args[2] == "fail" {
+			return nil, errors.New("failed")
+		}
+		um.Data().(*undoMap).data[args[1]] = args[2]
+		return nil, nil
+	}}
+	txn := func(cmds ...[]string) error {
+		m.index++
+		args := appendTxnCommands([]string{"txn", "0", "0"}, cmds)
+		_, err := cmdTXN(m, nil, args)
+		return err
+	}
+
+	// the data is not Undoable, so nothing is applied
+	m.data = data.data
+	if err := txn([]string{"set", "a", "1"}); err == nil ||
+		!strings.Contains(err.Error(), errTxnNotUndoable.Error()) {
+		t.Fatalf("expected %v, got %v", errTxnNotUndoable, err)
+	}
+	if len(data.data) != 0 {
+		t.Fatalf("unexpected %v", data.data)
+	}
+
+	// a failed command rolls back the commands before it
+	m.data = data
+	if err := txn([]string{"set", "a", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn([]string{"set", "a", "2"}, []string{"set", "b", "fail"}); err ==
+		nil || !strings.HasPrefix(err.Error(), "EXECABORT") {
+		t.Fatalf("expected EXECABORT, got %v", err)
+	}
+	if data.data["a"] != "1" {
+		t.Fatalf("expected 1, got %v", data.data["a"])
+	}
+}
@@ -13,6 +13,7 @@ require (
 	github.com/moontrade/nogc v0.1.1
 	github.com/pierrec/lz4/v4 v4.1.11
 	github.com/rs/zerolog v1.25.0
+	github.com/tetratelabs/wazero v1.0.1
 	github.com/tidwall/gjson v1.11.0
 	github.com/tidwall/match v1.1.1
 	github.com/tidwall/redcon v1.4.2
@@ -21,6 +22,8 @@ require (
 	github.com/tidwall/rtime v0.2.0
 	github.com/tidwall/sds v0.1.0
 	github.com/tidwall/tinybtree v1.1.0
+	github.com/yuin/gopher-lua v1.1.1
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
 
 require (
@@ -44,5 +47,4 @@ require (
 	golang.org/x/sys v0.0.0-20210616094352-59db8d763f22 // indirect
 	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
@@ -17,6 +17,7 @@ var (
 	ErrNotEasyJSONUnmarshaller = errors.New("not implements easyjson.EasyJSONUnmarshaller")
 	ErrNotBinaryMarshaller     = errors.New("not implements encoding.BinaryMarshaler")
 	ErrNotBinaryUnmarshaller   = errors.New("not implements encoding.BinaryUnmarshaler")
+	ErrSealedIndexes           = errors.New("SealedMarshaller can not be used by a collection with indexes")
 )
 
 var (
@@ -204,3 +205,43 @@ func (s BinaryNoAllocMarshaller) Unmarshal(data []byte, unmarshalled interface{}
 		return ErrNotBinaryUnmarshaller
 	}
 }
+
+// Cipher encrypts documents at rest, such as the app.KeyRing.
+type Cipher interface {
+	Seal(dst, plaintext, ad []byte) ([]byte, error)
+	Open(dst, sealed, ad []byte) ([]byte, error)
+}
+
+// SealedMarshaller is a Marshaller that encrypts the marshalled documents
+// with a Cipher. Indexes are built from the stored documents, so it can only
+// be used by collections without indexes, and parsing a schema with an
+// indexed collection that uses it fails with ErrSealedIndexes.
+type SealedMarshaller struct {
+	Marshaller Marshaller
+	Cipher     Cipher
+}
+
+func (s SealedMarshaller) Marshal(unmarshalled interface{}, into []byte) ([]byte, error) {
+	data, err := s.Marshaller.Marshal(unmarshalled, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.Cipher.Seal(into[:0], data, nil)
+}
+
+func (s SealedMarshaller) Unmarshal(data []byte, unmarshalled interface{}) error {
+	data, err := s.Cipher.Open(nil, data, nil)
+	if err != nil {
+		return err
+	}
+	return s.Marshaller.Unmarshal(data, unmarshalled)
+}
+
+// isSealed returns true when the Marshaller is a SealedMarshaller.
+func isSealed(m Marshaller) bool {
+	switch m.(type) {
+	case SealedMarshaller, *SealedMarshaller:
+		return true
+	}
+	return false
+}
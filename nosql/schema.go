@@ -236,11 +236,6 @@ collectionLoop:
 		fieldValueType := valueType.Field(i)
 		fieldType := t.Field(i)
 
-		var inter Marshaller
-		if fieldType.Name == "Marshaller" && fieldType.Type.Implements(reflect.TypeOf(inter)) {
-			col.Marshaller = fieldValueType.Interface().(Marshaller)
-		}
-
 		switch fieldType.Name {
 		case "Collection":
 			foundCollection = true
@@ -293,6 +288,12 @@ indexLoop:
 		case "Collection":
 			continue indexLoop
 
+		case "Marshaller":
+			if marshaller, ok := fieldValueType.Interface().(Marshaller); ok && marshaller != nil {
+				col.Marshaller = marshaller
+			}
+			continue indexLoop
+
 		case "_":
 			ofType := fieldType.Type
 			for ofType.Kind() == reflect.Ptr {
@@ -339,6 +340,10 @@ indexLoop:
 		col.Marshaller = MarshallerOfType(col.Type)
 	}
 
+	if isSealed(col.Marshaller) && len(col.indexes) > 0 {
+		return col, fmt.Errorf("%s: %w", col.Name, ErrSealedIndexes)
+	}
+
 	col.marshaller = col.Marshaller
 
 	return col, nil
@@ -101,6 +101,44 @@ func TestCRUD(t *testing.T) {
 	}
 }
 
+func TestSealedMarshaller(t *testing.T) {
+	sealed := nosql.SealedMarshaller{Marshaller: nosql.JsonMarshaller{}, Cipher: plainCipher{}}
+	type Sealed struct {
+		*nosql.Schema
+		Notes struct {
+			nosql.Collection
+			Marshaller nosql.SealedMarshaller
+		}
+	}
+	if _, err := nosql.ParseSchema(&Sealed{Notes: struct {
+		nosql.Collection
+		Marshaller nosql.SealedMarshaller
+	}{Marshaller: sealed}}); err != nil {
+		t.Fatal(err)
+	}
+	type SealedIndexed struct {
+		*nosql.Schema
+		Notes struct {
+			nosql.Collection
+			Marshaller nosql.SealedMarshaller
+			Key        nosql.String `@:"key"`
+		}
+	}
+	if _, err := nosql.ParseSchema(&SealedIndexed{}); !errors.Is(err, nosql.ErrSealedIndexes) {
+		t.Fatalf("expected %v, got %v", nosql.ErrSealedIndexes, err)
+	}
+}
+
+type plainCipher struct{}
+
+func (plainCipher) Seal(dst, plaintext, ad []byte) ([]byte, error) {
+	return append(dst, plaintext...), nil
+}
+
+func (plainCipher) Open(dst, sealed, ad []byte) ([]byte, error) {
+	return append(dst, sealed...), nil
+}
+
 func wait(progress <-chan nosql.EvolutionProgress) error {
 	if progress == nil {
 		return errors.New("schema does not require an evolution")